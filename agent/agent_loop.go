@@ -6,12 +6,15 @@ package agent
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"regexp"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -24,41 +27,48 @@ import (
 
 // Agent 结构体代表一个AI代理实例，负责协调以下组件：
 // llm: 与大语言模型通信的客户端（抽象接口）
+// embedder: 生成文本向量的嵌入服务（可与 llm 使用不同的端点和模型）
 // mem: 会话记忆存储（用于持久化对话历史）
 // prompts: 提示词管理器
 // vectorStore: 向量存储（用于RAG）
+// ingestJobs: 入库任务索引（用于恢复中断的入库），可为 nil
+// toolAudit: 工具调用审计日志，可为 nil
 // maxIterations: 代理执行循环的最大迭代次数
 // toolRegistry: 工具注册表，管理所有可用工具
 // confirmationManager: 工具执行确认管理器
 // config: 应用程序配置
 // sandboxOnce: 用于确保沙箱初始化只执行一次
-// runCodeSandboxSemaphore: 用于控制代码沙箱并发执行的信号量
 // role: Agent 的角色
 // allowedTools: 该 Agent 允许使用的工具
 // otherAgents: 其他 Agent 实例的引用，用于多 Agent 协作
+// reindex: 后台重建向量索引任务的状态
 type Agent struct {
-	llm                     LLMProvider
-	mem                     *MemoryV3
-	prompts                 *PromptManager
-	vectorStore             VectorStore // 使用接口类型
-	maxIterations           int
-	toolRegistry            *ToolRegistry
-	confirmationManager     *ConfirmationManager
-	config                  Config
-	sandboxOnce             sync.Once
-	runCodeSandboxSemaphore chan struct{}
-	role                    string
-	allowedTools            map[string]bool
-	otherAgents             map[string]*Agent
+	llm                 LLMProvider
+	embedder            EmbeddingProvider
+	mem                 *MemoryV3
+	prompts             *PromptManager
+	vectorStore         VectorStore // 使用接口类型
+	ingestJobs          *IngestJobStore
+	toolAudit           *ToolAuditLog
+	maxIterations       int
+	toolRegistry        *ToolRegistry
+	confirmationManager *ConfirmationManager
+	config              Config
+	sandboxOnce         sync.Once
+	role                string
+	allowedTools        map[string]bool
+	otherAgents         map[string]*Agent
+	reindex             reindexer
 }
 
 // NewAgent 创建新的代理实例
 // l: LLMProvider 接口实现
+// e: EmbeddingProvider 接口实现，为 nil 时使用 l
 // m: MemoryV3 实例
 // vs: VectorStore 接口实现
 // cfg: 应用程序配置
 // agentConfig: Agent 的特定配置
-func NewAgent(l LLMProvider, m *MemoryV3, vs VectorStore, cfg Config, agentConfig AgentConfig) *Agent {
+func NewAgent(l LLMProvider, e EmbeddingProvider, m *MemoryV3, vs VectorStore, cfg Config, agentConfig AgentConfig) *Agent {
 	allowedTools := make(map[string]bool)
 	for _, toolName := range agentConfig.AllowedTools {
 		allowedTools[toolName] = true
@@ -69,8 +79,13 @@ func NewAgent(l LLMProvider, m *MemoryV3, vs VectorStore, cfg Config, agentConfi
 		prompts.SetSystemPrompt(agentConfig.SystemPrompt)
 	}
 
+	if e == nil {
+		e = l
+	}
+
 	a := &Agent{
 		llm:                 l,
+		embedder:            e,
 		mem:                 m,
 		prompts:             prompts,
 		vectorStore:         vs,
@@ -83,6 +98,18 @@ func NewAgent(l LLMProvider, m *MemoryV3, vs VectorStore, cfg Config, agentConfi
 		otherAgents:         make(map[string]*Agent), // 初始化为空 map
 	}
 	a.registerTools() // 注册工具
+
+	// 应用全局和 Agent 级别的工具禁用列表
+	for _, name := range cfg.Agent.DisabledTools {
+		a.toolRegistry.Disable(name)
+	}
+	for _, name := range agentConfig.DeniedTools {
+		a.toolRegistry.Disable(name)
+	}
+	// shell_cmd 需要运维人员显式配置允许列表才会启用
+	if len(cfg.ShellCmd.AllowedCommands) == 0 {
+		a.toolRegistry.Disable("shell_cmd")
+	}
 	return a
 }
 
@@ -95,15 +122,24 @@ func (a *Agent) SetOtherAgents(otherAgents map[string]*Agent) {
 func (a *Agent) registerTools() {
 	allTools := []Tool{
 		&WebSearchTool{},
+		&SummarizeURLTool{},
 		&RunCodeTool{},
+		&LintCodeTool{},
 		&ReadFileTool{},
+		&OutlineFileTool{},
 		&WriteFileTool{},
+		&WriteFilesTool{},
 		&GitCmdTool{},
+		&HTTPRequestTool{},
+		&ShellCmdTool{},
 		&CreateSessionTool{},
 		&SwitchSessionTool{},
 		&KnowledgeSearchTool{},
+		&ListKnowledgeSourcesTool{},
+		&GetSourceChunksTool{},
 		&CallCoderTool{},
 		&CallResearcherTool{},
+		&ListToolsTool{},
 	}
 
 	for _, tool := range allTools {
@@ -111,6 +147,31 @@ func (a *Agent) registerTools() {
 			a.toolRegistry.Register(tool)
 		}
 	}
+
+	// 配置文件中定义的 webhook 工具同样受 allowedTools 限制
+	for _, wc := range a.config.WebhookTools.Tools {
+		if !a.allowedTools[wc.Name] {
+			continue
+		}
+		if err := a.RegisterWebhookTool(wc, false); err != nil {
+			Logger.Warn().Err(err).Str("tool", wc.Name).Msg("Failed to register webhook tool")
+		}
+	}
+}
+
+// SetIngestJobStore 设置入库任务索引，多个 Agent 可共享同一个索引
+func (a *Agent) SetIngestJobStore(s *IngestJobStore) {
+	a.ingestJobs = s
+}
+
+// SetToolAuditLog 设置工具调用审计日志，多个 Agent 可共享同一个实例，为 nil 时不记录
+func (a *Agent) SetToolAuditLog(l *ToolAuditLog) {
+	a.toolAudit = l
+}
+
+// GetIngestJobStore 获取入库任务索引，未设置时返回 nil
+func (a *Agent) GetIngestJobStore() *IngestJobStore {
+	return a.ingestJobs
 }
 
 // GetMemory 获取Agent的内存实例
@@ -128,11 +189,38 @@ func (a *Agent) GetLLM() LLMProvider {
 	return a.llm
 }
 
+// GetEmbedder 获取Agent的EmbeddingProvider实例
+func (a *Agent) GetEmbedder() EmbeddingProvider {
+	return a.embedder
+}
+
 // GetPromptManager 获取Agent的PromptManager实例
 func (a *Agent) GetPromptManager() *PromptManager {
 	return a.prompts
 }
 
+// SetConfirmationManager 设置确认管理器，多个 Agent 可共享同一个管理器，
+// 使子 Agent 发起的确认请求也能由同一个入口响应
+func (a *Agent) SetConfirmationManager(cm *ConfirmationManager) {
+	a.confirmationManager = cm
+}
+
+// ListTools 返回该 Agent 注册的所有工具及其元数据
+func (a *Agent) ListTools() []ToolInfo {
+	return a.toolRegistry.List()
+}
+
+// GetRole 获取Agent的角色
+func (a *Agent) GetRole() string {
+	return a.role
+}
+
+// GetOtherAgent 按名称获取协作的其他 Agent
+func (a *Agent) GetOtherAgent(name string) (*Agent, bool) {
+	other, ok := a.otherAgents[name]
+	return other, ok
+}
+
 // GetConfirmationManager 获取Agent的ConfirmationManager实例
 func (a *Agent) GetConfirmationManager() *ConfirmationManager {
 	return a.confirmationManager
@@ -146,13 +234,13 @@ func (a *Agent) validateToolCall(ctx context.Context, originalPrompt string, too
 
 	// --- 硬编码启发式检查 (快速路径) ---
 	// 使用 Agent 实例的方法进行检查
-	if !a.isReasonableToolCall(originalPrompt, toolCall) {
-		Logger.Warn().Str("tool", toolCall.Function.Name).Msg("Tool call rejected by heuristic check")
+	if !a.isReasonableToolCall(ctx, originalPrompt, toolCall) {
+		Logger.Warn().Ctx(ctx).Str("tool", toolCall.Function.Name).Msg("Tool call rejected by heuristic check")
 		return false
 	}
 	// --- 启发式检查结束 ---
 
-	Logger.Info().Msg("Tool call passed heuristic checks, proceeding to LLM validation.")
+	Logger.Info().Ctx(ctx).Msg("Tool call passed heuristic checks, proceeding to LLM validation.")
 	args, _ := json.Marshal(toolCall.Function.Arguments)
 	// 渲染工具验证提示
 	prompt, err := a.prompts.Render("tool_validation", map[string]string{
@@ -161,7 +249,7 @@ func (a *Agent) validateToolCall(ctx context.Context, originalPrompt string, too
 		"ToolArgs":       string(args),
 	})
 	if err != nil {
-		Logger.Error().Err(err).Msg("Failed to render tool validation prompt")
+		Logger.Error().Ctx(ctx).Err(err).Msg("Failed to render tool validation prompt")
 		return true // 失败开放：如果无法渲染提示，则假定调用有效
 	}
 
@@ -169,13 +257,13 @@ func (a *Agent) validateToolCall(ctx context.Context, originalPrompt string, too
 	// 调用 LLM 进行验证
 	resp, err := a.llm.CallWithContext(ctx, validationMessages, nil)
 	if err != nil {
-		Logger.Error().Err(err).Msg("Tool validation LLM call failed")
+		Logger.Error().Ctx(ctx).Err(err).Msg("Tool validation LLM call failed")
 		return true // 失败开放
 	}
 
 	if len(resp.Choices) > 0 {
 		answer := strings.TrimSpace(resp.Choices[0].Message.Content)
-		Logger.Info().Str("validation_answer", answer).Msg("Tool validation response")
+		Logger.Info().Ctx(ctx).Str("validation_answer", answer).Msg("Tool validation response")
 		// 如果 LLM 回复包含 "yes" 或 "是"，则认为工具调用有效
 		return strings.Contains(strings.ToLower(answer), "yes") || strings.Contains(answer, "是")
 	}
@@ -185,14 +273,18 @@ func (a *Agent) validateToolCall(ctx context.Context, originalPrompt string, too
 
 // prepareSessionAndMessages 初始化会话并加载历史消息
 // 如果 sessionID 为空，则创建新会话；否则切换到指定会话
-func (a *Agent) prepareSessionAndMessages(prompt string, sessionID string, images []string) (string, []ChatMessage) {
+// 计划模式下只读取历史，不创建或切换会话，也不写入用户消息
+func (a *Agent) prepareSessionAndMessages(ctx context.Context, prompt string, sessionID string, images []string) (string, []ChatMessage) {
+	persist := !IsPlanMode(ctx)
 	if sessionID == "" {
 		sessionID = a.mem.GetCurrentSessionID()
 	}
 	if sessionID == "" {
 		sessionID = uuid.New().String()
-		a.mem.CreateSession(sessionID, fmt.Sprintf("会话-%s", time.Now().Format("2006-01-02 15:04:05")))
-	} else {
+		if persist {
+			a.mem.CreateSession(sessionID, fmt.Sprintf("会话-%s", time.Now().Format("2006-01-02 15:04:05")), "")
+		}
+	} else if persist {
 		a.mem.SetCurrentSession(sessionID)
 	}
 
@@ -201,22 +293,110 @@ func (a *Agent) prepareSessionAndMessages(prompt string, sessionID string, image
 		messages = msgs
 	}
 	if len(messages) == 0 {
-		systemContent := a.prompts.GetSystemPrompt()
+		// 优先使用会话专属的系统提示词，未设置时回退到全局提示词
+		systemContent := a.mem.GetSessionSystemPrompt(sessionID)
+		if systemContent == "" {
+			systemContent = a.prompts.GetSystemPrompt()
+		}
 		messages = []ChatMessage{{Role: "system", Content: systemContent}}
 	}
 
 	userMsg := ChatMessage{Role: "user", Content: prompt, Images: images}
 	messages = append(messages, userMsg)
-	a.mem.AddMessageToSession(sessionID, userMsg)
-	a.mem.AddConversation(prompt)
+	if persist {
+		a.mem.AddMessageToSession(sessionID, userMsg)
+		a.mem.AddConversation(prompt)
+	}
 
 	return sessionID, messages
 }
 
+// AddSessionInstruction 向会话历史追加一条系统消息，用于在对话中途调整模型行为（例如"之后请用英文回答"）
+// 该消息会持久化，并在之后的每次运行中随历史一起发送；它不会被当作用户轮次
+// 会话尚无消息时先写入基础系统提示词，保证默认提示词仍位于历史开头
+func (a *Agent) AddSessionInstruction(sessionID, content string) error {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return fmt.Errorf("content is required")
+	}
+	msgs, exists := a.mem.GetSessionMessages(sessionID)
+	if !exists {
+		return ErrSessionNotFound
+	}
+	if len(msgs) == 0 {
+		base := a.mem.GetSessionSystemPrompt(sessionID)
+		if base == "" {
+			base = a.prompts.GetSystemPrompt()
+		}
+		a.mem.AddMessageToSession(sessionID, ChatMessage{Role: "system", Content: base})
+	}
+	a.mem.AddMessageToSession(sessionID, ChatMessage{Role: "system", Content: content})
+	return nil
+}
+
+// injectContextDocuments 将调用方提供的上下文文档作为系统消息插入到用户消息之前
+// 该消息只存在于本次运行的消息列表中，不会持久化到会话
+func injectContextDocuments(messages []ChatMessage, docs []string) []ChatMessage {
+	var parts []string
+	for _, d := range docs {
+		if strings.TrimSpace(d) != "" {
+			parts = append(parts, d)
+		}
+	}
+	if len(parts) == 0 || len(messages) == 0 {
+		return messages
+	}
+
+	var sb strings.Builder
+	sb.WriteString("以下是用户为本次请求提供的参考资料，请结合这些内容回答：\n")
+	for i, p := range parts {
+		fmt.Fprintf(&sb, "\n[资料 %d]\n%s\n", i+1, p)
+	}
+	contextMsg := ChatMessage{Role: "system", Content: sb.String()}
+
+	last := len(messages) - 1
+	out := make([]ChatMessage, 0, len(messages)+1)
+	out = append(out, messages[:last]...)
+	out = append(out, contextMsg, messages[last])
+	return out
+}
+
+// streamDelta 是流式响应单帧中的增量消息
+type streamDelta struct {
+	Content   string            `json:"content"`
+	ToolCalls []json.RawMessage `json:"tool_calls"`
+}
+
+// streamChunk 是流式响应的单帧，兼容 Ollama (message) 和 OpenAI 兼容接口 (choices[].delta)
+type streamChunk struct {
+	Message *streamDelta `json:"message"`
+	Choices []struct {
+		Delta streamDelta `json:"delta"`
+	} `json:"choices"`
+}
+
+// liveAnswerEnabled 判断本次运行是否可以把模型的回答实时转发为 token 事件
+// 需要移除推理内容或校验结构化输出时，回答必须在完整生成后处理，因此不实时转发
+func (a *Agent) liveAnswerEnabled(ctx context.Context) bool {
+	return a.config.Agent.StreamFinalAnswer && !a.config.Agent.StripReasoning && ResponseSchema(ctx) == nil
+}
+
+// looksLikeToolCallText 判断回答开头是否像以文本形式输出的工具调用 JSON 或推理块
+func looksLikeToolCallText(s string) bool {
+	return strings.ContainsAny(s[:1], "{[`<")
+}
+
 // processLLMStream 处理 LLM 的流式响应，提取文本内容和工具调用
-func (a *Agent) processLLMStream(ctx context.Context, messages []ChatMessage, events chan<- StreamEvent) (string, []ToolCall, error) {
-	toolsMetadata := a.toolRegistry.GetMetadata() // 获取所有工具的元数据
-	pipeReader, pipeWriter := io.Pipe()           // 创建管道用于 LLM 响应的流式处理
+// 回答开头不像工具调用时，文本会实时作为 token 事件转发（可能是最终答案）；
+// 之后如果出现工具调用，则停止转发并发送 answer_reset 事件，已转发的文本被视为推理过程。
+// 返回的 streamed 表示完整内容是否已经实时转发给客户端
+func (a *Agent) processLLMStream(ctx context.Context, messages []ChatMessage, events chan<- StreamEvent) (content string, calls []ToolCall, streamed bool, err error) {
+	// 获取工具的元数据，会话限制了可用工具时只提供允许的工具
+	toolsMetadata := a.toolRegistry.GetMetadataFiltered(func(name string) bool { return ToolAllowed(ctx, name) })
+	pipeReader, pipeWriter := io.Pipe() // 创建管道用于 LLM 响应的流式处理
+
+	// 记录本次调用的 token 估算，便于观察上下文增长
+	Logger.Debug().Ctx(ctx).Int("message_count", len(messages)).Int("estimated_tokens", EstimateMessagesTokens(messages)).Msg("Estimated prompt size")
 
 	// 发送“正在思考”事件给前端
 	events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: "正在思考如何响应..."}}
@@ -226,73 +406,110 @@ func (a *Agent) processLLMStream(ctx context.Context, messages []ChatMessage, ev
 		defer pipeWriter.Close()
 		err := a.llm.StreamCallWithContext(ctx, messages, toolsMetadata, pipeWriter)
 		if err != nil {
-			Logger.Error().Err(err).Msg("LLM Stream call failed")
-			errorEvent := StreamEvent{Type: "error", Payload: ErrorEventPayload{Message: err.Error()}}
+			Logger.Error().Ctx(ctx).Err(err).Msg("LLM Stream call failed")
+			errorEvent := NewErrorEvent(ErrorCodeFor(err, ErrorCodeModel), err.Error())
 			errBytes, _ := json.Marshal(errorEvent)
 			pipeWriter.Write(errBytes) // 将错误事件写入管道
 		}
 	}()
 
-	var fullContent strings.Builder // 存储完整的文本内容
-	var allToolCalls []ToolCall     // 存储所有提取到的工具调用
+	var fullContent strings.Builder       // 存储完整的文本内容
+	toolCalls := NewToolCallAccumulator() // 合并分帧发送的工具调用
+	decided := !a.liveAnswerEnabled(ctx)  // 是否已经决定要不要实时转发
+	streaming := false                    // 当前是否正在实时转发文本
+	stopStreaming := func() {
+		if streaming {
+			streaming = false
+			events <- StreamEvent{Type: "answer_reset"}
+		}
+	}
 
 	scanner := bufio.NewScanner(pipeReader) // 使用扫描器从管道读取数据
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
+		// OpenAI 兼容接口使用 SSE 格式，每行以 "data: " 开头，并以 [DONE] 结束
+		line := bytes.TrimPrefix(bytes.TrimSpace(scanner.Bytes()), []byte("data:"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || bytes.Equal(line, []byte("[DONE]")) {
 			continue
 		}
-		var event StreamEvent
-		// 尝试解析为 StreamEvent，如果解析成功且是错误事件，则直接转发
+		var event struct {
+			Type    string            `json:"type"`
+			Payload ErrorEventPayload `json:"payload"`
+		}
+		// 尝试解析为错误事件，如果解析成功则转为带类型负载的事件直接转发
 		if err := json.Unmarshal(line, &event); err == nil && event.Type == "error" {
-			events <- event
-			return "", nil, fmt.Errorf("stream error: %v", event.Payload)
+			events <- StreamEvent{Type: event.Type, Payload: event.Payload}
+			return "", nil, false, fmt.Errorf("stream error: %s", event.Payload.Message)
 		}
-		var chunk map[string]interface{}
-		// 尝试解析为通用 JSON 块
+		var chunk streamChunk
 		if err := json.Unmarshal(line, &chunk); err != nil {
-			Logger.Warn().Bytes("line", line).Msg("Failed to unmarshal stream chunk")
+			Logger.Warn().Ctx(ctx).Bytes("line", line).Msg("Failed to unmarshal stream chunk")
 			continue
 		}
-		// 提取消息内容和工具调用
-		if message, ok := chunk["message"].(map[string]interface{}); ok {
-			if content, ok := message["content"].(string); ok && content != "" {
-				fullContent.WriteString(content)
-			}
-			if toolCallsRaw, ok := message["tool_calls"].([]interface{}); ok {
-				for _, tcRaw := range toolCallsRaw {
-					tcBytes, _ := json.Marshal(tcRaw)
-					var tc ToolCall
-					if err := json.Unmarshal(tcBytes, &tc); err == nil {
-						if tc.Type == "" {
-							tc.Type = "function" // 默认为函数类型
-						}
-						allToolCalls = append(allToolCalls, tc)
+		// 提取消息内容和工具调用：Ollama 使用 message，OpenAI 兼容接口使用 choices[].delta
+		deltas := make([]streamDelta, 0, 1)
+		if chunk.Message != nil {
+			deltas = append(deltas, *chunk.Message)
+		}
+		for _, c := range chunk.Choices {
+			deltas = append(deltas, c.Delta)
+		}
+		for _, d := range deltas {
+			fullContent.WriteString(d.Content)
+			switch {
+			case streaming && d.Content != "":
+				events <- StreamEvent{Type: "token", Payload: TokenEventPayload{Text: d.Content}}
+			case !decided:
+				// 等到出现第一个非空白字符时再决定是否实时转发
+				if trimmed := strings.TrimSpace(fullContent.String()); trimmed != "" {
+					decided = true
+					if !looksLikeToolCallText(trimmed) && toolCalls.Len() == 0 {
+						streaming = true
+						events <- StreamEvent{Type: "token", Payload: TokenEventPayload{Text: fullContent.String()}}
 					}
 				}
 			}
+			if len(d.ToolCalls) > 0 {
+				stopStreaming()
+			}
+			for _, raw := range d.ToolCalls {
+				if err := toolCalls.Add(raw); err != nil {
+					Logger.Warn().Ctx(ctx).Err(err).RawJSON("tool_call", raw).Msg("Failed to merge tool call delta")
+					continue
+				}
+				// 转发目前累积的调用参数，前端可以在工具执行前展示即将进行的调用
+				if delta, ok := toolCalls.Latest(); ok {
+					events <- StreamEvent{Type: "tool_call_delta", Payload: delta}
+				}
+			}
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		Logger.Error().Err(err).Msg("Error reading from LLM stream pipe")
-		events <- StreamEvent{Type: "error", Payload: ErrorEventPayload{Message: "Stream read error"}}
-		return "", nil, err
+		Logger.Error().Ctx(ctx).Err(err).Msg("Error reading from LLM stream pipe")
+		events <- NewErrorEvent(ErrorCodeModel, "Stream read error")
+		return "", nil, false, err
+	}
+
+	allToolCalls, err := toolCalls.Calls()
+	if err != nil {
+		Logger.Warn().Ctx(ctx).Err(err).Msg("Dropped incomplete tool calls from LLM stream")
 	}
 
 	// 备用提取：如果 LLM 没有明确返回 tool_calls 字段，但内容中包含类似 JSON 的结构，尝试从中提取
 	if len(allToolCalls) == 0 && strings.Contains(fullContent.String(), `"name"`) {
-		Logger.Info().Msg("Attempting fallback tool extraction")
+		Logger.Info().Ctx(ctx).Msg("Attempting fallback tool extraction")
 		extractedCalls := extractToolCallsFromContent(fullContent.String())
 		if len(extractedCalls) > 0 {
+			stopStreaming()
 			allToolCalls = extractedCalls
-			Logger.Info().Int("count", len(allToolCalls)).Msg("Fallback extraction successful")
+			Logger.Info().Ctx(ctx).Int("count", len(allToolCalls)).Msg("Fallback extraction successful")
 		} else {
-			Logger.Warn().Str("content", fullContent.String()).Msg("Fallback extraction failed")
+			Logger.Warn().Ctx(ctx).Str("content", fullContent.String()).Msg("Fallback extraction failed")
 		}
 	}
 
-	return fullContent.String(), allToolCalls, nil
+	return fullContent.String(), allToolCalls, streaming, nil
 }
 
 // handleToolCalls 并发执行工具调用并返回结果
@@ -304,10 +521,23 @@ func (a *Agent) handleToolCalls(ctx context.Context, toolCalls []ToolCall, sessi
 		wg.Add(1)
 		go func(tc ToolCall) {
 			defer wg.Done()
+			// 工具中的 panic 转为失败结果返回给模型，不影响其他工具和进程
+			defer func() {
+				if p := recover(); p != nil {
+					Logger.Error().Ctx(ctx).Interface("panic", p).Str("tool", tc.Function.Name).Bytes("stack", debug.Stack()).Msg("Recovered from panic in tool")
+					toolResults <- ChatMessage{Role: "tool", Content: fmt.Sprintf("Tool '%s' execution failed.\nError: internal error", tc.Function.Name), Name: tc.Function.Name}
+				}
+			}()
+
+			// 计划模式下不执行工具，用合成结果代替，让模型继续规划
+			if IsPlanMode(ctx) {
+				toolResults <- ChatMessage{Role: "tool", Content: fmt.Sprintf("[dry-run] Tool '%s' was not executed because the agent is running in plan mode. Assume it succeeded and continue planning.", tc.Function.Name), Name: tc.Function.Name}
+				return
+			}
 
 			// --- 工具确认逻辑 ---
 			tool, exists := a.toolRegistry.Get(tc.Function.Name)
-			if exists && tool.IsSensitive() { // 如果工具是敏感的，需要用户确认
+			if exists && tool.IsSensitive() && !a.toolRegistry.IsDisabled(tc.Function.Name) && ToolAllowed(ctx, tc.Function.Name) { // 如果工具是敏感的，需要用户确认
 				// 注册确认请求，获取确认 ID 和结果通道
 				confID, ch := a.confirmationManager.RegisterRequest()
 
@@ -345,6 +575,13 @@ func (a *Agent) handleToolCalls(ctx context.Context, toolCalls []ToolCall, sessi
 			events <- StreamEvent{Type: "tool_end", Payload: ToolCallEventPayload{ToolName: tc.Function.Name}}
 			if toolErr != nil {
 				toolResult = fmt.Sprintf("Tool '%s' execution failed.\nError: %v", tc.Function.Name, toolErr)
+			} else {
+				// 按配置截断或摘要并标注来源工具，控制进入上下文的输出量
+				toolResult = a.formatToolResult(ctx, tc.Function.Name, toolResult)
+				if a.isUntrustedTool(tc.Function.Name) {
+					// 外部内容可能包含注入指令，包裹为不可信数据后再交给模型
+					toolResult = guardToolOutput(tc.Function.Name, toolResult, a.config.PromptGuard.StripInjections)
+				}
 			}
 			toolResults <- ChatMessage{Role: "tool", Content: toolResult, Name: tc.Function.Name}
 		}(toolCall)
@@ -367,6 +604,13 @@ func (a *Agent) StreamRunWithSessionAndImages(ctx context.Context, prompt string
 		// 确保“完成”事件总是被发送
 		events <- StreamEvent{Type: "status", Payload: map[string]string{"status": "stream_complete"}}
 	}()
+	// 捕获 Agent 循环中的 panic，转为错误事件，保证事件通道正常关闭、调用方不会阻塞
+	defer func() {
+		if p := recover(); p != nil {
+			Logger.Error().Ctx(ctx).Interface("panic", p).Bytes("stack", debug.Stack()).Msg("Recovered from panic in agent run")
+			events <- NewErrorEvent(ErrorCodeInternal, "internal error during agent run")
+		}
+	}()
 
 	// 启动 OpenTelemetry Span 进行追踪
 	ctx, span := tracer.Start(ctx, "Agent.StreamRunWithSessionAndImages",
@@ -379,23 +623,34 @@ func (a *Agent) StreamRunWithSessionAndImages(ctx context.Context, prompt string
 	)
 	defer span.End() // 确保 Span 在函数退出时结束
 
-	Logger.Info().Str("prompt", prompt).Int("image_count", len(images)).Str("model", model).Msg("User prompt received")
+	Logger.Info().Ctx(ctx).Str("prompt", prompt).Int("image_count", len(images)).Str("model", model).Msg("User prompt received")
 
 	// 准备会话和消息历史
-	sessionID, messages := a.prepareSessionAndMessages(prompt, sessionID, images)
+	sessionID, messages := a.prepareSessionAndMessages(ctx, prompt, sessionID, images)
+	// 会话限制了可用工具时，通过 Context 传递给本次运行以及调用的协作 Agent；已有的限制（来自上层 Agent）保持不变
+	if allowed, ok := a.mem.GetSessionAllowedTools(sessionID); ok && ctx.Value(allowedToolsContextKey) == nil {
+		ctx = WithAllowedTools(ctx, allowed)
+	}
+	messages = injectContextDocuments(messages, ContextDocuments(ctx))
+	messages = a.injectResponseSchema(messages, ResponseSchema(ctx))
 
 	// 如果指定了模型，则将其添加到上下文中
 	if model != "" {
 		ctx = WithModel(ctx, model)
 	}
 
-	var lastToolCallHash string // 用于检测重复的工具调用
+	seenToolCalls := make(map[string]int) // 本次运行中每个工具调用（名称+参数）的执行次数，用于检测重复调用
+	var emptyAnswerRetries int            // 已针对空回答进行的重试次数
+	budget := a.newRunOutputBudget()      // 本次运行累计的工具输出和最终回答的大小上限
 	// 代理执行循环
 	for iter := 0; iter < a.maxIterations; iter++ {
-		continueLoop, newMessages := a._runIteration(ctx, prompt, sessionID, messages, &lastToolCallHash, events)
+		events <- StreamEvent{Type: "iteration", Payload: IterationEventPayload{Iteration: iter + 1, MaxIterations: a.maxIterations}}
+		events <- StreamEvent{Type: "step", Payload: StepEventPayload{Index: iter + 1, Phase: StepPhaseStart}}
+		continueLoop, newMessages := a._runIteration(ctx, prompt, sessionID, messages, seenToolCalls, &emptyAnswerRetries, budget, events)
+		events <- StreamEvent{Type: "step", Payload: stepEndPayload(iter+1, messages, newMessages, !continueLoop)}
 		messages = newMessages
-		if !continueLoop { // 如果 _runIteration 返回 false，表示循环结束
-			break
+		if !continueLoop { // 如果 _runIteration 返回 false，表示循环已经结束（成功或已报告错误）
+			return
 		}
 	}
 
@@ -404,33 +659,52 @@ func (a *Agent) StreamRunWithSessionAndImages(ctx context.Context, prompt string
 		span.SetStatus(codes.Error, "Iteration limit reached")
 	}
 	// 发送错误事件
-	events <- StreamEvent{Type: "error", Payload: ErrorEventPayload{Message: "Iteration limit reached"}}
+	events <- NewErrorEvent(ErrorCodeIterationLimit, "Iteration limit reached")
+}
+
+// stepEndPayload 根据本次迭代新增的工具结果消息构造步骤结束事件
+func stepEndPayload(index int, before, after []ChatMessage, final bool) StepEventPayload {
+	step := StepEventPayload{Index: index, Phase: StepPhaseEnd, Final: final}
+	if len(after) > len(before) {
+		for _, m := range after[len(before):] {
+			if m.Role == "tool" {
+				step.Tools = append(step.Tools, m.Name)
+			}
+		}
+	}
+	step.ToolsUsed = len(step.Tools) > 0
+	return step
 }
 
 // _runIteration 执行代理循环的单次迭代
 // 返回一个布尔值，指示是否继续循环，以及更新后的消息列表
-func (a *Agent) _runIteration(ctx context.Context, prompt, sessionID string, messages []ChatMessage, lastToolCallHash *string, events chan<- StreamEvent) (bool, []ChatMessage) {
+func (a *Agent) _runIteration(ctx context.Context, prompt, sessionID string, messages []ChatMessage, seenToolCalls map[string]int, emptyAnswerRetries *int, budget *runOutputBudget, events chan<- StreamEvent) (bool, []ChatMessage) {
 	ctx, span := tracer.Start(ctx, "Agent._runIteration")
 	defer span.End()
 
 	// 1. 调用 LLM 获取响应
-	fullContent, allToolCalls, err := a.processLLMStream(ctx, messages, events)
+	fullContent, allToolCalls, streamed, err := a.processLLMStream(ctx, messages, events)
 	if err != nil {
 		return false, messages
 	}
 
 	msg := ChoiceMessage{Role: "assistant", Content: fullContent, ToolCalls: allToolCalls}
 
-	Logger.Info().Int("tool_calls", len(msg.ToolCalls)).Str("content_preview", truncateString(msg.Content, 50)).Msg("LLM response processed")
+	Logger.Info().Ctx(ctx).Int("tool_calls", len(msg.ToolCalls)).Str("content_preview", truncateString(msg.Content, 50)).Msg("LLM response processed")
 
 	// 2. 如果 LLM 建议工具调用
+	// 优先级：只要响应中包含工具调用，就以工具调用为准，同时返回的文本内容仅被视为推理过程，
+	// 以 "thinking" 事件发送给前端，不会作为最终答案返回；只有不含工具调用的响应才会被视为最终答案。
 	if len(msg.ToolCalls) > 0 {
+		if reasoning := strings.TrimSpace(msg.Content); reasoning != "" {
+			events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: reasoning}}
+		}
 		// 发送“正在验证工具”事件
 		events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: "检测到工具调用，正在验证并准备执行..."}}
 
 		// 验证工具调用的合理性
 		if !a.validateToolCall(ctx, prompt, msg.ToolCalls[0]) {
-			Logger.Warn().Interface("tool_call", msg.ToolCalls[0]).Msg("Tool call failed validation. Forcing text response.")
+			Logger.Warn().Ctx(ctx).Interface("tool_call", msg.ToolCalls[0]).Msg("Tool call failed validation. Forcing text response.")
 			// 如果验证失败，强制 LLM 返回文本响应
 			forceTextPrompt, _ := a.prompts.Render("force_text_response", nil)
 			messages = append(messages, ChatMessage{Role: "assistant", ToolCalls: msg.ToolCalls})
@@ -438,45 +712,99 @@ func (a *Agent) _runIteration(ctx context.Context, prompt, sessionID string, mes
 			return true, messages // 继续循环，让 LLM 重新生成响应
 		}
 
-		// 检测重复工具调用，防止无限循环
-		currentToolCallHash := hashToolCalls(msg.ToolCalls)
-		if currentToolCallHash == *lastToolCallHash {
-			Logger.Warn().Str("hash", currentToolCallHash).Msg("Detected duplicate tool call. Breaking loop.")
-			// 如果检测到重复，强制 LLM 总结答案
-			forceFinalAnswerMsg, _ := a.prompts.Render("duplicate_tool_call", nil)
-			messages = append(messages, ChatMessage{Role: "user", Content: forceFinalAnswerMsg})
-			return true, messages // 继续循环，让 LLM 总结答案
-		}
-		*lastToolCallHash = currentToolCallHash
+		// 检测重复工具调用，防止模型每轮都用相同参数调用同一个工具
+		// 超过次数上限的调用不会执行，而是返回提示让模型停止重复
+		toExecute, repeated := a.filterRepeatedToolCalls(ctx, msg.ToolCalls, seenToolCalls)
 
 		// 将助手的工具调用消息添加到消息历史
 		assistantMsg := ChatMessage{Role: "assistant", Content: msg.Content, ToolCalls: msg.ToolCalls}
 		messages = append(messages, assistantMsg)
-		a.mem.AddMessageToSession(sessionID, assistantMsg)
+		persistedMsg := assistantMsg
+		if a.config.Agent.StripReasoning {
+			persistedMsg.Content, _ = SplitReasoning(assistantMsg.Content)
+		}
+		// 计划模式下工具没有真正执行，工具调用和模拟结果都不写入会话，避免之后的正常运行误以为工具已执行
+		if !IsPlanMode(ctx) {
+			a.mem.AddMessageToSession(sessionID, persistedMsg)
+		}
 
-		// 执行工具调用
-		toolResults := a.handleToolCalls(ctx, msg.ToolCalls, sessionID, events)
+		// 计划模式下报告将要执行的工具调用
+		if IsPlanMode(ctx) {
+			for _, tc := range msg.ToolCalls {
+				events <- StreamEvent{Type: "tool_planned", Payload: PlannedToolCallEventPayload{ToolName: tc.Function.Name, Arguments: tc.Function.Arguments, Reasoning: strings.TrimSpace(msg.Content)}}
+			}
+		}
+
+		// 执行工具调用，重复的调用以提示消息作为结果
+		var toolResults []ChatMessage
+		if len(toExecute) > 0 {
+			toolResults = a.handleToolCalls(ctx, toExecute, sessionID, events)
+		}
+		toolResults = append(toolResults, repeated...)
+		// 累计的工具输出超过本次运行的上限后截断，避免上下文和会话历史无限增长
+		toolResults = budget.applyToolResults(ctx, toolResults)
 		// 发送“工具执行完毕”事件
 		events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: "工具执行完毕，正在处理工具结果..."}}
 
 		// 将工具执行结果添加到消息历史
 		for _, res := range toolResults {
 			messages = append(messages, res)
-			a.mem.AddMessageToSession(sessionID, res)
+			if !IsPlanMode(ctx) {
+				a.mem.AddMessageToSession(sessionID, res)
+			}
 		}
 		return true, messages // 继续循环，将工具结果反馈给 LLM
 	}
 
-	// 3. 如果 LLM 返回文本内容，则认为是最终答案
-	if msg.Content != "" {
-		// 发送“正在生成最终答案”事件和文本 token
-		events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: "正在生成最终答案..."}}
-		events <- StreamEvent{Type: "token", Payload: TokenEventPayload{Text: msg.Content}}
+	// 3. 既没有工具调用也没有有效内容：部分小模型会返回空回答
+	// 在配置的次数内追加提示让模型重新回答，超过后返回明确的错误，而不是把空字符串当作成功
+	if strings.TrimSpace(msg.Content) == "" {
+		if *emptyAnswerRetries < a.config.Agent.EmptyAnswerRetries {
+			*emptyAnswerRetries++
+			Logger.Warn().Ctx(ctx).Int("retry", *emptyAnswerRetries).Msg("LLM returned an empty answer. Retrying with a nudge.")
+			nudge, err := a.prompts.Render("empty_answer_nudge", nil)
+			if err != nil {
+				nudge = "请给出完整的回答。"
+			}
+			// 提示消息只用于本次运行，不写入会话历史
+			messages = append(messages, ChatMessage{Role: "user", Content: nudge})
+			return true, messages
+		}
+		Logger.Error().Ctx(ctx).Int("retries", *emptyAnswerRetries).Msg("LLM returned an empty answer")
+		if span.IsRecording() {
+			span.SetStatus(codes.Error, "Empty answer from model")
+		}
+		events <- NewErrorEvent(ErrorCodeModel, "模型返回了空回答，请重试或更换模型")
+		return false, messages
 	}
+
+	// 4. 否则认为是最终答案
 	lastAnswer := msg.Content
-	a.mem.AddNote(lastAnswer) // 记录最终答案
-	assistantMsg := ChatMessage{Role: "assistant", Content: lastAnswer}
-	a.mem.AddMessageToSession(sessionID, assistantMsg) // 将最终答案添加到消息历史
+	if a.config.Agent.StripReasoning {
+		// 推理内容只作为临时的 "reasoning" 事件发送，不进入会话历史
+		answer, reasoning := SplitReasoning(msg.Content)
+		if reasoning != "" {
+			events <- StreamEvent{Type: "reasoning", Payload: ReasoningEventPayload{Text: reasoning}}
+		}
+		lastAnswer = answer
+	}
+	lastAnswer, truncated := budget.applyAnswer(ctx, lastAnswer)
+	// 已实时转发的回答超出上限时，通知前端丢弃已显示的内容并重新发送截断后的回答
+	if streamed && truncated {
+		events <- StreamEvent{Type: "answer_reset"}
+		streamed = false
+	}
+	// 发送“正在生成最终答案”事件和文本 token，已实时转发的回答不再重复发送
+	if !streamed {
+		events <- StreamEvent{Type: "thinking", Payload: ThinkingEventPayload{Text: "正在生成最终答案..."}}
+		events <- StreamEvent{Type: "token", Payload: TokenEventPayload{Text: lastAnswer}}
+	}
+	// 计划模式的计划不是真正的回答，不写入笔记和会话历史
+	if !IsPlanMode(ctx) {
+		a.mem.AddNote(lastAnswer) // 记录最终答案
+		assistantMsg := ChatMessage{Role: "assistant", Content: lastAnswer}
+		a.mem.AddMessageToSession(sessionID, assistantMsg) // 将最终答案添加到消息历史
+	}
 
 	// 设置 Span 状态为成功
 	if span.IsRecording() {
@@ -485,17 +813,64 @@ func (a *Agent) _runIteration(ctx context.Context, prompt, sessionID string, mes
 	return false, messages // 循环结束
 }
 
-// hashToolCalls 计算工具调用的哈希值，用于检测重复的工具调用
-func hashToolCalls(calls []ToolCall) string {
-	if len(calls) == 0 {
-		return ""
+// reasoningBlockRe 匹配推理模型输出的 <think>...</think> 块
+var reasoningBlockRe = regexp.MustCompile(`(?s)<think>(.*?)</think>`)
+
+// SplitReasoning 将推理模型的输出拆分为最终答案和推理内容
+func SplitReasoning(content string) (answer string, reasoning string) {
+	var parts []string
+	for _, m := range reasoningBlockRe.FindAllStringSubmatch(content, -1) {
+		if r := strings.TrimSpace(m[1]); r != "" {
+			parts = append(parts, r)
+		}
 	}
-	// 仅对第一个工具调用进行哈希，简化处理
-	call := calls[0]
-	data, _ := json.Marshal(call)
-	hasher := sha256.New()
-	hasher.Write(data)
-	return hex.EncodeToString(hasher.Sum(nil))
+	if len(parts) == 0 {
+		return content, ""
+	}
+	return strings.TrimSpace(reasoningBlockRe.ReplaceAllString(content, "")), strings.Join(parts, "\n\n")
+}
+
+// DuplicateToolCallPromptData 是重复工具调用提示模板的数据
+type DuplicateToolCallPromptData struct {
+	Tool  string // 工具名称
+	Count int    // 本次运行中相同调用已执行的次数
+}
+
+// filterRepeatedToolCalls 将工具调用分为需要执行的调用和重复调用
+// 相同名称和参数的调用在一次运行中最多执行 MaxIdenticalToolCalls 次，超出的调用以提示消息作为工具结果返回
+func (a *Agent) filterRepeatedToolCalls(ctx context.Context, calls []ToolCall, seen map[string]int) ([]ToolCall, []ChatMessage) {
+	limit := a.config.Agent.MaxIdenticalToolCalls
+	if limit <= 0 {
+		return calls, nil
+	}
+	toExecute := make([]ToolCall, 0, len(calls))
+	var repeated []ChatMessage
+	for _, tc := range calls {
+		hash := hashToolCall(tc)
+		if seen[hash] < limit {
+			seen[hash]++
+			toExecute = append(toExecute, tc)
+			continue
+		}
+		Logger.Warn().Ctx(ctx).Str("tool", tc.Function.Name).Int("count", seen[hash]).Msg("Detected repeated identical tool call, skipping execution")
+		content, err := a.prompts.Render("duplicate_tool_call", DuplicateToolCallPromptData{Tool: tc.Function.Name, Count: seen[hash]})
+		if err != nil {
+			content = fmt.Sprintf("Tool '%s' was already called with the same arguments. Stop repeating it and answer with the information you have.", tc.Function.Name)
+		}
+		repeated = append(repeated, ChatMessage{Role: "tool", Content: content, Name: tc.Function.Name})
+	}
+	return toExecute, repeated
+}
+
+// hashToolCall 计算工具名称和参数的哈希值，用于检测重复的工具调用
+// 参数为 map，json.Marshal 会按键排序，因此相同参数得到相同的哈希
+func hashToolCall(call ToolCall) string {
+	data, _ := json.Marshal(struct {
+		Name string         `json:"name"`
+		Args map[string]any `json:"args"`
+	}{call.Function.Name, call.Function.Arguments})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // extractToolCallsFromContent 是一个辅助函数，用于从字符串内容中查找并提取工具调用 JSON
@@ -557,7 +932,7 @@ func extractToolCallsFromContent(content string) []ToolCall {
 }
 
 // execTool 执行指定的工具函数
-func (a *Agent) execTool(ctx context.Context, fc *FunctionCall, sessionID string, events chan<- StreamEvent) (string, error) {
+func (a *Agent) execTool(ctx context.Context, fc *FunctionCall, sessionID string, events chan<- StreamEvent) (res string, err error) {
 	ctx, span := tracer.Start(ctx, "Agent.execTool",
 		trace.WithAttributes(
 			attribute.String("tool.name", fc.Name),
@@ -567,17 +942,60 @@ func (a *Agent) execTool(ctx context.Context, fc *FunctionCall, sessionID string
 	)
 	defer span.End()
 	fname := fc.Name
-	Logger.Info().Str("tool_name", fname).Msg("Executing tool")
+	Logger.Info().Ctx(ctx).Str("tool_name", fname).Msg("Executing tool")
+	if a.toolAudit != nil {
+		start := time.Now()
+		defer func() {
+			entry := ToolAuditEntry{
+				Time:       start,
+				RequestID:  RequestIDFromContext(ctx),
+				SessionID:  sessionID,
+				Agent:      a.role,
+				Tool:       fname,
+				Arguments:  string(fc.Arguments),
+				Result:     res,
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			a.toolAudit.Record(ctx, entry)
+		}()
+	}
+	if a.toolRegistry.IsDisabled(fname) {
+		err := fmt.Errorf("tool '%s' is disabled by configuration and cannot be used", fname)
+		span.SetStatus(codes.Error, err.Error())
+		return err.Error(), nil // 将拒绝原因作为结果返回给 LLM
+	}
+	if !ToolAllowed(ctx, fname) {
+		err := fmt.Errorf("tool '%s' is not allowed in this session", fname)
+		span.SetStatus(codes.Error, err.Error())
+		return err.Error(), nil // 将拒绝原因作为结果返回给 LLM
+	}
 	tool, exists := a.toolRegistry.Get(fname) // 从工具注册表中获取工具
 	if !exists {
 		err := fmt.Errorf("model hallucinated an unknown tool: %s", fname)
 		span.SetStatus(codes.Error, err.Error())
 		return err.Error(), nil // 将错误作为结果返回给 LLM
 	}
-	// 运行工具
-	res, err := tool.Run(ctx, string(fc.Arguments), sessionID, a, events)
+	// 运行工具，暂时性失败时按递增的间隔重试有限次数，参数错误等永久性失败直接返回
+	for attempt := 0; ; attempt++ {
+		res, err = tool.Run(ctx, string(fc.Arguments), sessionID, a, events)
+		if err == nil || !IsTransient(err) || attempt >= a.config.Agent.ToolMaxRetries {
+			break
+		}
+		Logger.Warn().Ctx(ctx).Err(err).Str("tool_name", fname).Int("attempt", attempt+1).Msg("Transient tool failure, retrying")
+		span.AddEvent("tool.retry", trace.WithAttributes(attribute.Int("attempt", attempt+1)))
+		select {
+		case <-time.After(time.Duration(attempt+1) * 500 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
 	if err != nil {
-		Logger.Error().Err(err).Str("tool_name", fname).Msg("Tool execution failed")
+		Logger.Error().Ctx(ctx).Err(err).Str("tool_name", fname).Msg("Tool execution failed")
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		return "", err
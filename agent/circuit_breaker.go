@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 表示模型服务连续失败后熔断器已打开，调用被直接拒绝而不再等待超时
+var ErrCircuitOpen = errors.New("llm circuit open: model backend is unavailable")
+
+// 熔断器状态
+const (
+	circuitClosed   = "closed"    // 正常放行
+	circuitOpen     = "open"      // 冷却期内直接拒绝
+	circuitHalfOpen = "half_open" // 冷却期结束，放行一个探测请求
+)
+
+// CircuitBreakerProvider 包装 LLMProvider：连续失败达到阈值后打开熔断器，冷却期内的调用立即返回 ErrCircuitOpen，
+// 冷却期结束后只放行一个探测请求，成功则恢复正常，失败则重新进入冷却期
+// 只有连接错误、超时和 5xx 计为失败；4xx 说明服务仍在响应，调用方取消也不计入
+type CircuitBreakerProvider struct {
+	next      LLMProvider
+	threshold int           // 打开熔断器所需的连续失败次数
+	cooldown  time.Duration // 打开后拒绝调用的时长
+
+	mu       sync.Mutex
+	state    string
+	failures int       // 当前连续失败次数
+	openedAt time.Time // 最近一次打开的时间
+	probing  bool      // 半开状态下是否已有探测请求在进行
+}
+
+// 确保 CircuitBreakerProvider 实现了 LLMProvider 接口
+var _ LLMProvider = (*CircuitBreakerProvider)(nil)
+
+// NewCircuitBreakerProvider 创建熔断器
+// threshold: 连续失败多少次后打开，<=0 时使用 5
+// cooldown: 打开后拒绝调用的时长，<=0 时使用 30 秒
+func NewCircuitBreakerProvider(next LLMProvider, threshold int, cooldown time.Duration) *CircuitBreakerProvider {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &CircuitBreakerProvider{next: next, threshold: threshold, cooldown: cooldown, state: circuitClosed}
+}
+
+// allow 判断是否放行本次调用，拒绝时返回包装了 ErrCircuitOpen 的错误
+func (c *CircuitBreakerProvider) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if wait := c.cooldown - time.Since(c.openedAt); wait > 0 {
+			return fmt.Errorf("%w, retry in %s", ErrCircuitOpen, max(wait.Round(time.Second), time.Second))
+		}
+		c.state = circuitHalfOpen
+		c.probing = true
+		Logger.Info().Msg("LLM circuit half-open, probing model backend")
+		return nil
+	case circuitHalfOpen:
+		if c.probing {
+			return fmt.Errorf("%w, probing recovery", ErrCircuitOpen)
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// record 根据调用结果更新熔断器状态
+func (c *CircuitBreakerProvider) record(ctx context.Context, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	halfOpen := c.state == circuitHalfOpen
+	c.probing = false
+
+	if err != nil && ctx.Err() != nil {
+		// 调用方取消或超时，无法判断服务状态
+		return
+	}
+	var se *StatusError
+	if err == nil || (errors.As(err, &se) && se.StatusCode < 500) {
+		if c.state != circuitClosed {
+			Logger.Info().Msg("LLM circuit closed, model backend recovered")
+		}
+		c.state = circuitClosed
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if halfOpen || c.failures >= c.threshold {
+		if c.state != circuitOpen {
+			Logger.Warn().Ctx(ctx).Err(err).Int("consecutive_failures", c.failures).Dur("cooldown", c.cooldown).Msg("LLM circuit opened, failing fast until cooldown ends")
+		}
+		c.state = circuitOpen
+		c.openedAt = time.Now()
+	}
+}
+
+// CallWithContext 在熔断器放行时发起非流式对话
+func (c *CircuitBreakerProvider) CallWithContext(ctx context.Context, messages []ChatMessage, tools any) (*ChatResponse, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.next.CallWithContext(ctx, messages, tools)
+	c.record(ctx, err)
+	return resp, err
+}
+
+// StreamCallWithContext 在熔断器放行时发起流式对话
+func (c *CircuitBreakerProvider) StreamCallWithContext(ctx context.Context, messages []ChatMessage, tools any, writer io.Writer) error {
+	if err := c.allow(); err != nil {
+		return err
+	}
+	err := c.next.StreamCallWithContext(ctx, messages, tools, writer)
+	c.record(ctx, err)
+	return err
+}
+
+// Embed 在熔断器放行时获取文本的向量表示
+func (c *CircuitBreakerProvider) Embed(ctx context.Context, text string) ([]float64, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	vec, err := c.next.Embed(ctx, text)
+	c.record(ctx, err)
+	return vec, err
+}
+
+// Health 报告熔断器状态：打开或半开时为降级，模型服务不可用时所有实例同样受影响，因此不报告为 down
+func (c *CircuitBreakerProvider) Health() SubsystemHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := SubsystemHealth{Name: "llm", Status: HealthOK}
+	if c.state != circuitClosed {
+		h.Status = HealthDegraded
+		h.Detail = fmt.Sprintf("circuit %s after %d consecutive failures", c.state, c.failures)
+	}
+	return h
+}
@@ -13,6 +13,20 @@ type AgentConfig struct {
 	Role         string   `mapstructure:"role"`          // Agent 的角色 (e.g., "foreman", "coder", "researcher")
 	AllowedTools []string `mapstructure:"allowed_tools"` // 该 Agent 允许使用的工具列表
 	SystemPrompt string   `mapstructure:"system_prompt"` // 该 Agent 的系统提示词 (可选)
+	DeniedTools  []string `mapstructure:"denied_tools"`  // 该 Agent 禁用的工具列表，优先于 AllowedTools (可选)
+}
+
+// WebSearchConfig 定义了网页搜索和页面抓取的配置
+type WebSearchConfig struct {
+	UserAgent         string            `mapstructure:"user_agent"`          // 请求使用的 User-Agent，默认使用常见浏览器的 UA 以减少被拦截
+	AcceptLanguage    string            `mapstructure:"accept_language"`     // Accept-Language 请求头
+	Headers           map[string]string `mapstructure:"headers"`             // 额外的请求头（键名大小写不敏感）
+	DefaultResults    int               `mapstructure:"default_results"`     // 未指定 num_results 时返回的结果数量
+	MaxResults        int               `mapstructure:"max_results"`         // num_results 的上限，防止过量抓取
+	DefaultTimeout    int               `mapstructure:"default_timeout"`     // 未指定 timeout 时的超时时间（秒）
+	MaxTimeout        int               `mapstructure:"max_timeout"`         // timeout 的上限（秒）
+	DefaultContentLen int               `mapstructure:"default_content_len"` // 未指定 max_content_len 时每个抓取页面保留的字符数
+	MaxContentLen     int               `mapstructure:"max_content_len"`     // max_content_len 的上限，防止单个页面占满上下文
 }
 
 // Config 定义了应用程序的所有配置结构
@@ -24,8 +38,17 @@ type Config struct {
 	} `mapstructure:"service"`
 	// Server HTTP 服务器配置
 	Server struct {
-		Address    string `mapstructure:"address"`     // 监听地址，例如 ":8080"
-		StaticPath string `mapstructure:"static_path"` // 静态文件目录路径
+		Address             string `mapstructure:"address"`                // 监听地址，例如 ":8080"
+		StaticPath          string `mapstructure:"static_path"`            // 静态文件目录路径
+		SSEHeartbeatSecs    int    `mapstructure:"sse_heartbeat_secs"`     // SSE 无事件时首次发送进度心跳的间隔（秒）
+		SSEHeartbeatMaxSecs int    `mapstructure:"sse_heartbeat_max_secs"` // SSE 进度心跳指数退避的间隔上限（秒）
+		WSPingIntervalSecs  int    `mapstructure:"ws_ping_interval_secs"`  // WebSocket ping 间隔（秒），读写超时也由此推导
+		MaxPromptChars      int    `mapstructure:"max_prompt_chars"`       // 单次提示词允许的最大字符数，0 表示不限制
+		RequestTimeoutSecs  int    `mapstructure:"request_timeout_secs"`   // 普通非流式端点的处理超时（秒），0 表示不限制
+		AgentTimeoutSecs    int    `mapstructure:"agent_timeout_secs"`     // POST /agent 和 /upload 等耗时端点的处理超时（秒），0 表示不限制
+		// IdempotencyTTLSecs 带 Idempotency-Key 的 POST /agent 结果保留时间（秒），0 表示不启用去重
+		IdempotencyTTLSecs    int `mapstructure:"idempotency_ttl_secs"`
+		IdempotencyMaxEntries int `mapstructure:"idempotency_max_entries"` // 最多保留的幂等结果数
 	} `mapstructure:"server"`
 	// Ollama 大语言模型服务配置
 	Ollama struct {
@@ -33,40 +56,169 @@ type Config struct {
 		DefaultModel string   `mapstructure:"default_model"` // 默认使用的模型名称
 		Models       []string `mapstructure:"models"`        // 可用模型列表
 		TimeoutSecs  int      `mapstructure:"timeout_secs"`  // 请求超时时间（秒）
+		// CallTimeoutSecs 单次调用的超时（秒），流式调用只限制收到首个数据块之前的等待，可小于 timeout_secs，0 表示只受 timeout_secs 限制
+		CallTimeoutSecs int `mapstructure:"call_timeout_secs"`
+		// SlowCallWarnSecs 调用超过该时长仍未完成（流式调用为仍未开始输出）时记录警告，0 表示不检测
+		SlowCallWarnSecs int      `mapstructure:"slow_call_warn_secs"`
+		Temperature      *float64 `mapstructure:"temperature"`  // 采样温度 (可选，不设置时使用模型默认值)
+		KeepAlive        string   `mapstructure:"keep_alive"`   // 模型在请求后保持加载的时长，例如 "30m"，"-1" 表示一直保留；为空时使用服务端默认值
+		Stop             []string `mapstructure:"stop"`         // 默认停止序列，模型生成到其中任意一个时停止；请求可通过 stop 字段覆盖
+		Seed             *int     `mapstructure:"seed"`         // 随机种子 (可选，不设置时由模型随机选择)，与 temperature 0 一起使用时生成结果可复现
+		VerifyModel      bool     `mapstructure:"verify_model"` // 启动时通过 /api/tags 检查默认模型是否已安装，未安装时记录警告
+		// Cache 非流式响应缓存，仅在 temperature 为 0 时生效
+		Cache struct {
+			Enabled    bool `mapstructure:"enabled"`     // 是否启用
+			TTLSecs    int  `mapstructure:"ttl_secs"`    // 缓存条目的存活时间（秒）
+			MaxEntries int  `mapstructure:"max_entries"` // 最大缓存条目数
+		} `mapstructure:"cache"`
+		// CircuitBreaker 模型服务连续失败后快速拒绝调用，冷却期结束后放行一个探测请求
+		CircuitBreaker struct {
+			FailureThreshold int `mapstructure:"failure_threshold"` // 打开熔断器所需的连续失败次数，0 表示不启用
+			CooldownSecs     int `mapstructure:"cooldown_secs"`     // 打开后拒绝调用的时长（秒）
+		} `mapstructure:"circuit_breaker"`
+		// Fallbacks 主服务因连接错误或 5xx 失败时按顺序尝试的备用服务（Ollama 兼容 API）
+		Fallbacks []LLMFallbackConfig `mapstructure:"fallbacks"`
 	} `mapstructure:"ollama"`
 	// Log 日志配置
 	Log struct {
 		Level string `mapstructure:"level"` // 日志级别 (debug, info, warn, error)
+		Dir   string `mapstructure:"dir"`   // 日志文件目录，不存在时自动创建
+		File  string `mapstructure:"file"`  // 日志文件名
+		// 异步写入：缓冲区满时丢弃日志而不是阻塞业务，丢弃数量会定期汇报
+		Async          bool `mapstructure:"async"`            // 是否启用异步写入，默认同步（阻塞但不丢失）
+		BufferSize     int  `mapstructure:"buffer_size"`      // 异步缓冲区的条目数
+		DropReportSecs int  `mapstructure:"drop_report_secs"` // 汇报丢弃数量的间隔（秒）
 	} `mapstructure:"log"`
+	// Audit 工具调用审计日志，与会话记忆分开保存
+	Audit struct {
+		Enabled       bool   `mapstructure:"enabled"`         // 是否记录每次工具调用
+		Path          string `mapstructure:"path"`            // 审计文件路径，每次调用追加一行 JSON
+		MaxFieldChars int    `mapstructure:"max_field_chars"` // 参数和结果保留的最大字符数，超出部分截断，0 表示不截断
+	} `mapstructure:"audit"`
 	// Storage 存储配置
 	Storage struct {
-		MemoryPath string `mapstructure:"memory_path"` // 会话记忆存储路径
-		VectorPath string `mapstructure:"vector_path"` // 向量数据库存储路径
+		MemoryPath             string `mapstructure:"memory_path"`               // 会话记忆存储路径
+		VectorPath             string `mapstructure:"vector_path"`               // 向量数据库存储路径
+		VectorFormat           string `mapstructure:"vector_format"`             // 向量文件格式：jsonl (可读) 或 binary (加载更快)
+		VectorMetric           string `mapstructure:"vector_metric"`             // 检索使用的相似度度量：cosine、dot 或 euclidean
+		PersistEveryN          int    `mapstructure:"persist_every_n"`           // 每追加 N 条会话消息强制持久化一次元数据 (<=0 表示不启用)
+		PersistOnSessionChange bool   `mapstructure:"persist_on_session_change"` // 创建或切换会话后是否立即持久化元数据
+		PrettyJSON             bool   `mapstructure:"pretty_json"`               // memory.json 是否使用缩进格式，关闭后写入紧凑 JSON
+		IdleSessionMinutes     int    `mapstructure:"idle_session_minutes"`      // 会话闲置多少分钟后生成摘要并释放内存中的消息 (<=0 表示不启用)
+		IdleCheckMinutes       int    `mapstructure:"idle_check_minutes"`        // 检查闲置会话的间隔（分钟）
+		CompressArchived       bool   `mapstructure:"compress_archived"`         // 归档闲置会话时是否将会话文件压缩为 .gz，恢复使用时自动解压
+		FlatLog                bool   `mapstructure:"flat_log"`                  // 是否将提示词和最终答案另外记录到 memory.json 的 conversations/notes 列表
+		MaxConversations       int    `mapstructure:"max_conversations"`         // conversations 最多保留的最近条目数 (<=0 表示不限制)
+		MaxNotes               int    `mapstructure:"max_notes"`                 // notes 最多保留的最近条目数 (<=0 表示不限制)
+		BackupDir              string `mapstructure:"backup_dir"`                // POST /admin/backup 生成的快照目录，每次备份一个带时间戳的子目录
+		AllowBackup            bool   `mapstructure:"allow_backup"`              // 是否启用 POST /admin/backup，默认关闭
 	} `mapstructure:"storage"`
+	// Workspace 会话工作区配置，用于存放用户为某个会话上传的文件
+	Workspace struct {
+		BaseDir    string `mapstructure:"base_dir"`     // 工作区根目录，每个会话一个子目录
+		MaxFiles   int    `mapstructure:"max_files"`    // 每个会话工作区最多允许的文件数
+		MaxTotalMB int    `mapstructure:"max_total_mb"` // 每个会话工作区允许的总大小 (MB)
+	} `mapstructure:"workspace"`
 	// Agent 代理核心配置
 	Agent struct {
-		MaxIterations int                    `mapstructure:"max_iterations"` // 最大思考/执行循环次数
-		Agents        map[string]AgentConfig `mapstructure:"agents"`         // 多 Agent 配置，key 为 Agent 名称
+		MaxIterations           int                    `mapstructure:"max_iterations"`            // 最大思考/执行循环次数
+		MaxConcurrentRuns       int                    `mapstructure:"max_concurrent_runs"`       // 全局最大并发 Agent 运行数 (<=0 表示不限制)
+		DisabledTools           []string               `mapstructure:"disabled_tools"`            // 对所有 Agent 禁用的工具列表，例如只读部署时禁用 write_file/run_code/git_cmd
+		ToolMaxRetries          int                    `mapstructure:"tool_max_retries"`          // 工具遇到暂时性失败时的最大重试次数
+		EmptyAnswerRetries      int                    `mapstructure:"empty_answer_retries"`      // 模型返回空回答时追加提示重试的次数，0 表示直接报错
+		MaxIdenticalToolCalls   int                    `mapstructure:"max_identical_tool_calls"`  // 一次运行中相同名称和参数的工具调用最多执行的次数，超出后提示模型停止重复 (<=0 表示不检测)
+		MaxRunToolOutputChars   int                    `mapstructure:"max_run_tool_output_chars"` // 一次运行中累计加入对话的工具输出字符数上限，超出后截断并标注 (0 表示不限制)
+		MaxAnswerChars          int                    `mapstructure:"max_answer_chars"`          // 最终回答的最大字符数，超出后截断并标注 (0 表示不限制)
+		StripReasoning          bool                   `mapstructure:"strip_reasoning"`           // 是否在写入会话历史前移除 <think> 推理块（推理内容作为 reasoning 事件单独发送）
+		StreamFinalAnswer       bool                   `mapstructure:"stream_final_answer"`       // 回答不像工具调用时实时转发 token，而不是在完整生成后一次性发送
+		StructuredOutputRetries int                    `mapstructure:"structured_output_retries"` // 结构化输出不符合 response_schema 时调用模型修复的次数
+		Agents                  map[string]AgentConfig `mapstructure:"agents"`                    // 多 Agent 配置，key 为 Agent 名称
 	} `mapstructure:"agent"`
 	// Embedding 向量嵌入配置
 	Embedding struct {
-		Model   string `mapstructure:"model"`    // 用于生成嵌入的模型名称
-		APIPath string `mapstructure:"api_path"` // 嵌入 API 的路径
+		URL           string `mapstructure:"url"`             // 独立的嵌入服务地址 (可选，为空时使用对话服务)
+		Model         string `mapstructure:"model"`           // 用于生成嵌入的模型名称
+		APIPath       string `mapstructure:"api_path"`        // 嵌入 API 的路径
+		TimeoutSecs   int    `mapstructure:"timeout_secs"`    // 独立嵌入服务的请求超时时间（秒）
+		MaxInputChars int    `mapstructure:"max_input_chars"` // 单次嵌入输入的最大字符数，超出部分在嵌入前截断，0 表示不限制
+		Normalize     bool   `mapstructure:"normalize"`       // 是否将嵌入向量归一化为单位长度（文档和查询同时生效）
+		Dimension     int    `mapstructure:"dimension"`       // 嵌入模型应输出的向量维度，入库前检查，不一致时中止；0 表示不检查
 	} `mapstructure:"embedding"`
+	// Ingest 知识入库配置
+	Ingest struct {
+		Workers          int `mapstructure:"workers"`            // 并发嵌入的工作协程数量
+		ChunkTimeoutSecs int `mapstructure:"chunk_timeout_secs"` // 单个文本块嵌入请求的超时时间（秒）
+		ChunkMaxRetries  int `mapstructure:"chunk_max_retries"`  // 单个文本块嵌入失败后的最大重试次数
+		TimeoutSecs      int `mapstructure:"timeout_secs"`       // 单次入库的整体超时（秒），超时后停止嵌入剩余的块 (0 表示不限制)
+	} `mapstructure:"ingest"`
+	// WebSearch 网页搜索配置
+	WebSearch WebSearchConfig `mapstructure:"web_search"`
+	// SummarizeURL summarize_url 工具配置
+	SummarizeURL struct {
+		DefaultChars  int `mapstructure:"default_chars"`   // 未指定 max_chars 时的摘要长度（字符）
+		MaxInputChars int `mapstructure:"max_input_chars"` // 送入模型摘要的网页正文最大字符数，超出部分被截断
+	} `mapstructure:"summarize_url"`
+	// Confirmation 敏感工具执行确认配置
+	Confirmation struct {
+		TimeoutSecs int    `mapstructure:"timeout_secs"` // 等待用户响应的超时（秒），超时后视为拒绝
+		Store       string `mapstructure:"store"`        // 确认请求的存储后端："memory"（默认）或 "file"
+		Dir         string `mapstructure:"dir"`          // file 存储的目录，多实例部署时挂载同一目录即可共享
+		PollMillis  int    `mapstructure:"poll_millis"`  // 使用共享存储时轮询其他实例写入的响应的间隔（毫秒）
+	} `mapstructure:"confirmation"`
 	// Sandbox 代码沙箱配置
 	Sandbox struct {
-		MaxConcurrency int     `mapstructure:"max_concurrency"` // 最大并发执行数
-		DefaultTimeout int     `mapstructure:"default_timeout"` // 默认执行超时（秒）
-		MaxTimeout     int     `mapstructure:"max_timeout"`     // 最大允许超时（秒）
-		MemoryMB       int     `mapstructure:"memory_mb"`       // 内存限制 (MB)
-		CpuQuota       float64 `mapstructure:"cpu_quota"`       // CPU 配额 (核心数)
+		MaxConcurrency     int               `mapstructure:"max_concurrency"`      // 最大并发执行数，由所有 Agent 共享
+		AcquireTimeoutSecs int               `mapstructure:"acquire_timeout_secs"` // 并发已满时等待空闲槽位的超时（秒），超时后返回沙箱繁忙 (<=0 表示一直等待)
+		DefaultTimeout     int               `mapstructure:"default_timeout"`      // 默认执行超时（秒）
+		MaxTimeout         int               `mapstructure:"max_timeout"`          // 最大允许超时（秒）
+		MemoryMB           int               `mapstructure:"memory_mb"`            // 内存限制 (MB)
+		CpuQuota           float64           `mapstructure:"cpu_quota"`            // CPU 配额 (核心数)
+		AllowNetwork       bool              `mapstructure:"allow_network"`        // 是否允许 run_code 通过 allow_network 参数请求联网，默认禁止
+		Network            string            `mapstructure:"network"`              // 允许联网时使用的 docker 网络，可指定受限的自定义网络
+		Images             map[string]string `mapstructure:"images"`               // 按语言覆盖默认的 docker 镜像，例如 {"python": "python:3.12"}
 	} `mapstructure:"sandbox"`
+	// ShellCmd shell_cmd 工具配置，允许列表为空时该工具被禁用
+	ShellCmd struct {
+		AllowedCommands []string `mapstructure:"allowed_commands"` // 允许执行的基础命令，例如 make、go、npm
+		DefaultTimeout  int      `mapstructure:"default_timeout"`  // 默认执行超时（秒）
+		MaxTimeout      int      `mapstructure:"max_timeout"`      // 最大允许超时（秒）
+	} `mapstructure:"shell_cmd"`
+	// WriteFile write_file 工具配置
+	WriteFile struct {
+		AllowedExtensions []string `mapstructure:"allowed_extensions"` // 允许写入的文件扩展名，例如 .md、.txt；为空时不限制
+	} `mapstructure:"write_file"`
+	// WebhookTools 通过 HTTP webhook 实现的外部工具
+	WebhookTools struct {
+		AllowRegister bool                `mapstructure:"allow_register"` // 是否允许通过 POST /tools/register 在运行时注册工具
+		Tools         []WebhookToolConfig `mapstructure:"tools"`          // 启动时注册的工具，需出现在对应 Agent 的 allowed_tools 中
+	} `mapstructure:"webhook_tools"`
+	// ToolOutput 工具结果加入对话前的格式化配置
+	ToolOutput struct {
+		MaxChars  int                       `mapstructure:"max_chars"` // 默认最大字符数，0 表示不限制
+		Template  string                    `mapstructure:"template"`  // 默认格式化模板名称 (prompts 目录)，"none" 表示原样输出
+		Summarize bool                      `mapstructure:"summarize"` // 超出长度时是否默认调用模型摘要
+		Tools     map[string]ToolOutputRule `mapstructure:"tools"`     // 按工具覆盖的规则
+	} `mapstructure:"tool_output"`
+	// PromptGuard 提示词注入防护配置，作用于从网页、文件等外部来源获取内容的工具输出
+	PromptGuard struct {
+		Enabled         bool     `mapstructure:"enabled"`          // 是否将外部工具输出包裹在分隔符中并声明为不可信数据
+		StripInjections bool     `mapstructure:"strip_injections"` // 是否移除明显的指令注入语句
+		Tools           []string `mapstructure:"tools"`            // 输出被视为外部不可信内容的工具列表
+	} `mapstructure:"prompt_guard"`
 	// ToolValidation 工具调用验证配置
 	ToolValidation struct {
 		Keywords map[string][]string `mapstructure:"keywords"` // 每个工具对应的验证关键词列表
 	} `mapstructure:"tool_validation"`
 }
 
+// LLMFallbackConfig 定义了一个备用的 LLM 服务
+type LLMFallbackConfig struct {
+	Name        string `mapstructure:"name"`         // 名称，用于日志
+	URL         string `mapstructure:"url"`          // Ollama 兼容的对话 API 地址
+	Model       string `mapstructure:"model"`        // 使用的模型，为空时沿用请求指定的模型
+	TimeoutSecs int    `mapstructure:"timeout_secs"` // 请求超时时间（秒），为空时沿用 ollama.timeout_secs
+}
+
 // LoadConfig 从配置文件、环境变量和默认值加载配置
 // 返回加载后的 Config 结构体，如果出错则返回 error
 func LoadConfig() (Config, error) {
@@ -81,36 +233,141 @@ func LoadConfig() (Config, error) {
 	// Server
 	viper.SetDefault("server.address", ":8080")
 	viper.SetDefault("server.static_path", "./client")
+	viper.SetDefault("server.sse_heartbeat_secs", 2)
+	viper.SetDefault("server.sse_heartbeat_max_secs", 30)
+	viper.SetDefault("server.ws_ping_interval_secs", 30)
+	viper.SetDefault("server.max_prompt_chars", 32000)
+	viper.SetDefault("server.request_timeout_secs", 30)
+	viper.SetDefault("server.agent_timeout_secs", 300)
+	viper.SetDefault("server.idempotency_ttl_secs", 600)
+	viper.SetDefault("server.idempotency_max_entries", 1000)
 	// Ollama
 	viper.SetDefault("ollama.url", "http://localhost:11434/api/chat")
 	viper.SetDefault("ollama.default_model", "qwen2.5-coder:3b")
 	viper.SetDefault("ollama.timeout_secs", 300) // 5 minutes
+	viper.SetDefault("ollama.call_timeout_secs", 0)
+	viper.SetDefault("ollama.slow_call_warn_secs", 30)
+	viper.SetDefault("ollama.circuit_breaker.failure_threshold", 5)
+	viper.SetDefault("ollama.circuit_breaker.cooldown_secs", 30)
+	viper.SetDefault("ollama.verify_model", true)
+	viper.SetDefault("ollama.cache.enabled", false)
+	viper.SetDefault("ollama.cache.ttl_secs", 600)
+	viper.SetDefault("ollama.cache.max_entries", 256)
 	// Log
 	viper.SetDefault("log.level", "INFO")
+	viper.SetDefault("log.dir", "logs")
+	viper.SetDefault("log.file", "app.log")
+	viper.SetDefault("log.async", false)
+	viper.SetDefault("log.buffer_size", DefaultLogBufferSize)
+	viper.SetDefault("log.drop_report_secs", DefaultLogDropReportSecs)
+
+	// Audit
+	viper.SetDefault("audit.enabled", false)
+	viper.SetDefault("audit.path", "logs/tool_audit.jsonl")
+	viper.SetDefault("audit.max_field_chars", 2000)
 	// Storage
 	viper.SetDefault("storage.memory_path", "./memory_store")
 	viper.SetDefault("storage.vector_path", "./memory_store")
+	viper.SetDefault("storage.vector_format", VectorFormatJSONL)
+	viper.SetDefault("storage.vector_metric", SimilarityCosine)
+	viper.SetDefault("storage.persist_every_n", 0)
+	viper.SetDefault("storage.persist_on_session_change", false)
+	viper.SetDefault("storage.pretty_json", true)
+	viper.SetDefault("storage.idle_session_minutes", 0)
+	viper.SetDefault("storage.idle_check_minutes", DefaultIdleCheckMinutes)
+	viper.SetDefault("storage.compress_archived", false)
+	viper.SetDefault("storage.flat_log", false)
+	viper.SetDefault("storage.max_conversations", 1000)
+	viper.SetDefault("storage.max_notes", 1000)
+	viper.SetDefault("storage.backup_dir", "./backups")
+	viper.SetDefault("storage.allow_backup", false)
+	// Workspace
+	viper.SetDefault("workspace.base_dir", "./workspaces")
+	viper.SetDefault("workspace.max_files", DefaultWorkspaceMaxFiles)
+	viper.SetDefault("workspace.max_total_mb", DefaultWorkspaceMaxTotalMB)
 	// Agent
 	viper.SetDefault("agent.max_iterations", 6)
+	viper.SetDefault("agent.max_concurrent_runs", 10)
+	viper.SetDefault("agent.tool_max_retries", 2)
+	viper.SetDefault("agent.empty_answer_retries", 1)
+	viper.SetDefault("agent.max_identical_tool_calls", 3)
+	viper.SetDefault("agent.max_run_tool_output_chars", 50000)
+	viper.SetDefault("agent.max_answer_chars", 20000)
+	viper.SetDefault("agent.structured_output_retries", DefaultStructuredOutputRetries)
+	viper.SetDefault("agent.strip_reasoning", false)
+	viper.SetDefault("agent.stream_final_answer", true)
 	// Embedding
 	viper.SetDefault("embedding.model", "nomic-embed-text")
 	viper.SetDefault("embedding.api_path", "/api/embeddings")
+	viper.SetDefault("embedding.timeout_secs", 60)
+	viper.SetDefault("embedding.max_input_chars", DefaultEmbeddingMaxInputChars)
+	viper.SetDefault("embedding.normalize", false)
+	viper.SetDefault("embedding.dimension", 0)
+	// Ingest
+	viper.SetDefault("ingest.workers", DefaultIngestWorkers)
+	viper.SetDefault("ingest.chunk_timeout_secs", DefaultIngestChunkTimeout)
+	viper.SetDefault("ingest.chunk_max_retries", 2)
+	viper.SetDefault("ingest.timeout_secs", 0)
+	// WebSearch
+	viper.SetDefault("web_search.user_agent", DefaultWebUserAgent)
+	viper.SetDefault("web_search.accept_language", "zh-CN,zh;q=0.9,en;q=0.8")
+	viper.SetDefault("web_search.default_results", DefaultWebSearchResults)
+	viper.SetDefault("web_search.max_results", DefaultWebSearchMaxResults)
+	viper.SetDefault("web_search.default_timeout", DefaultWebSearchTimeout)
+	viper.SetDefault("web_search.max_timeout", DefaultWebSearchMaxTimeout)
+	viper.SetDefault("web_search.default_content_len", DefaultWebSearchContentLen)
+	viper.SetDefault("web_search.max_content_len", DefaultWebSearchMaxContentLen)
+	viper.SetDefault("summarize_url.default_chars", summarizeURLDefaultChars)
+	viper.SetDefault("summarize_url.max_input_chars", summarizeURLDefaultInput)
+	// Confirmation
+	viper.SetDefault("confirmation.timeout_secs", 300) // 5 minutes
+	viper.SetDefault("confirmation.store", "memory")
+	viper.SetDefault("confirmation.dir", "./memory_store/confirmations")
+	viper.SetDefault("confirmation.poll_millis", 500)
 	// Sandbox
 	viper.SetDefault("sandbox.max_concurrency", 5)
+	viper.SetDefault("sandbox.acquire_timeout_secs", DefaultSandboxAcquireTimeoutSecs)
 	viper.SetDefault("sandbox.default_timeout", 60) // 60 seconds
 	viper.SetDefault("sandbox.max_timeout", 300)    // 300 seconds
 	viper.SetDefault("sandbox.memory_mb", 256)
 	viper.SetDefault("sandbox.cpu_quota", 0.5)
+	viper.SetDefault("sandbox.allow_network", false)
+	viper.SetDefault("sandbox.network", "bridge")
+	// ShellCmd
+	viper.SetDefault("shell_cmd.allowed_commands", []string{})
+	viper.SetDefault("shell_cmd.default_timeout", 60)
+	viper.SetDefault("shell_cmd.max_timeout", 600)
+	// WebhookTools
+	viper.SetDefault("webhook_tools.allow_register", false)
+
+	// ToolOutput
+	viper.SetDefault("tool_output.max_chars", 4000)
+	viper.SetDefault("tool_output.template", DefaultToolOutputTemplate)
+	viper.SetDefault("tool_output.summarize", false)
+
+	// PromptGuard
+	viper.SetDefault("prompt_guard.enabled", true)
+	viper.SetDefault("prompt_guard.strip_injections", false)
+	viper.SetDefault("prompt_guard.tools", []string{"web_search", "summarize_url", "read_file", "knowledge_search", "get_source_chunks", "http_request"})
 
 	// ToolValidation Defaults
 	// 设置工具验证的默认关键词，支持多语言
 	viper.SetDefault("tool_validation.keywords.read_file", []string{"file", "read", "write", "save", "open", "path", "tệp", "đọc", "ghi", "lưu", "mở", "đường dẫn", "文件", "读取", "写入", "保存", "路径", "打开"})
 	viper.SetDefault("tool_validation.keywords.write_file", []string{"file", "read", "write", "save", "open", "path", "tệp", "đọc", "ghi", "lưu", "mở", "đường dẫn", "文件", "读取", "写入", "保存", "路径", "打开"})
+	viper.SetDefault("tool_validation.keywords.write_files", []string{"file", "files", "write", "save", "create", "project", "scaffold", "path", "文件", "写入", "保存", "创建", "项目", "脚手架", "路径"})
+	viper.SetDefault("tool_validation.keywords.shell_cmd", []string{"build", "test", "make", "install", "compile", "run", "构建", "编译", "测试", "安装", "运行"})
+	viper.SetDefault("tool_validation.keywords.summarize_url", []string{"url", "link", "page", "website", "article", "summary", "summarize", "gist", "http", "链接", "网页", "网址", "文章", "总结", "摘要", "概括"})
+	viper.SetDefault("tool_validation.keywords.http_request", []string{"api", "http", "request", "endpoint", "url", "get", "post", "接口", "请求", "调用"})
 	viper.SetDefault("tool_validation.keywords.run_code", []string{"run", "execute", "code", "script", "chạy", "thực thi", "mã", "运行", "执行", "代码", "开发", "写", "编写", "implement", "develop", "write"})
+	viper.SetDefault("tool_validation.keywords.outline_file", []string{"outline", "structure", "file", "function", "class", "type", "code", "read", "大纲", "结构", "文件", "函数", "类", "代码", "读取"})
+	viper.SetDefault("tool_validation.keywords.lint_code", []string{"lint", "check", "review", "compile", "syntax", "vet", "code", "检查", "审查", "编译", "语法", "代码"})
 	// 移除了通用的词汇如 "create", "new", "创建", "新建" 以防止误报
 	viper.SetDefault("tool_validation.keywords.create_session", []string{"session", "conversation", "chat", "topic", "switch", "hội thoại", "chủ đề", "trò chuyện", "chuyển", "会话", "聊天", "主题", "切换"})
 	viper.SetDefault("tool_validation.keywords.switch_session", []string{"session", "conversation", "chat", "topic", "switch", "hội thoại", "chủ đề", "trò chuyện", "chuyển", "会话", "聊天", "主题", "切换"})
 	viper.SetDefault("tool_validation.keywords.web_search", []string{"search", "find", "what is", "how to", "who is", "tell me about", "tìm", "là gì", "hướng dẫn", "ai là", "kể cho tôi về", "搜索", "查找", "是什么", "如何", "谁是", "告诉我关于"})
+	viper.SetDefault("tool_validation.keywords.list_knowledge_sources", []string{"knowledge", "source", "document", "docs", "知识库", "来源", "文档", "资料"})
+	viper.SetDefault("tool_validation.keywords.get_source_chunks", []string{"knowledge", "source", "document", "docs", "知识库", "来源", "文档", "资料"})
+	viper.SetDefault("tool_validation.keywords.list_tools", []string{"tool", "tools", "capability", "capabilities", "agent", "工具", "能力", "功能"})
 	viper.SetDefault("tool_validation.keywords.knowledge_search", []string{"search", "find", "what is", "how to", "who is", "tell me about", "tìm", "là gì", "hướng dẫn", "ai là", "kể cho tôi về", "搜索", "查找", "是什么", "如何", "谁是", "告诉我关于"})
 
 	// 从环境变量读取配置
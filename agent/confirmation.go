@@ -7,18 +7,70 @@ import (
 	"github.com/google/uuid"
 )
 
+// 确认请求的默认参数，配置未设置时使用
+const (
+	DefaultConfirmationTimeout      = 5 * time.Minute        // 等待用户响应的超时
+	DefaultConfirmationPollInterval = 500 * time.Millisecond // 使用共享存储时轮询用户响应的间隔
+)
+
 // ConfirmationManager 管理待处理的工具执行确认请求。
 // 它维护一个映射，将确认请求 ID 映射到用于传递用户响应的通道。
+// 默认只在内存中保存；通过 WithConfirmationStore 设置共享存储后，其他实例收到的响应也能送达。
 type ConfirmationManager struct {
 	mu       sync.Mutex           // 互斥锁，用于保护 requests 映射的并发访问
 	requests map[string]chan bool // 存储确认请求 ID 到结果通道的映射
+
+	timeout      time.Duration     // 等待用户响应的超时
+	store        ConfirmationStore // 共享存储，为 nil 时只使用内存
+	pollInterval time.Duration     // 轮询共享存储的间隔
+	stop         chan struct{}     // 关闭轮询协程
+	stopOnce     sync.Once
+}
+
+// ConfirmationOption 是 ConfirmationManager 的可选配置
+type ConfirmationOption func(*ConfirmationManager)
+
+// WithConfirmationTimeout 设置等待用户响应的超时，<=0 时使用默认值
+func WithConfirmationTimeout(d time.Duration) ConfirmationOption {
+	return func(cm *ConfirmationManager) {
+		if d > 0 {
+			cm.timeout = d
+		}
+	}
+}
+
+// WithConfirmationStore 设置共享存储以及轮询用户响应的间隔（<=0 时使用默认值）
+func WithConfirmationStore(store ConfirmationStore, pollInterval time.Duration) ConfirmationOption {
+	return func(cm *ConfirmationManager) {
+		cm.store = store
+		if pollInterval > 0 {
+			cm.pollInterval = pollInterval
+		}
+	}
 }
 
 // NewConfirmationManager 创建并返回一个新的 ConfirmationManager 实例。
-func NewConfirmationManager() *ConfirmationManager {
-	return &ConfirmationManager{
-		requests: make(map[string]chan bool), // 初始化请求映射
+// 设置了共享存储时会清理已过期的记录，并启动轮询协程，需要调用 Close 停止。
+func NewConfirmationManager(opts ...ConfirmationOption) *ConfirmationManager {
+	cm := &ConfirmationManager{
+		requests:     make(map[string]chan bool), // 初始化请求映射
+		timeout:      DefaultConfirmationTimeout,
+		pollInterval: DefaultConfirmationPollInterval,
+		stop:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(cm)
+	}
+	if cm.store != nil {
+		cm.purgeExpired()
+		go cm.pollLoop()
 	}
+	return cm
+}
+
+// Close 停止轮询共享存储的协程
+func (cm *ConfirmationManager) Close() {
+	cm.stopOnce.Do(func() { close(cm.stop) })
 }
 
 // RegisterRequest 注册一个新的确认请求。
@@ -33,14 +85,23 @@ func (cm *ConfirmationManager) RegisterRequest() (string, chan bool) {
 	ch := make(chan bool, 1)  // 创建一个带缓冲的通道，用于传递布尔结果 (true 表示允许，false 表示拒绝)
 	cm.requests[id] = ch      // 将请求 ID 和通道存储起来
 
-	// 启动一个 goroutine，在 5 分钟后自动清理此请求，防止悬挂请求
+	if cm.store != nil {
+		now := time.Now()
+		rec := ConfirmationRecord{ID: id, Status: ConfirmationPending, CreatedAt: now, ExpiresAt: now.Add(cm.timeout)}
+		if err := cm.store.Save(rec); err != nil {
+			Logger.Error().Err(err).Str("confirmation_id", id).Msg("Failed to save confirmation request to store")
+		}
+	}
+
+	// 启动一个 goroutine，超时后自动清理此请求，防止悬挂请求
 	go func() {
-		time.Sleep(5 * time.Minute) // 等待 5 分钟
-		cm.mu.Lock()                // 获取锁以修改 requests 映射
+		time.Sleep(cm.timeout)
+		cm.mu.Lock() // 获取锁以修改 requests 映射
 		defer cm.mu.Unlock()
 		if _, ok := cm.requests[id]; ok { // 再次检查请求是否存在，可能已被 ResolveRequest 处理
 			close(ch)               // 关闭通道
 			delete(cm.requests, id) // 从映射中删除请求
+			cm.deleteRecord(id)
 			Logger.Warn().Str("confirmation_id", id).Msg("Confirmation request timed out and was cleaned up.")
 		}
 	}()
@@ -50,18 +111,103 @@ func (cm *ConfirmationManager) RegisterRequest() (string, chan bool) {
 
 // ResolveRequest 解决一个确认请求。
 // 它根据确认 ID 查找对应的通道，并将用户响应（允许或拒绝）发送到该通道。
+// 请求不在本实例时，将响应写入共享存储，由发起请求的实例轮询取走。
 // id: 要解决的确认请求的 ID。
 // allowed: 用户是否允许执行操作 (true 表示允许，false 表示拒绝)。
 func (cm *ConfirmationManager) ResolveRequest(id string, allowed bool) {
 	cm.mu.Lock() // 获取锁，确保并发安全
 	defer cm.mu.Unlock()
 
-	if ch, ok := cm.requests[id]; ok { // 如果找到了对应的请求通道
-		ch <- allowed           // 将用户响应发送到通道
-		close(ch)               // 关闭通道
-		delete(cm.requests, id) // 从映射中删除请求
+	if cm.deliverLocked(id, allowed) {
 		Logger.Info().Str("confirmation_id", id).Bool("allowed", allowed).Msg("Confirmation request resolved.")
-	} else {
-		Logger.Warn().Str("confirmation_id", id).Msg("Attempted to resolve a non-existent or already resolved confirmation request.")
+		return
+	}
+	if cm.store != nil {
+		rec, ok, err := cm.store.Get(id)
+		if err != nil {
+			Logger.Error().Err(err).Str("confirmation_id", id).Msg("Failed to read confirmation request from store")
+			return
+		}
+		if ok && rec.Status == ConfirmationPending && time.Now().Before(rec.ExpiresAt) {
+			rec.Status = ConfirmationResolved
+			rec.Allowed = allowed
+			if err := cm.store.Save(rec); err != nil {
+				Logger.Error().Err(err).Str("confirmation_id", id).Msg("Failed to save confirmation response to store")
+				return
+			}
+			Logger.Info().Str("confirmation_id", id).Bool("allowed", allowed).Msg("Confirmation response forwarded through store.")
+			return
+		}
+	}
+	Logger.Warn().Str("confirmation_id", id).Msg("Attempted to resolve a non-existent or already resolved confirmation request.")
+}
+
+// deliverLocked 将响应发送给本实例中等待的请求，调用方必须持有 mu；请求不在本实例时返回 false
+func (cm *ConfirmationManager) deliverLocked(id string, allowed bool) bool {
+	ch, ok := cm.requests[id]
+	if !ok {
+		return false
+	}
+	ch <- allowed           // 将用户响应发送到通道
+	close(ch)               // 关闭通道
+	delete(cm.requests, id) // 从映射中删除请求
+	cm.deleteRecord(id)
+	return true
+}
+
+// deleteRecord 从共享存储中删除记录，未设置存储时不做任何事
+func (cm *ConfirmationManager) deleteRecord(id string) {
+	if cm.store == nil {
+		return
+	}
+	if err := cm.store.Delete(id); err != nil {
+		Logger.Warn().Err(err).Str("confirmation_id", id).Msg("Failed to delete confirmation record")
+	}
+}
+
+// pollLoop 定期检查本实例等待中的请求是否已由其他实例写入响应，并按超时间隔清理过期记录
+func (cm *ConfirmationManager) pollLoop() {
+	ticker := time.NewTicker(cm.pollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(cm.timeout)
+	defer purge.Stop()
+	for {
+		select {
+		case <-cm.stop:
+			return
+		case <-ticker.C:
+			cm.pollOnce()
+		case <-purge.C:
+			cm.purgeExpired()
+		}
+	}
+}
+
+// pollOnce 取走共享存储中已解决的本实例请求
+func (cm *ConfirmationManager) pollOnce() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for id := range cm.requests {
+		rec, ok, err := cm.store.Get(id)
+		if err != nil || !ok || rec.Status != ConfirmationResolved {
+			continue
+		}
+		cm.deliverLocked(id, rec.Allowed)
+		Logger.Info().Str("confirmation_id", id).Bool("allowed", rec.Allowed).Msg("Confirmation request resolved from store.")
+	}
+}
+
+// purgeExpired 删除共享存储中已过期的记录，例如服务重启前未完成的请求
+func (cm *ConfirmationManager) purgeExpired() {
+	recs, err := cm.store.List()
+	if err != nil {
+		Logger.Warn().Err(err).Msg("Failed to list confirmation records")
+		return
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		if now.After(rec.ExpiresAt) {
+			cm.deleteRecord(rec.ID)
+		}
 	}
 }
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 确认请求在共享存储中的状态
+const (
+	ConfirmationPending  = "pending"  // 等待用户响应
+	ConfirmationResolved = "resolved" // 用户已响应，等待发起请求的实例取走结果
+)
+
+// ConfirmationRecord 是确认请求在共享存储中的记录
+type ConfirmationRecord struct {
+	ID        string    `json:"id"`         // 确认请求 ID
+	Status    string    `json:"status"`     // ConfirmationPending 或 ConfirmationResolved
+	Allowed   bool      `json:"allowed"`    // 用户是否允许执行，仅在 resolved 时有效
+	CreatedAt time.Time `json:"created_at"` // 创建时间
+	ExpiresAt time.Time `json:"expires_at"` // 过期时间，过期后记录会被清理
+}
+
+// ConfirmationStore 是确认请求的持久化或共享后端。
+// 设置后，任何实例收到的用户响应都会写入存储，由发起请求并阻塞等待的实例轮询取走，
+// 使确认在多实例部署中可用，且待处理的请求在重启后仍可查到并按过期时间清理。
+type ConfirmationStore interface {
+	// Save 创建或覆盖一条记录
+	Save(rec ConfirmationRecord) error
+	// Get 返回指定 ID 的记录，不存在时第二个返回值为 false
+	Get(id string) (ConfirmationRecord, bool, error)
+	// Delete 删除指定 ID 的记录，记录不存在时不返回错误
+	Delete(id string) error
+	// List 返回所有记录
+	List() ([]ConfirmationRecord, error)
+}
+
+// FileConfirmationStore 将每个确认请求保存为目录下的一个 JSON 文件。
+// 多个实例挂载同一目录（例如共享卷）即可共享确认请求。
+type FileConfirmationStore struct {
+	dir string
+}
+
+// NewFileConfirmationStore 创建基于目录的确认存储
+func NewFileConfirmationStore(dir string) (*FileConfirmationStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create confirmation directory: %w", err)
+	}
+	return &FileConfirmationStore{dir: dir}, nil
+}
+
+// path 返回记录文件的路径，ID 只保留文件名部分以防止路径遍历
+func (s *FileConfirmationStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+// Save 先写入临时文件再重命名，其他实例不会读到写了一半的记录
+func (s *FileConfirmationStore) Save(rec ConfirmationRecord) error {
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	target := s.path(rec.ID)
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// Get 读取指定 ID 的记录
+func (s *FileConfirmationStore) Get(id string) (ConfirmationRecord, bool, error) {
+	bs, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return ConfirmationRecord{}, false, nil
+	}
+	if err != nil {
+		return ConfirmationRecord{}, false, err
+	}
+	var rec ConfirmationRecord
+	if err := json.Unmarshal(bs, &rec); err != nil {
+		return ConfirmationRecord{}, false, fmt.Errorf("decode confirmation %s: %w", id, err)
+	}
+	return rec, true, nil
+}
+
+// Delete 删除指定 ID 的记录文件
+func (s *FileConfirmationStore) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List 读取目录下的所有记录，跳过无法解析的文件
+func (s *FileConfirmationStore) List() ([]ConfirmationRecord, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var recs []ConfirmationRecord
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		rec, ok, err := s.Get(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			Logger.Warn().Err(err).Str("file", e.Name()).Msg("Skipping unreadable confirmation record")
+			continue
+		}
+		if ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EmbeddingProvider 定义了生成文本向量的接口
+// 嵌入与对话可以使用不同的模型和端点（例如对话使用远程服务，嵌入使用本地模型）
+// LLMProvider 同样实现了此接口，可以在未单独配置嵌入服务时作为回退
+type EmbeddingProvider interface {
+	// Embed 获取文本的向量表示
+	Embed(ctx context.Context, text string) ([]float64, error)
+}
+
+// OllamaEmbedder 通过 Ollama 兼容的嵌入 API 生成向量
+type OllamaEmbedder struct {
+	baseURL string       // 服务地址，只使用其 scheme 和 host 部分
+	apiPath string       // 嵌入 API 的路径，例如 "/api/embeddings"
+	model   string       // 嵌入模型名称
+	client  *http.Client // HTTP 客户端实例
+}
+
+// 确保 OllamaEmbedder 实现了 EmbeddingProvider 接口
+var _ EmbeddingProvider = (*OllamaEmbedder)(nil)
+
+// NewOllamaEmbedder 创建新的嵌入客户端
+// baseURL: 服务地址
+// apiPath: 嵌入 API 的路径
+// model: 嵌入模型名称
+// client: HTTP 客户端，为 nil 时创建一个默认客户端
+func NewOllamaEmbedder(baseURL, apiPath, model string, client *http.Client) *OllamaEmbedder {
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	return &OllamaEmbedder{
+		baseURL: baseURL,
+		apiPath: apiPath,
+		model:   model,
+		client:  client,
+	}
+}
+
+// NewEmbeddingProvider 根据配置创建嵌入服务
+// 如果配置了 embedding.url，则使用独立的嵌入端点；否则回退到对话服务的 Embed 实现
+func NewEmbeddingProvider(cfg Config, fallback LLMProvider) EmbeddingProvider {
+	if cfg.Embedding.URL == "" {
+		return fallback
+	}
+	timeout := time.Duration(cfg.Embedding.TimeoutSecs) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return NewOllamaEmbedder(cfg.Embedding.URL, cfg.Embedding.APIPath, cfg.Embedding.Model, &http.Client{Timeout: timeout})
+}
+
+// Embed 获取文本的向量表示
+// ctx: 上下文
+// text: 需要生成嵌入的文本
+func (e *OllamaEmbedder) Embed(ctx context.Context, text string) ([]float64, error) {
+	ctx, span := tracer.Start(ctx, "OllamaEmbedder.Embed",
+		trace.WithAttributes(
+			attribute.String("embedding.url", e.baseURL),
+			attribute.String("embedding.model", e.model),
+			attribute.Int("text.length", len(text)),
+		),
+	)
+	defer span.End()
+
+	// 构建嵌入 API 的完整 URL
+	u, err := url.Parse(e.baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse embedding base url: %w", err)
+	}
+	u.Path = e.apiPath
+	embedURL := u.String()
+
+	reqBody := map[string]interface{}{
+		"model":  e.model,
+		"prompt": text,
+	}
+
+	// 序列化请求体
+	bs, err := json.Marshal(reqBody)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "embed request marshal failed")
+		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
+	}
+
+	// 创建 HTTP 请求
+	req, err := http.NewRequestWithContext(ctx, "POST", embedURL, bytes.NewReader(bs))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "embed request creation failed")
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// 发送 HTTP 请求
+	resp, err := e.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "embed http request failed")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 处理非 2xx 状态码的响应
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("ollama embed error: %d %s", resp.StatusCode, string(body))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "ollama embed returned error status")
+		return nil, err
+	}
+
+	var result struct {
+		Embedding []float64 `json:"embedding"` // 嵌入向量
+	}
+	// 反序列化响应体
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "embed response decode failed")
+		return nil, err
+	}
+	span.SetStatus(codes.Ok, "Embedding successful")
+	return result.Embedding, nil
+}
+
+// DefaultEmbeddingMaxInputChars 是嵌入输入的默认最大字符数
+const DefaultEmbeddingMaxInputChars = 2000
+
+// embedText 按配置截断输入、生成向量并可选地归一化
+// 文档入库和查询都应通过此方法生成向量，保证两者处理方式一致
+func (a *Agent) embedText(ctx context.Context, text string) ([]float64, error) {
+	if limit := a.config.Embedding.MaxInputChars; limit > 0 {
+		if n := utf8.RuneCountInString(text); n > limit {
+			Logger.Warn().Ctx(ctx).Int("chars", n).Int("limit", limit).Msg("Embedding input exceeds the limit, truncating")
+			text = string([]rune(text)[:limit])
+		}
+	}
+	vec, err := a.embedder.Embed(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	if a.config.Embedding.Normalize {
+		l2Normalize(vec)
+	}
+	return vec, nil
+}
+
+// l2Normalize 将向量原地缩放为单位长度，零向量保持不变
+func l2Normalize(vec []float64) {
+	var sum float64
+	for _, v := range vec {
+		sum += v * v
+	}
+	if sum == 0 {
+		return
+	}
+	norm := math.Sqrt(sum)
+	for i := range vec {
+		vec[i] /= norm
+	}
+}
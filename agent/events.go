@@ -1,9 +1,14 @@
 package agent
 
+import (
+	"context"
+	"errors"
+)
+
 // StreamEvent 表示代理执行流中的单个事件。
 // 这些事件用于实时向客户端（例如 WebSocket 或 SSE 连接）发送代理的思考过程、工具调用、输出和最终响应。
 type StreamEvent struct {
-	Type    string      `json:"type"`              // 事件类型，例如 "thinking", "tool_start", "tool_output", "token", "final_answer", "error", "awaiting_confirmation"
+	Type    string      `json:"type"`              // 事件类型，例如 "thinking", "iteration", "progress", "tool_planned", "tool_call_delta", "tool_start", "tool_output", "token", "answer_reset", "reasoning", "step", "final_answer", "error", "awaiting_confirmation"
 	Payload interface{} `json:"payload,omitempty"` // 与事件关联的数据负载，具体类型取决于 Type 字段
 }
 
@@ -20,6 +25,14 @@ type ToolCallEventPayload struct {
 	Arguments map[string]interface{} `json:"arguments"` // 工具调用的参数
 }
 
+// ToolCallDeltaEventPayload 是 "tool_call_delta" 事件的负载结构。
+// 模型流式生成工具调用时，每收到一帧就发送目前累积的参数，便于前端在 "tool_start" 之前展示即将执行的调用。
+type ToolCallDeltaEventPayload struct {
+	Index     int    `json:"index"`     // 工具调用在本轮响应中的序号
+	ToolName  string `json:"tool_name"` // 工具名称，首帧之前可能为空
+	Arguments string `json:"arguments"` // 已累积的参数文本，生成完成前可能是不完整的 JSON
+}
+
 // ToolOutputEventPayload 是 "tool_output" 事件的负载结构。
 // 用于实时向客户端发送工具执行过程中的输出。
 type ToolOutputEventPayload struct {
@@ -33,18 +46,58 @@ type TokenEventPayload struct {
 	Text string `json:"text"` // 生成的文本 token
 }
 
+// "answer_reset" 事件没有负载：已实时转发的 token 之后出现了工具调用，
+// 客户端应丢弃本轮已收到的 token，它们只是工具调用前的推理内容。
+// 回答超过 agent.max_answer_chars 被截断时也会发送此事件，随后重新发送截断后的回答。
+
+// ReasoningEventPayload 是 "reasoning" 事件的负载结构。
+// 开启 agent.strip_reasoning 时，最终回答中 <think> 块的推理内容通过此事件单独发送，不写入会话历史。
+type ReasoningEventPayload struct {
+	Text string `json:"text"` // 推理内容
+}
+
 // FinalAnswerEventPayload 是 "final_answer" 事件的负载结构。
 // 用于通知客户端代理已生成最终答案。
 type FinalAnswerEventPayload struct {
 	Text string `json:"text"` // 最终答案的文本内容
 }
 
+// "error" 事件的错误码，客户端据此区分可以重试的失败和需要修正请求的错误
+const (
+	ErrorCodeModel          = "model_error"       // 模型服务调用失败或返回了无效回答，通常可以重试
+	ErrorCodeUnavailable    = "model_unavailable" // 模型服务连续失败，熔断器已打开，冷却期结束后再试
+	ErrorCodeTimeout        = "timeout"           // 请求或模型调用超时
+	ErrorCodeBadRequest     = "bad_request"       // 请求无效，修正后再试
+	ErrorCodeTool           = "tool_error"        // 工具（包括协作 Agent）执行失败
+	ErrorCodeBusy           = "busy"              // 会话已有运行或服务繁忙，稍后重试
+	ErrorCodeIterationLimit = "iteration_limit"   // 达到最大迭代次数仍未得到最终答案
+	ErrorCodeInternal       = "internal_error"    // 服务内部错误
+)
+
 // ErrorEventPayload 是 "error" 事件的负载结构。
 // 用于通知客户端代理执行过程中发生了错误。
 type ErrorEventPayload struct {
+	Code    string `json:"code"`    // 错误码，取值见 ErrorCode* 常量
 	Message string `json:"message"` // 错误消息
 }
 
+// NewErrorEvent 创建一个带错误码的 "error" 事件
+func NewErrorEvent(code, message string) StreamEvent {
+	return StreamEvent{Type: "error", Payload: ErrorEventPayload{Code: code, Message: message}}
+}
+
+// ErrorCodeFor 根据错误判断错误码：熔断返回 ErrorCodeUnavailable，超时返回 ErrorCodeTimeout，否则返回 fallback
+func ErrorCodeFor(err error, fallback string) string {
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrorCodeUnavailable
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &timeout) && timeout.Timeout()) {
+		return ErrorCodeTimeout
+	}
+	return fallback
+}
+
 // AwaitingConfirmationEventPayload 是 "awaiting_confirmation" 事件的负载结构。
 // 用于通知客户端代理正在等待用户确认敏感工具的执行。
 type AwaitingConfirmationEventPayload struct {
@@ -52,3 +105,63 @@ type AwaitingConfirmationEventPayload struct {
 	ToolName       string                 `json:"tool_name"`       // 需要确认的工具名称
 	Arguments      map[string]interface{} `json:"arguments"`       // 工具调用的参数
 }
+
+// IterationEventPayload 是 "iteration" 事件的负载结构。
+// 用于在代理执行循环的每次迭代开始时通知客户端当前的迭代序号。
+type IterationEventPayload struct {
+	Iteration     int `json:"iteration"`      // 当前迭代序号，从 1 开始
+	MaxIterations int `json:"max_iterations"` // 最大迭代次数
+}
+
+// 步骤事件的阶段
+const (
+	StepPhaseStart = "start" // 迭代开始
+	StepPhaseEnd   = "end"   // 迭代结束
+)
+
+// StepEventPayload 是 "step" 事件的负载结构。
+// 每次迭代开始和结束时各发送一次，客户端可以据此把两者之间的细粒度事件归入同一个编号步骤，
+// 用于折叠或展开展示每一步推理。
+type StepEventPayload struct {
+	Index     int      `json:"index"`                // 步骤序号，从 1 开始，与 "iteration" 事件的序号一致
+	Phase     string   `json:"phase"`                // StepPhaseStart 或 StepPhaseEnd
+	ToolsUsed bool     `json:"tools_used,omitempty"` // 本步骤是否执行了工具，仅在结束阶段设置
+	Tools     []string `json:"tools,omitempty"`      // 本步骤产生结果的工具名称，仅在结束阶段设置
+	Final     bool     `json:"final,omitempty"`      // 本步骤之后运行是否结束，仅在结束阶段设置
+}
+
+// ProgressEventPayload 是 "progress" 事件的负载结构。
+// 当长时间没有其他事件时由传输层周期性发送，告知客户端代理仍在工作。
+type ProgressEventPayload struct {
+	Iteration   int `json:"iteration"`    // 最近一次观察到的迭代序号，0 表示尚未开始
+	ElapsedSecs int `json:"elapsed_secs"` // 自请求开始以来经过的秒数
+}
+
+// PlannedToolCallEventPayload 是 "tool_planned" 事件的负载结构。
+// 计划 (dry-run) 模式下用于报告模型打算执行但未实际执行的工具调用。
+type PlannedToolCallEventPayload struct {
+	ToolName  string                 `json:"tool_name"`           // 工具的名称
+	Arguments map[string]interface{} `json:"arguments"`           // 工具调用的参数
+	Reasoning string                 `json:"reasoning,omitempty"` // 模型在提出该调用时给出的推理内容
+}
+
+// IngestProgressEventPayload 是 "ingest_progress" 事件的负载结构。
+// 知识入库过程中每完成（或失败）一个文本块的嵌入就报告一次进度。
+type IngestProgressEventPayload struct {
+	Source    string `json:"source"`    // 内容来源标识符
+	Completed int    `json:"completed"` // 已处理的块数量（包括失败的块）
+	Failed    int    `json:"failed"`    // 嵌入失败的块数量
+	Total     int    `json:"total"`     // 块的总数
+}
+
+// IngestResultEventPayload 是 "ingest_complete" 事件的负载结构。
+// 用于在知识入库结束时报告最终结果。
+type IngestResultEventPayload struct {
+	Source    string `json:"source"`            // 内容来源标识符
+	Success   bool   `json:"success"`           // 是否入库成功（至少有一个块成功）
+	Skipped   bool   `json:"skipped,omitempty"` // 内容未变化，跳过了入库
+	Succeeded int    `json:"succeeded"`         // 成功入库的块数量
+	Failed    int    `json:"failed"`            // 嵌入失败的块数量
+	Total     int    `json:"total"`             // 块的总数
+	Error     string `json:"error,omitempty"`   // 失败时的错误信息
+}
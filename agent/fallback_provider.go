@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// FallbackTarget 是故障转移链中的一个 LLM 服务
+type FallbackTarget struct {
+	Name     string      // 名称，用于日志
+	Provider LLMProvider // 服务实现
+	Model    string      // 使用该服务时强制使用的模型，为空时沿用上下文或服务的默认模型
+}
+
+// FallbackProvider 按顺序尝试多个 LLMProvider，前一个因连接错误或 5xx 失败时自动切换到下一个
+// 4xx 等请求本身的错误和上下文取消不会触发故障转移
+type FallbackProvider struct {
+	targets []FallbackTarget
+}
+
+// 确保 FallbackProvider 实现了 LLMProvider 接口
+var _ LLMProvider = (*FallbackProvider)(nil)
+
+// NewFallbackProvider 创建故障转移链，第一个为主服务
+func NewFallbackProvider(targets ...FallbackTarget) *FallbackProvider {
+	return &FallbackProvider{targets: targets}
+}
+
+// noFailoverError 标记不应再切换服务的错误
+type noFailoverError struct{ error }
+
+func (e noFailoverError) Unwrap() error { return e.error }
+
+// shouldFailover 判断错误是否应该切换到下一个服务
+func shouldFailover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.As(err, new(noFailoverError)) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500
+	}
+	// 连接失败、超时、响应解析失败等
+	return true
+}
+
+// targetContext 返回调用指定服务时使用的上下文
+func (t FallbackTarget) targetContext(ctx context.Context) context.Context {
+	if t.Model != "" {
+		return WithModel(ctx, t.Model)
+	}
+	return ctx
+}
+
+// try 依次在每个服务上执行 call，直到成功或遇到不可转移的错误
+func (f *FallbackProvider) try(ctx context.Context, op string, call func(ctx context.Context, t FallbackTarget) error) error {
+	if len(f.targets) == 0 {
+		return fmt.Errorf("no llm provider configured")
+	}
+	var lastErr error
+	for i, t := range f.targets {
+		err := call(t.targetContext(ctx), t)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if i == len(f.targets)-1 || !shouldFailover(ctx, err) {
+			break
+		}
+		Logger.Warn().Ctx(ctx).Err(err).Str("op", op).Str("from", t.Name).Str("to", f.targets[i+1].Name).Msg("LLM provider failed, falling back")
+	}
+	return lastErr
+}
+
+// CallWithContext 发起一次非流式对话，失败时按顺序故障转移
+func (f *FallbackProvider) CallWithContext(ctx context.Context, messages []ChatMessage, tools any) (*ChatResponse, error) {
+	ctx, span := tracer.Start(ctx, "FallbackProvider.Call")
+	defer span.End()
+
+	var resp *ChatResponse
+	err := f.try(ctx, "call", func(ctx context.Context, t FallbackTarget) error {
+		span.SetAttributes(attribute.String("llm.provider", t.Name))
+		r, err := t.Provider.CallWithContext(ctx, messages, tools)
+		resp = r
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// countingWriter 记录已写入的字节数，用于判断流式响应是否已经开始
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StreamCallWithContext 发起一次流式对话
+// 只有在尚未向 writer 写入任何数据时才会故障转移，避免输出被拼接
+func (f *FallbackProvider) StreamCallWithContext(ctx context.Context, messages []ChatMessage, tools any, writer io.Writer) error {
+	ctx, span := tracer.Start(ctx, "FallbackProvider.Stream")
+	defer span.End()
+
+	cw := &countingWriter{w: writer}
+	err := f.try(ctx, "stream", func(ctx context.Context, t FallbackTarget) error {
+		span.SetAttributes(attribute.String("llm.provider", t.Name))
+		err := t.Provider.StreamCallWithContext(ctx, messages, tools, cw)
+		if err != nil && cw.n > 0 {
+			// 已经输出了部分内容，不能再切换
+			return noFailoverError{err}
+		}
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+// Embed 获取文本的向量表示，失败时按顺序故障转移
+// 注意：不同服务的嵌入模型应保持一致，否则向量不可比较
+func (f *FallbackProvider) Embed(ctx context.Context, text string) ([]float64, error) {
+	var vec []float64
+	err := f.try(ctx, "embed", func(ctx context.Context, t FallbackTarget) error {
+		v, err := t.Provider.Embed(ctx, text)
+		vec = v
+		return err
+	})
+	return vec, err
+}
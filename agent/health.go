@@ -0,0 +1,64 @@
+package agent
+
+import "time"
+
+// 子系统健康状态
+const (
+	HealthOK       = "ok"       // 正常
+	HealthDegraded = "degraded" // 可用但写入积压，可能正在丢弃或绕过队列写入
+	HealthDown     = "down"     // 后台协程已退出，写入不会再被持久化
+)
+
+// queueSaturationRatio 队列占用达到容量的该比例时视为积压
+const queueSaturationRatio = 0.9
+
+// queueFullWindow 在该时间窗口内出现过队列已满时视为降级
+const queueFullWindow = time.Minute
+
+// SubsystemHealth 描述单个存储子系统的就绪状态
+type SubsystemHealth struct {
+	Name       string `json:"name"`                   // 子系统名称
+	Status     string `json:"status"`                 // ok / degraded / down
+	Detail     string `json:"detail,omitempty"`       // 非正常状态的原因
+	QueueLen   int    `json:"queue_len"`              // 写入队列当前长度
+	QueueCap   int    `json:"queue_cap"`              // 写入队列容量
+	LastFullAt string `json:"last_full_at,omitempty"` // 最近一次队列已满的时间 (RFC3339)
+}
+
+// HealthChecker 是可以报告自身健康状态的存储实现的可选接口
+type HealthChecker interface {
+	Health() SubsystemHealth
+}
+
+// queueHealth 根据后台协程状态、队列占用和最近一次队列已满的时间计算健康状态
+func queueHealth(name string, alive bool, queueLen, queueCap int, lastFull int64) SubsystemHealth {
+	h := SubsystemHealth{Name: name, Status: HealthOK, QueueLen: queueLen, QueueCap: queueCap}
+	if lastFull > 0 {
+		h.LastFullAt = time.Unix(0, lastFull).Format(time.RFC3339)
+	}
+	switch {
+	case !alive:
+		h.Status = HealthDown
+		h.Detail = "background writer is not running"
+	case queueCap > 0 && float64(queueLen) >= float64(queueCap)*queueSaturationRatio:
+		h.Status = HealthDegraded
+		h.Detail = "write queue is backed up"
+	case lastFull > 0 && time.Since(time.Unix(0, lastFull)) < queueFullWindow:
+		h.Status = HealthDegraded
+		h.Detail = "write queue was full recently"
+	}
+	return h
+}
+
+// Readiness 检查记忆存储、向量存储和模型服务熔断器的就绪状态
+// 不支持 HealthChecker 的向量存储和 LLMProvider 实现不参与检查
+func (a *Agent) Readiness() []SubsystemHealth {
+	checks := []SubsystemHealth{a.mem.Health()}
+	if hc, ok := a.vectorStore.(HealthChecker); ok {
+		checks = append(checks, hc.Health())
+	}
+	if hc, ok := a.llm.(HealthChecker); ok {
+		checks = append(checks, hc.Health())
+	}
+	return checks
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// http_request 工具的限制
+const (
+	httpRequestDefaultTimeout = 30        // 默认超时（秒）
+	httpRequestMaxTimeout     = 60        // 最大超时（秒）
+	httpRequestMaxBody        = 1 << 20   // 请求体最大字节数
+	httpRequestMaxResponse    = 8000      // 返回给模型的响应体最大字节数
+	httpRequestReadLimit      = 256 << 10 // 从远端读取的响应体最大字节数
+)
+
+// allowedHTTPMethods 是 http_request 工具允许的 HTTP 方法
+var allowedHTTPMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+// HTTPRequestArgs 定义了 http_request 工具的参数结构
+type HTTPRequestArgs struct {
+	Method  string            `json:"method"`            // HTTP 方法 (GET/POST/PUT/DELETE)
+	URL     string            `json:"url"`               // 请求地址，只允许 http/https
+	Headers map[string]string `json:"headers,omitempty"` // 请求头
+	Body    string            `json:"body,omitempty"`    // 请求体
+	Timeout int               `json:"timeout,omitempty"` // 超时时间（秒）
+}
+
+// validateOutboundURL 检查外部请求的 URL：只允许 http/https 且必须带主机名
+func validateOutboundURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme %q not allowed, only http and https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("url has no host")
+	}
+	return u, nil
+}
+
+// isPublicIP 判断 IP 是否为公网地址，拒绝回环、私有、链路本地、组播和未指定地址
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// newSSRFSafeClient 创建一个防 SSRF 的 HTTP 客户端
+// 在实际建立连接时检查目标 IP（而不是只检查解析结果），以防止 DNS 重绑定绕过；重定向同样受此约束
+func newSSRFSafeClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("connection to non-public address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil, // 不使用代理，确保检查的是实际连接的地址
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			_, err := validateOutboundURL(req.URL.String())
+			return err
+		},
+	}
+}
+
+type HTTPRequestTool struct{}
+
+func (t *HTTPRequestTool) Name() string { return "http_request" }
+func (t *HTTPRequestTool) Description() string {
+	return "Sends an HTTP request (GET/POST/PUT/DELETE) to a public JSON/HTTP API and returns the status and response body. Use this ONLY when the user asks to call a specific API."
+}
+func (t *HTTPRequestTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"method":  map[string]any{"type": "string", "description": "HTTP method: GET, POST, PUT or DELETE."},
+			"url":     map[string]any{"type": "string", "description": "The full http(s) URL to request."},
+			"headers": map[string]any{"type": "object", "description": "Optional request headers.", "additionalProperties": map[string]any{"type": "string"}},
+			"body":    map[string]any{"type": "string", "description": "Optional request body, e.g. a JSON string."},
+			"timeout": map[string]any{"type": "integer", "description": "Request timeout in seconds."},
+		},
+		"required": []string{"method", "url"},
+	}
+}
+func (t *HTTPRequestTool) IsSensitive() bool { return true }
+func (t *HTTPRequestTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agent, _ chan<- StreamEvent) (string, error) {
+	ctx, span := tracer.Start(ctx, "Tool.HTTPRequest")
+	defer span.End()
+
+	var args HTTPRequestArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	args.Method = strings.ToUpper(args.Method)
+	if args.Method == "" {
+		args.Method = http.MethodGet
+	}
+	span.SetAttributes(attribute.String("method", args.Method), attribute.String("url", args.URL))
+
+	if !allowedHTTPMethods[args.Method] {
+		return fmt.Sprintf("http error: method '%s' not allowed", args.Method), nil
+	}
+	u, err := validateOutboundURL(args.URL)
+	if err != nil {
+		return "http error: " + err.Error(), nil
+	}
+	if len(args.Body) > httpRequestMaxBody {
+		return "http error: request body too large (max 1MB)", nil
+	}
+	if args.Timeout <= 0 {
+		args.Timeout = httpRequestDefaultTimeout
+	}
+	if args.Timeout > httpRequestMaxTimeout {
+		args.Timeout = httpRequestMaxTimeout
+	}
+
+	req, err := http.NewRequestWithContext(ctx, args.Method, u.String(), strings.NewReader(args.Body))
+	if err != nil {
+		return "", fmt.Errorf("invalid request: %v", err)
+	}
+	for k, v := range args.Headers {
+		req.Header.Set(k, v)
+	}
+	if args.Body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := newSSRFSafeClient(time.Duration(args.Timeout) * time.Second).Do(req)
+	if err != nil {
+		return "", markTransient(fmt.Errorf("http request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpRequestReadLimit))
+	if err != nil {
+		return "", markTransient(fmt.Errorf("read response failed: %w", err))
+	}
+	span.SetAttributes(attribute.Int("status", resp.StatusCode))
+
+	return fmt.Sprintf("Status: %s\nContent-Type: %s\n\n%s", resp.Status, resp.Header.Get("Content-Type"), truncateString(string(body), httpRequestMaxResponse)), nil
+}
@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 入库任务的状态
+const (
+	IngestStatusRunning     = "running"     // 正在入库
+	IngestStatusCompleted   = "completed"   // 所有块均已入库
+	IngestStatusFailed      = "failed"      // 入库结束，但有块失败
+	IngestStatusInterrupted = "interrupted" // 服务在入库过程中退出，可以恢复
+)
+
+// IngestJob 记录一个来源的入库进度
+type IngestJob struct {
+	Source    string    `json:"source"`          // 内容来源标识符
+	Status    string    `json:"status"`          // 任务状态
+	Hash      string    `json:"hash"`            // 来源内容的 SHA-256 哈希
+	Total     int       `json:"total"`           // 块的总数
+	Completed int       `json:"completed"`       // 已成功入库的块数量
+	Failed    int       `json:"failed"`          // 最近一次运行中嵌入失败的块数量
+	Error     string    `json:"error,omitempty"` // 最近一次运行的错误信息
+	StartedAt time.Time `json:"started_at"`      // 首次开始入库的时间
+	UpdatedAt time.Time `json:"updated_at"`      // 最近一次更新的时间
+}
+
+// IngestJobStore 是入库任务的持久化索引
+// 索引保存在 <dir>/ingest_jobs.json，未完成任务的文本块保存在 <dir>/ingest_pending/ 下，
+// 以便服务中断后只重新嵌入缺失的块
+type IngestJobStore struct {
+	mu         sync.Mutex
+	indexPath  string                // 索引文件路径，为空时不持久化
+	pendingDir string                // 未完成任务的文本块目录
+	jobs       map[string]*IngestJob // 来源到任务的映射
+}
+
+// NewIngestJobStore 创建入库任务索引，并将上次未结束的任务标记为已中断
+// dir: 持久化目录，为空时只保存在内存中（此时无法恢复入库）
+func NewIngestJobStore(dir string) (*IngestJobStore, error) {
+	s := &IngestJobStore{jobs: make(map[string]*IngestJob)}
+	if dir == "" {
+		return s, nil
+	}
+	s.indexPath = filepath.Join(dir, "ingest_jobs.json")
+	s.pendingDir = filepath.Join(dir, "ingest_pending")
+	if err := os.MkdirAll(s.pendingDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create ingest pending directory: %w", err)
+	}
+
+	bs, err := os.ReadFile(s.indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		var jobs []*IngestJob
+		if err := json.Unmarshal(bs, &jobs); err != nil {
+			return nil, fmt.Errorf("failed to parse ingest job index: %w", err)
+		}
+		for _, job := range jobs {
+			if job.Status == IngestStatusRunning {
+				job.Status = IngestStatusInterrupted
+			}
+			s.jobs[job.Source] = job
+		}
+	}
+	return s, s.persist()
+}
+
+// Start 记录一个新的入库任务，并保存其全部文本块以便之后恢复
+// hash: 来源内容的哈希，恢复入库时写入文档元数据
+func (s *IngestJobStore) Start(source string, hash string, chunks []string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.jobs[source] = &IngestJob{
+		Source:    source,
+		Status:    IngestStatusRunning,
+		Hash:      hash,
+		Total:     len(chunks),
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if s.pendingDir != "" {
+		bs, err := json.Marshal(chunks)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.pendingPath(source), bs, 0o644); err != nil {
+			return err
+		}
+	}
+	return s.persist()
+}
+
+// Resume 将已有任务重新标记为运行中
+func (s *IngestJobStore) Resume(source string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[source]
+	if !ok {
+		return fmt.Errorf("no ingest job for source: %s", source)
+	}
+	job.Status = IngestStatusRunning
+	job.Error = ""
+	job.UpdatedAt = time.Now()
+	return s.persist()
+}
+
+// Update 更新任务的进度（只更新内存，任务结束时统一持久化）
+func (s *IngestJobStore) Update(source string, completed, failed int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[source]; ok {
+		job.Completed = completed
+		job.Failed = failed
+		job.UpdatedAt = time.Now()
+	}
+}
+
+// Finish 结束任务。所有块都已入库时删除保存的文本块，否则保留以便恢复
+func (s *IngestJobStore) Finish(source string, completed, failed int, runErr error) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[source]
+	if !ok {
+		return nil
+	}
+	job.Completed = completed
+	job.Failed = failed
+	job.UpdatedAt = time.Now()
+	job.Error = ""
+	if runErr != nil {
+		job.Error = runErr.Error()
+	}
+	if completed >= job.Total {
+		job.Status = IngestStatusCompleted
+		if s.pendingDir != "" {
+			os.Remove(s.pendingPath(source))
+		}
+	} else {
+		job.Status = IngestStatusFailed
+	}
+	return s.persist()
+}
+
+// Get 返回指定来源的任务副本
+func (s *IngestJobStore) Get(source string) (IngestJob, bool) {
+	if s == nil {
+		return IngestJob{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[source]
+	if !ok {
+		return IngestJob{}, false
+	}
+	return *job, true
+}
+
+// List 返回所有任务，最近开始的在前
+func (s *IngestJobStore) List() []IngestJob {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]IngestJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		out = append(out, *job)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// PendingChunks 读取未完成任务保存的文本块
+func (s *IngestJobStore) PendingChunks(source string) ([]string, error) {
+	if s == nil || s.pendingDir == "" {
+		return nil, fmt.Errorf("ingest job persistence is not enabled")
+	}
+	bs, err := os.ReadFile(s.pendingPath(source))
+	if err != nil {
+		return nil, fmt.Errorf("no pending chunks for source %s: %w", source, err)
+	}
+	var chunks []string
+	if err := json.Unmarshal(bs, &chunks); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// pendingPath 返回来源对应的文本块文件路径，文件名使用来源的哈希以避免非法字符
+func (s *IngestJobStore) pendingPath(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(s.pendingDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// persist 原子地写入索引文件，调用方需持有锁
+func (s *IngestJobStore) persist() error {
+	if s.indexPath == "" {
+		return nil
+	}
+	jobs := make([]*IngestJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	bs, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, bs, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.indexPath)
+}
@@ -2,9 +2,13 @@ package agent
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel/attribute"
@@ -12,12 +16,102 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// 知识入库的默认参数，配置未设置时使用
+const (
+	DefaultIngestWorkers      = 8  // 默认并发工作协程数量
+	DefaultIngestChunkTimeout = 60 // 默认单个文本块嵌入超时（秒）
+)
+
+// embedChunk 嵌入单个文本块，每次尝试使用独立的超时，失败后按配置的次数重试
+func (a *Agent) embedChunk(ctx context.Context, chunk string) ([]float64, error) {
+	timeout := a.config.Ingest.ChunkTimeoutSecs
+	if timeout <= 0 {
+		timeout = DefaultIngestChunkTimeout
+	}
+	maxRetries := max(a.config.Ingest.ChunkMaxRetries, 0)
+
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+			}
+		}
+		chunkCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		vec, err := a.embedText(chunkCtx, chunk)
+		cancel()
+		if err == nil {
+			return vec, nil
+		}
+		lastErr = err
+		Logger.Warn().Ctx(ctx).Err(err).Int("attempt", attempt+1).Msg("Embed attempt failed")
+	}
+	return nil, lastErr
+}
+
+// ErrEmbeddingDimension 表示嵌入模型返回的向量维度与 embedding.dimension 配置不一致
+var ErrEmbeddingDimension = errors.New("embedding dimension mismatch")
+
+// checkEmbeddingDimension 嵌入一个样本块并检查向量维度是否与配置一致，未配置维度时不检查
+// 维度不一致的向量在检索时会被全部跳过，因此在删除旧版本和写入任何块之前中止入库
+func (a *Agent) checkEmbeddingDimension(ctx context.Context, sample string) error {
+	want := a.config.Embedding.Dimension
+	if want <= 0 {
+		return nil
+	}
+	vec, err := a.embedChunk(ctx, sample)
+	if err != nil {
+		return fmt.Errorf("failed to embed sample chunk for dimension check: %w", err)
+	}
+	if len(vec) != want {
+		return fmt.Errorf("%w: embedding model %q returned %d-dimensional vectors but embedding.dimension is %d; check embedding.model",
+			ErrEmbeddingDimension, a.config.Embedding.Model, len(vec), want)
+	}
+	return nil
+}
+
+// contentHash 计算内容的 SHA-256 哈希
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// SourceUnchanged 判断来源的内容是否与向量库中已存储的版本相同，相同时无需重新入库
+func (a *Agent) SourceUnchanged(source string, content string) bool {
+	changed, err := a.vectorStore.SourceChanged(source, contentHash(content))
+	return err == nil && !changed
+}
+
+// ingestContext 在 ctx 上附加配置的整体入库超时，未配置时只继承 ctx 的取消
+func (a *Agent) ingestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.config.Ingest.TimeoutSecs > 0 {
+		return context.WithTimeout(ctx, time.Duration(a.config.Ingest.TimeoutSecs)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
 // IngestContent 处理文本内容：分割、嵌入，并将其存储在向量存储中
 // 此版本使用工作池并发嵌入文本块，以提高性能
+// ctx: 取消或超时后停止嵌入剩余的块，入库任务标记为失败，之后可以通过 ResumeIngest 补齐
 // source: 内容来源标识符
 // content: 要处理的文本内容
-func (a *Agent) IngestContent(source string, content string) error {
-	ctx, span := tracer.Start(context.Background(), "Agent.IngestContent",
+func (a *Agent) IngestContent(ctx context.Context, source string, content string) error {
+	return a.IngestContentWithProgress(ctx, source, content, nil)
+}
+
+// IngestContentWithProgress 与 IngestContent 相同，但会在每个工作协程处理完一个文本块后
+// 通过 progress 通道报告进度。progress 为 nil 时不报告；否则调用方必须持续读取，
+// 函数返回前会关闭该通道
+func (a *Agent) IngestContentWithProgress(ctx context.Context, source string, content string, progress chan<- IngestProgressEventPayload) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	ctx, cancel := a.ingestContext(ctx)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "Agent.IngestContent",
 		trace.WithAttributes(
 			attribute.String("source", source),
 			attribute.Int("content.length", len(content)),
@@ -30,11 +124,189 @@ func (a *Agent) IngestContent(source string, content string) error {
 	span.SetAttributes(attribute.Int("chunks.count", len(chunks)))
 	Logger.Info().Str("source", source).Int("chunk_count", len(chunks)).Msg("Ingesting content")
 
-	// 2. 使用工作池并发嵌入
-	const numWorkers = 8                         // 并发工作协程的数量
-	jobs := make(chan int, len(chunks))          // 任务通道，用于分发 chunk 索引
-	results := make(chan *Document, len(chunks)) // 结果通道，用于收集嵌入后的文档
-	var wg sync.WaitGroup                        // 等待组，用于等待所有工作协程完成
+	// 嵌入模型配置错误时直接中止，保留该来源之前的版本
+	if len(chunks) > 0 {
+		if err := a.checkEmbeddingDimension(ctx, chunks[0]); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	// 内容已变化（或首次入库）：旧版本保留到新版本的所有块入库之后再删除，嵌入失败或取消时旧版本仍可检索
+	// 同一内容之前已入库的块（例如上次入库中断）直接复用，只嵌入缺失的块
+	hash := contentHash(content)
+	present, err := a.presentChunks(source, hash)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	var indices []int
+	for i := range chunks {
+		if !present[i] {
+			indices = append(indices, i)
+		}
+	}
+	alreadyDone := len(chunks) - len(indices)
+
+	// 记录入库任务，服务中断后可以通过 ResumeIngest 只补齐缺失的块
+	if err := a.ingestJobs.Start(source, hash, chunks); err != nil {
+		Logger.Warn().Err(err).Str("source", source).Msg("Failed to record ingest job")
+	}
+
+	// 2. 使用工作池并发嵌入缺失的块
+	succeeded, failed := a.embedChunks(ctx, source, hash, chunks, indices, alreadyDone, progress)
+	done := alreadyDone + succeeded
+
+	Logger.Info().Int("successful_chunks", done).Int("total_chunks", len(chunks)).Str("source", source).Msg("Content ingestion finished")
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = fmt.Errorf("ingest for source %s stopped after %d of %d chunks: %w", source, done, len(chunks), ctxErr)
+		span.SetStatus(codes.Error, err.Error())
+	} else if done == 0 && len(chunks) > 0 {
+		err = fmt.Errorf("all chunks failed to ingest for source: %s", source)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "Content ingestion finished")
+	}
+	if err == nil && failed == 0 {
+		a.deleteStaleVersions(source, hash)
+	}
+	if jobErr := a.ingestJobs.Finish(source, done, failed, err); jobErr != nil {
+		Logger.Warn().Err(jobErr).Str("source", source).Msg("Failed to update ingest job")
+	}
+	return err
+}
+
+// presentChunks 返回向量库中该来源内容哈希为 hash 的版本已入库的块索引
+func (a *Agent) presentChunks(source, hash string) (map[int]bool, error) {
+	existing, err := a.vectorStore.GetSourceChunks(source)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[int]bool, len(existing))
+	for _, doc := range existing {
+		if h, _ := doc.Metadata[MetaSourceHash].(string); h == hash {
+			present[docChunkIndex(doc)] = true
+		}
+	}
+	return present, nil
+}
+
+// deleteStaleVersions 在新版本的所有块入库后删除该来源的旧版本
+func (a *Agent) deleteStaleVersions(source, hash string) {
+	a.reindex.writes.RLock()
+	removed, err := a.vectorStore.DeleteStaleVersions(source, hash)
+	a.reindex.writes.RUnlock()
+	if err != nil {
+		Logger.Warn().Err(err).Str("source", source).Msg("Failed to delete previous version of source")
+	} else if removed > 0 {
+		Logger.Info().Str("source", source).Int("removed_chunks", removed).Msg("Removed previous version of source")
+	}
+}
+
+// ResumeIngest 恢复一个中断或部分失败的入库任务，只重新嵌入向量库中缺失的块
+// progress 的用法与 IngestContentWithProgress 相同
+func (a *Agent) ResumeIngest(ctx context.Context, source string, progress chan<- IngestProgressEventPayload) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	ctx, cancel := a.ingestContext(ctx)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "Agent.ResumeIngest",
+		trace.WithAttributes(attribute.String("source", source)),
+	)
+	defer span.End()
+
+	job, ok := a.ingestJobs.Get(source)
+	if !ok {
+		return fmt.Errorf("no ingest job for source: %s", source)
+	}
+	if job.Status == IngestStatusRunning {
+		return fmt.Errorf("ingest for source %s is already running", source)
+	}
+	chunks, err := a.ingestJobs.PendingChunks(source)
+	if err != nil {
+		return err
+	}
+
+	// 找出向量库中缺失的块，旧版本的块不计入
+	present, err := a.presentChunks(source, job.Hash)
+	if err != nil {
+		return err
+	}
+	var missing []int
+	for i := range chunks {
+		if !present[i] {
+			missing = append(missing, i)
+		}
+	}
+	alreadyDone := len(chunks) - len(missing)
+	span.SetAttributes(attribute.Int("chunks.total", len(chunks)), attribute.Int("chunks.missing", len(missing)))
+	Logger.Info().Str("source", source).Int("missing_chunks", len(missing)).Int("total_chunks", len(chunks)).Msg("Resuming ingest")
+
+	if len(missing) > 0 {
+		if err := a.checkEmbeddingDimension(ctx, chunks[missing[0]]); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+	if err := a.ingestJobs.Resume(source); err != nil {
+		return err
+	}
+	succeeded, failed := a.embedChunks(ctx, source, job.Hash, chunks, missing, alreadyDone, progress)
+
+	var runErr error
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		runErr = fmt.Errorf("resumed ingest for source %s stopped: %w", source, ctxErr)
+		span.SetStatus(codes.Error, runErr.Error())
+	} else if failed > 0 {
+		runErr = fmt.Errorf("%d chunks failed to ingest for source: %s", failed, source)
+		span.SetStatus(codes.Error, runErr.Error())
+	} else {
+		span.SetStatus(codes.Ok, "Ingest resumed")
+		// 新版本已完整入库，删除旧版本
+		a.deleteStaleVersions(source, job.Hash)
+	}
+	if jobErr := a.ingestJobs.Finish(source, alreadyDone+succeeded, failed, runErr); jobErr != nil {
+		Logger.Warn().Err(jobErr).Str("source", source).Msg("Failed to update ingest job")
+	}
+	return runErr
+}
+
+// embedChunks 使用工作池并发嵌入指定索引的文本块，并在每个块完成后立即写入向量库
+// ctx 取消后剩余的块不再嵌入，计为失败
+// sourceHash: 来源内容的哈希，写入每个文档的元数据
+// alreadyDone: 之前已经入库的块数量，用于计算进度
+// 返回本次成功和失败的块数量
+func (a *Agent) embedChunks(ctx context.Context, source string, sourceHash string, chunks []string, indices []int, alreadyDone int, progress chan<- IngestProgressEventPayload) (int, int) {
+	numWorkers := a.config.Ingest.Workers // 并发工作协程的数量
+	if numWorkers <= 0 {
+		numWorkers = DefaultIngestWorkers
+	}
+	ingestedAt := time.Now().Format(time.RFC3339) // 本次入库的版本时间
+	jobs := make(chan int, len(indices))          // 任务通道，用于分发 chunk 索引
+	var wg sync.WaitGroup                         // 等待组，用于等待所有工作协程完成
+
+	// 进度计数，由各工作协程在处理完一个块后更新并报告
+	var progressMu sync.Mutex
+	var succeeded, failed int
+	reportProgress := func(ok bool) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		if ok {
+			succeeded++
+		} else {
+			failed++
+		}
+		a.ingestJobs.Update(source, alreadyDone+succeeded, failed)
+		if progress != nil {
+			progress <- IngestProgressEventPayload{Source: source, Completed: alreadyDone + succeeded + failed, Failed: failed, Total: len(chunks)}
+		}
+	}
 
 	// 启动工作协程
 	for w := 0; w < numWorkers; w++ {
@@ -42,6 +314,10 @@ func (a *Agent) IngestContent(source string, content string) error {
 		go func(workerID int) {
 			defer wg.Done()
 			for i := range jobs { // 从任务通道接收 chunk 索引
+				if ctx.Err() != nil {
+					reportProgress(false)
+					continue
+				}
 				chunk := chunks[i]
 				chunkSpanCtx, chunkSpan := tracer.Start(ctx, "Agent.IngestContent.Chunk",
 					trace.WithAttributes(
@@ -52,63 +328,57 @@ func (a *Agent) IngestContent(source string, content string) error {
 					),
 				)
 
-				// 调用 LLM 嵌入文本块
-				vec, err := a.llm.Embed(chunkSpanCtx, chunk)
+				// 调用嵌入服务，带超时和重试
+				vec, err := a.embedChunk(chunkSpanCtx, chunk)
 				if err != nil {
-					Logger.Error().Err(err).Int("chunk_index", i).Str("source", source).Msg("Embed failed for chunk")
+					Logger.Error().Ctx(ctx).Err(err).Int("chunk_index", i).Str("source", source).Msg("Embed failed for chunk")
 					chunkSpan.RecordError(err)
 					chunkSpan.SetStatus(codes.Error, fmt.Sprintf("Embed failed: %v", err))
 					chunkSpan.End()
-					results <- nil // 发送 nil 表示失败
+					reportProgress(false)
 					continue
 				}
 
-				// 创建文档对象
-				doc := &Document{
+				// 创建文档对象并立即写入向量库，中断后已完成的块不需要重新嵌入
+				doc := Document{
 					ID:      uuid.New().String(), // 生成唯一 ID
 					Content: chunk,
 					Metadata: map[string]any{
-						"source": source,
-						"chunk":  i,
+						MetaSource:     source,
+						MetaChunk:      i,
+						MetaChunkHash:  contentHash(chunk),
+						MetaSourceHash: sourceHash,
+						MetaIngestedAt: ingestedAt,
 					},
 					Embedding: vec,
 				}
-				results <- doc // 将文档发送到结果通道
+				// 持有重建索引的屏障读锁：切换期间等待，切换后再写入，避免被 Replace 覆盖
+				a.reindex.writes.RLock()
+				err = a.vectorStore.Add(doc)
+				a.reindex.writes.RUnlock()
+				if err != nil {
+					Logger.Error().Ctx(ctx).Err(err).Int("chunk_index", i).Str("source", source).Msg("Failed to add chunk to vector store")
+					chunkSpan.RecordError(err)
+					chunkSpan.End()
+					reportProgress(false)
+					continue
+				}
 				chunkSpan.SetStatus(codes.Ok, "Chunk embedded")
 				chunkSpan.End()
+				reportProgress(true)
 			}
 		}(w)
 	}
 
 	// 分发任务
-	for i := 0; i < len(chunks); i++ {
+	for _, i := range indices {
 		jobs <- i
 	}
 	close(jobs) // 关闭任务通道，表示没有更多任务
 
 	// 等待所有工作协程完成
 	wg.Wait()
-	close(results) // 关闭结果通道
-
-	// 3. 将成功的结果添加到向量存储
-	var successfulCount int
-	for doc := range results { // 从结果通道收集文档
-		if doc != nil {
-			a.vectorStore.Add(*doc) // 添加到向量存储
-			successfulCount++
-		}
-	}
-
-	Logger.Info().Int("successful_chunks", successfulCount).Int("total_chunks", len(chunks)).Str("source", source).Msg("Content ingestion finished")
-
-	if successfulCount == 0 && len(chunks) > 0 {
-		err := fmt.Errorf("all chunks failed to ingest for source: %s", source)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
-	span.SetStatus(codes.Ok, "Content ingestion finished")
-	return nil
+	return succeeded, failed
 }
 
 // recursiveSplit 递归地将文本分割成块
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// LintCodeArgs 定义了 lint_code 工具的参数结构
+type LintCodeArgs struct {
+	Language string            `json:"language"`        // 编程语言，与 run_code 支持的语言相同
+	Code     string            `json:"code"`            // 要检查的源代码
+	Files    map[string]string `json:"files,omitempty"` // 需要一起检查的额外文件
+}
+
+// LintDiagnostic 是静态检查报告的一条问题
+type LintDiagnostic struct {
+	File     string `json:"file"`             // 文件名
+	Line     int    `json:"line,omitempty"`   // 行号，0 表示整个文件
+	Column   int    `json:"column,omitempty"` // 列号，0 表示未知
+	Severity string `json:"severity"`         // error 或 warning
+	Message  string `json:"message"`          // 问题描述
+}
+
+// LintResult 是 lint_code 返回给模型的结构化结果
+type LintResult struct {
+	Language    string           `json:"language"`
+	OK          bool             `json:"ok"` // 检查命令成功且没有报告任何问题
+	Diagnostics []LintDiagnostic `json:"diagnostics"`
+	// Output 检查失败但无法解析出任何问题时附带的原始输出，便于模型自行判断
+	Output string `json:"output,omitempty"`
+}
+
+var (
+	// lintLocationRe 匹配 "file:line[:col]: message" 形式的诊断，适用于 go vet、gofmt、ruff、rustc、javac 和 ruby
+	lintLocationRe = regexp.MustCompile(`^(?:vet: )?(\S+?\.\w+):(?:(\d+):)?(?:(\d+):)?\s*(.+)$`)
+	// lintPyFileRe 和 lintPyErrorRe 匹配 py_compile 输出的 Python 异常
+	lintPyFileRe  = regexp.MustCompile(`^\s*File "([^"]+)", line (\d+)`)
+	lintPyErrorRe = regexp.MustCompile(`^(\w+(?:Error|Warning)): (.+)$`)
+	// lintSeverityRe 匹配消息开头的严重级别，例如 "error[E0425]:" 或 "warning:"
+	lintSeverityRe = regexp.MustCompile(`^(?i)(error|warning)(\[\w+\])?:\s*`)
+)
+
+// parseLintOutput 从检查命令的输出中解析诊断信息，无法识别的行被忽略，重复的诊断只保留一条
+func parseLintOutput(output string) []LintDiagnostic {
+	diags := []LintDiagnostic{}
+	seen := make(map[LintDiagnostic]bool)
+	add := func(d LintDiagnostic) {
+		if !seen[d] {
+			seen[d] = true
+			diags = append(diags, d)
+		}
+	}
+
+	var pyFile string
+	var pyLine int
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := lintPyFileRe.FindStringSubmatch(line); m != nil {
+			pyFile = m[1]
+			pyLine, _ = strconv.Atoi(m[2])
+			continue
+		}
+		if m := lintPyErrorRe.FindStringSubmatch(line); m != nil && pyFile != "" {
+			add(LintDiagnostic{File: path.Clean(pyFile), Line: pyLine, Severity: lintSeverity(m[1]), Message: m[1] + ": " + m[2]})
+			pyFile = ""
+			continue
+		}
+		m := lintLocationRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d := LintDiagnostic{File: path.Clean(m[1]), Severity: "error"}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		msg := m[4]
+		if sm := lintSeverityRe.FindStringSubmatch(msg); sm != nil {
+			d.Severity = strings.ToLower(sm[1])
+			msg = msg[len(sm[0]):]
+			if sm[2] != "" {
+				msg = strings.Trim(sm[2], "[]") + ": " + msg
+			}
+		}
+		d.Message = strings.TrimSpace(msg)
+		add(d)
+	}
+	return diags
+}
+
+// lintSeverity 根据 Python 异常名判断严重级别
+func lintSeverity(name string) string {
+	if strings.HasSuffix(name, "Warning") {
+		return "warning"
+	}
+	return "error"
+}
+
+// LintCodeTool 在沙箱中对代码执行静态检查和编译检查，不运行程序
+type LintCodeTool struct{}
+
+func (t *LintCodeTool) Name() string { return "lint_code" }
+func (t *LintCodeTool) Description() string {
+	return "Checks code for syntax, compile and lint errors in a sandbox WITHOUT running it (go vet/gofmt, py_compile/ruff, rustc, javac, ruby -wc). Returns structured diagnostics. Prefer this over run_code when reviewing code."
+}
+func (t *LintCodeTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"language": map[string]any{"type": "string", "enum": supportedSandboxLanguages(), "description": "The programming language."},
+			"code":     map[string]any{"type": "string", "description": "The source code to check."},
+			"files":    map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}, "description": "Optional extra files to check together with the code, keyed by relative path."},
+		},
+		"required": []string{"language", "code"},
+	}
+}
+func (t *LintCodeTool) IsSensitive() bool { return false }
+func (t *LintCodeTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.LintCode")
+	defer span.End()
+
+	var args LintCodeArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.String("language", args.Language))
+
+	name, _, err := lookupSandboxLanguage(args.Language, a.config.Sandbox.Images)
+	if err != nil {
+		return "lint error: " + err.Error(), nil
+	}
+
+	output, runErr := a.RunCodeSandbox(RunCodeArgs{
+		Language:  name,
+		Code:      args.Code,
+		Files:     args.Files,
+		SessionID: sessionID,
+		lintOnly:  true,
+	}, io.Discard)
+	if runErr != nil && IsTransient(runErr) {
+		return "", runErr
+	}
+	// 沙箱本身的错误（例如繁忙）原样返回
+	if runErr == nil && (strings.HasPrefix(output, "sandbox error:") || strings.HasPrefix(output, "sandbox busy:")) {
+		return output, nil
+	}
+
+	result := LintResult{Language: name, Diagnostics: parseLintOutput(output)}
+	result.OK = runErr == nil && len(result.Diagnostics) == 0
+	if runErr != nil && len(result.Diagnostics) == 0 {
+		result.Output = output
+		if result.Output == "" {
+			result.Output = runErr.Error()
+		}
+	}
+	bs, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lint result: %v", err)
+	}
+	return string(bs), nil
+}
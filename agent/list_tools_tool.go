@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ListToolsArgs 定义了 list_tools 工具的参数结构
+type ListToolsArgs struct {
+	Agent string `json:"agent,omitempty"` // 要查看的协作 Agent 名称，例如 "coder"；为空时列出自己的工具
+}
+
+// ListToolsTool 让模型在运行时查看自己或协作 Agent 可用的工具，便于选择合适的工具或 Agent
+type ListToolsTool struct{}
+
+func (t *ListToolsTool) Name() string { return "list_tools" }
+func (t *ListToolsTool) Description() string {
+	return "Lists the tools available to you, or to another agent (e.g. 'coder', 'researcher'), with their descriptions and parameters. Use this to decide which tool or agent fits a task."
+}
+func (t *ListToolsTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"agent": map[string]any{"type": "string", "description": "Optional name of another agent whose tools to list, e.g. 'coder' or 'researcher'. Omit to list your own tools."},
+		},
+	}
+}
+func (t *ListToolsTool) IsSensitive() bool { return false }
+func (t *ListToolsTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.ListTools")
+	defer span.End()
+
+	var args ListToolsArgs
+	if argsJSON != "" {
+		if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+			return "", fmt.Errorf("invalid args: %v", err)
+		}
+	}
+	span.SetAttributes(attribute.String("agent", args.Agent))
+
+	target := a
+	if args.Agent != "" && args.Agent != a.role {
+		other, ok := a.GetOtherAgent(args.Agent)
+		if !ok {
+			return fmt.Sprintf("list_tools error: unknown agent '%s'", args.Agent), nil
+		}
+		target = other
+	}
+
+	var sb strings.Builder
+	for _, info := range target.ListTools() {
+		if info.Disabled {
+			continue
+		}
+		params, _ := json.Marshal(info.Schema["properties"])
+		fmt.Fprintf(&sb, "- %s: %s\n  parameters: %s\n", info.Name, info.Description, params)
+		if info.Sensitive {
+			sb.WriteString("  requires user confirmation\n")
+		}
+	}
+	if sb.Len() == 0 {
+		return "No tools are available.", nil
+	}
+	return sb.String(), nil
+}
@@ -1,14 +1,17 @@
 package agent
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/diode"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -18,18 +21,31 @@ var Logger zerolog.Logger
 // logOnce 确保日志系统只被初始化一次
 var logOnce sync.Once
 
+// 异步日志的默认配置
+const (
+	DefaultLogBufferSize     = 1000 // 异步日志缓冲区的默认条目数
+	DefaultLogDropReportSecs = 10   // 汇报丢弃日志数量的默认间隔（秒）
+)
+
+var (
+	asyncLogWriter *diode.Writer // 异步模式下的写入器，关闭时用于刷新缓冲区
+	droppedLogs    atomic.Int64  // 自上次汇报以来因缓冲区满而丢弃的日志条数
+	stopDropReport chan struct{} // 通知丢弃汇报协程退出
+)
+
 // InitLogger 初始化全局日志系统
 // 它配置了日志轮转、多重写入（文件和控制台）以及基于配置的日志级别过滤
 func InitLogger(cfg Config) {
 	logOnce.Do(func() {
-		// 配置 lumberjack 用于日志轮转 (JSON 格式输出到文件)
-		fileLogger := &lumberjack.Logger{
-			Filename:   filepath.Join("logs", "app.log"), // 日志文件路径
-			MaxSize:    10,                               // 每个日志文件的最大尺寸 (MB)
-			MaxBackups: 5,                                // 保留的旧日志文件数量
-			MaxAge:     30,                               // 日志文件保留天数
-			Compress:   true,                             // 是否压缩旧的日志文件
+		dir := cfg.Log.Dir
+		if dir == "" {
+			dir = "logs"
+		}
+		file := cfg.Log.File
+		if file == "" {
+			file = "app.log"
 		}
+		logPath := filepath.Join(dir, file)
 
 		// 配置控制台写入器 (人类可读格式)
 		consoleWriter := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
@@ -37,7 +53,37 @@ func InitLogger(cfg Config) {
 		// 创建一个多重写入器
 		// 所有级别的日志都会以 JSON 格式写入文件
 		// 只有达到或超过配置级别的日志才会写入控制台
-		multiWriter := io.MultiWriter(fileLogger, consoleWriter)
+		var multiWriter io.Writer
+		fileErr := checkLogFile(logPath)
+		if fileErr == nil {
+			// 配置 lumberjack 用于日志轮转 (JSON 格式输出到文件)
+			fileLogger := &lumberjack.Logger{
+				Filename:   logPath, // 日志文件路径
+				MaxSize:    10,      // 每个日志文件的最大尺寸 (MB)
+				MaxBackups: 5,       // 保留的旧日志文件数量
+				MaxAge:     30,      // 日志文件保留天数
+				Compress:   true,    // 是否压缩旧的日志文件
+			}
+			multiWriter = io.MultiWriter(fileLogger, consoleWriter)
+		} else {
+			// 日志文件不可用时不应导致服务退出，回退为只输出到标准错误
+			consoleWriter.Out = os.Stderr
+			multiWriter = consoleWriter
+		}
+
+		// 异步模式：日志先写入环形缓冲区，由后台协程写出；缓冲区满时丢弃最旧的条目并计数，
+		// 不会阻塞业务协程。同步模式（默认）下写入会阻塞直到完成，不会丢失日志
+		if cfg.Log.Async {
+			size := cfg.Log.BufferSize
+			if size <= 0 {
+				size = DefaultLogBufferSize
+			}
+			dw := diode.NewWriter(multiWriter, size, 10*time.Millisecond, func(missed int) {
+				droppedLogs.Add(int64(missed))
+			})
+			asyncLogWriter = &dw
+			multiWriter = dw
+		}
 
 		// 从配置中解析日志级别
 		logLevel, err := zerolog.ParseLevel(strings.ToLower(cfg.Log.Level))
@@ -51,20 +97,94 @@ func InitLogger(cfg Config) {
 			Level(logLevel).
 			With().
 			Timestamp(). // 添加时间戳到每条日志
-			Logger()
+			Logger().
+			Hook(requestIDHook) // 为携带上下文的日志添加请求 ID
 
 		// 备选方案：如果需要为文件和控制台设置不同的日志级别，可以使用 MultiLevelWriter
 		// fileWriterWithLevel := zerolog.New(fileLogger).With().Timestamp().Logger() // 文件记录所有级别
 		// consoleWriterWithLevel := zerolog.New(consoleWriter).Level(logLevel).With().Timestamp().Logger() // 控制台只记录指定级别及以上
 		// Logger = zerolog.New(zerolog.MultiLevelWriter(fileWriterWithLevel, consoleWriterWithLevel)).With().Logger()
 
-		Logger.Info().Msg("Logger initialized")
+		if fileErr != nil {
+			Logger.Warn().Err(fileErr).Str("path", logPath).Msg("Cannot open log file, logging to stderr only")
+		}
+		if asyncLogWriter != nil {
+			interval := cfg.Log.DropReportSecs
+			if interval <= 0 {
+				interval = DefaultLogDropReportSecs
+			}
+			stopDropReport = make(chan struct{})
+			go reportDroppedLogs(time.Duration(interval)*time.Second, stopDropReport)
+		}
+		Logger.Info().Bool("async", cfg.Log.Async).Msg("Logger initialized")
 	})
 }
 
+// reportDroppedLogs 定期汇报异步模式下被丢弃的日志数量，使日志丢失可见
+func reportDroppedLogs(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flushDroppedLogCount()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flushDroppedLogCount 记录并清零丢弃的日志数量
+func flushDroppedLogCount() {
+	if n := droppedLogs.Swap(0); n > 0 {
+		Logger.Warn().Int64("dropped", n).Msgf("%d log entries dropped because the log buffer was full", n)
+	}
+}
+
+// requestIDKey 是请求 ID 在 Context 中的键
+const requestIDKey contextKey = "request_id"
+
+// WithRequestID 返回一个携带请求 ID 的新 Context，用于关联同一请求的所有日志
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext 获取 Context 中的请求 ID，不存在时返回空字符串
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestIDHook 在日志事件通过 .Ctx(ctx) 携带上下文时，自动添加 request_id 字段
+var requestIDHook = zerolog.HookFunc(func(e *zerolog.Event, _ zerolog.Level, _ string) {
+	if id := RequestIDFromContext(e.GetCtx()); id != "" {
+		e.Str("request_id", id)
+	}
+})
+
 // CloseLogger 在应用程序关闭时调用，用于记录日志系统关闭的消息
 // 对于 lumberjack，不需要显式关闭文件句柄，它会在程序退出时自动处理
-// 这个函数目前主要用于记录一条明确的关闭日志
+// 异步模式下会汇报剩余的丢弃数量并刷新缓冲区中的日志
 func CloseLogger() {
 	Logger.Info().Msg("Logger shutting down.")
+	if asyncLogWriter != nil {
+		close(stopDropReport)
+		flushDroppedLogCount()
+		_ = asyncLogWriter.Close()
+	}
+}
+
+// checkLogFile 确保日志目录存在且日志文件可以写入
+func checkLogFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
@@ -3,13 +3,22 @@ package agent
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 // ---------- 可配置常量 ----------
@@ -20,8 +29,24 @@ const (
 	DefaultMemoryFileName     = "memory.json"   // 默认内存文件名
 	DefaultSessionLoadLimit   = 200             // 启动时每个会话只加载最近 N 条消息到内存（节省内存）
 	DefaultWriteQueueCapacity = 1000            // 默认写入队列容量
+	compressedSessionExt      = ".gz"           // 归档压缩后的会话文件扩展名
 )
 
+// sessionIDPattern 限制会话 ID 只包含字母、数字、下划线和连字符（UUID 满足该格式）
+// 会话 ID 会被直接用作会话文件名和工作区目录名，必须拒绝路径分隔符和 ".." 以防止路径穿越
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// ErrInvalidSessionID 表示会话 ID 格式不合法
+var ErrInvalidSessionID = errors.New("invalid session id: only letters, digits, '-' and '_' are allowed")
+
+// ErrSessionNotFound 表示指定的会话不存在
+var ErrSessionNotFound = errors.New("session not found")
+
+// ValidSessionID 判断会话 ID 是否可以安全地用作文件名
+func ValidSessionID(id string) bool {
+	return sessionIDPattern.MatchString(id)
+}
+
 // ---------- 持久化数据结构：MemoryStore（可序列化） ----------
 // MemoryStorePersist 是用于持久化到 memory.json 的数据结构
 type MemoryStorePersist struct {
@@ -33,11 +58,30 @@ type MemoryStorePersist struct {
 
 // ConversationSessionMeta 是会话的元数据结构
 type ConversationSessionMeta struct {
-	ID           string    `json:"id"`             // 会话 ID
-	Title        string    `json:"title"`          // 会话标题
-	CreatedAt    time.Time `json:"created_at"`     // 创建时间
-	LastActiveAt time.Time `json:"last_active_at"` // 最后活动时间
-	MessageCount int       `json:"message_count"`  // 消息数量
+	ID           string    `json:"id"`                      // 会话 ID
+	Title        string    `json:"title"`                   // 会话标题
+	CreatedAt    time.Time `json:"created_at"`              // 创建时间
+	LastActiveAt time.Time `json:"last_active_at"`          // 最后活动时间
+	MessageCount int       `json:"message_count"`           // 消息数量
+	SystemPrompt string    `json:"system_prompt,omitempty"` // 会话专属的系统提示词，为空时使用全局提示词
+	Tags         []string  `json:"tags,omitempty"`          // 会话标签，用于组织和筛选会话
+	Summary      string    `json:"summary,omitempty"`       // 会话闲置归档时生成的摘要
+	Archived     bool      `json:"archived,omitempty"`      // 消息是否已从内存中释放，恢复使用时从会话文件重新加载
+	ForkedFrom   string    `json:"forked_from,omitempty"`   // 分叉来源会话的 ID，仅由 ForkSession 创建的会话设置
+	// AllowedTools 会话允许使用的工具；null 表示不限制（仍受全局配置约束），空列表表示只能聊天
+	AllowedTools []string `json:"allowed_tools"`
+}
+
+// SessionOption 是创建会话时的可选配置
+type SessionOption func(*ConversationSessionMeta)
+
+// WithSessionAllowedTools 限制会话只能使用指定的工具，传入空列表表示禁止所有工具
+func WithSessionAllowedTools(tools []string) SessionOption {
+	return func(meta *ConversationSessionMeta) {
+		if tools != nil {
+			meta.AllowedTools = append([]string{}, tools...)
+		}
+	}
 }
 
 // ---------- 运行时内存结构 ----------
@@ -52,6 +96,13 @@ type MemoryV3 struct {
 	sessions         map[string]*ConversationSession
 	currentSessionID string
 
+	// 磁盘写入闸门：会话消息和 memory.json 的写入持有读锁，Snapshot 持有写锁以暂停所有写入
+	pauseMu sync.RWMutex
+
+	// 每个会话的消息写入器，保证会话文件中的消息顺序与到达顺序一致
+	writersMu      sync.Mutex
+	sessionWriters map[string]*sessionWriter
+
 	// 持久化路径
 	baseDir    string
 	memoryPath string
@@ -63,11 +114,23 @@ type MemoryV3 struct {
 	batchSize     int
 	durableSync   bool
 	wg            sync.WaitGroup // 用于等待后台写入完成
+	writerAlive   atomic.Bool    // writerLoop 是否仍在运行
+	lastQueueFull atomic.Int64   // 最近一次写入队列已满的时间 (UnixNano)，0 表示从未发生
 
 	// 标志
 	dirty    int32
 	flushing int32
 
+	// 元数据持久化策略
+	persistEveryN          int   // 每追加 N 条会话消息强制持久化一次 memory.json，<=0 表示不启用
+	persistOnSessionChange bool  // 创建或切换会话后是否立即持久化 memory.json
+	messagesSincePersist   int32 // 自上次强制持久化以来追加的消息数
+	prettyJSON             bool  // memory.json 是否使用缩进格式（便于调试），否则写入紧凑 JSON
+	compressArchived       bool  // 归档会话时是否将会话文件压缩为 gzip
+	flatLog                bool  // 是否将提示词和最终答案另外记录到全局的 conversations/notes 列表
+	maxConversations       int   // conversations 最多保留的最近条目数，<=0 表示不限制
+	maxNotes               int   // notes 最多保留的最近条目数，<=0 表示不限制
+
 	// 启动配置
 	sessionLoadLimit int
 	closed           chan struct{}
@@ -79,6 +142,15 @@ type ConversationSession struct {
 	Messages []ChatMessage           `json:"messages"` // 会话消息
 }
 
+// sessionWriter 按到达顺序缓存某个会话待写入的消息。
+// 写入任务可能由 writerLoop 执行，也可能在队列已满时由独立 goroutine 执行，
+// 因此不能依赖任务的执行顺序，而是由写入任务按 FIFO 顺序取出消息并串行写入。
+type sessionWriter struct {
+	writeMu   sync.Mutex    // 串行化同一会话的写入
+	pendingMu sync.Mutex    // 保护 pending
+	pending   []ChatMessage // 已到达但尚未写入的消息，按到达顺序排列
+}
+
 // ---------- 构造函数 / 加载器 ----------
 // NewMemoryV3 创建一个新的 MemoryV3 实例
 func NewMemoryV3(baseDir string, opts ...MemoryV3Option) (*MemoryV3, error) {
@@ -89,6 +161,7 @@ func NewMemoryV3(baseDir string, opts ...MemoryV3Option) (*MemoryV3, error) {
 		conversations:    make([]string, 0),
 		notes:            make([]string, 0),
 		sessions:         make(map[string]*ConversationSession),
+		sessionWriters:   make(map[string]*sessionWriter),
 		baseDir:          baseDir,
 		memoryPath:       filepath.Join(baseDir, DefaultMemoryFileName),
 		sessionDir:       filepath.Join(baseDir, DefaultSessionDirName),
@@ -97,6 +170,7 @@ func NewMemoryV3(baseDir string, opts ...MemoryV3Option) (*MemoryV3, error) {
 		batchSize:        DefaultBatchSize,
 		durableSync:      false,
 		sessionLoadLimit: DefaultSessionLoadLimit,
+		prettyJSON:       true,
 		closed:           make(chan struct{}),
 	}
 
@@ -117,6 +191,7 @@ func NewMemoryV3(baseDir string, opts ...MemoryV3Option) (*MemoryV3, error) {
 
 	// 启动后台写入器
 	mem.wg.Add(1)
+	mem.writerAlive.Store(true)
 	go mem.writerLoop()
 
 	return mem, nil
@@ -141,6 +216,53 @@ func WithDurableSync(enabled bool) MemoryV3Option {
 	return func(m *MemoryV3) { m.durableSync = enabled }
 }
 
+// WithPersistEveryN 设置每追加 N 条会话消息后强制持久化一次 memory.json
+// 以少量额外 I/O 换取更强的元数据持久性（消息数量、当前会话等），n<=0 表示不启用
+func WithPersistEveryN(n int) MemoryV3Option {
+	return func(m *MemoryV3) { m.persistEveryN = n }
+}
+
+// WithPersistOnSessionChange 设置创建或切换会话后是否立即持久化 memory.json
+func WithPersistOnSessionChange(enabled bool) MemoryV3Option {
+	return func(m *MemoryV3) { m.persistOnSessionChange = enabled }
+}
+
+// WithPrettyJSON 设置 memory.json 是否使用缩进格式
+// 生产环境可关闭以减小文件体积、加快写入；调试时保持开启便于阅读
+func WithPrettyJSON(enabled bool) MemoryV3Option {
+	return func(m *MemoryV3) { m.prettyJSON = enabled }
+}
+
+// WithCompressArchived 设置归档闲置会话时是否将会话文件压缩为 gzip
+// 追加写入只作用于未压缩的文件，会话恢复使用时会先解压
+func WithCompressArchived(enabled bool) MemoryV3Option {
+	return func(m *MemoryV3) { m.compressArchived = enabled }
+}
+
+// WithFlatLog 设置是否将每次的提示词和最终答案另外记录到全局的 conversations/notes 列表
+// 会话文件中已保存完整的历史，这两个列表只是重复数据，默认不记录以免 memory.json 无限增长；
+// 已有的记录仍会被加载和保存
+func WithFlatLog(enabled bool) MemoryV3Option {
+	return func(m *MemoryV3) { m.flatLog = enabled }
+}
+
+// WithFlatLogLimits 设置 conversations 和 notes 最多保留的最近条目数，超出时丢弃最早的条目，<=0 表示不限制
+// 用于控制 memory.json 的大小，使每次刷新时的序列化保持快速
+func WithFlatLogLimits(maxConversations, maxNotes int) MemoryV3Option {
+	return func(m *MemoryV3) {
+		m.maxConversations = maxConversations
+		m.maxNotes = maxNotes
+	}
+}
+
+// keepLast 只保留切片中最近的 n 条记录，n<=0 时原样返回
+func keepLast(s []string, n int) []string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
+
 // WithSessionLoadLimit 设置会话加载限制
 func WithSessionLoadLimit(limit int) MemoryV3Option {
 	return func(m *MemoryV3) { m.sessionLoadLimit = limit }
@@ -161,10 +283,14 @@ func (m *MemoryV3) loadFromDisk() error {
 		}
 		// 加载到运行时
 		m.mu.Lock()
-		m.conversations = append([]string{}, store.Conversations...)
-		m.notes = append([]string{}, store.Notes...)
+		m.conversations = keepLast(append([]string{}, store.Conversations...), m.maxConversations)
+		m.notes = keepLast(append([]string{}, store.Notes...), m.maxNotes)
 		m.currentSessionID = store.CurrentSessionID
 		for id, meta := range store.SessionsMeta {
+			if !ValidSessionID(id) {
+				Logger.Warn().Str("session_id", id).Msg("Skipping session with invalid id in memory.json")
+				continue
+			}
 			m.sessions[id] = &ConversationSession{
 				Meta:     ConversationSessionMetaToMeta(meta),
 				Messages: make([]ChatMessage, 0),
@@ -182,31 +308,20 @@ func (m *MemoryV3) loadFromDisk() error {
 		if fi.IsDir() {
 			continue
 		}
-		sessionFile := filepath.Join(m.sessionDir, fi.Name())
-		sessionID := fi.Name()
-		f, err := os.Open(sessionFile)
-		if err != nil {
+		sessionID := strings.TrimSuffix(fi.Name(), compressedSessionExt)
+		if !ValidSessionID(sessionID) {
 			continue
 		}
-		scanner := bufio.NewScanner(f)
-		msgs := make([]ChatMessage, 0)
-		total := 0
-		for scanner.Scan() {
-			var msg ChatMessage
-			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
-				continue
-			}
-			total++
-			msgs = append(msgs, msg)
-			if len(msgs) > m.sessionLoadLimit {
-				msgs = msgs[len(msgs)-m.sessionLoadLimit:]
-			}
+		msgs, total, err := m.readSessionFile(sessionID)
+		if err != nil {
+			continue
 		}
-		f.Close()
 		if len(msgs) > 0 {
 			m.mu.Lock()
 			if session, ok := m.sessions[sessionID]; ok {
-				session.Messages = msgs
+				if !session.Meta.Archived {
+					session.Messages = msgs
+				}
 				session.Meta.MessageCount = total
 			} else {
 				m.sessions[sessionID] = &ConversationSession{
@@ -226,6 +341,49 @@ func (m *MemoryV3) loadFromDisk() error {
 	return nil
 }
 
+// readSessionFile 读取会话的 jsonl 文件，返回最近 sessionLoadLimit 条消息以及文件中的消息总数
+// 未压缩的文件不存在时读取归档压缩后的 .gz 文件
+func (m *MemoryV3) readSessionFile(sessionID string) ([]ChatMessage, int, error) {
+	var r io.Reader
+	f, err := os.Open(m.sessionPath(sessionID))
+	if os.IsNotExist(err) {
+		if f, err = os.Open(m.sessionPath(sessionID) + compressedSessionExt); err == nil {
+			defer f.Close()
+			gz, gzErr := gzip.NewReader(f)
+			if gzErr != nil {
+				return nil, 0, gzErr
+			}
+			defer gz.Close()
+			r = gz
+		}
+	} else if err == nil {
+		defer f.Close()
+		r = f
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	scanner := bufio.NewScanner(r)
+	msgs := make([]ChatMessage, 0)
+	total := 0
+	for scanner.Scan() {
+		var msg ChatMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if normalized, changed := normalizeRole(msg); changed {
+			Logger.Warn().Str("session_id", sessionID).Str("role", msg.Role).Str("normalized_role", normalized.Role).Msg("Normalized invalid message role loaded from disk")
+			msg = normalized
+		}
+		total++
+		msgs = append(msgs, msg)
+		if len(msgs) > m.sessionLoadLimit {
+			msgs = msgs[len(msgs)-m.sessionLoadLimit:]
+		}
+	}
+	return msgs, total, nil
+}
+
 // ConversationSessionMetaToMeta 将 ConversationSessionMeta 转换为 ConversationSessionMeta
 func ConversationSessionMetaToMeta(meta ConversationSessionMeta) ConversationSessionMeta {
 	return ConversationSessionMeta{
@@ -234,6 +392,12 @@ func ConversationSessionMetaToMeta(meta ConversationSessionMeta) ConversationSes
 		CreatedAt:    meta.CreatedAt,
 		LastActiveAt: meta.LastActiveAt,
 		MessageCount: meta.MessageCount,
+		SystemPrompt: meta.SystemPrompt,
+		Tags:         append([]string(nil), meta.Tags...),
+		Summary:      meta.Summary,
+		Archived:     meta.Archived,
+		ForkedFrom:   meta.ForkedFrom,
+		AllowedTools: slices.Clone(meta.AllowedTools),
 	}
 }
 
@@ -252,48 +416,205 @@ func (m *MemoryV3) Close() error {
 	return nil
 }
 
-// AddConversation 添加对话
+// AddConversation 添加对话，未启用 flatLog 时不记录
 func (m *MemoryV3) AddConversation(text string) {
+	if !m.flatLog {
+		return
+	}
 	m.enqueueWrite(func() error {
 		m.mu.Lock()
 		defer m.mu.Unlock()
-		m.conversations = append(m.conversations, text)
+		m.conversations = keepLast(append(m.conversations, text), m.maxConversations)
 		atomic.StoreInt32(&m.dirty, 1)
 		return nil
 	})
 }
 
-// AddNote 添加笔记
+// AddNote 添加笔记，未启用 flatLog 时不记录
 func (m *MemoryV3) AddNote(text string) {
+	if !m.flatLog {
+		return
+	}
 	m.enqueueWrite(func() error {
 		m.mu.Lock()
 		defer m.mu.Unlock()
-		m.notes = append(m.notes, text)
+		m.notes = keepLast(append(m.notes, text), m.maxNotes)
 		atomic.StoreInt32(&m.dirty, 1)
 		return nil
 	})
 }
 
 // CreateSession 创建会话
-func (m *MemoryV3) CreateSession(sessionID, title string) {
+// systemPrompt: 会话专属的系统提示词，为空时使用全局提示词
+// opts: 可选配置，例如 WithSessionAllowedTools
+func (m *MemoryV3) CreateSession(sessionID, title, systemPrompt string, opts ...SessionOption) {
+	if !ValidSessionID(sessionID) {
+		Logger.Error().Str("session_id", sessionID).Msg("Refusing to create session with invalid id")
+		return
+	}
 	m.enqueueWrite(func() error {
 		m.mu.Lock()
-		defer m.mu.Unlock()
 		now := time.Now()
+		meta := ConversationSessionMeta{
+			ID:           sessionID,
+			Title:        title,
+			CreatedAt:    now,
+			LastActiveAt: now,
+			MessageCount: 0,
+			SystemPrompt: systemPrompt,
+		}
+		for _, opt := range opts {
+			opt(&meta)
+		}
 		m.sessions[sessionID] = &ConversationSession{
-			Meta: ConversationSessionMeta{
-				ID:           sessionID,
-				Title:        title,
-				CreatedAt:    now,
-				LastActiveAt: now,
-				MessageCount: 0,
-			},
+			Meta:     meta,
 			Messages: make([]ChatMessage, 0),
 		}
 		m.currentSessionID = sessionID
 		atomic.StoreInt32(&m.dirty, 1)
+		m.mu.Unlock()
+		return m.persistOnChange()
+	})
+}
+
+// ForkSession 将源会话的前 upToIndex+1 条消息复制到一个新会话中，源会话不受影响。
+// 索引与 GetSessionMessages 返回的消息列表一致；upToIndex 为负数时复制全部消息。
+// 新会话继承源会话的系统提示词和标签，但不会成为当前会话。
+func (m *MemoryV3) ForkSession(sourceID string, upToIndex int) (string, error) {
+	msgs, ok := m.GetSessionMessages(sourceID)
+	if !ok {
+		return "", ErrSessionNotFound
+	}
+	if upToIndex >= len(msgs) {
+		return "", fmt.Errorf("message index %d out of range: session has %d messages", upToIndex, len(msgs))
+	}
+	if upToIndex >= 0 {
+		msgs = msgs[:upToIndex+1]
+	}
+	meta, _, _ := m.GetSessionMeta(sourceID)
+
+	newID := uuid.New().String()
+	now := time.Now()
+	session := &ConversationSession{
+		Meta: ConversationSessionMeta{
+			ID:           newID,
+			Title:        meta.Title + " (fork)",
+			CreatedAt:    now,
+			LastActiveAt: now,
+			SystemPrompt: meta.SystemPrompt,
+			Tags:         meta.Tags,
+			ForkedFrom:   sourceID,
+			AllowedTools: meta.AllowedTools,
+		},
+		Messages: make([]ChatMessage, 0, len(msgs)),
+	}
+	// 复制的历史经过新会话的写入器登记并同步写入，与之后追加的消息共用同一个 FIFO，
+	// 保证历史先于之后追加的消息落盘；返回前新会话的消息已全部在内存中
+	w := m.writerFor(newID)
+	w.pendingMu.Lock()
+	w.pending = append(w.pending, msgs...)
+	w.pendingMu.Unlock()
+
+	m.mu.Lock()
+	m.sessions[newID] = session
+	atomic.StoreInt32(&m.dirty, 1)
+	m.mu.Unlock()
+
+	if err := m.drainSessionWrites(newID, session, w); err != nil {
+		Logger.Error().Err(err).Str("session_id", newID).Msg("Failed to write forked session history")
+	}
+	m.enqueueWrite(m.persistOnChange)
+	Logger.Info().Str("source_session_id", sourceID).Str("session_id", newID).Int("messages", len(msgs)).Msg("Forked session")
+	return newID, nil
+}
+
+// SetSessionSystemPrompt 设置会话专属的系统提示词
+// 仅影响之后新开始的会话消息历史，已存在的 system 消息不会被改写
+func (m *MemoryV3) SetSessionSystemPrompt(sessionID, systemPrompt string) {
+	m.enqueueWrite(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if s, ok := m.sessions[sessionID]; ok {
+			s.Meta.SystemPrompt = systemPrompt
+			atomic.StoreInt32(&m.dirty, 1)
+		}
+		return nil
+	})
+}
+
+// GetSessionAllowedTools 获取会话允许使用的工具，ok 为 false 表示会话不存在或未限制工具
+func (m *MemoryV3) GetSessionAllowedTools(sessionID string) ([]string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if s, ok := m.sessions[sessionID]; ok && s.Meta.AllowedTools != nil {
+		return slices.Clone(s.Meta.AllowedTools), true
+	}
+	return nil, false
+}
+
+// GetSessionSystemPrompt 获取会话专属的系统提示词，未设置时返回空字符串
+func (m *MemoryV3) GetSessionSystemPrompt(sessionID string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if s, ok := m.sessions[sessionID]; ok {
+		return s.Meta.SystemPrompt
+	}
+	return ""
+}
+
+// AddSessionTag 为会话添加标签，已存在的标签不会重复添加
+func (m *MemoryV3) AddSessionTag(sessionID, tag string) bool {
+	m.mu.RLock()
+	_, ok := m.sessions[sessionID]
+	m.mu.RUnlock()
+	if !ok || tag == "" {
+		return false
+	}
+	m.enqueueWrite(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		s, ok := m.sessions[sessionID]
+		if !ok {
+			return nil
+		}
+		for _, t := range s.Meta.Tags {
+			if t == tag {
+				return nil
+			}
+		}
+		s.Meta.Tags = append(s.Meta.Tags, tag)
+		atomic.StoreInt32(&m.dirty, 1)
 		return nil
 	})
+	return true
+}
+
+// RemoveSessionTag 从会话中移除标签
+func (m *MemoryV3) RemoveSessionTag(sessionID, tag string) bool {
+	m.mu.RLock()
+	_, ok := m.sessions[sessionID]
+	m.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	m.enqueueWrite(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		s, ok := m.sessions[sessionID]
+		if !ok {
+			return nil
+		}
+		tags := s.Meta.Tags[:0]
+		for _, t := range s.Meta.Tags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		s.Meta.Tags = tags
+		atomic.StoreInt32(&m.dirty, 1)
+		return nil
+	})
+	return true
 }
 
 // SetCurrentSession 设置当前会话
@@ -306,13 +627,13 @@ func (m *MemoryV3) SetCurrentSession(sessionID string) bool {
 	}
 	m.enqueueWrite(func() error {
 		m.mu.Lock()
-		defer m.mu.Unlock()
 		m.currentSessionID = sessionID
 		if s, ok := m.sessions[sessionID]; ok {
 			s.Meta.LastActiveAt = time.Now()
 		}
 		atomic.StoreInt32(&m.dirty, 1)
-		return nil
+		m.mu.Unlock()
+		return m.persistOnChange()
 	})
 	return true
 }
@@ -325,32 +646,290 @@ func (m *MemoryV3) AddMessageToSession(sessionID string, msg ChatMessage) bool {
 	if !ok {
 		return false
 	}
+	// 规范化消息角色，防止无效角色写入历史后导致整个会话的模型调用失败
+	if normalized, changed := normalizeRole(msg); changed {
+		Logger.Warn().Str("session_id", sessionID).Str("role", msg.Role).Str("normalized_role", normalized.Role).Msg("Normalized invalid message role")
+		msg = normalized
+	}
+	// 记录消息加入会话的时间
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	// 在调用时按到达顺序登记消息，实际写入由任务按相同顺序完成
+	w := m.writerFor(sessionID)
+	w.pendingMu.Lock()
+	w.pending = append(w.pending, msg)
+	w.pendingMu.Unlock()
 	m.enqueueWrite(func() error {
+		return m.drainSessionWrites(sessionID, session, w)
+	})
+	return true
+}
+
+// writerFor 返回会话的消息写入器，不存在时创建
+func (m *MemoryV3) writerFor(sessionID string) *sessionWriter {
+	m.writersMu.Lock()
+	defer m.writersMu.Unlock()
+	w, ok := m.sessionWriters[sessionID]
+	if !ok {
+		w = &sessionWriter{}
+		m.sessionWriters[sessionID] = w
+	}
+	return w
+}
+
+// drainSessionWrites 按到达顺序写入会话中所有待写入的消息。
+// 同一会话的写入通过 writeMu 串行化，先执行的任务会顺带写入后续任务的消息，后者发现没有待写入消息时直接返回。
+func (m *MemoryV3) drainSessionWrites(sessionID string, session *ConversationSession, w *sessionWriter) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.pendingMu.Lock()
+	msgs := w.pending
+	w.pending = nil
+	w.pendingMu.Unlock()
+
+	var firstErr error
+	for _, msg := range msgs {
+		// 内存中的追加和会话文件的写入在同一个读锁内完成，快照中的元数据与会话文件保持一致
+		m.pauseMu.RLock()
 		m.mu.Lock()
+		// 已归档的会话在追加前先恢复消息，此时新消息尚未写入会话文件
+		m.restoreArchivedLocked(sessionID, session)
 		session.Messages = append(session.Messages, msg)
 		session.Meta.LastActiveAt = time.Now()
 		session.Meta.MessageCount++
 		m.mu.Unlock()
 
 		// 将一条消息行持久化到 sessions/<id>.jsonl
-		return m.appendSessionLine(sessionID, msg)
-	})
-	return true
+		err := m.appendSessionLine(sessionID, msg)
+		m.pauseMu.RUnlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		// 达到配置的消息数后强制持久化元数据
+		if m.persistEveryN > 0 && atomic.AddInt32(&m.messagesSincePersist, 1) >= int32(m.persistEveryN) {
+			atomic.StoreInt32(&m.messagesSincePersist, 0)
+			if err := m.persistStore(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
-// GetSessionMessages 获取会话消息
+// GetSessionMessages 获取会话消息，已归档的会话会从会话文件中重新加载
 func (m *MemoryV3) GetSessionMessages(sessionID string) ([]ChatMessage, bool) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
 	s, ok := m.sessions[sessionID]
+	archived := ok && s.Meta.Archived
+	m.mu.RUnlock()
 	if !ok {
 		return nil, false
 	}
+	if archived {
+		m.mu.Lock()
+		m.restoreArchivedLocked(sessionID, s)
+		m.mu.Unlock()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	out := make([]ChatMessage, len(s.Messages))
 	copy(out, s.Messages)
 	return out, true
 }
 
+// MessageFilter 定义了会话消息的筛选条件，零值表示不筛选
+type MessageFilter struct {
+	Roles []string  // 只返回这些角色的消息，为空时返回所有角色
+	Since time.Time // 只返回该时间及之后的消息，为零值时不限制
+	Until time.Time // 只返回该时间及之前的消息，为零值时不限制
+}
+
+// match 判断消息是否满足筛选条件；指定了时间范围时，没有时间戳的旧消息会被排除
+func (f MessageFilter) match(msg ChatMessage) bool {
+	if len(f.Roles) > 0 && !slices.Contains(f.Roles, msg.Role) {
+		return false
+	}
+	if (!f.Since.IsZero() || !f.Until.IsZero()) && msg.Timestamp.IsZero() {
+		return false
+	}
+	if !f.Since.IsZero() && msg.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && msg.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// FilterSessionMessages 按角色和时间范围筛选会话消息
+func (m *MemoryV3) FilterSessionMessages(sessionID string, f MessageFilter) ([]ChatMessage, bool) {
+	msgs, ok := m.GetSessionMessages(sessionID)
+	if !ok {
+		return nil, false
+	}
+	out := msgs[:0]
+	for _, msg := range msgs {
+		if f.match(msg) {
+			out = append(out, msg)
+		}
+	}
+	return out, true
+}
+
+// IdleSessions 返回最后活动时间早于 before、尚未归档且内存中仍有消息的会话，以及各自的最后活动时间
+func (m *MemoryV3) IdleSessions(before time.Time) map[string]time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string]time.Time)
+	for id, s := range m.sessions {
+		if !s.Meta.Archived && len(s.Messages) > 0 && s.Meta.LastActiveAt.Before(before) {
+			out[id] = s.Meta.LastActiveAt
+		}
+	}
+	return out
+}
+
+// ArchiveSession 保存会话摘要并释放内存中的消息，只保留元数据
+// lastActiveAt 为判断闲置时的最后活动时间；如果期间会话又有新活动，则放弃归档
+// 消息仍保存在会话文件中，会话恢复使用时会按需重新加载
+func (m *MemoryV3) ArchiveSession(sessionID, summary string, lastActiveAt time.Time) {
+	m.enqueueWrite(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		s, ok := m.sessions[sessionID]
+		if !ok || s.Meta.Archived || !s.Meta.LastActiveAt.Equal(lastActiveAt) {
+			return nil
+		}
+		s.Meta.Summary = summary
+		s.Meta.Archived = true
+		s.Messages = nil
+		atomic.StoreInt32(&m.dirty, 1)
+		if m.compressArchived {
+			if err := m.compressSessionFile(sessionID); err != nil {
+				Logger.Error().Err(err).Str("session_id", sessionID).Msg("Failed to compress archived session file")
+			}
+		}
+		return nil
+	})
+}
+
+// sessionPath 返回会话 jsonl 文件的路径
+func (m *MemoryV3) sessionPath(sessionID string) string {
+	return filepath.Join(m.sessionDir, sessionID)
+}
+
+// compressSessionFile 将会话文件压缩为 .gz 并删除原文件
+// 先写入临时文件再重命名，中途失败时原文件保持不变
+func (m *MemoryV3) compressSessionFile(sessionID string) error {
+	src := m.sessionPath(sessionID)
+	in, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+
+	dst := src + compressedSessionExt
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// decompressSessionFile 将归档压缩的会话文件还原为可追加写入的 jsonl 文件
+func (m *MemoryV3) decompressSessionFile(sessionID string) error {
+	dst := m.sessionPath(sessionID)
+	src := dst + compressedSessionExt
+	in, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, gz)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// restoreArchivedLocked 从会话文件重新加载已归档会话的消息，调用方必须持有写锁
+func (m *MemoryV3) restoreArchivedLocked(sessionID string, s *ConversationSession) {
+	if !s.Meta.Archived {
+		return
+	}
+	if err := m.decompressSessionFile(sessionID); err != nil {
+		Logger.Error().Err(err).Str("session_id", sessionID).Msg("Failed to decompress archived session file")
+		return
+	}
+	msgs, _, err := m.readSessionFile(sessionID)
+	if err != nil && !os.IsNotExist(err) {
+		Logger.Error().Err(err).Str("session_id", sessionID).Msg("Failed to reload archived session")
+		return
+	}
+	s.Messages = msgs
+	s.Meta.Archived = false
+	atomic.StoreInt32(&m.dirty, 1)
+}
+
+// GetSessionMeta 获取会话的完整元数据
+// 返回元数据副本、内存中已加载的消息数量，以及会话是否存在
+func (m *MemoryV3) GetSessionMeta(sessionID string) (ConversationSessionMeta, int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[sessionID]
+	if !ok {
+		return ConversationSessionMeta{}, 0, false
+	}
+	return ConversationSessionMetaToMeta(s.Meta), len(s.Messages), true
+}
+
 // GetCurrentSessionID 获取当前会话 ID
 func (m *MemoryV3) GetCurrentSessionID() string {
 	m.mu.RLock()
@@ -369,11 +948,60 @@ func (m *MemoryV3) GetAllSessions() map[string]map[string]interface{} {
 			"created_at":     s.Meta.CreatedAt,
 			"last_active_at": s.Meta.LastActiveAt,
 			"message_count":  s.Meta.MessageCount,
+			"system_prompt":  s.Meta.SystemPrompt,
+			"tags":           append([]string(nil), s.Meta.Tags...),
+			"summary":        s.Meta.Summary,
+			"archived":       s.Meta.Archived,
 		}
 	}
 	return ret
 }
 
+// SessionListOptions 定义了会话列表的排序、筛选和分页选项
+type SessionListOptions struct {
+	SortBy    string // 排序字段："last_active"（默认）或 "created"
+	Ascending bool   // 是否升序，默认降序（最近的在前）
+	Tag       string // 只返回带有该标签的会话，为空时不筛选
+	Offset    int    // 跳过的会话数量
+	Limit     int    // 返回的最大会话数量，<=0 表示不限制
+}
+
+// ListSessions 按选项排序、筛选和分页返回会话元数据
+// 返回当前页的会话列表，以及筛选后（分页前）的会话总数
+func (m *MemoryV3) ListSessions(opts SessionListOptions) ([]ConversationSessionMeta, int) {
+	m.mu.RLock()
+	metas := make([]ConversationSessionMeta, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		if opts.Tag != "" && !slices.Contains(s.Meta.Tags, opts.Tag) {
+			continue
+		}
+		metas = append(metas, ConversationSessionMetaToMeta(s.Meta))
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool {
+		ti, tj := metas[i].LastActiveAt, metas[j].LastActiveAt
+		if opts.SortBy == "created" {
+			ti, tj = metas[i].CreatedAt, metas[j].CreatedAt
+		}
+		if ti.Equal(tj) {
+			return metas[i].ID < metas[j].ID // 时间相同时按 ID 排序，保证结果稳定
+		}
+		if opts.Ascending {
+			return ti.Before(tj)
+		}
+		return ti.After(tj)
+	})
+
+	total := len(metas)
+	start := min(max(opts.Offset, 0), total)
+	end := total
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, total)
+	}
+	return metas[start:end], total
+}
+
 // GetConversations 获取所有对话
 func (m *MemoryV3) GetConversations() []string {
 	m.mu.RLock()
@@ -392,6 +1020,35 @@ func (m *MemoryV3) GetNotes() []string {
 	return out
 }
 
+// MemoryStats 是内存存储的汇总统计
+type MemoryStats struct {
+	Sessions      int `json:"sessions"`      // 会话总数
+	Messages      int `json:"messages"`      // 所有会话的消息总数
+	Notes         int `json:"notes"`         // 笔记总数
+	Conversations int `json:"conversations"` // 对话记录总数
+}
+
+// Stats 汇总内存存储的统计信息
+// 消息数量使用会话元数据中的 MessageCount 求和，不需要加载消息内容
+func (m *MemoryV3) Stats() MemoryStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := MemoryStats{
+		Sessions:      len(m.sessions),
+		Notes:         len(m.notes),
+		Conversations: len(m.conversations),
+	}
+	for _, s := range m.sessions {
+		stats.Messages += s.Meta.MessageCount
+	}
+	return stats
+}
+
+// Health 报告后台写入器是否存活以及写入队列是否积压
+func (m *MemoryV3) Health() SubsystemHealth {
+	return queueHealth("memory", m.writerAlive.Load(), len(m.writeQueue), cap(m.writeQueue), m.lastQueueFull.Load())
+}
+
 // ---------- 持久化帮助程序 ----------
 
 // enqueueWrite 将写入任务排入队列
@@ -401,6 +1058,7 @@ func (m *MemoryV3) enqueueWrite(task func() error) {
 		// 已排队
 	default:
 		// 队列已满：执行非阻塞回退以避免阻塞调用者
+		m.lastQueueFull.Store(time.Now().UnixNano())
 		go func() { _ = task() }()
 	}
 	atomic.StoreInt32(&m.dirty, 1)
@@ -409,6 +1067,7 @@ func (m *MemoryV3) enqueueWrite(task func() error) {
 // writerLoop 是后台写入循环
 func (m *MemoryV3) writerLoop() {
 	defer m.wg.Done()
+	defer m.writerAlive.Store(false)
 	ticker := time.NewTicker(m.flushInterval)
 	defer ticker.Stop()
 
@@ -493,8 +1152,37 @@ func (m *MemoryV3) runTasks(tasks []func() error) {
 
 // persistStore 持久化存储
 func (m *MemoryV3) persistStore() error {
+	m.pauseMu.RLock()
+	defer m.pauseMu.RUnlock()
+
 	// 快照
 	m.mu.RLock()
+	store := m.storeLocked()
+	m.mu.RUnlock()
+
+	bs, err := m.marshalStore(store)
+	if err != nil {
+		return err
+	}
+	tmpPath := m.memoryPath + ".tmp"
+	if err := writeTempFile(tmpPath, bs, m.durableSync); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, m.memoryPath); err != nil {
+		return err
+	}
+	if m.durableSync {
+		dirF, _ := os.Open(m.baseDir)
+		if dirF != nil {
+			_ = dirF.Sync()
+			_ = dirF.Close()
+		}
+	}
+	return nil
+}
+
+// storeLocked 生成 memory.json 的内容，调用方必须持有读锁
+func (m *MemoryV3) storeLocked() MemoryStorePersist {
 	store := MemoryStorePersist{
 		Conversations:    append([]string{}, m.conversations...),
 		Notes:            append([]string{}, m.notes...),
@@ -508,35 +1196,145 @@ func (m *MemoryV3) persistStore() error {
 			CreatedAt:    s.Meta.CreatedAt,
 			LastActiveAt: s.Meta.LastActiveAt,
 			MessageCount: s.Meta.MessageCount,
+			SystemPrompt: s.Meta.SystemPrompt,
+			Tags:         append([]string(nil), s.Meta.Tags...),
+			Summary:      s.Meta.Summary,
+			Archived:     s.Meta.Archived,
+			ForkedFrom:   s.Meta.ForkedFrom,
+			AllowedTools: slices.Clone(s.Meta.AllowedTools),
 		}
 	}
-	m.mu.RUnlock()
+	return store
+}
 
-	tmpPath := m.memoryPath + ".tmp"
-	bs, err := json.MarshalIndent(store, "", "  ")
+// marshalStore 按 prettyJSON 设置序列化 memory.json
+func (m *MemoryV3) marshalStore(store MemoryStorePersist) ([]byte, error) {
+	if m.prettyJSON {
+		return json.MarshalIndent(store, "", "  ")
+	}
+	return json.Marshal(store)
+}
+
+// Snapshot 将 memory.json 和会话文件复制到 dir，用于服务运行时的一致性备份
+// 先写入所有已到达但尚未落盘的消息，然后短暂暂停所有磁盘写入和会话变更，
+// 复制完成后恢复。dir 中已存在 memory.json 时返回错误，避免覆盖之前的备份
+// 返回复制的会话文件数量
+func (m *MemoryV3) Snapshot(dir string) (int, error) {
+	// 写入各会话待写入的消息，减少暂停期间仍在队列中的消息
+	m.writersMu.Lock()
+	writers := make(map[string]*sessionWriter, len(m.sessionWriters))
+	for id, w := range m.sessionWriters {
+		writers[id] = w
+	}
+	m.writersMu.Unlock()
+	for id, w := range writers {
+		m.mu.RLock()
+		s, ok := m.sessions[id]
+		m.mu.RUnlock()
+		if ok {
+			if err := m.drainSessionWrites(id, s, w); err != nil {
+				return 0, fmt.Errorf("failed to flush session %s: %w", id, err)
+			}
+		}
+	}
+
+	sessionsDst := filepath.Join(dir, DefaultSessionDirName)
+	if err := os.MkdirAll(sessionsDst, 0o755); err != nil {
+		return 0, err
+	}
+
+	// 暂停磁盘写入，并持有读锁阻止会话变更以及归档会话文件的压缩和解压
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bs, err := m.marshalStore(m.storeLocked())
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, DefaultMemoryFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(m.sessionDir)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, e := range entries {
+		// 跳过压缩和解压过程中遗留的临时文件
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		if err := copyFile(filepath.Join(m.sessionDir, e.Name()), filepath.Join(sessionsDst, e.Name())); err != nil {
+			return copied, fmt.Errorf("failed to copy session file %s: %w", e.Name(), err)
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// copyFile 复制单个文件，目标文件已存在时覆盖
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(tmpPath, bs, 0o644); err != nil {
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
 		return err
 	}
-	if err := os.Rename(tmpPath, m.memoryPath); err != nil {
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
 		return err
 	}
-	if m.durableSync {
-		dirF, _ := os.Open(m.baseDir)
-		if dirF != nil {
-			_ = dirF.Sync()
-			_ = dirF.Close()
+	return out.Close()
+}
+
+// writeTempFile 写入重命名前的临时文件。sync 为 true 时在关闭前刷盘，
+// 否则崩溃后重命名可能已生效而数据尚未落盘，留下一个空的或不完整的 memory.json
+func writeTempFile(path string, data []byte, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
 		}
 	}
-	return nil
+	return f.Close()
+}
+
+// persistOnChange 在启用 persistOnSessionChange 时立即持久化存储
+func (m *MemoryV3) persistOnChange() error {
+	if !m.persistOnSessionChange {
+		return nil
+	}
+	return m.persistStore()
 }
 
 // appendSessionLine 向会话文件追加一行
 func (m *MemoryV3) appendSessionLine(sessionID string, msg ChatMessage) error {
-	path := filepath.Join(m.sessionDir, sessionID)
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if !ValidSessionID(sessionID) {
+		return ErrInvalidSessionID
+	}
+	f, err := os.OpenFile(m.sessionPath(sessionID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
 		return err
 	}
@@ -9,11 +9,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -44,15 +48,63 @@ type ChatMessage struct {
 	Name      string     `json:"name,omitempty"`       // 工具调用时的函数名称
 	Images    []string   `json:"images,omitempty"`     // 图片数据（Base64编码），支持多模态
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"` // 助手消息中的工具调用列表
+	Timestamp time.Time  `json:"timestamp,omitzero"`   // 消息加入会话的时间，旧数据中缺失时为零值
+}
+
+// requestMessages 返回发送给模型的消息副本，去掉只用于会话记录的字段（Timestamp），
+// 避免严格校验消息字段的 OpenAI 兼容服务拒绝请求，也保证响应缓存的键不受时间影响
+func requestMessages(msgs []ChatMessage) []ChatMessage {
+	out := make([]ChatMessage, len(msgs))
+	for i, msg := range msgs {
+		msg.Timestamp = time.Time{}
+		out[i] = msg
+	}
+	return out
+}
+
+// validRoles 是模型接受的消息角色
+var validRoles = map[string]bool{"system": true, "user": true, "assistant": true, "tool": true}
+
+// roleAliases 将常见的非标准角色名映射到标准角色
+var roleAliases = map[string]string{
+	"human":    "user",
+	"ai":       "assistant",
+	"bot":      "assistant",
+	"model":    "assistant",
+	"function": "tool",
+}
+
+// normalizeRole 校验并规范化消息角色
+// 大小写和空白会被规范化，常见别名会被映射；无法识别的角色在消息带有工具调用时视为 assistant，否则视为 user
+// 返回规范化后的消息以及角色是否被修改
+func normalizeRole(msg ChatMessage) (ChatMessage, bool) {
+	role := strings.ToLower(strings.TrimSpace(msg.Role))
+	if alias, ok := roleAliases[role]; ok {
+		role = alias
+	}
+	if !validRoles[role] {
+		if len(msg.ToolCalls) > 0 {
+			role = "assistant"
+		} else {
+			role = "user"
+		}
+	}
+	changed := role != msg.Role
+	msg.Role = role
+	return msg, changed
 }
 
 // ChatRequest 封装发送给Ollama模型的完整请求
 type ChatRequest struct {
-	Model      string        `json:"model"`                 // 使用的模型名称
-	Messages   []ChatMessage `json:"messages"`              // 对话历史消息数组
-	Tools      any           `json:"tools,omitempty"`       // 可用工具的元数据描述
-	ToolChoice string        `json:"tool_choice,omitempty"` // 工具选择策略（auto/manual/none）
-	Stream     bool          `json:"stream,omitempty"`      // 是否启用流式响应
+	Model      string         `json:"model"`                 // 使用的模型名称
+	Messages   []ChatMessage  `json:"messages"`              // 对话历史消息数组
+	Tools      any            `json:"tools,omitempty"`       // 可用工具的元数据描述
+	ToolChoice string         `json:"tool_choice,omitempty"` // 工具选择策略（auto/manual/none）
+	Stream     bool           `json:"stream,omitempty"`      // 是否启用流式响应
+	Options    map[string]any `json:"options,omitempty"`     // 模型生成参数，例如 temperature
+	Format     any            `json:"format,omitempty"`      // 输出格式："json" 或 JSON Schema，约束模型输出结构化数据
+	KeepAlive  any            `json:"keep_alive,omitempty"`  // 请求结束后模型在内存中保留的时长，例如 "30m"；-1 表示一直保留
+	Stop       []string       `json:"stop,omitempty"`        // 停止序列（OpenAI 兼容接口），Ollama 通过 options.stop 读取
 }
 
 // FunctionCall 表示模型建议执行的函数调用 (Legacy 兼容)
@@ -71,6 +123,35 @@ type ChoiceMessage struct {
 	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`    // 工具调用列表
 }
 
+// UnmarshalJSON 通过 ToolCallAccumulator 解析工具调用，
+// 兼容 Ollama 的对象参数和 OpenAI 兼容接口的字符串参数
+func (m *ChoiceMessage) UnmarshalJSON(data []byte) error {
+	type plain ChoiceMessage
+	var raw struct {
+		plain
+		ToolCalls []json.RawMessage `json:"tool_calls,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = ChoiceMessage(raw.plain)
+	if len(raw.ToolCalls) == 0 {
+		return nil
+	}
+	acc := NewToolCallAccumulator()
+	for _, tc := range raw.ToolCalls {
+		if err := acc.Add(tc); err != nil {
+			return err
+		}
+	}
+	calls, err := acc.Calls()
+	if err != nil {
+		Logger.Warn().Err(err).Msg("Dropped malformed tool calls from LLM response")
+	}
+	m.ToolCalls = calls
+	return nil
+}
+
 // Choice 表示一个完整的响应选项
 // Ollama API可能返回多个选择，当前只处理第一个
 type Choice struct {
@@ -86,10 +167,53 @@ type ChatResponse struct {
 
 // OllamaClient 封装与Ollama服务的通信
 type OllamaClient struct {
-	url    string       // Ollama API 端点 URL
-	client *http.Client // HTTP 客户端实例
-	model  string       // 默认使用的模型名称
-	cfg    Config       // 应用程序配置
+	url         string         // Ollama API 端点 URL
+	client      *http.Client   // HTTP 客户端实例
+	model       string         // 默认使用的模型名称
+	cfg         Config         // 应用程序配置
+	temperature *float64       // 采样温度，为 nil 时使用模型默认值
+	stop        []string       // 默认停止序列，可被 Context 中的 WithStop 覆盖
+	seed        *int           // 默认随机种子，为 nil 时由模型随机选择，可被 Context 中的 WithSeed 覆盖
+	cache       *responseCache // 非流式响应缓存，为 nil 时不启用
+	callTimeout time.Duration  // 单次调用的超时（流式调用为首个数据块的超时），0 表示只受 HTTP 客户端超时限制
+	slowCall    time.Duration  // 调用超过该时长仍未完成时记录警告，0 表示不检测
+}
+
+// OllamaClientOption 是 OllamaClient 的选项函数
+type OllamaClientOption func(*OllamaClient)
+
+// WithTemperature 设置采样温度
+func WithTemperature(t float64) OllamaClientOption {
+	return func(o *OllamaClient) { o.temperature = &t }
+}
+
+// WithStopSequences 设置默认停止序列，模型生成到其中任意一个序列时停止
+func WithStopSequences(stop []string) OllamaClientOption {
+	return func(o *OllamaClient) { o.stop = stop }
+}
+
+// WithDefaultSeed 设置默认随机种子，与 temperature 0 一起使用时生成结果可复现
+func WithDefaultSeed(seed int) OllamaClientOption {
+	return func(o *OllamaClient) { o.seed = &seed }
+}
+
+// WithResponseCache 启用非流式响应缓存
+// 缓存键为 (模型, 消息, 工具) 的哈希，只有在 temperature 为 0（确定性输出）时才会读写缓存，
+// 以避免返回过期的采样结果
+// ttl: 缓存条目的存活时间
+// maxEntries: 最大缓存条目数，超出时淘汰最久未使用的条目
+func WithResponseCache(ttl time.Duration, maxEntries int) OllamaClientOption {
+	return func(o *OllamaClient) { o.cache = newResponseCache(ttl, maxEntries) }
+}
+
+// StatusError 表示 LLM 服务返回了非 2xx 状态码
+type StatusError struct {
+	StatusCode int    // HTTP 状态码
+	Body       string // 响应体
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("ollama error: %d %s", e.StatusCode, e.Body)
 }
 
 // 确保 OllamaClient 实现了 LLMProvider 接口
@@ -97,7 +221,8 @@ var _ LLMProvider = (*OllamaClient)(nil)
 
 // NewOllamaClient 创建新的Ollama客户端实例
 // cfg: 应用程序配置
-func NewOllamaClient(cfg Config) *OllamaClient {
+// opts: 可选配置，例如 WithTemperature、WithResponseCache
+func NewOllamaClient(cfg Config, opts ...OllamaClientOption) *OllamaClient {
 	// 从配置中获取超时时间，如果无效则使用默认值
 	timeout := time.Duration(cfg.Ollama.TimeoutSecs) * time.Second
 	if timeout <= 0 {
@@ -106,7 +231,7 @@ func NewOllamaClient(cfg Config) *OllamaClient {
 
 	model := cfg.Ollama.DefaultModel // 从配置中获取默认模型
 
-	return &OllamaClient{
+	o := &OllamaClient{
 		url: cfg.Ollama.URL, // 从配置中获取 Ollama URL
 		client: &http.Client{
 			Timeout: timeout, // 设置 HTTP 请求超时
@@ -117,9 +242,89 @@ func NewOllamaClient(cfg Config) *OllamaClient {
 				IdleConnTimeout:     90 * time.Second, // 空闲连接超时时间
 			},
 		},
-		model: model, // 设置默认模型
-		cfg:   cfg,   // 存储配置
+		model:       model, // 设置默认模型
+		cfg:         cfg,   // 存储配置
+		callTimeout: time.Duration(cfg.Ollama.CallTimeoutSecs) * time.Second,
+		slowCall:    time.Duration(cfg.Ollama.SlowCallWarnSecs) * time.Second,
 	}
+
+	// 应用选项
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// generationOptions 返回请求中携带的模型生成参数
+func (o *OllamaClient) generationOptions(ctx context.Context) map[string]any {
+	options := make(map[string]any)
+	if o.temperature != nil {
+		options["temperature"] = *o.temperature
+	}
+	if stop := o.stopSequences(ctx); len(stop) > 0 {
+		options["stop"] = stop
+	}
+	if seed, ok := ctx.Value(seedContextKey).(int); ok {
+		options["seed"] = seed
+	} else if o.seed != nil {
+		options["seed"] = *o.seed
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// stopSequences 返回本次调用的停止序列，Context 中通过 WithStop 指定的优先于默认值
+func (o *OllamaClient) stopSequences(ctx context.Context) []string {
+	if stop, ok := ctx.Value(stopContextKey).([]string); ok {
+		return stop
+	}
+	return o.stop
+}
+
+// keepAlive 返回请求中携带的 keep_alive 值，未配置时返回 nil 使用服务端默认值
+// 纯数字按秒数（-1 表示一直保留）以数字形式发送，其他值作为时长字符串（例如 "30m"）发送
+func (o *OllamaClient) keepAlive() any {
+	s := strings.TrimSpace(o.cfg.Ollama.KeepAlive)
+	if s == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return s
+}
+
+// watchSlowCall 在调用超过 slow_call_warn_secs 仍未完成时记录警告，之后每经过一个阈值再记录一次，
+// 便于在模型服务挂起时尽早发现；返回的函数用于在调用结束时停止检测
+func (o *OllamaClient) watchSlowCall(ctx context.Context, model string, stream bool) func() {
+	if o.slowCall <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	ticker := time.NewTicker(o.slowCall)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				Logger.Warn().Ctx(ctx).Str("model", model).Bool("stream", stream).Dur("elapsed", time.Since(start)).
+					Dur("threshold", o.slowCall).Msg("LLM call is taking longer than expected, still waiting for the model server")
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// cacheable 判断当前配置下的响应是否可以缓存（仅确定性输出）
+func (o *OllamaClient) cacheable() bool {
+	return o.cache != nil && o.temperature != nil && *o.temperature == 0
 }
 
 // contextKey 是一个私有类型，用于防止 Context 键冲突
@@ -127,12 +332,80 @@ type contextKey string
 
 const modelContextKey contextKey = "llm_model"
 
+const planModeContextKey contextKey = "plan_mode"
+
+const contextDocsContextKey contextKey = "context_documents"
+
+const responseFormatContextKey contextKey = "response_format"
+
+const allowedToolsContextKey contextKey = "allowed_tools"
+
+const stopContextKey contextKey = "stop_sequences"
+
+const seedContextKey contextKey = "seed"
+
 // WithModel 返回一个新的 Context，其中包含指定的模型名称
 // 允许在运行时动态切换模型
 func WithModel(ctx context.Context, model string) context.Context {
 	return context.WithValue(ctx, modelContextKey, model)
 }
 
+// WithPlanMode 返回一个新的 Context，标记本次运行为计划 (dry-run) 模式
+// 计划模式下 Agent 只会报告将要调用的工具，不会真正执行
+func WithPlanMode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, planModeContextKey, true)
+}
+
+// IsPlanMode 判断 Context 是否处于计划 (dry-run) 模式
+func IsPlanMode(ctx context.Context) bool {
+	plan, _ := ctx.Value(planModeContextKey).(bool)
+	return plan
+}
+
+// WithContextDocuments 返回一个新的 Context，携带调用方预先提供的上下文文档
+// 这些文档只在本次运行中作为系统消息注入，不会写入会话历史或向量库
+func WithContextDocuments(ctx context.Context, docs []string) context.Context {
+	return context.WithValue(ctx, contextDocsContextKey, docs)
+}
+
+// ContextDocuments 获取 Context 中携带的上下文文档
+func ContextDocuments(ctx context.Context) []string {
+	docs, _ := ctx.Value(contextDocsContextKey).([]string)
+	return docs
+}
+
+// WithAllowedTools 返回一个新的 Context，限制本次运行（包括调用的协作 Agent）只能使用指定的工具
+func WithAllowedTools(ctx context.Context, tools []string) context.Context {
+	return context.WithValue(ctx, allowedToolsContextKey, tools)
+}
+
+// ToolAllowed 判断 Context 是否允许使用指定的工具，未设置限制时总是允许
+func ToolAllowed(ctx context.Context, name string) bool {
+	tools, ok := ctx.Value(allowedToolsContextKey).([]string)
+	return !ok || slices.Contains(tools, name)
+}
+
+// WithResponseFormat 返回一个新的 Context，要求模型按指定格式输出
+// format 可以是 "json" 或 JSON Schema，会作为请求的 format 字段发送
+func WithResponseFormat(ctx context.Context, format any) context.Context {
+	return context.WithValue(ctx, responseFormatContextKey, format)
+}
+
+// ResponseFormat 获取 Context 中指定的输出格式，未指定时返回 nil
+func ResponseFormat(ctx context.Context) any {
+	return ctx.Value(responseFormatContextKey)
+}
+
+// WithStop 为本次调用指定停止序列，覆盖 ollama.stop 配置的默认值；传入空切片表示不使用停止序列
+func WithStop(ctx context.Context, stop []string) context.Context {
+	return context.WithValue(ctx, stopContextKey, stop)
+}
+
+// WithSeed 为本次调用指定随机种子，覆盖 ollama.seed 配置的默认值
+func WithSeed(ctx context.Context, seed int) context.Context {
+	return context.WithValue(ctx, seedContextKey, seed)
+}
+
 // CallWithContext 是非流式调用的实现
 // ctx: 上下文，可包含追踪信息和动态模型选择
 // promptMessages: 对话消息历史
@@ -145,6 +418,7 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 		),
 	)
 	defer span.End()
+	promptMessages = requestMessages(promptMessages)
 
 	// 从 Context 中获取模型，如果存在则覆盖默认模型
 	model := o.model
@@ -153,13 +427,39 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 	}
 	span.SetAttributes(attribute.String("ollama.model", model))
 
-	Logger.Info().Str("model", model).Int("message_count", len(promptMessages)).Msg("Making API call")
+	options := o.generationOptions(ctx)
+	format := ResponseFormat(ctx)
+
+	// 命中缓存时直接返回（结构化输出请求不缓存）
+	var cacheKey string
+	if o.cacheable() && format == nil {
+		cacheKey = responseCacheKey(model, promptMessages, tools, options)
+		if cached, ok := o.cache.get(cacheKey); ok {
+			Logger.Debug().Ctx(ctx).Str("model", model).Msg("LLM response cache hit")
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			span.SetStatus(codes.Ok, "LLM call served from cache")
+			return cached, nil
+		}
+	}
+
+	Logger.Info().Ctx(ctx).Str("model", model).Int("message_count", len(promptMessages)).Msg("Making API call")
+	parent := ctx
+	if o.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.callTimeout)
+		defer cancel()
+	}
+	defer o.watchSlowCall(ctx, model, false)()
 	reqBody := ChatRequest{
 		Model:      model,
 		Messages:   promptMessages,
 		Tools:      tools,
 		ToolChoice: "auto",
 		Stream:     false, // 明确设置为非流式
+		Options:    options,
+		Format:     format,
+		KeepAlive:  o.keepAlive(),
+		Stop:       o.stopSequences(ctx),
 	}
 
 	// 序列化请求体
@@ -182,7 +482,11 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 	// 发送 HTTP 请求
 	resp, err := o.client.Do(req)
 	if err != nil {
-		Logger.Error().Err(err).Msg("HTTP request to Ollama failed")
+		// 区分单次调用超时与调用方取消，便于排查挂起的模型服务
+		if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("LLM call timed out after %s: %w", o.callTimeout, err)
+		}
+		Logger.Error().Ctx(ctx).Err(err).Msg("HTTP request to Ollama failed")
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "http request failed")
 		return nil, err
@@ -192,7 +496,7 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 	// 处理非 2xx 状态码的响应
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		err = fmt.Errorf("ollama error: %d %s", resp.StatusCode, string(body))
+		err = &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "ollama returned error status")
 		return nil, err
@@ -201,6 +505,9 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 	var finalResponse ChatResponse
 	// 反序列化响应体
 	if err := json.NewDecoder(resp.Body).Decode(&finalResponse); err != nil {
+		if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("LLM call timed out after %s: %w", o.callTimeout, err)
+		}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "response decode failed")
 		return nil, fmt.Errorf("failed to decode ollama response: %w", err)
@@ -218,6 +525,10 @@ func (o *OllamaClient) CallWithContext(ctx context.Context, promptMessages []Cha
 		}
 	}
 
+	if cacheKey != "" {
+		o.cache.put(cacheKey, &finalResponse)
+	}
+
 	span.SetStatus(codes.Ok, "LLM call successful")
 	return &finalResponse, nil
 }
@@ -286,6 +597,7 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 		),
 	)
 	defer span.End()
+	promptMessages = requestMessages(promptMessages)
 
 	// 从 Context 中获取模型，如果存在则覆盖默认模型
 	model := o.model
@@ -300,6 +612,10 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 		Tools:      tools,
 		ToolChoice: "auto",
 		Stream:     true, // 明确设置为流式
+		Options:    o.generationOptions(ctx),
+		Format:     ResponseFormat(ctx),
+		KeepAlive:  o.keepAlive(),
+		Stop:       o.stopSequences(ctx),
 	}
 
 	// 序列化请求体
@@ -310,6 +626,29 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 		return fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	// 流式调用的总时长取决于输出长度，因此 call_timeout_secs 只限制收到首个数据块之前的等待，
+	// 模型服务挂起时尽快失败，开始输出后只受 HTTP 客户端超时限制
+	// firstChunk: 0 等待首个数据块，1 已收到，2 已超时；两者只有一个能生效，避免刚开始输出就被取消
+	var firstChunk atomic.Int32
+	markFirstChunk := func() { firstChunk.CompareAndSwap(0, 1) }
+	if o.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		timer := time.AfterFunc(o.callTimeout, func() {
+			if firstChunk.CompareAndSwap(0, 2) {
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+	timeoutErr := func(err error) error {
+		if firstChunk.Load() == 2 {
+			return fmt.Errorf("LLM stream produced no output within %s: %w", o.callTimeout, err)
+		}
+		return err
+	}
+
 	// 创建 HTTP 请求
 	req, err := http.NewRequestWithContext(ctx, "POST", o.url, bytes.NewReader(bs))
 	if err != nil {
@@ -319,9 +658,13 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// 发送 HTTP 请求
+	// 发送 HTTP 请求，流式调用在收到响应头（模型开始输出）之前检测是否过慢
+	stopWatch := o.watchSlowCall(ctx, model, true)
 	resp, err := o.client.Do(req)
+	stopWatch()
 	if err != nil {
+		err = timeoutErr(err)
+		Logger.Error().Ctx(ctx).Err(err).Msg("HTTP stream request to Ollama failed")
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "http request failed")
 		return err
@@ -331,15 +674,16 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 	// 处理非 2xx 状态码的响应
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		err = fmt.Errorf("ollama error: %d %s", resp.StatusCode, string(body))
+		err = &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "ollama returned error status")
 		return err
 	}
 
-	// 将响应体直接复制到 writer，实现流式传输
-	_, err = io.Copy(writer, resp.Body)
+	// 将响应体直接复制到 writer，实现流式传输；读到第一个数据块后首块超时不再生效
+	_, err = io.Copy(writer, &firstReadNotifier{r: resp.Body, onFirst: markFirstChunk})
 	if err != nil {
+		err = timeoutErr(err)
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "stream copy failed")
 		return err
@@ -349,79 +693,95 @@ func (o *OllamaClient) StreamCallWithContext(ctx context.Context, promptMessages
 	return nil
 }
 
+// firstReadNotifier 在第一次读到数据时调用 onFirst
+type firstReadNotifier struct {
+	r       io.Reader
+	onFirst func()
+}
+
+func (f *firstReadNotifier) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.onFirst != nil {
+		f.onFirst()
+		f.onFirst = nil
+	}
+	return n, err
+}
+
 // Embed 获取文本的向量表示
+// 使用 embedding 配置中的模型和 API 路径，端点与对话服务相同
 // ctx: 上下文
 // text: 需要生成嵌入的文本
 func (o *OllamaClient) Embed(ctx context.Context, text string) ([]float64, error) {
-	ctx, span := tracer.Start(ctx, "OllamaClient.Embed",
-		trace.WithAttributes(
-			attribute.String("ollama.url", o.url),
-			attribute.Int("text.length", len(text)),
-		),
-	)
-	defer span.End()
-
-	// 从配置中获取嵌入模型和 API 路径
-	embedModel := o.cfg.Embedding.Model
-	embedAPIPath := o.cfg.Embedding.APIPath
+	return NewOllamaEmbedder(o.url, o.cfg.Embedding.APIPath, o.cfg.Embedding.Model, o.client).Embed(ctx, text)
+}
 
-	// 构建嵌入 API 的完整 URL
-	baseURL, err := url.Parse(o.url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse base ollama url: %w", err)
-	}
-	baseURL.Path = embedAPIPath
-	embedURL := baseURL.String()
+// ollamaTagsResponse 是 /api/tags 的响应结构，只保留需要的字段
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	} `json:"models"`
+}
 
-	reqBody := map[string]interface{}{
-		"model":  embedModel,
-		"prompt": text,
-	}
+// Model 返回客户端默认使用的模型名称
+func (o *OllamaClient) Model() string {
+	return o.model
+}
 
-	// 序列化请求体
-	bs, err := json.Marshal(reqBody)
+// ListModels 通过 /api/tags 获取 Ollama 服务上已安装的模型名称
+func (o *OllamaClient) ListModels(ctx context.Context) ([]string, error) {
+	u, err := url.Parse(o.url)
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "embed request marshal failed")
-		return nil, fmt.Errorf("failed to marshal embed request: %w", err)
+		return nil, fmt.Errorf("failed to parse ollama url: %w", err)
 	}
+	u.Path = "/api/tags"
+	u.RawQuery = ""
 
-	// 创建 HTTP 请求
-	req, err := http.NewRequestWithContext(ctx, "POST", embedURL, bytes.NewReader(bs))
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "embed request creation failed")
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// 发送 HTTP 请求
 	resp, err := o.client.Do(req)
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "embed http request failed")
 		return nil, err
 	}
 	defer resp.Body.Close()
-
-	// 处理非 2xx 状态码的响应
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		err = fmt.Errorf("ollama embed error: %d %s", resp.StatusCode, string(body))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "ollama embed returned error status")
-		return nil, err
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
-	var result struct {
-		Embedding []float64 `json:"embedding"` // 嵌入向量
+	var tags ollamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("failed to decode ollama tags: %w", err)
 	}
-	// 反序列化响应体
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "embed response decode failed")
-		return nil, err
+	names := make([]string, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		name := m.Name
+		if name == "" {
+			name = m.Model
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// HasModel 检查默认模型是否已安装在 Ollama 服务上
+// 未指定标签的模型名按 Ollama 的规则视为 ":latest"
+func (o *OllamaClient) HasModel(ctx context.Context) (bool, error) {
+	names, err := o.ListModels(ctx)
+	if err != nil {
+		return false, err
+	}
+	want := o.model
+	if !strings.Contains(want, ":") {
+		want += ":latest"
+	}
+	for _, name := range names {
+		if name == o.model || name == want {
+			return true, nil
+		}
 	}
-	span.SetStatus(codes.Ok, "Embedding successful")
-	return result.Embedding, nil
+	return false, nil
 }
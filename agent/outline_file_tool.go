@@ -0,0 +1,271 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// maxOutlineFileSize 是 outline_file 允许解析的最大文件大小，与 read_file 一致
+const maxOutlineFileSize = 10 * 1024 * 1024
+
+// OutlineFileArgs 定义了 outline_file 工具的参数结构
+type OutlineFileArgs struct {
+	Path      string `json:"path"`                // 文件路径
+	Workspace bool   `json:"workspace,omitempty"` // 为 true 时，path 相对于当前会话工作区解析
+}
+
+// outlineEntry 是大纲中的一条声明
+type outlineEntry struct {
+	Line   int    // 声明所在的行号，从 1 开始
+	Indent int    // 缩进层级，类的方法为 1
+	Text   string // 声明的简短描述，例如 "func (s *Server) Start(ctx context.Context) error"
+}
+
+// OutlineFileTool 只返回源文件的顶层声明及行号，便于模型在读取大文件前先了解结构
+type OutlineFileTool struct{}
+
+func (t *OutlineFileTool) Name() string { return "outline_file" }
+func (t *OutlineFileTool) Description() string {
+	return "Returns the outline of a Go or Python source file: top-level functions, types, classes (with their methods), constants and variables, each with its line number. Use this before read_file to navigate large files cheaply."
+}
+func (t *OutlineFileTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"path":      map[string]any{"type": "string", "description": "The path to the source file (.go or .py)."},
+			"workspace": map[string]any{"type": "boolean", "description": "Resolve the path inside the files the user uploaded to this session's workspace."},
+		},
+		"required": []string{"path"},
+	}
+}
+func (t *OutlineFileTool) IsSensitive() bool { return false }
+func (t *OutlineFileTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.OutlineFile")
+	defer span.End()
+
+	var args OutlineFileArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.String("path", args.Path), attribute.Bool("workspace", args.Workspace))
+
+	path := args.Path
+	if args.Workspace {
+		full, err := a.ResolveWorkspacePath(sessionID, args.Path)
+		if err != nil {
+			return "outline error: " + err.Error(), nil
+		}
+		path = full
+	}
+	return OutlineFile(path, args.Path), nil
+}
+
+// OutlineFile 读取源文件并生成大纲，错误以 "outline error:" 开头的文本返回给模型
+// path: 实际读取的文件路径
+// display: 大纲标题中显示的路径，避免向模型暴露工作区的绝对路径
+func OutlineFile(path, display string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "outline error: " + err.Error()
+	}
+	if info.IsDir() {
+		return "outline error: path is a directory"
+	}
+	if info.Size() > maxOutlineFileSize {
+		return "outline error: file too large (max 10MB)"
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return "outline error: " + err.Error()
+	}
+
+	var entries []outlineEntry
+	var lang, note string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".go":
+		lang = "go"
+		entries, err = outlineGo(src)
+		if err != nil {
+			// 语法错误时仍返回已解析出的部分声明
+			note = "parse error, outline may be incomplete: " + err.Error()
+		}
+	case ".py", ".pyw":
+		lang = "python"
+		entries = outlinePython(src)
+	default:
+		return fmt.Sprintf("outline error: unsupported file type %q, supported: .go, .py", filepath.Ext(path))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%s, %d lines)\n", display, lang, bytes.Count(src, []byte("\n"))+1)
+	if note != "" {
+		sb.WriteString(note + "\n")
+	}
+	if len(entries) == 0 {
+		sb.WriteString("(no top-level declarations)\n")
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&sb, "%5d: %s%s\n", e.Line, strings.Repeat("  ", e.Indent), e.Text)
+	}
+	return sb.String()
+}
+
+// outlineGo 使用 go/parser 提取 Go 文件的包名、函数、方法、类型、常量和变量声明
+func outlineGo(src []byte) ([]outlineEntry, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if file == nil {
+		return nil, err
+	}
+
+	var entries []outlineEntry
+	if file.Name != nil {
+		entries = append(entries, outlineEntry{Line: fset.Position(file.Package).Line, Text: "package " + file.Name.Name})
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			entries = append(entries, outlineEntry{Line: fset.Position(d.Pos()).Line, Text: goFuncSignature(fset, d)})
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					entries = append(entries, outlineEntry{Line: fset.Position(s.Pos()).Line, Text: "type " + s.Name.Name + goTypeKind(s)})
+				case *ast.ValueSpec:
+					names := make([]string, len(s.Names))
+					for i, n := range s.Names {
+						names[i] = n.Name
+					}
+					entries = append(entries, outlineEntry{Line: fset.Position(s.Pos()).Line, Text: d.Tok.String() + " " + strings.Join(names, ", ")})
+				}
+			}
+		}
+	}
+	return entries, err
+}
+
+// goFuncSignature 返回不含函数体的函数签名，例如 "func (s *Server) Start(ctx context.Context) error"
+func goFuncSignature(fset *token.FileSet, d *ast.FuncDecl) string {
+	var buf bytes.Buffer
+	buf.WriteString("func ")
+	if d.Recv != nil && len(d.Recv.List) > 0 {
+		recv := d.Recv.List[0]
+		buf.WriteString("(")
+		if len(recv.Names) > 0 {
+			buf.WriteString(recv.Names[0].Name + " ")
+		}
+		printer.Fprint(&buf, fset, recv.Type)
+		buf.WriteString(") ")
+	}
+	buf.WriteString(d.Name.Name)
+	var sig bytes.Buffer
+	printer.Fprint(&sig, fset, d.Type)
+	buf.WriteString(strings.TrimPrefix(sig.String(), "func"))
+	return buf.String()
+}
+
+// goTypeKind 返回类型声明的种类描述，例如 " struct"、" interface" 或 " = Other"
+func goTypeKind(s *ast.TypeSpec) string {
+	if s.Assign.IsValid() {
+		return " = " + goExprString(s.Type)
+	}
+	switch s.Type.(type) {
+	case *ast.StructType:
+		return " struct"
+	case *ast.InterfaceType:
+		return " interface"
+	case *ast.FuncType:
+		return " func"
+	}
+	return " " + goExprString(s.Type)
+}
+
+// goExprString 将类型表达式格式化为源码文本
+func goExprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+var (
+	// pyDefRe 匹配 Python 的函数和类定义，捕获缩进、关键字、名称和参数/基类的开头部分
+	pyDefRe = regexp.MustCompile(`^([ \t]*)(async\s+def|def|class)\s+(\w+)\s*(\([^)]*\)?)?`)
+	// pyConstRe 匹配顶层的大写常量赋值
+	pyConstRe = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\s*(?::[^=]+)?=[^=]`)
+)
+
+// outlinePython 使用正则提取 Python 文件的顶层函数、类、类的方法和大写常量
+// 嵌套在函数内部的定义会被忽略，三引号字符串中的内容也不会被误判为声明
+func outlinePython(src []byte) []outlineEntry {
+	var entries []outlineEntry
+	classIndent := -1 // 当前所在顶层类的方法缩进，-1 表示不在类中
+	inString := ""    // 当前所在的三引号字符串分隔符
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if inString != "" {
+			if strings.Count(line, inString)%2 == 1 {
+				inString = ""
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		if indent == 0 {
+			classIndent = -1
+		}
+		if m := pyDefRe.FindStringSubmatch(line); m != nil {
+			switch {
+			case indent == 0:
+				entries = append(entries, outlineEntry{Line: i + 1, Text: pyDefText(m)})
+				if m[2] == "class" {
+					classIndent = 0
+				}
+			case classIndent == 0 || indent == classIndent:
+				// 类体中第一个定义决定方法的缩进
+				classIndent = indent
+				entries = append(entries, outlineEntry{Line: i + 1, Indent: 1, Text: pyDefText(m)})
+			}
+		} else if indent == 0 {
+			if m := pyConstRe.FindStringSubmatch(line); m != nil {
+				entries = append(entries, outlineEntry{Line: i + 1, Text: m[1] + " = ..."})
+			}
+		}
+
+		for _, q := range []string{`"""`, `'''`} {
+			if strings.Count(line, q)%2 == 1 {
+				inString = q
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// pyDefText 格式化 Python 定义，例如 "def load(path, *, strict=False)" 或 "class Server(Base)"
+func pyDefText(m []string) string {
+	kw := strings.Join(strings.Fields(m[2]), " ")
+	params := m[4]
+	if params != "" && !strings.HasSuffix(params, ")") {
+		params += "...)" // 参数跨多行
+	}
+	return kw + " " + m[3] + params
+}
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ErrReindexRunning 表示已有重建索引任务在运行
+var ErrReindexRunning = errors.New("reindex is already running")
+
+// ReindexStatus 记录后台重建索引任务的进度
+type ReindexStatus struct {
+	Status     string     `json:"status"`                // 任务状态，取值同入库任务；从未运行时为空
+	Model      string     `json:"model,omitempty"`       // 本次使用的嵌入模型
+	Total      int        `json:"total"`                 // 需要重新嵌入的文档数量
+	Completed  int        `json:"completed"`             // 已成功重新嵌入的文档数量
+	Failed     int        `json:"failed"`                // 重新嵌入失败的文档数量
+	Error      string     `json:"error,omitempty"`       // 失败原因
+	StartedAt  *time.Time `json:"started_at,omitempty"`  // 开始时间
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // 结束时间
+}
+
+// maxReindexCatchUpRounds 是进入屏障前补充嵌入新增文档的最大轮数
+const maxReindexCatchUpRounds = 3
+
+// reindexer 保证同一时间只有一个重建索引任务，并保存最近一次任务的状态
+type reindexer struct {
+	mu     sync.Mutex
+	status ReindexStatus
+	// writes 是入库、删除与切换之间的屏障：入库和删除修改向量库时持有读锁，
+	// 重建索引在最后一次对比和 Replace 期间持有写锁，保证切换时不会丢失新入库的文档，也不会写回已删除的文档
+	writes sync.RWMutex
+}
+
+// update 在锁内修改任务状态
+func (r *reindexer) update(fn func(*ReindexStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.status)
+}
+
+// ReindexStatus 返回最近一次重建索引任务的状态
+func (a *Agent) ReindexStatus() ReindexStatus {
+	a.reindex.mu.Lock()
+	defer a.reindex.mu.Unlock()
+	return a.reindex.status
+}
+
+// StartReindex 在后台用当前嵌入模型重新嵌入向量库中的所有文档，全部成功后通过 Replace 原子切换。
+// 任一文档嵌入失败时放弃本次重建，保留旧数据，避免新旧模型的向量混在一起。
+// 已有任务在运行时返回 ErrReindexRunning；ctx 取消后任务停止并保留旧数据。
+func (a *Agent) StartReindex(ctx context.Context) (ReindexStatus, error) {
+	a.reindex.mu.Lock()
+	defer a.reindex.mu.Unlock()
+	if a.reindex.status.Status == IngestStatusRunning {
+		return a.reindex.status, ErrReindexRunning
+	}
+	now := time.Now()
+	a.reindex.status = ReindexStatus{Status: IngestStatusRunning, Model: a.config.Embedding.Model, StartedAt: &now}
+
+	go func() {
+		err := a.runReindex(ctx)
+		a.reindex.update(func(s *ReindexStatus) {
+			finished := time.Now()
+			s.FinishedAt = &finished
+			s.Status = IngestStatusCompleted
+			if err != nil {
+				s.Status = IngestStatusFailed
+				s.Error = err.Error()
+			}
+		})
+	}()
+	return a.reindex.status, nil
+}
+
+// runReindex 执行重建索引。重新嵌入期间新入库的文档会反复对比并补充嵌入，
+// 最后一次对比和切换在屏障内进行，期间的入库和删除会等待切换完成
+func (a *Agent) runReindex(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Agent.Reindex")
+	defer span.End()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("reindex panicked: %v", p)
+		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			Logger.Error().Ctx(ctx).Err(err).Msg("Reindex failed")
+		}
+	}()
+
+	docs, err := a.snapshotDocuments()
+	if err != nil {
+		return err
+	}
+	a.reindex.update(func(s *ReindexStatus) { s.Total = len(docs) })
+	Logger.Info().Ctx(ctx).Int("documents", len(docs)).Str("model", a.config.Embedding.Model).Msg("Reindex started")
+
+	if err := a.reembedDocuments(ctx, docs); err != nil {
+		return err
+	}
+	done := make(map[string]Document, len(docs))
+	for _, doc := range docs {
+		done[doc.ID] = doc
+	}
+
+	// 在屏障外补充嵌入重新嵌入期间新增的文档，直到没有新增，使屏障内需要嵌入的文档尽量少
+	for round := 0; round < maxReindexCatchUpRounds; round++ {
+		_, added, err := a.reindexCatchUp(ctx, done)
+		if err != nil {
+			return err
+		}
+		if added == 0 {
+			break
+		}
+	}
+
+	a.reindex.writes.Lock()
+	defer a.reindex.writes.Unlock()
+	result, added, err := a.reindexCatchUp(ctx, done)
+	if err != nil {
+		return err
+	}
+	if err := a.vectorStore.Replace(result); err != nil {
+		return fmt.Errorf("swap in reindexed store: %w", err)
+	}
+	span.SetAttributes(attribute.Int("documents", len(result)), attribute.Int("added_during_swap", added))
+	span.SetStatus(codes.Ok, "Reindex finished")
+	Logger.Info().Ctx(ctx).Int("documents", len(result)).Msg("Reindex finished")
+	return nil
+}
+
+// reindexCatchUp 对比向量库当前的文档与已重新嵌入的文档 done：重新嵌入新增的文档并加入 done，
+// 返回按存储顺序排列的当前文档（均为重新嵌入后的版本，已删除的文档不在其中）以及本轮新增的数量
+func (a *Agent) reindexCatchUp(ctx context.Context, done map[string]Document) ([]Document, int, error) {
+	current, err := a.snapshotDocuments()
+	if err != nil {
+		return nil, 0, err
+	}
+	var added []Document
+	for _, doc := range current {
+		if _, ok := done[doc.ID]; !ok {
+			added = append(added, doc)
+		}
+	}
+	if len(added) > 0 {
+		a.reindex.update(func(s *ReindexStatus) { s.Total += len(added) })
+		if err := a.reembedDocuments(ctx, added); err != nil {
+			return nil, 0, err
+		}
+		for _, doc := range added {
+			done[doc.ID] = doc
+		}
+	}
+	for i, doc := range current {
+		current[i] = done[doc.ID]
+	}
+	return current, len(added), nil
+}
+
+// snapshotDocuments 返回向量库中所有文档的副本
+func (a *Agent) snapshotDocuments() ([]Document, error) {
+	var docs []Document
+	err := a.vectorStore.Scan(func(doc Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return docs, err
+}
+
+// reembedDocuments 使用入库工作池原地重新嵌入 docs，任一文档失败或 ctx 取消时返回错误
+func (a *Agent) reembedDocuments(ctx context.Context, docs []Document) error {
+	numWorkers := a.config.Ingest.Workers
+	if numWorkers <= 0 {
+		numWorkers = DefaultIngestWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int, len(docs))
+	for i := range docs {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				vec, err := a.embedChunk(ctx, docs[i].Content)
+				if err != nil {
+					a.reindex.update(func(s *ReindexStatus) { s.Failed++ })
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("re-embed document %s: %w", docs[i].ID, err)
+						cancel()
+					})
+					return
+				}
+				docs[i].Embedding = vec
+				a.reindex.update(func(s *ReindexStatus) { s.Completed++ })
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// responseCache 是一个带 TTL 的有界 LRU 缓存，用于缓存确定性（temperature 为 0）的模型响应
+type responseCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration            // 缓存条目的存活时间
+	maxEntries int                      // 最大缓存条目数
+	ll         *list.List               // LRU 链表，最近使用的在前
+	items      map[string]*list.Element // 缓存键到链表节点的映射
+}
+
+// responseCacheEntry 是缓存中的单个条目
+type responseCacheEntry struct {
+	key       string
+	resp      ChatResponse
+	expiresAt time.Time
+}
+
+// newResponseCache 创建一个新的响应缓存
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// responseCacheKey 根据模型、消息、工具和生成参数计算缓存键
+// 消息的时间戳不影响模型输出，计算前会被清除
+func responseCacheKey(model string, messages []ChatMessage, tools any, options map[string]any) string {
+	msgs := make([]ChatMessage, len(messages))
+	for i, m := range messages {
+		m.Timestamp = time.Time{}
+		msgs[i] = m
+	}
+	data, _ := json.Marshal(struct {
+		Model    string         `json:"model"`
+		Messages []ChatMessage  `json:"messages"`
+		Tools    any            `json:"tools"`
+		Options  map[string]any `json:"options"`
+	}{model, msgs, tools, options})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get 返回未过期的缓存响应副本
+func (c *responseCache) get(key string) (*ChatResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*responseCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return copyChatResponse(entry.resp), true
+}
+
+// put 写入缓存，超过容量时淘汰最久未使用的条目
+func (c *responseCache) put(key string, resp *ChatResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &responseCacheEntry{key: key, resp: *copyChatResponse(*resp), expiresAt: time.Now().Add(c.ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+// copyChatResponse 复制响应，避免调用方修改缓存中的数据
+func copyChatResponse(resp ChatResponse) *ChatResponse {
+	out := ChatResponse{Choices: make([]Choice, len(resp.Choices))}
+	copy(out.Choices, resp.Choices)
+	return &out
+}
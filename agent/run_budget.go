@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+)
+
+// runOutputBudget 记录一次 Agent 运行中累计加入对话的工具输出量，防止多次工具调用撑爆上下文和会话存储
+type runOutputBudget struct {
+	maxToolChars   int // 一次运行允许累计的工具输出字符数，0 表示不限制
+	maxAnswerChars int // 最终回答允许的最大字符数，0 表示不限制
+	usedToolChars  int // 已累计的工具输出字符数
+}
+
+// newRunOutputBudget 按配置创建一次运行的输出预算
+func (a *Agent) newRunOutputBudget() *runOutputBudget {
+	return &runOutputBudget{
+		maxToolChars:   a.config.Agent.MaxRunToolOutputChars,
+		maxAnswerChars: a.config.Agent.MaxAnswerChars,
+	}
+}
+
+// applyToolResults 按剩余预算截断工具结果，预算用完后的结果只保留说明，让模型基于已有信息作答
+func (b *runOutputBudget) applyToolResults(ctx context.Context, results []ChatMessage) []ChatMessage {
+	if b.maxToolChars <= 0 {
+		return results
+	}
+	for i, res := range results {
+		n := utf8.RuneCountInString(res.Content)
+		remaining := b.maxToolChars - b.usedToolChars
+		switch {
+		case remaining <= 0:
+			results[i].Content = fmt.Sprintf("[tool output omitted: this run reached its limit of %d characters of tool output. Answer with the information already gathered instead of calling more tools.]", b.maxToolChars)
+		case n > remaining:
+			results[i].Content = truncateRunes(res.Content, remaining) + fmt.Sprintf("\n[tool output truncated: this run reached its limit of %d characters of tool output]", b.maxToolChars)
+		default:
+			b.usedToolChars += n
+			continue
+		}
+		b.usedToolChars = b.maxToolChars
+		Logger.Warn().Ctx(ctx).Str("tool", res.Name).Int("chars", n).Int("limit", b.maxToolChars).Msg("Run tool output limit reached, tool result shortened")
+	}
+	return results
+}
+
+// applyAnswer 截断超出上限的最终回答
+func (b *runOutputBudget) applyAnswer(ctx context.Context, answer string) (string, bool) {
+	if b.maxAnswerChars <= 0 || utf8.RuneCountInString(answer) <= b.maxAnswerChars {
+		return answer, false
+	}
+	Logger.Warn().Ctx(ctx).Int("chars", utf8.RuneCountInString(answer)).Int("limit", b.maxAnswerChars).Msg("Final answer exceeds limit, truncating")
+	return truncateRunes(answer, b.maxAnswerChars) + fmt.Sprintf("\n\n[回答已截断：超过 %d 个字符的上限]", b.maxAnswerChars), true
+}
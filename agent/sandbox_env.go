@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// 传入代码沙箱的环境变量限制
+const (
+	sandboxMaxEnvVars  = 32       // 最多允许传入的环境变量数量
+	sandboxMaxEnvBytes = 16 << 10 // 所有环境变量名和值的总字节数上限
+)
+
+// sandboxEnvNamePattern 限制环境变量名只能由字母、数字和下划线组成，且不能以数字开头
+var sandboxEnvNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sandboxDeniedEnv 是禁止覆盖的环境变量，它们会改变解释器、动态链接器或 shell 的行为
+var sandboxDeniedEnv = []string{
+	"PATH", "HOME", "SHELL", "USER", "HOSTNAME", "IFS", "ENV", "BASH_ENV", "PS4",
+	"PYTHONPATH", "PYTHONHOME", "PYTHONSTARTUP", "PYTHONINSPECT",
+	"GOROOT", "GOPATH", "GOFLAGS", "GOTOOLCHAIN", "GOPROXY",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY",
+}
+
+// sandboxDeniedEnvPrefixes 是禁止使用的环境变量名前缀
+var sandboxDeniedEnvPrefixes = []string{"LD_", "DYLD_", "DOCKER_"}
+
+// sandboxEnvArgs 校验传入沙箱的环境变量，并返回按名称排序的 docker `-e KEY=VALUE` 参数
+func sandboxEnvArgs(env map[string]string) ([]string, error) {
+	if len(env) == 0 {
+		return nil, nil
+	}
+	if len(env) > sandboxMaxEnvVars {
+		return nil, fmt.Errorf("too many env vars: %d (max %d)", len(env), sandboxMaxEnvVars)
+	}
+
+	names := make([]string, 0, len(env))
+	size := 0
+	for name, value := range env {
+		if !sandboxEnvNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid env var name '%s'", name)
+		}
+		upper := strings.ToUpper(name)
+		if slices.Contains(sandboxDeniedEnv, upper) || slices.ContainsFunc(sandboxDeniedEnvPrefixes, func(p string) bool {
+			return strings.HasPrefix(upper, p)
+		}) {
+			return nil, fmt.Errorf("env var '%s' is not allowed", name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("env var '%s' contains a NUL byte", name)
+		}
+		size += len(name) + len(value)
+		names = append(names, name)
+	}
+	if size > sandboxMaxEnvBytes {
+		return nil, fmt.Errorf("env vars too large: %d bytes (max %d)", size, sandboxMaxEnvBytes)
+	}
+
+	slices.Sort(names)
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, "-e", name+"="+env[name])
+	}
+	return args, nil
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sandboxLanguage 描述代码沙箱中一种语言的入口文件、镜像和运行命令
+type sandboxLanguage struct {
+	MainFile    string            // 代码写入的入口文件名
+	Image       string            // 默认使用的 docker 镜像，可通过 sandbox.images 覆盖
+	Command     string            // 在 /work 下执行的运行命令
+	LintCommand string            // lint_code 使用的静态检查命令，只检查和编译，不运行程序
+	ExtraFiles  map[string]string // 运行前需要额外写入的文件，例如 go.mod
+}
+
+// sandboxLanguages 是 run_code 支持的语言
+var sandboxLanguages = map[string]sandboxLanguage{
+	// 镜像中安装了 ruff 时额外运行 ruff，否则只做语法编译检查
+	"python": {MainFile: "main.py", Image: "python:3.11", Command: "python3 main.py",
+		LintCommand: "python3 -m py_compile main.py && if command -v ruff >/dev/null; then ruff check --no-cache --output-format=concise .; fi"},
+	"go": {MainFile: "main.go", Image: "golang:1.22", Command: "go run .",
+		LintCommand: "gofmt -l . | sed \"s/$/: warning: file is not gofmt-formatted/\"; go vet ./...",
+		ExtraFiles:  map[string]string{"go.mod": "module sandbox\n\ngo 1.20\n"}},
+	"ruby": {MainFile: "main.rb", Image: "ruby:3.3", Command: "ruby main.rb", LintCommand: "ruby -wc main.rb"},
+	"rust": {MainFile: "main.rs", Image: "rust:1.79", Command: "rustc -O -o /tmp/main main.rs && /tmp/main",
+		LintCommand: "rustc --edition 2021 --error-format=short --emit=metadata -o /tmp/main.rmeta main.rs"},
+	"java": {MainFile: "Main.java", Image: "eclipse-temurin:21", Command: "java Main.java",
+		LintCommand: "javac -Xlint:all -d /tmp/classes *.java"},
+}
+
+// sandboxLanguageAliases 将常见的别名映射到 sandboxLanguages 中的名称
+var sandboxLanguageAliases = map[string]string{
+	"py":      "python",
+	"python3": "python",
+	"golang":  "go",
+	"rb":      "ruby",
+	"rs":      "rust",
+}
+
+// lookupSandboxLanguage 按名称（不区分大小写，支持别名）查找语言，并应用配置中覆盖的镜像
+func lookupSandboxLanguage(name string, images map[string]string) (string, sandboxLanguage, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := sandboxLanguageAliases[name]; ok {
+		name = alias
+	}
+	lang, ok := sandboxLanguages[name]
+	if !ok {
+		return "", sandboxLanguage{}, fmt.Errorf("unsupported language '%s'; supported languages: %s", name, strings.Join(supportedSandboxLanguages(), ", "))
+	}
+	if image := images[name]; image != "" {
+		lang.Image = image
+	}
+	return name, lang, nil
+}
+
+// supportedSandboxLanguages 返回按名称排序的支持语言列表
+func supportedSandboxLanguages() []string {
+	names := make([]string, 0, len(sandboxLanguages))
+	for name := range sandboxLanguages {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
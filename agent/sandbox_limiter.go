@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSandboxAcquireTimeoutSecs 是等待代码沙箱空闲槽位的默认超时（秒）
+const DefaultSandboxAcquireTimeoutSecs = 30
+
+// SandboxStats 是代码沙箱并发槽位的使用统计
+type SandboxStats struct {
+	MaxConcurrency int     `json:"max_concurrency"` // 最大并发执行数
+	Running        int     `json:"running"`         // 正在执行的数量
+	Waiting        int64   `json:"waiting"`         // 正在排队等待槽位的数量
+	Runs           int64   `json:"runs"`            // 成功获取槽位的总次数
+	Timeouts       int64   `json:"timeouts"`        // 等待超时而被拒绝的总次数
+	AvgWaitMs      float64 `json:"avg_wait_ms"`     // 成功获取槽位前的平均等待时间（毫秒）
+	MaxWaitMs      int64   `json:"max_wait_ms"`     // 成功获取槽位前的最长等待时间（毫秒）
+}
+
+// sandboxLimiter 限制所有 Agent 共享的代码沙箱并发数，并记录排队情况
+type sandboxLimiter struct {
+	slots     chan struct{}
+	waiting   atomic.Int64
+	runs      atomic.Int64
+	timeouts  atomic.Int64
+	waitTotal atomic.Int64 // 累计等待时间 (ns)
+	waitMax   atomic.Int64 // 最长等待时间 (ns)
+}
+
+var (
+	sandboxLimiterOnce sync.Once
+	sandboxSlots       *sandboxLimiter
+)
+
+// getSandboxLimiter 返回全局沙箱限制器，首次调用时按配置的并发数创建
+func getSandboxLimiter(maxConcurrency int) *sandboxLimiter {
+	sandboxLimiterOnce.Do(func() {
+		if maxConcurrency <= 0 {
+			maxConcurrency = 5
+		}
+		sandboxSlots = &sandboxLimiter{slots: make(chan struct{}, maxConcurrency)}
+	})
+	return sandboxSlots
+}
+
+// acquire 在 timeout 内等待一个空闲槽位，返回等待时长以及是否成功
+// timeout<=0 表示一直等待。成功时调用方必须在执行结束后调用 release
+func (l *sandboxLimiter) acquire(timeout time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		l.recordWait(time.Since(start))
+		return time.Since(start), true
+	default:
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		wait := time.Since(start)
+		l.recordWait(wait)
+		return wait, true
+	case <-expired:
+		l.timeouts.Add(1)
+		return time.Since(start), false
+	}
+}
+
+// release 释放一个槽位
+func (l *sandboxLimiter) release() {
+	<-l.slots
+}
+
+// recordWait 记录一次成功获取槽位的等待时间
+func (l *sandboxLimiter) recordWait(wait time.Duration) {
+	l.runs.Add(1)
+	l.waitTotal.Add(int64(wait))
+	for {
+		cur := l.waitMax.Load()
+		if int64(wait) <= cur || l.waitMax.CompareAndSwap(cur, int64(wait)) {
+			return
+		}
+	}
+}
+
+// stats 返回当前的使用统计
+func (l *sandboxLimiter) stats() SandboxStats {
+	s := SandboxStats{
+		MaxConcurrency: cap(l.slots),
+		Running:        len(l.slots),
+		Waiting:        l.waiting.Load(),
+		Runs:           l.runs.Load(),
+		Timeouts:       l.timeouts.Load(),
+		MaxWaitMs:      time.Duration(l.waitMax.Load()).Milliseconds(),
+	}
+	if s.Runs > 0 {
+		s.AvgWaitMs = float64(time.Duration(l.waitTotal.Load()/s.Runs).Microseconds()) / 1000
+	}
+	return s
+}
+
+// SandboxStats 返回代码沙箱的并发槽位统计，沙箱限制器由所有 Agent 共享
+func (a *Agent) SandboxStats() SandboxStats {
+	return getSandboxLimiter(a.config.Sandbox.MaxConcurrency).stats()
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	sessionSummaryMaxChars  = 1000            // 会话摘要的最大字符数
+	sessionSummaryMsgChars  = 500             // 生成摘要时每条消息保留的最大字符数
+	sessionSummaryTimeout   = 2 * time.Minute // 单个会话摘要的模型调用超时
+	DefaultIdleCheckMinutes = 10              // 检查闲置会话的默认间隔（分钟）
+)
+
+// SessionSummaryPromptData 是会话摘要提示词模板的数据
+type SessionSummaryPromptData struct {
+	Transcript string // 对话记录
+	MaxChars   int    // 摘要的最大字符数
+}
+
+// StartIdleSessionArchiver 启动后台协程，定期将闲置超过 idle 的会话生成摘要并归档
+// 归档后内存中只保留摘要和元数据，会话恢复使用时再从会话文件加载消息。ctx 取消后协程退出
+func (a *Agent) StartIdleSessionArchiver(ctx context.Context, idle, interval time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultIdleCheckMinutes * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.archiveIdleSessions(ctx, idle)
+			}
+		}
+	}()
+	Logger.Info().Dur("idle", idle).Dur("interval", interval).Msg("Idle session archiver started")
+}
+
+// archiveIdleSessions 归档一轮闲置会话，单个会话失败不影响其他会话
+func (a *Agent) archiveIdleSessions(ctx context.Context, idle time.Duration) {
+	defer func() {
+		if p := recover(); p != nil {
+			Logger.Error().Interface("panic", p).Bytes("stack", debug.Stack()).Msg("Recovered from panic in idle session archiver")
+		}
+	}()
+	for id, lastActiveAt := range a.mem.IdleSessions(time.Now().Add(-idle)) {
+		if ctx.Err() != nil {
+			return
+		}
+		summary, err := a.summarizeSession(ctx, id)
+		if err != nil {
+			// 摘要失败时仍然归档以释放内存，保留已有摘要
+			Logger.Warn().Err(err).Str("session_id", id).Msg("Failed to summarize idle session, archiving without new summary")
+			meta, _, _ := a.mem.GetSessionMeta(id)
+			summary = meta.Summary
+		}
+		a.mem.ArchiveSession(id, summary, lastActiveAt)
+		Logger.Info().Str("session_id", id).Time("last_active_at", lastActiveAt).Msg("Archived idle session")
+	}
+}
+
+// summarizeSession 调用模型总结会话中的用户和助手消息
+func (a *Agent) summarizeSession(ctx context.Context, sessionID string) (string, error) {
+	msgs, ok := a.mem.GetSessionMessages(sessionID)
+	if !ok {
+		return "", ErrSessionNotFound
+	}
+	var sb strings.Builder
+	for _, msg := range msgs {
+		if (msg.Role != "user" && msg.Role != "assistant") || strings.TrimSpace(msg.Content) == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", msg.Role, truncateRunes(msg.Content, sessionSummaryMsgChars))
+	}
+	if sb.Len() == 0 {
+		return "", nil
+	}
+
+	prompt, err := a.prompts.Render("session_summary", SessionSummaryPromptData{Transcript: sb.String(), MaxChars: sessionSummaryMaxChars})
+	if err != nil {
+		return "", fmt.Errorf("render session summary prompt: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, sessionSummaryTimeout)
+	defer cancel()
+	resp, err := a.llm.CallWithContext(ctx, []ChatMessage{{Role: "user", Content: prompt}}, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("empty summary response")
+	}
+	return truncateRunes(strings.TrimSpace(resp.Choices[0].Message.Content), sessionSummaryMaxChars), nil
+}
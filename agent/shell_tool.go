@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// shell_cmd 工具的限制
+const (
+	shellCmdDefaultTimeout = 60   // 默认超时（秒）
+	shellCmdMaxTimeout     = 600  // 最大超时（秒）
+	shellCmdMaxOutput      = 8000 // 返回给模型的 stdout/stderr 最大字符数
+)
+
+// ShellCmdArgs 定义了 shell_cmd 工具的参数结构
+type ShellCmdArgs struct {
+	Cmd     []string `json:"cmd"`               // 命令及其参数，第一个元素必须在允许列表中
+	Workdir string   `json:"workdir,omitempty"` // 相对于会话工作区的工作目录，可选
+	Timeout int      `json:"timeout,omitempty"` // 超时时间（秒），可选
+}
+
+// ShellCmdTool 在会话工作区中执行允许列表内的命令（例如 make、go build、npm install）
+// 允许列表为空时该工具被禁用
+// 注意：命令直接在宿主机上执行，而不是在 run_code 的 docker 沙箱中；make、npm install 等命令会运行工作区中的代码，
+// 因此只向子进程传递最小的环境变量（PATH、指向工作区的 HOME、LANG），避免泄露服务进程环境中的密钥
+type ShellCmdTool struct{}
+
+func (t *ShellCmdTool) Name() string { return "shell_cmd" }
+func (t *ShellCmdTool) Description() string {
+	return "Runs a build or test command (e.g. make, go build, npm install) inside this session's workspace on the host (not in the code sandbox). Only commands on the operator's allow-list are permitted; arguments are passed directly without a shell, and only PATH, HOME (the workspace) and LANG are set in the environment."
+}
+func (t *ShellCmdTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"cmd":     map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "The command and its arguments, e.g. [\"go\", \"test\", \"./...\"]."},
+			"workdir": map[string]any{"type": "string", "description": "Working directory relative to the session workspace."},
+			"timeout": map[string]any{"type": "integer", "description": "Timeout in seconds."},
+		},
+		"required": []string{"cmd"},
+	}
+}
+func (t *ShellCmdTool) IsSensitive() bool { return true }
+func (t *ShellCmdTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	ctx, span := tracer.Start(ctx, "Tool.ShellCmd")
+	defer span.End()
+
+	var args ShellCmdArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.StringSlice("cmd", args.Cmd), attribute.String("workdir", args.Workdir))
+
+	if len(args.Cmd) == 0 {
+		return "shell error: cmd empty", nil
+	}
+	// 只比较基础命令名，拒绝带路径的命令，防止绕过允许列表
+	if strings.ContainsAny(args.Cmd[0], `/\`) || !slices.Contains(a.config.ShellCmd.AllowedCommands, args.Cmd[0]) {
+		return fmt.Sprintf("shell error: command '%s' not allowed", args.Cmd[0]), nil
+	}
+
+	workdir, err := a.ResolveWorkspacePath(sessionID, args.Workdir)
+	if err != nil {
+		return "shell error: " + err.Error(), nil
+	}
+	if err := os.MkdirAll(workdir, 0o755); err != nil {
+		return "", fmt.Errorf("mkdir error: %v", err)
+	}
+
+	timeout := a.config.ShellCmd.DefaultTimeout
+	if timeout <= 0 {
+		timeout = shellCmdDefaultTimeout
+	}
+	maxTimeout := a.config.ShellCmd.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = shellCmdMaxTimeout
+	}
+	if args.Timeout > 0 {
+		timeout = args.Timeout
+	}
+	timeout = min(timeout, maxTimeout)
+
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	home, err := a.ResolveWorkspacePath(sessionID, "")
+	if err != nil {
+		return "shell error: " + err.Error(), nil
+	}
+	cmd := exec.CommandContext(runCtx, args.Cmd[0], args.Cmd[1:]...)
+	cmd.Dir = workdir
+	cmd.Env = shellCmdEnv(home)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			if runCtx.Err() == context.DeadlineExceeded {
+				return fmt.Sprintf("shell error: command timed out after %ds\nstdout:\n%s\nstderr:\n%s",
+					timeout, truncateString(stdout.String(), shellCmdMaxOutput), truncateString(stderr.String(), shellCmdMaxOutput)), nil
+			}
+			return "shell error: " + err.Error(), nil
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	span.SetAttributes(attribute.Int("exit_code", exitCode))
+
+	return fmt.Sprintf("exit code: %d\nstdout:\n%s\nstderr:\n%s",
+		exitCode, truncateString(stdout.String(), shellCmdMaxOutput), truncateString(stderr.String(), shellCmdMaxOutput)), nil
+}
+
+// shellCmdEnv 返回 shell_cmd 子进程的环境变量：只保留 PATH 用于查找命令，HOME 指向会话工作区，
+// 服务进程中的 API 密钥、令牌等其他变量一律不传递
+func shellCmdEnv(home string) []string {
+	return []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + home,
+		"LANG=C.UTF-8",
+	}
+}
@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultStructuredOutputRetries 是结构化输出校验失败时的默认修复次数
+const DefaultStructuredOutputRetries = 2
+
+const responseSchemaContextKey contextKey = "response_schema"
+
+// WithResponseSchema 返回一个新的 Context，要求本次运行的最终回答为符合 schema 的 JSON
+// Agent 会在运行时注入格式说明，调用方应在运行结束后使用 EnforceResponseSchema 校验和修复结果
+func WithResponseSchema(ctx context.Context, schema map[string]any) context.Context {
+	return context.WithValue(ctx, responseSchemaContextKey, schema)
+}
+
+// ResponseSchema 获取 Context 中的响应 JSON Schema，未设置时返回 nil
+func ResponseSchema(ctx context.Context) map[string]any {
+	schema, _ := ctx.Value(responseSchemaContextKey).(map[string]any)
+	return schema
+}
+
+// StructuredOutputPromptData 是结构化输出相关模板的数据上下文
+type StructuredOutputPromptData struct {
+	Schema string // 缩进格式的 JSON Schema
+	Error  string // 校验错误（仅修复模板使用）
+	Answer string // 原始回答（仅修复模板使用）
+}
+
+// injectResponseSchema 在用户消息之前插入结构化输出说明，该消息不会持久化到会话
+func (a *Agent) injectResponseSchema(messages []ChatMessage, schema map[string]any) []ChatMessage {
+	if schema == nil || len(messages) == 0 {
+		return messages
+	}
+	bs, _ := json.MarshalIndent(schema, "", "  ")
+	instruction, err := a.prompts.Render("structured_output", StructuredOutputPromptData{Schema: string(bs)})
+	if err != nil {
+		Logger.Warn().Err(err).Msg("Failed to render structured output prompt")
+		return messages
+	}
+	last := len(messages) - 1
+	out := make([]ChatMessage, 0, len(messages)+1)
+	out = append(out, messages[:last]...)
+	out = append(out, ChatMessage{Role: "system", Content: instruction}, messages[last])
+	return out
+}
+
+// EnforceResponseSchema 校验回答是否为符合 schema 的 JSON，不符合时以 format 约束调用模型修复
+// 最多修复 agent.structured_output_retries 次，仍失败时返回最后一次的校验错误
+func (a *Agent) EnforceResponseSchema(ctx context.Context, answer string, schema map[string]any) (json.RawMessage, error) {
+	ctx, span := tracer.Start(ctx, "Agent.EnforceResponseSchema")
+	defer span.End()
+
+	retries := a.config.Agent.StructuredOutputRetries
+	if retries < 0 {
+		retries = 0
+	}
+	schemaJSON, _ := json.MarshalIndent(schema, "", "  ")
+
+	for attempt := 0; ; attempt++ {
+		data, err := parseStructuredAnswer(answer, schema)
+		if err == nil {
+			return data, nil
+		}
+		if attempt >= retries {
+			span.RecordError(err)
+			return nil, fmt.Errorf("answer does not match response schema: %w", err)
+		}
+		Logger.Warn().Ctx(ctx).Err(err).Int("attempt", attempt+1).Msg("Structured output validation failed, asking model to repair")
+
+		prompt, rerr := a.prompts.Render("structured_output_repair", StructuredOutputPromptData{
+			Schema: string(schemaJSON),
+			Error:  err.Error(),
+			Answer: answer,
+		})
+		if rerr != nil {
+			return nil, fmt.Errorf("render repair prompt: %w", rerr)
+		}
+		resp, cerr := a.llm.CallWithContext(WithResponseFormat(ctx, schema), []ChatMessage{{Role: "user", Content: prompt}}, nil)
+		if cerr != nil {
+			return nil, fmt.Errorf("repair call failed: %w", cerr)
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("repair call returned no choices")
+		}
+		answer = resp.Choices[0].Message.Content
+	}
+}
+
+// parseStructuredAnswer 从回答中提取 JSON 并按 schema 校验，返回紧凑格式的 JSON
+func parseStructuredAnswer(answer string, schema map[string]any) (json.RawMessage, error) {
+	raw := extractJSON(answer)
+	var v any
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if err := validateJSONSchema(v, schema, "$"); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// extractJSON 去除回答中的 Markdown 代码块和首尾说明文字，返回最可能的 JSON 片段
+func extractJSON(s string) string {
+	s, _ = SplitReasoning(s)
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "```"); i >= 0 {
+		rest := s[i+3:]
+		if nl := strings.IndexByte(rest, '\n'); nl >= 0 {
+			rest = rest[nl+1:]
+		}
+		if j := strings.Index(rest, "```"); j >= 0 {
+			rest = rest[:j]
+		}
+		s = strings.TrimSpace(rest)
+	}
+	start := strings.IndexAny(s, "{[")
+	end := strings.LastIndexAny(s, "}]")
+	if start >= 0 && end > start {
+		return s[start : end+1]
+	}
+	return s
+}
+
+// validateJSONSchema 按 JSON Schema 的常用子集校验值：
+// type、enum、properties、required、additionalProperties (false)、items、minItems/maxItems
+func validateJSONSchema(v any, schema map[string]any, path string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch tt := t.(type) {
+		case string:
+			types = []string{tt}
+		case []any:
+			for _, x := range tt {
+				if s, ok := x.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		if len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return matchesJSONType(v, t) }) {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(v))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, exists := val[name]; !exists {
+						return fmt.Errorf("%s: missing required property %q", path, name)
+					}
+				}
+			}
+		}
+		for name, pv := range val {
+			ps, ok := props[name].(map[string]any)
+			if !ok {
+				if ap, isBool := schema["additionalProperties"].(bool); isBool && !ap {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := validateJSONSchema(pv, ps, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s: expected at least %d items", path, int(n))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s: expected at most %d items", path, int(n))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchesJSONType 判断解码后的 JSON 值是否属于指定的 JSON Schema 类型
+func matchesJSONType(v any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true // 未知类型不做限制
+}
+
+// jsonTypeName 返回解码后 JSON 值的类型名称，用于错误信息
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual 比较两个解码后的 JSON 值是否相等
+func jsonEqual(a, b any) bool {
+	ab, err1 := json.Marshal(a)
+	bb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ab) == string(bb)
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// summarize_url 工具的限制
+const (
+	summarizeURLDefaultChars   = 800   // 未配置时的默认摘要长度（字符）
+	summarizeURLMaxChars       = 4000  // 摘要长度的上限（字符）
+	summarizeURLDefaultInput   = 20000 // 未配置时送入模型的网页正文最大字符数
+	summarizeURLDefaultTimeout = 20    // 抓取网页的超时（秒）
+)
+
+// SummarizeURLArgs 定义了 summarize_url 工具的参数结构
+type SummarizeURLArgs struct {
+	URL      string `json:"url"`                 // 要总结的网页地址，只允许 http/https
+	MaxChars int    `json:"max_chars,omitempty"` // 摘要的目标长度（字符）
+	Focus    string `json:"focus,omitempty"`     // 需要重点关注的问题或主题
+}
+
+// SummarizeURLPromptData 是网页摘要提示词模板的数据
+type SummarizeURLPromptData struct {
+	URL       string // 网页地址
+	Text      string // 网页正文
+	Truncated bool   // 正文是否被截断
+	MaxChars  int    // 摘要的最大字符数
+	Focus     string // 需要重点关注的内容
+}
+
+type SummarizeURLTool struct{}
+
+func (t *SummarizeURLTool) Name() string { return "summarize_url" }
+func (t *SummarizeURLTool) Description() string {
+	return "Fetches a web page and returns a concise summary of its content instead of the raw text. Use this when the user wants the gist of a specific URL."
+}
+func (t *SummarizeURLTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"url":       map[string]any{"type": "string", "description": "The http or https URL of the page to summarize."},
+			"max_chars": map[string]any{"type": "integer", "description": "Target length of the summary in characters."},
+			"focus":     map[string]any{"type": "string", "description": "Optional question or topic the summary should focus on."},
+		},
+		"required": []string{"url"},
+	}
+}
+func (t *SummarizeURLTool) IsSensitive() bool { return false }
+func (t *SummarizeURLTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, events chan<- StreamEvent) (string, error) {
+	ctx, span := tracer.Start(ctx, "Tool.SummarizeURL")
+	defer span.End()
+
+	var args SummarizeURLArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.String("url", args.URL))
+
+	cfg := a.config.SummarizeURL
+	maxChars := args.MaxChars
+	if maxChars <= 0 {
+		maxChars = cfg.DefaultChars
+	}
+	if maxChars <= 0 {
+		maxChars = summarizeURLDefaultChars
+	}
+	maxChars = min(maxChars, summarizeURLMaxChars)
+	maxInput := cfg.MaxInputChars
+	if maxInput <= 0 {
+		maxInput = summarizeURLDefaultInput
+	}
+
+	// fetchPageText 会校验 URL 并使用禁止访问内网地址的客户端，响应体大小也有上限
+	text, err := fetchPageText(args.URL, summarizeURLDefaultTimeout, a.config.WebSearch)
+	if err != nil {
+		return "fetch error: " + err.Error(), nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return "fetch error: page has no readable text", nil
+	}
+	if events != nil {
+		events <- StreamEvent{Type: "tool_output", Payload: ToolOutputEventPayload{ToolName: t.Name(), Output: fmt.Sprintf("已抓取 %s，正在生成摘要...", args.URL)}}
+	}
+
+	data := SummarizeURLPromptData{URL: args.URL, Text: text, MaxChars: maxChars, Focus: strings.TrimSpace(args.Focus)}
+	if len([]rune(text)) > maxInput {
+		data.Text = string([]rune(text)[:maxInput])
+		data.Truncated = true
+	}
+	prompt, err := a.prompts.Render("summarize_url", data)
+	if err != nil {
+		return "", fmt.Errorf("render summarize_url prompt: %w", err)
+	}
+	resp, err := a.llm.CallWithContext(ctx, []ChatMessage{{Role: "user", Content: prompt}}, nil)
+	if err != nil {
+		return "summarize error: " + err.Error(), nil
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return "summarize error: model returned an empty summary", nil
+	}
+	summary, _ := SplitReasoning(resp.Choices[0].Message.Content)
+	return fmt.Sprintf("Summary of %s:\n%s", args.URL, truncateRunes(strings.TrimSpace(summary), maxChars)), nil
+}
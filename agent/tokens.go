@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 令牌估算参数
+// 没有使用具体模型的分词器，而是采用经验规则：CJK 字符大约每个字符一个 token，
+// 其他文本（英文、代码等）大约每 4 个字符一个 token
+// 图片不计入估算，各模型对图片的计费方式差异很大
+const (
+	charsPerToken    = 4 // 非 CJK 文本平均每个 token 的字符数
+	tokensPerMessage = 4 // 每条消息的角色和分隔符等固定开销
+)
+
+// EstimateTokens 估算文本的 token 数量
+func EstimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	var cjk, other int
+	for _, r := range text {
+		if isCJK(r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+charsPerToken-1)/charsPerToken
+}
+
+// EstimateMessagesTokens 估算一组消息的 token 数量，包括每条消息的固定开销和工具调用参数
+func EstimateMessagesTokens(messages []ChatMessage) int {
+	total := 0
+	for _, m := range messages {
+		total += tokensPerMessage + EstimateTokens(m.Content)
+		for _, tc := range m.ToolCalls {
+			args, _ := json.Marshal(tc.Function.Arguments)
+			total += EstimateTokens(tc.Function.Name) + EstimateTokens(string(args))
+		}
+	}
+	return total
+}
+
+// isCJK 判断字符是否为中日韩文字或全角标点
+func isCJK(r rune) bool {
+	if r < utf8.RuneSelf {
+		return false
+	}
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ToolAuditEntry 是审计日志中的一条工具调用记录
+type ToolAuditEntry struct {
+	Time       time.Time `json:"time"`                 // 调用开始时间
+	RequestID  string    `json:"request_id,omitempty"` // 触发调用的请求 ID
+	SessionID  string    `json:"session_id,omitempty"` // 会话 ID
+	Agent      string    `json:"agent,omitempty"`      // 执行调用的 Agent 角色
+	Tool       string    `json:"tool"`                 // 工具名称
+	Arguments  string    `json:"arguments"`            // 调用参数（原始 JSON，超出长度时截断）
+	Result     string    `json:"result,omitempty"`     // 工具结果（超出长度时截断）
+	Error      string    `json:"error,omitempty"`      // 工具执行失败时的错误
+	DurationMs int64     `json:"duration_ms"`          // 执行耗时（毫秒）
+	Truncated  bool      `json:"truncated,omitempty"`  // 参数或结果是否被截断
+}
+
+// ToolAuditLog 将每次工具调用以 JSON 行的形式追加到独立的审计文件，与会话记忆互不影响
+// 文件只追加不改写，多个 Agent 可共享同一个实例
+type ToolAuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	maxChars int // 参数和结果保留的最大字符数，0 表示不截断
+}
+
+// NewToolAuditLog 打开（不存在时创建）审计文件
+// path: 审计文件路径，所在目录不存在时自动创建
+// maxChars: 参数和结果保留的最大字符数，0 表示不截断
+func NewToolAuditLog(path string, maxChars int) (*ToolAuditLog, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create audit log dir: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &ToolAuditLog{file: f, maxChars: maxChars}, nil
+}
+
+// Record 截断过长的参数和结果后追加一条记录，写入失败只记录日志，不影响工具调用
+func (l *ToolAuditLog) Record(ctx context.Context, e ToolAuditEntry) {
+	var argsCut, resCut bool
+	e.Arguments, argsCut = l.redact(e.Arguments)
+	e.Result, resCut = l.redact(e.Result)
+	e.Truncated = argsCut || resCut
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		Logger.Error().Ctx(ctx).Err(err).Str("tool", e.Tool).Msg("Failed to marshal tool audit entry")
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		Logger.Error().Ctx(ctx).Err(err).Str("tool", e.Tool).Msg("Failed to write tool audit entry")
+	}
+}
+
+// redact 将超过 maxChars 的内容截断，并注明原始长度
+func (l *ToolAuditLog) redact(s string) (string, bool) {
+	if l.maxChars <= 0 {
+		return s, false
+	}
+	n := utf8.RuneCountInString(s)
+	if n <= l.maxChars {
+		return s, false
+	}
+	return truncateRunes(s, l.maxChars) + fmt.Sprintf("...[truncated, %d chars total]", n), true
+}
+
+// Close 关闭审计文件
+func (l *ToolAuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
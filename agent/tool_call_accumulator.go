@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// toolCallDelta 是流式响应中单帧的工具调用片段
+// OpenAI 兼容接口按 index 分帧发送，arguments 为 JSON 字符串片段；Ollama 每帧发送完整调用，arguments 为 JSON 对象
+type toolCallDelta struct {
+	Index    *int   `json:"index"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// partialToolCall 是正在合并中的工具调用
+type partialToolCall struct {
+	typ  string
+	name string
+	args strings.Builder        // 字符串形式的参数片段
+	obj  map[string]interface{} // 对象形式的完整参数
+}
+
+// ToolCallAccumulator 将分帧发送的工具调用片段合并为完整的工具调用
+// 带 index 的片段按 index 合并，不带 index 的片段视为一个完整的调用
+type ToolCallAccumulator struct {
+	calls   []*partialToolCall
+	byIndex map[int]*partialToolCall
+	last    int // 最近一次 Add 更新的调用在 calls 中的位置
+}
+
+// NewToolCallAccumulator 创建一个空的工具调用累加器
+func NewToolCallAccumulator() *ToolCallAccumulator {
+	return &ToolCallAccumulator{byIndex: make(map[int]*partialToolCall)}
+}
+
+// Add 合并一帧中的工具调用片段
+func (acc *ToolCallAccumulator) Add(raw json.RawMessage) error {
+	var d toolCallDelta
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return fmt.Errorf("invalid tool call delta: %w", err)
+	}
+
+	var call *partialToolCall
+	if d.Index != nil {
+		call = acc.byIndex[*d.Index]
+	}
+	if call == nil {
+		call = &partialToolCall{}
+		acc.calls = append(acc.calls, call)
+		if d.Index != nil {
+			acc.byIndex[*d.Index] = call
+		}
+	}
+	acc.last = slices.Index(acc.calls, call)
+	if d.Type != "" {
+		call.typ = d.Type
+	}
+	if d.Function.Name != "" {
+		call.name = d.Function.Name
+	}
+
+	args := bytes.TrimSpace(d.Function.Arguments)
+	switch {
+	case len(args) == 0 || bytes.Equal(args, []byte("null")):
+	case args[0] == '"':
+		var fragment string
+		if err := json.Unmarshal(args, &fragment); err != nil {
+			return fmt.Errorf("invalid tool call arguments fragment: %w", err)
+		}
+		call.args.WriteString(fragment)
+	default:
+		var obj map[string]interface{}
+		if err := json.Unmarshal(args, &obj); err != nil {
+			return fmt.Errorf("invalid tool call arguments: %w", err)
+		}
+		call.obj = obj
+	}
+	return nil
+}
+
+// Latest 返回最近一次 Add 更新的工具调用目前累积的名称和参数，参数可能是不完整的 JSON
+func (acc *ToolCallAccumulator) Latest() (ToolCallDeltaEventPayload, bool) {
+	if len(acc.calls) == 0 {
+		return ToolCallDeltaEventPayload{}, false
+	}
+	c := acc.calls[acc.last]
+	delta := ToolCallDeltaEventPayload{Index: acc.last, ToolName: c.name, Arguments: c.args.String()}
+	if c.obj != nil {
+		bs, _ := json.Marshal(c.obj)
+		delta.Arguments = string(bs)
+	}
+	return delta, true
+}
+
+// Len 返回已开始合并的工具调用数量
+func (acc *ToolCallAccumulator) Len() int {
+	return len(acc.calls)
+}
+
+// Calls 按出现顺序返回合并完成的工具调用
+// 缺少函数名或参数不是合法 JSON 对象的调用会被跳过，并通过 error 返回原因
+func (acc *ToolCallAccumulator) Calls() ([]ToolCall, error) {
+	out := make([]ToolCall, 0, len(acc.calls))
+	var problems []string
+	for i, c := range acc.calls {
+		if c.name == "" {
+			problems = append(problems, fmt.Sprintf("tool call %d has no function name", i))
+			continue
+		}
+		tc := ToolCall{Type: c.typ, Function: ToolCallFunction{Name: c.name, Arguments: c.obj}}
+		if tc.Type == "" {
+			tc.Type = "function" // 默认为函数类型
+		}
+		if s := strings.TrimSpace(c.args.String()); s != "" && tc.Function.Arguments == nil {
+			if err := json.Unmarshal([]byte(s), &tc.Function.Arguments); err != nil {
+				problems = append(problems, fmt.Sprintf("tool call %q has invalid arguments: %v", c.name, err))
+				continue
+			}
+		}
+		if tc.Function.Arguments == nil {
+			tc.Function.Arguments = map[string]interface{}{}
+		}
+		out = append(out, tc)
+	}
+	if len(problems) > 0 {
+		return out, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultToolOutputTemplate 是格式化工具结果使用的默认模板名称（位于 prompts 目录）
+const DefaultToolOutputTemplate = "tool_result"
+
+// ToolOutputRule 定义了单个工具结果在加入对话前的处理方式
+type ToolOutputRule struct {
+	MaxChars  int    `mapstructure:"max_chars"` // 结果允许的最大字符数，超出时截断或摘要，0 表示不限制
+	Template  string `mapstructure:"template"`  // 格式化模板名称，"none" 表示原样输出
+	Summarize bool   `mapstructure:"summarize"` // 超出长度时是否调用模型摘要，失败时回退为截断
+}
+
+// ToolResultPromptData 是工具结果模板的数据上下文
+type ToolResultPromptData struct {
+	Tool          string // 工具名称
+	Output        string // 处理后的输出
+	OriginalChars int    // 原始输出的字符数
+	Truncated     bool   // 是否被截断
+	Summarized    bool   // 是否被摘要
+	MaxChars      int    // 允许的最大字符数（摘要模板使用）
+}
+
+// toolOutputRule 返回指定工具的结果处理规则，按工具配置覆盖全局默认值
+func (a *Agent) toolOutputRule(toolName string) ToolOutputRule {
+	cfg := a.config.ToolOutput
+	rule := ToolOutputRule{MaxChars: cfg.MaxChars, Template: cfg.Template, Summarize: cfg.Summarize}
+	if r, ok := cfg.Tools[toolName]; ok {
+		if r.MaxChars != 0 {
+			rule.MaxChars = r.MaxChars
+		}
+		if r.Template != "" {
+			rule.Template = r.Template
+		}
+		rule.Summarize = rule.Summarize || r.Summarize
+	}
+	if rule.Template == "" {
+		rule.Template = DefaultToolOutputTemplate
+	}
+	return rule
+}
+
+// formatToolResult 在工具结果加入对话前按规则截断或摘要，并用模板标注来源工具
+// 渲染失败时返回处理后的原始内容，保证工具结果不会丢失
+func (a *Agent) formatToolResult(ctx context.Context, toolName, output string) string {
+	rule := a.toolOutputRule(toolName)
+	data := ToolResultPromptData{
+		Tool:          toolName,
+		Output:        output,
+		OriginalChars: utf8.RuneCountInString(output),
+		MaxChars:      rule.MaxChars,
+	}
+
+	if rule.MaxChars > 0 && data.OriginalChars > rule.MaxChars {
+		if rule.Summarize {
+			if summary, ok := a.summarizeToolResult(ctx, data); ok {
+				data.Output, data.Summarized = summary, true
+			}
+		}
+		if !data.Summarized {
+			data.Output, data.Truncated = truncateRunes(output, rule.MaxChars), true
+		}
+		Logger.Debug().Ctx(ctx).Str("tool", toolName).Int("original_chars", data.OriginalChars).Bool("summarized", data.Summarized).Msg("Tool output shortened")
+	}
+
+	if rule.Template == "none" {
+		return data.Output
+	}
+	formatted, err := a.prompts.Render(rule.Template, data)
+	if err != nil {
+		Logger.Warn().Ctx(ctx).Err(err).Str("template", rule.Template).Msg("Failed to render tool result template")
+		return data.Output
+	}
+	return formatted
+}
+
+// summarizeToolResult 调用模型对过长的工具结果进行摘要
+func (a *Agent) summarizeToolResult(ctx context.Context, data ToolResultPromptData) (string, bool) {
+	prompt, err := a.prompts.Render("tool_result_summary", data)
+	if err != nil {
+		Logger.Warn().Ctx(ctx).Err(err).Msg("Failed to render tool result summary prompt")
+		return "", false
+	}
+	resp, err := a.llm.CallWithContext(ctx, []ChatMessage{{Role: "user", Content: prompt}}, nil)
+	if err != nil {
+		Logger.Warn().Ctx(ctx).Err(err).Str("tool", data.Tool).Msg("Failed to summarize tool output, truncating instead")
+		return "", false
+	}
+	if len(resp.Choices) == 0 {
+		return "", false
+	}
+	summary := strings.TrimSpace(resp.Choices[0].Message.Content)
+	if summary == "" {
+		return "", false
+	}
+	return truncateRunes(summary, data.MaxChars), true
+}
+
+// truncateRunes 按字符截断字符串，避免截断多字节字符
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "..."
+}
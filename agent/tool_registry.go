@@ -2,6 +2,8 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"sync"
 )
 
@@ -25,16 +27,41 @@ type Tool interface {
 	Run(ctx context.Context, argsJSON string, sessionID string, agent *Agent, events chan<- StreamEvent) (string, error)
 }
 
+// TransientError 表示工具执行中的暂时性失败（例如网络错误、Docker 守护进程抖动），
+// Agent 会在有限次数内自动重试此类错误，而参数错误等永久性失败不会被重试。
+type TransientError struct {
+	Err error // 原始错误
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// markTransient 将错误标记为暂时性错误，nil 保持为 nil。
+func markTransient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err}
+}
+
+// IsTransient 判断错误链中是否包含暂时性错误。
+func IsTransient(err error) bool {
+	var te *TransientError
+	return errors.As(err, &te)
+}
+
 // ToolRegistry 管理所有可用工具的注册和查找。
 type ToolRegistry struct {
-	tools map[string]Tool // 存储工具名称到工具实例的映射
-	mu    sync.RWMutex    // 读写互斥锁，用于保护 tools 映射的并发访问
+	tools    map[string]Tool // 存储工具名称到工具实例的映射
+	disabled map[string]bool // 被配置禁用的工具名称集合
+	mu       sync.RWMutex    // 读写互斥锁，用于保护 tools 和 disabled 映射的并发访问
 }
 
 // NewToolRegistry 创建并返回一个新的 ToolRegistry 实例。
 func NewToolRegistry() *ToolRegistry {
 	return &ToolRegistry{
-		tools: make(map[string]Tool), // 初始化工具映射
+		tools:    make(map[string]Tool), // 初始化工具映射
+		disabled: make(map[string]bool), // 初始化禁用工具集合
 	}
 }
 
@@ -46,6 +73,22 @@ func (r *ToolRegistry) Register(t Tool) {
 	r.tools[t.Name()] = t // 将工具添加到映射中，以其名称作为键
 }
 
+// Disable 禁用指定名称的工具。
+// 被禁用的工具不会出现在提供给大语言模型的元数据中，调用时也会被拒绝。
+// name: 要禁用的工具名称。
+func (r *ToolRegistry) Disable(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled[name] = true
+}
+
+// IsDisabled 判断指定名称的工具是否已被配置禁用。
+func (r *ToolRegistry) IsDisabled(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.disabled[name]
+}
+
 // Get 根据工具名称从注册表中获取工具实例。
 // name: 要查找的工具名称。
 // 返回找到的 Tool 实例和指示是否找到的布尔值。
@@ -56,15 +99,64 @@ func (r *ToolRegistry) Get(name string) (Tool, bool) {
 	return t, ok
 }
 
+// ToolInfo 描述一个已注册的工具，用于调试模型收到的工具元数据
+type ToolInfo struct {
+	Name        string         `json:"name"`        // 工具名称
+	Description string         `json:"description"` // 提供给模型的工具描述
+	Schema      map[string]any `json:"schema"`      // 工具参数的 JSON Schema
+	Sensitive   bool           `json:"sensitive"`   // 执行前是否需要用户确认
+	Disabled    bool           `json:"disabled"`    // 是否被配置禁用，禁用的工具不会提供给模型
+}
+
+// List 返回所有已注册工具的信息（包括被禁用的工具），按名称排序
+func (r *ToolRegistry) List() []ToolInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := make([]ToolInfo, 0, len(r.tools))
+	for name, t := range r.tools {
+		infos = append(infos, ToolInfo{
+			Name:        name,
+			Description: t.Description(),
+			Schema:      t.Schema(),
+			Sensitive:   t.IsSensitive(),
+			Disabled:    r.disabled[name],
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
 // GetMetadata 生成所有注册工具的元数据列表，这些元数据将提供给大语言模型，
 // 以便模型了解可用的工具及其功能。
 // 返回一个包含所有工具元数据的 map 列表，每个 map 描述一个工具。
+// 工具按名称排序，保证每次提供给模型的工具顺序一致。
 func (r *ToolRegistry) GetMetadata() []map[string]any {
+	return r.GetMetadataFiltered(nil)
+}
+
+// GetMetadataFiltered 与 GetMetadata 相同，但只包含 keep 返回 true 的工具，keep 为 nil 时包含全部工具
+func (r *ToolRegistry) GetMetadataFiltered(keep func(name string) bool) []map[string]any {
 	r.mu.RLock() // 获取读锁
 	defer r.mu.RUnlock()
 
-	var metadata []map[string]any
-	for _, t := range r.tools {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		if r.disabled[name] {
+			continue // 跳过被禁用的工具
+		}
+		if keep != nil && !keep(name) {
+			continue // 跳过当前会话不允许的工具
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metadata := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		t := r.tools[name]
 		// 为每个工具构建符合 LLM 工具调用规范的元数据结构
 		metadata = append(metadata, map[string]any{
 			"type": "function", // 工具类型，通常为 "function"
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -32,12 +33,22 @@ type RunCodeArgs struct {
 	Code     string            `json:"code"`              // 要执行的源代码
 	Files    map[string]string `json:"files,omitempty"`   // 需要写入沙箱的额外文件
 	Timeout  int               `json:"timeout,omitempty"` // 执行超时时间（秒）
+	// UseWorkspace 为 true 时，将当前会话工作区中上传的文件复制到沙箱中
+	UseWorkspace bool `json:"use_workspace,omitempty"`
+	// Env 传入沙箱容器的环境变量，受数量、大小限制和拒绝列表约束
+	Env map[string]string `json:"env,omitempty"`
+	// AllowNetwork 为 true 时请求联网执行（例如 pip install），需运维在配置中启用并经用户确认
+	AllowNetwork bool   `json:"allow_network,omitempty"`
+	SessionID    string `json:"-"` // 当前会话 ID，由工具填充，用于定位工作区
+	// lintOnly 为 true 时只执行语言的静态检查命令，不运行程序，由 lint_code 设置
+	lintOnly bool
 }
 
 type ReadFileArgs struct {
 	Path      string `json:"path"`                 // 文件路径
 	ChunkSize int    `json:"chunk_size,omitempty"` // 读取块大小
 	Offset    int64  `json:"offset,omitempty"`     // 读取偏移量
+	Workspace bool   `json:"workspace,omitempty"`  // 为 true 时，path 相对于当前会话工作区解析
 }
 
 type WriteFileArgs struct {
@@ -47,8 +58,18 @@ type WriteFileArgs struct {
 }
 
 type GitCmdArgs struct {
-	Workdir string   `json:"workdir"` // git 命令的工作目录
-	Cmd     []string `json:"cmd"`     // git 命令及其参数
+	Workdir    string   `json:"workdir"`              // git 命令的工作目录
+	Cmd        []string `json:"cmd"`                  // git 命令及其参数
+	Workspace  bool     `json:"workspace,omitempty"`  // 为 true 时，workdir 相对于当前会话工作区解析
+	Structured bool     `json:"structured,omitempty"` // 为 true 时返回包含 stdout、stderr 和退出码的 JSON 结果
+}
+
+// GitCmdResult 是 git 命令的结构化执行结果
+type GitCmdResult struct {
+	Stdout   string `json:"stdout"`          // 标准输出
+	Stderr   string `json:"stderr"`          // 标准错误输出
+	ExitCode int    `json:"exit_code"`       // 退出码，0 表示成功
+	Error    string `json:"error,omitempty"` // 命令无法执行时的错误信息（例如超时）
 }
 
 // =================================================================================
@@ -74,10 +95,10 @@ func isSimpleGreeting(prompt string) bool {
 
 // isReasonableToolCall 应用一组硬编码规则来防止明显的工具幻觉
 // 这是工具调用验证的唯一真实来源
-func (a *Agent) isReasonableToolCall(originalPrompt string, toolCall ToolCall) bool {
+func (a *Agent) isReasonableToolCall(ctx context.Context, originalPrompt string, toolCall ToolCall) bool {
 	// 规则 1：对于简单的问候语，从不使用任何工具
 	if isSimpleGreeting(originalPrompt) {
-		Logger.Warn().Str("tool_name", toolCall.Function.Name).Str("prompt", originalPrompt).Msg("Tool call rejected by simple greeting rule.")
+		Logger.Warn().Ctx(ctx).Str("tool_name", toolCall.Function.Name).Str("prompt", originalPrompt).Msg("Tool call rejected by simple greeting rule.")
 		return false
 	}
 
@@ -86,9 +107,21 @@ func (a *Agent) isReasonableToolCall(originalPrompt string, toolCall ToolCall) b
 	toolName := toolCall.Function.Name
 
 	requiredKeywords, ok := a.config.ToolValidation.Keywords[toolName]
+	if !ok {
+		// webhook 等外部工具可以自带验证关键词，未提供关键词时不做关键词校验
+		if tool, exists := a.toolRegistry.Get(toolName); exists {
+			if kv, isKV := tool.(interface{ ValidationKeywords() []string }); isKV {
+				requiredKeywords = kv.ValidationKeywords()
+				if len(requiredKeywords) == 0 {
+					return true
+				}
+				ok = true
+			}
+		}
+	}
 	if !ok {
 		// 如果工具不在配置中，我们可以严格拒绝它
-		Logger.Warn().Str("tool_name", toolName).Msg("Tool call rejected because the tool itself is not in the validation config.")
+		Logger.Warn().Ctx(ctx).Str("tool_name", toolName).Msg("Tool call rejected because the tool itself is not in the validation config.")
 		return false
 	}
 
@@ -99,7 +132,7 @@ func (a *Agent) isReasonableToolCall(originalPrompt string, toolCall ToolCall) b
 	}
 
 	// 如果未找到相关关键词，则工具调用不合理
-	Logger.Warn().Str("tool_name", toolName).Str("prompt", originalPrompt).Msg("Tool call rejected by keyword validation.")
+	Logger.Warn().Ctx(ctx).Str("tool_name", toolName).Str("prompt", originalPrompt).Msg("Tool call rejected by keyword validation.")
 	return false
 }
 
@@ -125,15 +158,19 @@ func (t *WebSearchTool) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
 		"properties": map[string]any{
-			"query":       map[string]any{"type": "string", "description": "The search query."},
-			"num_results": map[string]any{"type": "integer", "description": "Number of results to return."},
-			"fetch_pages": map[string]any{"type": "boolean", "description": "Whether to fetch the full content of result pages."},
+			"query":           map[string]any{"type": "string", "description": "The search query."},
+			"num_results":     map[string]any{"type": "integer", "description": "Number of results to return."},
+			"fetch_pages":     map[string]any{"type": "boolean", "description": "Whether to fetch the full content of all result pages (slow)."},
+			"fetch_top_n":     map[string]any{"type": "integer", "description": "Fetch the full content of only the first N results; the rest return snippets only. Prefer this over fetch_pages."},
+			"region":          map[string]any{"type": "string", "description": "Optional DuckDuckGo region code, e.g. 'us-en', 'uk-en', 'cn-zh', 'de-de'."},
+			"max_content_len": map[string]any{"type": "integer", "description": "Maximum characters of fetched page content to keep per result (default 4000). Lower it to save context, raise it for more depth."},
+			"safe_search":     map[string]any{"type": "string", "enum": []string{"strict", "moderate", "off"}, "description": "Optional safe-search level."},
 		},
 		"required": []string{"query"},
 	}
 }
 func (t *WebSearchTool) IsSensitive() bool { return false }
-func (t *WebSearchTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agent, events chan<- StreamEvent) (string, error) {
+func (t *WebSearchTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, events chan<- StreamEvent) (string, error) {
 	_, span := tracer.Start(ctx, "Tool.WebSearch")
 	defer span.End()
 
@@ -146,14 +183,23 @@ func (t *WebSearchTool) Run(ctx context.Context, argsJSON string, _ string, _ *A
 	if !isValidQuery(args.Query) {
 		return "Error: The search query is too short or invalid.", nil
 	}
-	results, err := WebSearch(args)
+	// 抓取页面较慢，每抓取完一个页面就通过 tool_output 事件报告进度
+	results, err := WebSearchWithProgress(args, a.config.WebSearch, func(msg string) {
+		if events != nil {
+			events <- StreamEvent{Type: "tool_output", Payload: ToolOutputEventPayload{ToolName: t.Name(), Output: msg}}
+		}
+	})
 	if err != nil {
 		return "", err
 	}
 
 	var sb strings.Builder
 	for _, res := range results {
-		sb.WriteString(fmt.Sprintf("Title: %s\nLink: %s\nSnippet: %s\n\n", res.Title, res.Link, res.Snippet))
+		sb.WriteString(fmt.Sprintf("Title: %s\nLink: %s\nSnippet: %s\n", res.Title, res.Link, res.Snippet))
+		if res.Content != "" {
+			sb.WriteString(fmt.Sprintf("Content:\n%s\n", res.Content))
+		}
+		sb.WriteString("\n")
 	}
 
 	return sb.String(), nil
@@ -169,15 +215,18 @@ func (t *RunCodeTool) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
 		"properties": map[string]any{
-			"language": map[string]any{"type": "string", "description": "The programming language (e.g., 'python', 'go')."},
-			"code":     map[string]any{"type": "string", "description": "The source code to execute."},
-			"timeout":  map[string]any{"type": "integer", "description": "Execution timeout in seconds."},
+			"language":      map[string]any{"type": "string", "enum": supportedSandboxLanguages(), "description": "The programming language."},
+			"code":          map[string]any{"type": "string", "description": "The source code to execute."},
+			"timeout":       map[string]any{"type": "integer", "description": "Execution timeout in seconds."},
+			"use_workspace": map[string]any{"type": "boolean", "description": "Copy the files the user uploaded to this session's workspace into the sandbox."},
+			"env":           map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}, "description": "Environment variables to set in the sandbox, e.g. {\"FEATURE_X\": \"1\"}. System variables such as PATH or LD_* are not allowed."},
+			"allow_network": map[string]any{"type": "boolean", "description": "Request network access (e.g. for pip install or calling an API). Only set this when the code genuinely needs the network; it may be disabled by the operator."},
 		},
 		"required": []string{"language", "code"},
 	}
 }
 func (t *RunCodeTool) IsSensitive() bool { return true }
-func (t *RunCodeTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, events chan<- StreamEvent) (string, error) {
+func (t *RunCodeTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, events chan<- StreamEvent) (string, error) {
 	_, span := tracer.Start(ctx, "Tool.RunCode")
 	defer span.End()
 
@@ -185,22 +234,31 @@ func (t *RunCodeTool) Run(ctx context.Context, argsJSON string, _ string, a *Age
 	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
 		return "", fmt.Errorf("invalid args: %v", err)
 	}
+	args.SessionID = sessionID
 	span.SetAttributes(attribute.String("language", args.Language))
 
-	// 创建一个 io.Writer，将沙箱输出转发到 events 通道
+	// 创建一个 io.Writer，将沙箱输出逐行转发到 events 通道
 	pipeReader, pipeWriter := io.Pipe()
+	forwarded := make(chan struct{})
 	go func() {
-		defer pipeWriter.Close()
+		defer close(forwarded)
 		scanner := bufio.NewScanner(pipeReader)
 		for scanner.Scan() {
-			events <- StreamEvent{Type: "tool_output", Payload: ToolOutputEventPayload{ToolName: t.Name(), Output: scanner.Text()}}
+			if events != nil {
+				events <- StreamEvent{Type: "tool_output", Payload: ToolOutputEventPayload{ToolName: t.Name(), Output: scanner.Text()}}
+			}
 		}
 		if err := scanner.Err(); err != nil {
-			Logger.Error().Err(err).Str("tool_name", t.Name()).Msg("Error reading from sandbox output pipe")
+			Logger.Error().Ctx(ctx).Err(err).Str("tool_name", t.Name()).Msg("Error reading from sandbox output pipe")
 		}
+		// 确保写入端不会因读取端提前退出而阻塞
+		io.Copy(io.Discard, pipeReader)
 	}()
 
 	result, err := a.RunCodeSandbox(args, pipeWriter)
+	// 关闭写入端并等待剩余输出转发完毕，避免在工具返回后继续向 events 发送事件
+	pipeWriter.Close()
+	<-forwarded
 	if err != nil {
 		return "", err
 	}
@@ -217,13 +275,14 @@ func (t *ReadFileTool) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
 		"properties": map[string]any{
-			"path": map[string]any{"type": "string", "description": "The path to the file."},
+			"path":      map[string]any{"type": "string", "description": "The path to the file."},
+			"workspace": map[string]any{"type": "boolean", "description": "Resolve the path inside the files the user uploaded to this session's workspace."},
 		},
 		"required": []string{"path"},
 	}
 }
 func (t *ReadFileTool) IsSensitive() bool { return false }
-func (t *ReadFileTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agent, _ chan<- StreamEvent) (string, error) {
+func (t *ReadFileTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, _ chan<- StreamEvent) (string, error) {
 	_, span := tracer.Start(ctx, "Tool.ReadFile")
 	defer span.End()
 
@@ -231,8 +290,15 @@ func (t *ReadFileTool) Run(ctx context.Context, argsJSON string, _ string, _ *Ag
 	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
 		return "", fmt.Errorf("invalid args: %v", err)
 	}
-	span.SetAttributes(attribute.String("path", args.Path))
+	span.SetAttributes(attribute.String("path", args.Path), attribute.Bool("workspace", args.Workspace))
 
+	if args.Workspace {
+		full, err := a.ResolveWorkspacePath(sessionID, args.Path)
+		if err != nil {
+			return "read error: " + err.Error(), nil
+		}
+		args.Path = full
+	}
 	return ReadFile(args), nil
 }
 
@@ -254,7 +320,7 @@ func (t *WriteFileTool) Schema() map[string]any {
 	}
 }
 func (t *WriteFileTool) IsSensitive() bool { return true }
-func (t *WriteFileTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agent, _ chan<- StreamEvent) (string, error) {
+func (t *WriteFileTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, _ chan<- StreamEvent) (string, error) {
 	_, span := tracer.Start(ctx, "Tool.WriteFile")
 	defer span.End()
 
@@ -264,9 +330,34 @@ func (t *WriteFileTool) Run(ctx context.Context, argsJSON string, _ string, _ *A
 	}
 	span.SetAttributes(attribute.String("path", args.Path), attribute.String("mode", args.Mode))
 
+	if allowed := a.config.WriteFile.AllowedExtensions; !writeExtensionAllowed(args.Path, allowed) {
+		return fmt.Sprintf("write error: extension %q is not allowed, allowed extensions: %s", filepath.Ext(args.Path), strings.Join(allowed, ", ")), nil
+	}
 	return WriteFile(args), nil
 }
 
+// writeExtensionAllowed 判断文件扩展名是否在允许列表中，列表为空时允许所有文件
+// 比较时忽略大小写，配置中的扩展名可以省略前导点
+func writeExtensionAllowed(path string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if !strings.HasPrefix(a, ".") {
+			a = "." + a
+		}
+		if a == ext {
+			return true
+		}
+	}
+	return false
+}
+
 type GitCmdTool struct{}
 
 func (t *GitCmdTool) Name() string { return "git_cmd" }
@@ -277,14 +368,16 @@ func (t *GitCmdTool) Schema() map[string]any {
 	return map[string]any{
 		"type": "object",
 		"properties": map[string]any{
-			"workdir": map[string]any{"type": "string", "description": "The working directory for the git command."},
-			"cmd":     map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"workdir":    map[string]any{"type": "string", "description": "The working directory for the git command."},
+			"cmd":        map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"workspace":  map[string]any{"type": "boolean", "description": "Resolve workdir inside the files the user uploaded to this session's workspace."},
+			"structured": map[string]any{"type": "boolean", "description": "Return a JSON object with separate stdout, stderr and exit_code instead of plain text."},
 		},
 		"required": []string{"workdir", "cmd"},
 	}
 }
 func (t *GitCmdTool) IsSensitive() bool { return false }
-func (t *GitCmdTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agent, _ chan<- StreamEvent) (string, error) {
+func (t *GitCmdTool) Run(ctx context.Context, argsJSON string, sessionID string, a *Agent, _ chan<- StreamEvent) (string, error) {
 	_, span := tracer.Start(ctx, "Tool.GitCmd")
 	defer span.End()
 
@@ -294,6 +387,13 @@ func (t *GitCmdTool) Run(ctx context.Context, argsJSON string, _ string, _ *Agen
 	}
 	span.SetAttributes(attribute.String("workdir", args.Workdir), attribute.StringSlice("cmd", args.Cmd))
 
+	if args.Workspace {
+		full, err := a.ResolveWorkspacePath(sessionID, args.Workdir)
+		if err != nil {
+			return "git error: " + err.Error(), nil
+		}
+		args.Workdir = full
+	}
 	return GitCmd(args), nil
 }
 
@@ -325,7 +425,7 @@ func (t *CreateSessionTool) Run(ctx context.Context, argsJSON string, _ string,
 	span.SetAttributes(attribute.String("title", title))
 
 	newSessionID := uuid.New().String()
-	a.mem.CreateSession(newSessionID, title)
+	a.mem.CreateSession(newSessionID, title, "")
 	return fmt.Sprintf("New session created: %s (ID: %s)", title, newSessionID), nil
 }
 
@@ -396,7 +496,7 @@ func (t *KnowledgeSearchTool) Run(ctx context.Context, argsJSON string, _ string
 	}
 	span.SetAttributes(attribute.String("query", args.Query), attribute.Int("top_k", args.TopK))
 
-	queryVec, err := a.llm.Embed(ctx, args.Query)
+	queryVec, err := a.embedText(ctx, args.Query)
 	if err != nil {
 		return "", fmt.Errorf("embed error: %v", err)
 	}
@@ -416,12 +516,103 @@ func (t *KnowledgeSearchTool) Run(ctx context.Context, argsJSON string, _ string
 	return sb.String(), nil
 }
 
+type ListKnowledgeSourcesTool struct{}
+
+func (t *ListKnowledgeSourcesTool) Name() string { return "list_knowledge_sources" }
+func (t *ListKnowledgeSourcesTool) Description() string {
+	return "Lists all sources in the local knowledge base with their chunk counts. Use this when the user asks what documents or sources the knowledge base contains."
+}
+func (t *ListKnowledgeSourcesTool) Schema() map[string]any {
+	return map[string]any{
+		"type":       "object",
+		"properties": map[string]any{},
+	}
+}
+func (t *ListKnowledgeSourcesTool) IsSensitive() bool { return false }
+func (t *ListKnowledgeSourcesTool) Run(ctx context.Context, _ string, _ string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.ListKnowledgeSources")
+	defer span.End()
+
+	sources, err := a.vectorStore.ListSources()
+	if err != nil {
+		return "", fmt.Errorf("list sources error: %v", err)
+	}
+	span.SetAttributes(attribute.Int("sources.count", len(sources)))
+	if len(sources) == 0 {
+		return "The knowledge base is empty.", nil
+	}
+
+	var sb strings.Builder
+	for _, s := range sources {
+		sb.WriteString(fmt.Sprintf("- %s (%d chunks)\n", s.Source, s.ChunkCount))
+	}
+	return sb.String(), nil
+}
+
+type GetSourceChunksTool struct{}
+
+func (t *GetSourceChunksTool) Name() string { return "get_source_chunks" }
+func (t *GetSourceChunksTool) Description() string {
+	return "Returns all chunks of one knowledge base source in order. Use this when the user asks what the knowledge base knows about a specific source or document."
+}
+func (t *GetSourceChunksTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"source": map[string]any{"type": "string", "description": "The source name, as returned by list_knowledge_sources."},
+		},
+		"required": []string{"source"},
+	}
+}
+func (t *GetSourceChunksTool) IsSensitive() bool { return false }
+func (t *GetSourceChunksTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.GetSourceChunks")
+	defer span.End()
+
+	var args struct {
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.String("source", args.Source))
+
+	chunks, err := a.vectorStore.GetSourceChunks(args.Source)
+	if err != nil {
+		return "", fmt.Errorf("get source chunks error: %v", err)
+	}
+	if len(chunks) == 0 {
+		return fmt.Sprintf("No chunks found for source: %s", args.Source), nil
+	}
+
+	var sb strings.Builder
+	for _, doc := range chunks {
+		sb.WriteString(fmt.Sprintf("[chunk %d]\n%s\n\n", docChunkIndex(doc), doc.Content))
+	}
+	return sb.String(), nil
+}
+
 // =================================================================================
 //
 //	Multi-Agent Tools
 //
 // =================================================================================
 
+// subAgentEvent 将子 Agent 的事件转换为转发给 Foreman 的事件：错误改为工具错误码并保留原始消息；
+// 回答相关的 token 和 answer_reset 只属于子 Agent 的结果，转发后会混入或清空 Foreman 自己的回答，因此不转发
+func subAgentEvent(event StreamEvent) (StreamEvent, bool) {
+	switch event.Type {
+	case "token", "answer_reset":
+		return event, false
+	case "error":
+		if p, ok := event.Payload.(ErrorEventPayload); ok {
+			p.Code = ErrorCodeTool
+			event.Payload = p
+		}
+	}
+	return event, true
+}
+
 type CallCoderTool struct{}
 
 func (t *CallCoderTool) Name() string { return "call_coder" }
@@ -456,11 +647,11 @@ func (t *CallCoderTool) Run(ctx context.Context, argsJSON string, _ string, a *A
 		return "", fmt.Errorf("invalid args: %v", err)
 	}
 
-	Logger.Info().Str("foreman_agent", a.role).Str("coder_task", args.Task.Description).Msg("Foreman calling Coder Agent")
+	Logger.Info().Ctx(ctx).Str("foreman_agent", a.role).Str("coder_task", args.Task.Description).Msg("Foreman calling Coder Agent")
 
 	coderAgent, ok := a.otherAgents["coder"]
 	if !ok {
-		Logger.Error().Str("foreman_agent", a.role).Msg("Coder agent not found in otherAgents map")
+		Logger.Error().Ctx(ctx).Str("foreman_agent", a.role).Msg("Coder agent not found in otherAgents map")
 		return "", fmt.Errorf("coder agent not found")
 	}
 
@@ -469,23 +660,29 @@ func (t *CallCoderTool) Run(ctx context.Context, argsJSON string, _ string, a *A
 
 	var finalAnswer strings.Builder
 	for event := range subAgentEvents {
-		// 将子 Agent 的所有事件转发到 Foreman 的 events 通道
-		events <- event
+		// 将子 Agent 的过程事件转发到 Foreman 的 events 通道，子 Agent 的错误对 Foreman 而言是工具错误
+		event, forward := subAgentEvent(event)
+		if forward {
+			events <- event
+		}
 
-		// 同时收集最终答案或错误
-		if event.Type == "token" {
+		// 同时收集最终答案或错误；实时转发的回答被丢弃时（answer_reset）清空已收集的内容
+		switch event.Type {
+		case "token":
 			if p, ok := event.Payload.(TokenEventPayload); ok {
 				finalAnswer.WriteString(p.Text)
 			}
-		} else if event.Type == "error" {
+		case "answer_reset":
+			finalAnswer.Reset()
+		case "error":
 			if p, ok := event.Payload.(ErrorEventPayload); ok {
-				Logger.Error().Str("coder_agent_error", p.Message).Msg("Coder Agent returned an error")
+				Logger.Error().Ctx(ctx).Str("coder_agent_error", p.Message).Msg("Coder Agent returned an error")
 				return "", fmt.Errorf("coder agent error: %s", p.Message)
 			}
 		}
 	}
 
-	Logger.Info().Str("foreman_agent", a.role).Str("coder_result_preview", truncateString(finalAnswer.String(), 100)).Msg("Coder Agent returned result")
+	Logger.Info().Ctx(ctx).Str("foreman_agent", a.role).Str("coder_result_preview", truncateString(finalAnswer.String(), 100)).Msg("Coder Agent returned result")
 	return finalAnswer.String(), nil
 }
 
@@ -523,11 +720,11 @@ func (t *CallResearcherTool) Run(ctx context.Context, argsJSON string, _ string,
 		return "", fmt.Errorf("invalid args: %v", err)
 	}
 
-	Logger.Info().Str("foreman_agent", a.role).Str("researcher_task", args.Task.Description).Msg("Foreman calling Researcher Agent")
+	Logger.Info().Ctx(ctx).Str("foreman_agent", a.role).Str("researcher_task", args.Task.Description).Msg("Foreman calling Researcher Agent")
 
 	researcherAgent, ok := a.otherAgents["researcher"]
 	if !ok {
-		Logger.Error().Str("foreman_agent", a.role).Msg("Researcher agent not found in otherAgents map")
+		Logger.Error().Ctx(ctx).Str("foreman_agent", a.role).Msg("Researcher agent not found in otherAgents map")
 		return "", fmt.Errorf("researcher agent not found")
 	}
 
@@ -536,23 +733,29 @@ func (t *CallResearcherTool) Run(ctx context.Context, argsJSON string, _ string,
 
 	var finalAnswer strings.Builder
 	for event := range subAgentEvents {
-		// 将子 Agent 的所有事件转发到 Foreman 的 events 通道
-		events <- event
+		// 将子 Agent 的过程事件转发到 Foreman 的 events 通道，子 Agent 的错误对 Foreman 而言是工具错误
+		event, forward := subAgentEvent(event)
+		if forward {
+			events <- event
+		}
 
-		// 同时收集最终答案或错误
-		if event.Type == "token" {
+		// 同时收集最终答案或错误；实时转发的回答被丢弃时（answer_reset）清空已收集的内容
+		switch event.Type {
+		case "token":
 			if p, ok := event.Payload.(TokenEventPayload); ok {
 				finalAnswer.WriteString(p.Text)
 			}
-		} else if event.Type == "error" {
+		case "answer_reset":
+			finalAnswer.Reset()
+		case "error":
 			if p, ok := event.Payload.(ErrorEventPayload); ok {
-				Logger.Error().Str("researcher_agent_error", p.Message).Msg("Researcher Agent returned an error")
+				Logger.Error().Ctx(ctx).Str("researcher_agent_error", p.Message).Msg("Researcher Agent returned an error")
 				return "", fmt.Errorf("researcher agent error: %s", p.Message)
 			}
 		}
 	}
 
-	Logger.Info().Str("foreman_agent", a.role).Str("researcher_result_preview", truncateString(finalAnswer.String(), 100)).Msg("Researcher Agent returned result")
+	Logger.Info().Ctx(ctx).Str("foreman_agent", a.role).Str("researcher_result_preview", truncateString(finalAnswer.String(), 100)).Msg("Researcher Agent returned result")
 	return finalAnswer.String(), nil
 }
 
@@ -583,12 +786,6 @@ func (a *Agent) ensureSandboxInitialized() {
 		if err := cmd.Run(); err != nil {
 			Logger.Error().Err(err).Msg("Docker is not running or not installed. Code execution will fail.")
 		}
-
-		maxConcurrency := a.config.Sandbox.MaxConcurrency
-		if maxConcurrency <= 0 {
-			maxConcurrency = 5
-		}
-		a.runCodeSandboxSemaphore = make(chan struct{}, maxConcurrency)
 	})
 }
 
@@ -605,18 +802,71 @@ func cleanupWorkDirs() {
 	cleanupTimer.Reset(1 * time.Hour)
 }
 
+// validateSandboxFiles 校验模型提供的额外文件：路径必须是相对路径且不能跳出沙箱目录，
+// 也不能覆盖入口文件或语言自带的文件（例如 go.mod）
+func validateSandboxFiles(files map[string]string, lang sandboxLanguage) error {
+	for p := range files {
+		if !filepath.IsLocal(p) {
+			return fmt.Errorf("file path '%s' must be relative and stay inside the sandbox directory", p)
+		}
+		clean := filepath.Clean(p)
+		if clean == lang.MainFile {
+			return fmt.Errorf("file path '%s' would overwrite the code entry file", p)
+		}
+		if _, ok := lang.ExtraFiles[clean]; ok {
+			return fmt.Errorf("file path '%s' is generated by the sandbox and cannot be overwritten", p)
+		}
+	}
+	return nil
+}
+
 func (a *Agent) RunCodeSandbox(args RunCodeArgs, stream io.Writer) (string, error) {
 	// 在执行开始时添加检查
 	cmdCheck := exec.Command("docker", "info")
 	if err := cmdCheck.Run(); err != nil {
 		errMsg := "Docker is not running or accessible. Please start Docker Desktop and try again."
 		Logger.Error().Err(err).Msg(errMsg)
-		return errMsg, fmt.Errorf(errMsg)
+		return errMsg, markTransient(errors.New(errMsg))
 	}
 
 	a.ensureSandboxInitialized()
-	a.runCodeSandboxSemaphore <- struct{}{}
-	defer func() { <-a.runCodeSandboxSemaphore }()
+
+	// 在占用沙箱槽位之前校验语言和环境变量，非法输入直接告知模型
+	_, lang, err := lookupSandboxLanguage(args.Language, a.config.Sandbox.Images)
+	if err != nil {
+		return "sandbox error: " + err.Error(), nil
+	}
+	envArgs, err := sandboxEnvArgs(args.Env)
+	if err != nil {
+		return "sandbox error: " + err.Error(), nil
+	}
+	if err := validateSandboxFiles(args.Files, lang); err != nil {
+		return "sandbox error: " + err.Error(), nil
+	}
+	// 默认断网；联网需要运维显式开启，run_code 本身是敏感工具，用户会在确认时看到 allow_network 参数
+	network := "none"
+	if args.AllowNetwork && !args.lintOnly {
+		if !a.config.Sandbox.AllowNetwork {
+			return "sandbox error: network access is disabled for the code sandbox. Run the code without allow_network.", nil
+		}
+		network = a.config.Sandbox.Network
+		if network == "" {
+			network = "bridge"
+		}
+		Logger.Info().Str("network", network).Str("session_id", args.SessionID).Msg("Running code sandbox with network access")
+	}
+
+	// 沙箱槽位由所有 Agent 共享，等待超时后告知模型稍后重试，避免调用无限期挂起
+	slots := getSandboxLimiter(a.config.Sandbox.MaxConcurrency)
+	wait, ok := slots.acquire(time.Duration(a.config.Sandbox.AcquireTimeoutSecs) * time.Second)
+	if !ok {
+		Logger.Warn().Dur("waited", wait).Int("max_concurrency", cap(slots.slots)).Msg("Timed out waiting for a code sandbox slot")
+		return fmt.Sprintf("sandbox busy: all %d code sandbox slots are in use, waited %s. Try again later.", cap(slots.slots), wait.Round(time.Second)), nil
+	}
+	defer slots.release()
+	if wait > time.Second {
+		Logger.Info().Dur("waited", wait).Msg("Acquired code sandbox slot after waiting")
+	}
 
 	tmp := fmt.Sprintf("agent_work_%d", time.Now().UnixNano())
 	base := filepath.Join("./sandboxes", tmp)
@@ -628,27 +878,24 @@ func (a *Agent) RunCodeSandbox(args RunCodeArgs, stream io.Writer) (string, erro
 	workDirs[base] = time.Now()
 	cleanupMu.Unlock()
 
-	mainFile := ""
-	switch args.Language {
-	case "python":
-		mainFile = "main.py"
-		if err := os.WriteFile(filepath.Join(base, mainFile), []byte(args.Code), 0644); err != nil {
-			return "", fmt.Errorf("write file error: %v", err)
+	// 先复制会话工作区中的文件，随后写入的代码文件可以覆盖同名文件
+	if args.UseWorkspace {
+		if args.SessionID == "" {
+			return "", fmt.Errorf("no active session for workspace")
 		}
-	case "go":
-		mainFile = "main.go"
-		if err := os.WriteFile(filepath.Join(base, mainFile), []byte(args.Code), 0644); err != nil {
-			return "", fmt.Errorf("write file error: %v", err)
+		if err := a.copyWorkspaceTo(args.SessionID, base); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("copy workspace error: %v", err)
 		}
-		if err := os.WriteFile(filepath.Join(base, "go.mod"), []byte("module sandbox\n\ngo 1.20\n"), 0644); err != nil {
-			return "", fmt.Errorf("write go.mod error: %v", err)
-		}
-	default:
-		mainFile = "main.txt"
-		if err := os.WriteFile(filepath.Join(base, mainFile), []byte(args.Code), 0644); err != nil {
-			return "", fmt.Errorf("write file error: %v", err)
+	}
+
+	for name, content := range lang.ExtraFiles {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0644); err != nil {
+			return "", fmt.Errorf("write %s error: %v", name, err)
 		}
 	}
+	if err := os.WriteFile(filepath.Join(base, lang.MainFile), []byte(args.Code), 0644); err != nil {
+		return "", fmt.Errorf("write file error: %v", err)
+	}
 
 	for p, content := range args.Files {
 		full := filepath.Join(base, p)
@@ -665,29 +912,24 @@ func (a *Agent) RunCodeSandbox(args RunCodeArgs, stream io.Writer) (string, erro
 		timeout = args.Timeout
 	}
 
-	image := "python:3.11"
-	cmdSh := ""
-	switch args.Language {
-	case "python":
-		cmdSh = fmt.Sprintf("timeout %d python3 %s", timeout, mainFile)
-	case "go":
-		cmdSh = fmt.Sprintf("timeout %d go run .", timeout)
-	default:
-		cmdSh = fmt.Sprintf("timeout %d cat %s", timeout, mainFile)
-		image = "alpine:3.18"
+	// 编译和运行都计入超时
+	command := lang.Command
+	if args.lintOnly {
+		command = lang.LintCommand
 	}
+	cmdSh := fmt.Sprintf("timeout %d sh -c '%s'", timeout, command)
 
 	dockerArgs := []string{
 		"run", "--rm",
 		"-v", fmt.Sprintf("%s:/work", base),
 		"-w", "/work",
-		"--network", "none",
+		"--network", network,
 		"--pids-limit", "64",
 		"--memory", fmt.Sprintf("%dm", a.config.Sandbox.MemoryMB),
 		"--cpus", fmt.Sprintf("%.2f", a.config.Sandbox.CpuQuota),
-		image,
-		"sh", "-lc", cmdSh,
 	}
+	dockerArgs = append(dockerArgs, envArgs...)
+	dockerArgs = append(dockerArgs, lang.Image, "sh", "-lc", cmdSh)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout+3)*time.Second)
 	defer cancel()
@@ -699,7 +941,7 @@ func (a *Agent) RunCodeSandbox(args RunCodeArgs, stream io.Writer) (string, erro
 	cmd.Stdout = multiWriter
 	cmd.Stderr = multiWriter
 
-	err := cmd.Run()
+	err = cmd.Run()
 
 	go func() {
 		time.Sleep(1 * time.Minute)
@@ -710,7 +952,13 @@ func (a *Agent) RunCodeSandbox(args RunCodeArgs, stream io.Writer) (string, erro
 	}()
 
 	if err != nil {
-		return combinedOutput.String(), fmt.Errorf("error: %v\noutput:\n%s", err, combinedOutput.String())
+		runErr := fmt.Errorf("error: %v\noutput:\n%s", err, combinedOutput.String())
+		// 退出码 125 表示 docker run 本身失败（例如守护进程抖动），而不是用户代码出错，可以重试
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 125 {
+			return combinedOutput.String(), markTransient(runErr)
+		}
+		return combinedOutput.String(), runErr
 	}
 	return combinedOutput.String(), nil
 }
@@ -822,11 +1070,43 @@ func GitCmd(args GitCmdArgs) string {
 	cmd := exec.CommandContext(ctx, "git", args.Cmd...)
 	cmd.Dir = args.Workdir
 
-	out, err := cmd.CombinedOutput()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	res := GitCmdResult{Stdout: stdout.String(), Stderr: stderr.String()}
 	if err != nil {
-		return fmt.Sprintf("git error: %v\noutput:\n%s", err, string(out))
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			res.ExitCode = exitErr.ExitCode()
+		} else {
+			// 命令未能正常运行（例如超时或找不到 git），没有有效的退出码
+			res.ExitCode = -1
+			res.Error = err.Error()
+		}
+	}
+
+	if args.Structured {
+		b, _ := json.Marshal(res)
+		return string(b)
+	}
+	return formatGitCmdResult(res)
+}
+
+// formatGitCmdResult 将结构化结果格式化为便于阅读的文本
+// 成功时只返回 stdout（若有 stderr 则附在后面），失败时分别列出退出码、stderr 和 stdout
+func formatGitCmdResult(res GitCmdResult) string {
+	if res.ExitCode == 0 {
+		if strings.TrimSpace(res.Stderr) == "" {
+			return res.Stdout
+		}
+		return fmt.Sprintf("%s\nstderr:\n%s", res.Stdout, res.Stderr)
+	}
+	if res.Error != "" {
+		return fmt.Sprintf("git error: %s\nstderr:\n%s\nstdout:\n%s", res.Error, res.Stderr, res.Stdout)
 	}
-	return string(out)
+	return fmt.Sprintf("git error: exit status %d\nstderr:\n%s\nstdout:\n%s", res.ExitCode, res.Stderr, res.Stdout)
 }
 
 func MarshalArgs(v any) string {
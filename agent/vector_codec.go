@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// 向量存储的持久化格式
+const (
+	VectorFormatJSONL  = "jsonl"  // 每行一个 JSON 文档，便于阅读和排查（默认）
+	VectorFormatBinary = "binary" // 长度前缀的二进制记录，向量以原始 float64 存储，加载速度快得多
+)
+
+// maxBinaryRecordSize 是单条二进制记录允许的最大长度，用于识别损坏的文件
+const maxBinaryRecordSize = 64 << 20
+
+// vectorFileName 返回指定格式的向量文件名
+func vectorFileName(format string) string {
+	if format == VectorFormatBinary {
+		return "vectors.bin"
+	}
+	return "vectors.jsonl"
+}
+
+// validVectorFormat 判断持久化格式是否受支持
+func validVectorFormat(format string) bool {
+	return format == VectorFormatJSONL || format == VectorFormatBinary
+}
+
+// encodeDocument 将文档编码为指定格式的一条记录
+// 二进制记录布局（小端序）：
+//
+//	uint32 记录长度 | uvarint+ID | uvarint+内容 | uvarint+元数据JSON | uvarint 向量维度 | float64 * 维度
+func encodeDocument(doc Document, format string) ([]byte, error) {
+	if format != VectorFormatBinary {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	meta, err := json.Marshal(doc.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4, 4+3*binary.MaxVarintLen64+len(doc.ID)+len(doc.Content)+len(meta)+binary.MaxVarintLen64+8*len(doc.Embedding))
+	for _, field := range [][]byte{[]byte(doc.ID), []byte(doc.Content), meta} {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(doc.Embedding)))
+	for _, v := range doc.Embedding {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(buf)-4))
+	return buf, nil
+}
+
+// errRecordSize 表示记录的长度前缀超出上限，说明长度前缀本身已损坏，无法定位下一条记录
+var errRecordSize = errors.New("record size exceeds limit")
+
+// decodeBinaryDocument 从 reader 中读取一条二进制记录
+// 返回文档和记录占用的字节数；文件末尾返回 io.EOF，记录被截断时返回 io.ErrUnexpectedEOF
+// 记录完整但内容损坏时仍返回记录占用的字节数，调用方可以跳过这条记录继续读取
+func decodeBinaryDocument(r *bufio.Reader) (Document, int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Document{}, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > maxBinaryRecordSize {
+		return Document{}, 0, fmt.Errorf("%w: %d", errRecordSize, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Document{}, 0, err
+	}
+	doc, err := decodeBinaryPayload(payload)
+	return doc, 4 + int64(size), err
+}
+
+// decodeBinaryPayload 解析去掉长度前缀后的记录内容
+func decodeBinaryPayload(payload []byte) (Document, error) {
+	var doc Document
+	errCorrupt := fmt.Errorf("corrupt record")
+	next := func() ([]byte, error) {
+		n, k := binary.Uvarint(payload)
+		if k <= 0 || uint64(len(payload)-k) < n {
+			return nil, errCorrupt
+		}
+		field := payload[k : k+int(n)]
+		payload = payload[k+int(n):]
+		return field, nil
+	}
+
+	id, err := next()
+	if err != nil {
+		return doc, err
+	}
+	content, err := next()
+	if err != nil {
+		return doc, err
+	}
+	meta, err := next()
+	if err != nil {
+		return doc, err
+	}
+	doc.ID, doc.Content = string(id), string(content)
+	if err := json.Unmarshal(meta, &doc.Metadata); err != nil {
+		return doc, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	// 先比较 dim 与剩余长度再相乘，避免损坏的超大维度使 dim*8 溢出后通过校验
+	dim, k := binary.Uvarint(payload)
+	if k <= 0 {
+		return doc, errCorrupt
+	}
+	rest := uint64(len(payload) - k)
+	if dim > rest/8 || rest != dim*8 {
+		return doc, errCorrupt
+	}
+	payload = payload[k:]
+	doc.Embedding = make([]float64, dim)
+	for i := range doc.Embedding {
+		doc.Embedding[i] = math.Float64frombits(binary.LittleEndian.Uint64(payload[i*8:]))
+	}
+	return doc, nil
+}
+
+// readVectorFile 读取指定格式的向量文件，并应用其中的删除记录
+// 文件不存在时返回空列表
+func readVectorFile(path, format string) ([]Document, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open vector store file: %w", err)
+	}
+	defer file.Close()
+
+	var docs []Document
+	add := func(doc Document) {
+		// 删除记录：移除之前加载的同一来源的文档，带有保留哈希时只移除旧版本
+		if deleted, ok := doc.Metadata[metaDeletedSource].(string); ok {
+			keepHash, versioned := doc.Metadata[metaKeepSourceHash].(string)
+			kept := docs[:0]
+			for _, d := range docs {
+				if (versioned && !isStaleVersion(d, deleted, keepHash)) || (!versioned && docSource(d) != deleted) {
+					kept = append(kept, d)
+				}
+			}
+			docs = kept
+			return
+		}
+		docs = append(docs, doc)
+	}
+
+	if format == VectorFormatBinary {
+		r := bufio.NewReaderSize(file, 1<<20)
+		var valid int64 // 最后一条完整记录结束的位置
+		for {
+			doc, n, err := decodeBinaryDocument(r)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				// 进程在写入过程中退出导致的尾部截断：保留已读取的内容，
+				// 并截掉不完整的尾部，否则之后追加的记录将无法被读取
+				Logger.Warn().Err(err).Str("path", path).Int64("offset", valid).Msg("Vector store file ends with an incomplete record, truncating it.")
+				if err := os.Truncate(path, valid); err != nil {
+					return nil, fmt.Errorf("failed to truncate corrupt vector store file: %w", err)
+				}
+				break
+			}
+			if err != nil && n > 0 {
+				// 记录完整但内容损坏：按长度前缀跳过这一条，之后的记录不受影响
+				Logger.Warn().Err(err).Str("path", path).Int64("offset", valid).Msg("Failed to decode document from vector store file, skipping record.")
+				valid += n
+				continue
+			}
+			if err != nil {
+				// 长度前缀损坏时无法定位之后的记录，不截断文件以免丢失数据，交由运维处理
+				return nil, fmt.Errorf("corrupt vector store file %s at offset %d: %w", path, valid, err)
+			}
+			valid += n
+			add(doc)
+		}
+		return docs, nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1<<20), maxBinaryRecordSize)
+	for scanner.Scan() {
+		var doc Document
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			Logger.Warn().Err(err).Msg("Failed to unmarshal document from vector store file, skipping line.")
+			continue
+		}
+		add(doc)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading vector store file: %w", err)
+	}
+	return docs, nil
+}
+
+// ConvertVectorStore 将 dir 中的向量文件从一种格式转换为另一种格式
+// 转换时会应用删除记录，因此输出文件只包含当前有效的文档；源文件保持不变
+// 返回写入的文档数量
+func ConvertVectorStore(dir, from, to string) (int, error) {
+	if !validVectorFormat(from) || !validVectorFormat(to) {
+		return 0, fmt.Errorf("unsupported vector format: %q -> %q", from, to)
+	}
+	if from == to {
+		return 0, fmt.Errorf("source and target formats are both %q", from)
+	}
+
+	docs, err := readVectorFile(filepath.Join(dir, vectorFileName(from)), from)
+	if err != nil {
+		return 0, err
+	}
+
+	// 先写入临时文件再重命名，避免转换中断时留下不完整的目标文件
+	target := filepath.Join(dir, vectorFileName(to))
+	tmp := target + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := writeVectorRecords(file, to, docs); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// writeVectorRecords 按指定格式将所有文档写入 file，并在返回前关闭 file
+func writeVectorRecords(file *os.File, format string, docs []Document) error {
+	w := bufio.NewWriterSize(file, 1<<20)
+	for _, doc := range docs {
+		rec, err := encodeDocument(doc, format)
+		if err == nil {
+			_, err = w.Write(rec)
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write document %s: %w", doc.ID, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// appendTestRecords 将文档按指定格式编码后写入 path
+func appendTestRecords(t *testing.T, path, format string, docs ...Document) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, doc := range docs {
+		rec, err := encodeDocument(doc, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testVectorDocs() []Document {
+	return []Document{
+		{ID: "a", Content: "第一段", Metadata: map[string]any{MetaSource: "a.md"}, Embedding: []float64{0.1, -2.5, 3}},
+		{ID: "b", Content: "", Metadata: map[string]any{MetaSource: "b.md", "page": float64(2)}, Embedding: []float64{}},
+		{ID: "c", Content: "third", Metadata: map[string]any{MetaSource: "c.md"}, Embedding: []float64{1e-300, 42}},
+	}
+}
+
+func TestVectorCodecRoundTrip(t *testing.T) {
+	for _, format := range []string{VectorFormatJSONL, VectorFormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), vectorFileName(format))
+			docs := testVectorDocs()
+			appendTestRecords(t, path, format, docs...)
+			// 删除记录移除之前加载的同一来源的文档
+			appendTestRecords(t, path, format, Document{Metadata: map[string]any{metaDeletedSource: "b.md"}})
+
+			got, err := readVectorFile(path, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []Document{docs[0], docs[2]}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestVectorCodecTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), vectorFileName(VectorFormatBinary))
+	docs := testVectorDocs()
+	appendTestRecords(t, path, VectorFormatBinary, docs[:2]...)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := info.Size()
+
+	// 模拟写入过程中进程退出：最后一条记录只写入了一部分
+	rec, err := encodeDocument(docs[2], VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec[:len(rec)/2])
+	f.Close()
+
+	got, err := readVectorFile(path, VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, docs[:2]) {
+		t.Fatalf("got %+v, want %+v", got, docs[:2])
+	}
+	if info, _ := os.Stat(path); info.Size() != valid {
+		t.Fatalf("file size after truncation = %d, want %d", info.Size(), valid)
+	}
+
+	// 截掉尾部后追加的记录可以正常读取
+	appendTestRecords(t, path, VectorFormatBinary, docs[2])
+	got, err = readVectorFile(path, VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, docs) {
+		t.Fatalf("got %+v, want %+v", got, docs)
+	}
+}
+
+func TestVectorCodecSkipsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), vectorFileName(VectorFormatBinary))
+	docs := testVectorDocs()
+	appendTestRecords(t, path, VectorFormatBinary, docs...)
+
+	// 破坏中间一条记录的元数据，长度前缀保持不变
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := encodeDocument(docs[0], VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaStart := len(first) + 4 + 1 + len(docs[1].ID) + 1 + len(docs[1].Content) + 1
+	data[metaStart] = '!'
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readVectorFile(path, VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Document{docs[0], docs[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if info, _ := os.Stat(path); int(info.Size()) != len(data) {
+		t.Fatalf("file was truncated to %d bytes, want %d", info.Size(), len(data))
+	}
+}
+
+func TestVectorCodecSkipsOverflowingDimension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), vectorFileName(VectorFormatBinary))
+	docs := testVectorDocs()
+	appendTestRecords(t, path, VectorFormatBinary, docs[0])
+
+	// 向量维度为 2^61 时 dim*8 溢出为 0，与剩余的 0 字节相等
+	payload := []byte{}
+	for _, field := range []string{"bad", "", "{}"} {
+		payload = binary.AppendUvarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	payload = binary.AppendUvarint(payload, 1<<61)
+	rec := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	rec = append(rec, payload...)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec)
+	f.Close()
+	appendTestRecords(t, path, VectorFormatBinary, docs[2])
+
+	got, err := readVectorFile(path, VectorFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Document{docs[0], docs[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -1,14 +1,15 @@
 package agent
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Document 代表一条知识，包含其向量嵌入。
@@ -25,6 +26,12 @@ type SearchResult struct {
 	Score float64  // 查询向量与文档向量的相似度得分
 }
 
+// SourceInfo 描述知识库中的一个来源及其包含的块数量。
+type SourceInfo struct {
+	Source     string `json:"source"`      // 来源标识符，对应 Metadata["source"]
+	ChunkCount int    `json:"chunk_count"` // 该来源下的块数量
+}
+
 // VectorStore 是任何向量数据库的接口。
 // 这允许多种实现（例如，内存、Chroma、Pinecone 等）。
 type VectorStore interface {
@@ -33,40 +40,109 @@ type VectorStore interface {
 	// Search 根据查询向量在存储中搜索最相似的文档。
 	// topK: 返回最相似结果的数量。
 	Search(queryVec []float64, topK int) ([]SearchResult, error)
+	// ListSources 返回存储中所有不同的来源及其块数量，按来源名称排序。
+	ListSources() ([]SourceInfo, error)
+	// GetSourceChunks 按块顺序返回指定来源的所有文档。
+	GetSourceChunks(source string) ([]Document, error)
+	// SourceChanged 判断指定来源已存储内容的哈希是否与 hash 不同。
+	// 来源不存在或旧数据中没有哈希时视为已变化。
+	SourceChanged(source string, hash string) (bool, error)
+	// DeleteBySource 删除指定来源的所有文档，返回删除的数量。
+	DeleteBySource(source string) (int, error)
+	// DeleteStaleVersions 删除指定来源中内容哈希（Metadata["source_hash"]）不等于 sourceHash 的文档，
+	// 用于新版本全部入库后移除旧版本，返回删除的数量。
+	DeleteStaleVersions(source string, sourceHash string) (int, error)
+	// Count 返回存储中的文档总数。
+	Count() (int, error)
+	// Replace 用 docs 原子地替换存储中的全部文档，用于重新嵌入整个语料库后的零停机切换。
+	// 替换完成前的搜索看到的是旧数据，之后看到的是新数据，不会看到部分重建的状态。
+	Replace(docs []Document) error
+	// Scan 按存储顺序遍历所有文档，传入的是文档副本；fn 返回 false 时停止遍历。
+	// 用于导出、备份以及在不同存储后端之间迁移。
+	Scan(fn func(Document) bool) error
 	// Close 关闭向量存储，释放资源。
 	Close() error
 }
 
+// 文档元数据中的键
+const (
+	MetaSource     = "source"      // 来源标识符
+	MetaChunk      = "chunk"       // 块索引
+	MetaChunkHash  = "hash"        // 块内容的 SHA-256 哈希
+	MetaSourceHash = "source_hash" // 整个来源内容的 SHA-256 哈希，用于判断文件是否变化
+	MetaIngestedAt = "ingested_at" // 入库时间 (RFC3339)，作为内容版本
+
+	// metaDeletedSource 标记向量文件中的删除记录，加载时会移除该记录之前写入的同一来源的文档
+	metaDeletedSource = "_deleted_source"
+	// metaKeepSourceHash 出现在删除记录中时，只移除内容哈希与之不同的文档（旧版本）
+	metaKeepSourceHash = "_keep_source_hash"
+	// metaReplaceFile 是只在写入队列中流转的替换标记，持久化协程收到后用其指向的临时文件覆盖向量文件
+	metaReplaceFile = "_replace_file"
+)
+
 // --- 内存向量存储实现 ---
 
 // InMemoryVectorStore 是一个简单的内存向量存储实现。
 // 它适用于开发和小型应用程序。
 type InMemoryVectorStore struct {
-	docs     []Document   // 存储在内存中的文档列表
-	mu       sync.RWMutex // 读写互斥锁，用于保护 docs 的并发访问
-	filePath string       // JSONL 文件的路径，用于持久化
+	docs     []Document     // 存储在内存中的文档列表
+	mu       sync.RWMutex   // 读写互斥锁，用于保护 docs 的并发访问
+	filePath string         // 向量文件的路径，用于持久化
+	format   string         // 持久化格式，VectorFormatJSONL 或 VectorFormatBinary
+	score    SimilarityFunc // Search 使用的相似度函数
 
 	// 异步持久化
 	writeQueue chan Document  // 写入队列，用于异步持久化文档
 	wg         sync.WaitGroup // 等待组，用于等待后台写入完成
 	closed     chan struct{}  // 关闭信号通道
+	alive      atomic.Bool    // persistenceLoop 是否仍在运行
+	lastFull   atomic.Int64   // 最近一次写入队列已满的时间 (UnixNano)，0 表示从未发生
+}
+
+// VectorStoreOption 是 InMemoryVectorStore 的可选配置
+type VectorStoreOption func(*InMemoryVectorStore)
+
+// WithVectorFormat 设置持久化格式，不支持的格式回退为 jsonl
+func WithVectorFormat(format string) VectorStoreOption {
+	return func(vs *InMemoryVectorStore) {
+		if validVectorFormat(format) {
+			vs.format = format
+		} else {
+			Logger.Warn().Str("format", format).Msg("Unsupported vector store format, using jsonl")
+		}
+	}
+}
+
+// WithSimilarity 设置 Search 使用的相似度函数，nil 时保持余弦相似度
+func WithSimilarity(fn SimilarityFunc) VectorStoreOption {
+	return func(vs *InMemoryVectorStore) {
+		if fn != nil {
+			vs.score = fn
+		}
+	}
 }
 
 // NewInMemoryVectorStore 创建一个新的内存向量存储。
 // persistDir: 持久化目录的路径。如果为空，则不进行持久化。
-func NewInMemoryVectorStore(persistDir string) (*InMemoryVectorStore, error) {
+// opts: 可选配置，例如 WithVectorFormat
+func NewInMemoryVectorStore(persistDir string, opts ...VectorStoreOption) (*InMemoryVectorStore, error) {
 	vs := &InMemoryVectorStore{
 		docs:       make([]Document, 0),
+		format:     VectorFormatJSONL,
+		score:      cosineSimilarity,
 		writeQueue: make(chan Document, 1000), // 带缓冲的通道，用于异步写入
 		closed:     make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(vs)
+	}
 
 	if persistDir != "" {
 		if err := os.MkdirAll(persistDir, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create persist directory: %w", err)
 		}
-		vs.filePath = filepath.Join(persistDir, "vectors.jsonl") // 使用 .jsonl 扩展名
-		if err := vs.loadJSONL(); err != nil {
+		vs.filePath = filepath.Join(persistDir, vectorFileName(vs.format))
+		if err := vs.load(); err != nil {
 			// 记录错误，但不中断初始化
 			Logger.Warn().Err(err).Msg("Failed to load vector store from disk")
 		}
@@ -74,6 +150,7 @@ func NewInMemoryVectorStore(persistDir string) (*InMemoryVectorStore, error) {
 
 	// 启动后台持久化 goroutine
 	vs.wg.Add(1)
+	vs.alive.Store(true)
 	go vs.persistenceLoop()
 
 	return vs, nil
@@ -82,21 +159,22 @@ func NewInMemoryVectorStore(persistDir string) (*InMemoryVectorStore, error) {
 // Add 将一个文档添加到存储中，并将其排队等待持久化。
 func (vs *InMemoryVectorStore) Add(doc Document) error {
 	vs.mu.Lock()
+	defer vs.mu.Unlock()
 	vs.docs = append(vs.docs, doc)
-	vs.mu.Unlock()
 
-	// 非阻塞地写入队列
+	// 在锁内非阻塞地写入队列，保证写入队列的顺序与内存中的顺序一致，Replace 的替换标记不会越过之前的文档
 	select {
 	case vs.writeQueue <- doc:
 		// 文档成功排队等待异步写入
 	default:
 		// 如果队列已满，则记录警告并丢弃该文档的异步写入
+		vs.lastFull.Store(time.Now().UnixNano())
 		Logger.Warn().Msg("VectorStore write queue is full, dropping document for async write.")
 	}
 	return nil
 }
 
-// Search 在存储中的文档上执行余弦相似度搜索。
+// Search 在存储中的文档上执行相似度搜索，默认使用余弦相似度。
 // queryVec: 查询向量。
 // topK: 返回最相似结果的数量。
 func (vs *InMemoryVectorStore) Search(queryVec []float64, topK int) ([]SearchResult, error) {
@@ -109,7 +187,7 @@ func (vs *InMemoryVectorStore) Search(queryVec []float64, topK int) ([]SearchRes
 		if len(doc.Embedding) != len(queryVec) {
 			continue // 跳过嵌入维度不匹配的文档
 		}
-		score := cosineSimilarity(queryVec, doc.Embedding)
+		score := vs.score(queryVec, doc.Embedding)
 		results = append(results, SearchResult{
 			Doc:   doc,
 			Score: score,
@@ -127,6 +205,168 @@ func (vs *InMemoryVectorStore) Search(queryVec []float64, topK int) ([]SearchRes
 	return results, nil
 }
 
+// SourceChanged 比较指定来源已存储的内容哈希与给定哈希。
+func (vs *InMemoryVectorStore) SourceChanged(source string, hash string) (bool, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	for _, doc := range vs.docs {
+		if docSource(doc) == source {
+			stored, _ := doc.Metadata[MetaSourceHash].(string)
+			return stored == "" || stored != hash, nil
+		}
+	}
+	return true, nil
+}
+
+// DeleteBySource 从内存中删除指定来源的所有文档，并在向量文件中追加一条删除记录。
+// 删除记录与新增文档经过同一个写入队列，保证其之前排队的同一来源文档在重新加载时也会被移除。
+func (vs *InMemoryVectorStore) DeleteBySource(source string) (int, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	kept := vs.docs[:0]
+	removed := 0
+	for _, doc := range vs.docs {
+		if docSource(doc) == source {
+			removed++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	vs.docs = kept
+
+	if removed > 0 {
+		// 删除记录不能丢弃，因此阻塞写入；在锁内发送以免排到之后的替换标记后面
+		vs.writeQueue <- Document{Metadata: map[string]any{metaDeletedSource: source}}
+	}
+	return removed, nil
+}
+
+// DeleteStaleVersions 从内存中删除指定来源的旧版本文档，并在向量文件中追加一条带保留哈希的删除记录。
+func (vs *InMemoryVectorStore) DeleteStaleVersions(source string, sourceHash string) (int, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	kept := vs.docs[:0]
+	removed := 0
+	for _, doc := range vs.docs {
+		if isStaleVersion(doc, source, sourceHash) {
+			removed++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	vs.docs = kept
+
+	if removed > 0 {
+		// 与 DeleteBySource 相同，删除记录不能丢弃，在锁内阻塞写入
+		vs.writeQueue <- Document{Metadata: map[string]any{metaDeletedSource: source, metaKeepSourceHash: sourceHash}}
+	}
+	return removed, nil
+}
+
+// Replace 先将 docs 完整写入临时文件，再在写锁下一次性替换内存中的文档，
+// 并通过写入队列发送替换标记，由持久化协程在处理完之前排队的写入后用临时文件覆盖向量文件。
+func (vs *InMemoryVectorStore) Replace(docs []Document) error {
+	var tmp string
+	if vs.filePath != "" {
+		file, err := os.CreateTemp(filepath.Dir(vs.filePath), filepath.Base(vs.filePath)+".replace-*")
+		if err != nil {
+			return fmt.Errorf("failed to create replacement vector file: %w", err)
+		}
+		tmp = file.Name()
+		if err := writeVectorRecords(file, vs.format, docs); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to write replacement vector file: %w", err)
+		}
+	}
+
+	replaced := append(make([]Document, 0, len(docs)), docs...)
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.docs = replaced
+	if tmp != "" {
+		// 替换标记不能丢弃，因此阻塞写入；持久化协程不获取 mu，不会死锁
+		vs.writeQueue <- Document{Metadata: map[string]any{metaReplaceFile: tmp}}
+	}
+	Logger.Info().Int("count", len(replaced)).Msg("Replaced vector store contents")
+	return nil
+}
+
+// Count 返回内存中的文档数量。
+func (vs *InMemoryVectorStore) Count() (int, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return len(vs.docs), nil
+}
+
+// Health 报告持久化协程是否存活以及写入队列是否积压，实现 HealthChecker。
+func (vs *InMemoryVectorStore) Health() SubsystemHealth {
+	return queueHealth("vector_store", vs.alive.Load(), len(vs.writeQueue), cap(vs.writeQueue), vs.lastFull.Load())
+}
+
+// Scan 在读锁下逐个传递文档的副本，不会一次性复制整个存储。
+// 遍历期间持有读锁，fn 中不能调用 Add、DeleteBySource 等写操作。
+func (vs *InMemoryVectorStore) Scan(fn func(Document) bool) error {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	for _, doc := range vs.docs {
+		if !fn(copyDocument(doc)) {
+			break
+		}
+	}
+	return nil
+}
+
+// copyDocument 返回文档的深拷贝，调用方修改元数据或向量不会影响存储
+func copyDocument(doc Document) Document {
+	out := doc
+	if doc.Metadata != nil {
+		out.Metadata = make(map[string]any, len(doc.Metadata))
+		for k, v := range doc.Metadata {
+			out.Metadata[k] = v
+		}
+	}
+	out.Embedding = append([]float64(nil), doc.Embedding...)
+	return out
+}
+
+// ListSources 遍历所有文档，统计每个来源的块数量。
+func (vs *InMemoryVectorStore) ListSources() ([]SourceInfo, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, doc := range vs.docs {
+		counts[docSource(doc)]++
+	}
+
+	sources := make([]SourceInfo, 0, len(counts))
+	for source, count := range counts {
+		sources = append(sources, SourceInfo{Source: source, ChunkCount: count})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Source < sources[j].Source
+	})
+	return sources, nil
+}
+
+// GetSourceChunks 返回指定来源的所有文档，按块索引升序排列。
+func (vs *InMemoryVectorStore) GetSourceChunks(source string) ([]Document, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	var chunks []Document
+	for _, doc := range vs.docs {
+		if docSource(doc) == source {
+			chunks = append(chunks, doc)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return docChunkIndex(chunks[i]) < docChunkIndex(chunks[j])
+	})
+	return chunks, nil
+}
+
 // Close 优雅地关闭持久化循环。
 func (vs *InMemoryVectorStore) Close() error {
 	// 发出信号，通知 persistenceLoop 停止并处理所有剩余的项目
@@ -135,42 +375,33 @@ func (vs *InMemoryVectorStore) Close() error {
 	return nil
 }
 
-// loadJSONL 从磁盘上的 JSONL 文件读取向量存储。
-func (vs *InMemoryVectorStore) loadJSONL() error {
+// load 从磁盘上的向量文件读取向量存储。
+func (vs *InMemoryVectorStore) load() error {
 	if vs.filePath == "" {
 		return nil
 	}
 
-	file, err := os.OpenFile(vs.filePath, os.O_RDONLY|os.O_CREATE, 0644)
+	loadedDocs, err := readVectorFile(vs.filePath, vs.format)
 	if err != nil {
-		return fmt.Errorf("failed to open vector store file: %w", err)
+		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	var loadedDocs []Document
-	for scanner.Scan() {
-		var doc Document
-		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
-			Logger.Warn().Err(err).Msg("Failed to unmarshal document from vector store file, skipping line.")
-			continue
+	if len(loadedDocs) == 0 && vs.format != VectorFormatJSONL {
+		// 切换格式后未转换旧数据时给出提示
+		legacy := filepath.Join(filepath.Dir(vs.filePath), vectorFileName(VectorFormatJSONL))
+		if _, err := os.Stat(legacy); err == nil {
+			Logger.Warn().Str("path", legacy).Msg("Found vectors in jsonl format but the configured format differs; run with -convert-vectors to migrate")
 		}
-		loadedDocs = append(loadedDocs, doc)
-	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading vector store file: %w", err)
 	}
 
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 	vs.docs = loadedDocs
-	Logger.Info().Int("count", len(loadedDocs)).Str("path", vs.filePath).Msg("Loaded documents from vector store")
+	Logger.Info().Int("count", len(loadedDocs)).Str("path", vs.filePath).Str("format", vs.format).Msg("Loaded documents from vector store")
 	return nil
 }
 
-// appendDocumentToJSONL 将单个文档追加到 JSONL 文件。
-func (vs *InMemoryVectorStore) appendDocumentToJSONL(doc Document) error {
+// appendDocument 将单个文档追加到向量文件。
+func (vs *InMemoryVectorStore) appendDocument(doc Document) error {
 	if vs.filePath == "" {
 		return nil
 	}
@@ -181,12 +412,12 @@ func (vs *InMemoryVectorStore) appendDocumentToJSONL(doc Document) error {
 	}
 	defer file.Close()
 
-	line, err := json.Marshal(doc)
+	rec, err := encodeDocument(doc, vs.format)
 	if err != nil {
-		return fmt.Errorf("failed to marshal document for append: %w", err)
+		return fmt.Errorf("failed to encode document for append: %w", err)
 	}
 
-	if _, err := file.Write(append(line, '\n')); err != nil {
+	if _, err := file.Write(rec); err != nil {
 		return fmt.Errorf("failed to write document to file: %w", err)
 	}
 	return nil
@@ -195,6 +426,7 @@ func (vs *InMemoryVectorStore) appendDocumentToJSONL(doc Document) error {
 // persistenceLoop 是将文档保存到磁盘的后台 goroutine。
 func (vs *InMemoryVectorStore) persistenceLoop() {
 	defer vs.wg.Done()
+	defer vs.alive.Store(false)
 
 	for {
 		select {
@@ -202,7 +434,14 @@ func (vs *InMemoryVectorStore) persistenceLoop() {
 			if !ok { // 通道已关闭
 				return // 退出 goroutine
 			}
-			if err := vs.appendDocumentToJSONL(doc); err != nil {
+			if tmp, ok := doc.Metadata[metaReplaceFile].(string); ok {
+				if err := os.Rename(tmp, vs.filePath); err != nil {
+					os.Remove(tmp)
+					Logger.Error().Err(err).Str("path", vs.filePath).Msg("Failed to swap in replacement vector store file.")
+				}
+				continue
+			}
+			if err := vs.appendDocument(doc); err != nil {
 				Logger.Error().Err(err).Msg("Failed to persist document to vector store.")
 			}
 		case <-vs.closed: // 此通道不再使用，writeQueue 的关闭处理了关闭逻辑
@@ -211,6 +450,72 @@ func (vs *InMemoryVectorStore) persistenceLoop() {
 	}
 }
 
+// isStaleVersion 判断文档是否属于 source 且内容哈希不等于 sourceHash；没有哈希的旧数据同样视为旧版本。
+func isStaleVersion(doc Document, source, sourceHash string) bool {
+	hash, _ := doc.Metadata[MetaSourceHash].(string)
+	return docSource(doc) == source && hash != sourceHash
+}
+
+// docSource 返回文档元数据中的来源，缺失时返回空字符串。
+func docSource(doc Document) string {
+	source, _ := doc.Metadata[MetaSource].(string)
+	return source
+}
+
+// docChunkIndex 返回文档元数据中的块索引。
+// 新添加的文档中为 int，从文件加载后则为 float64。
+func docChunkIndex(doc Document) int {
+	switch v := doc.Metadata[MetaChunk].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// 相似度度量名称
+const (
+	SimilarityCosine    = "cosine"    // 余弦相似度（默认）
+	SimilarityDot       = "dot"       // 点积，适合输出已归一化向量或推荐使用内积的嵌入模型
+	SimilarityEuclidean = "euclidean" // 欧氏距离，转换为 1/(1+d) 使得分越高越相似
+)
+
+// SimilarityFunc 计算两个等长向量的相似度得分，得分越高越相似
+type SimilarityFunc func(a, b []float64) float64
+
+// SimilarityByName 根据名称返回相似度函数，空字符串表示余弦相似度
+func SimilarityByName(name string) (SimilarityFunc, error) {
+	switch strings.ToLower(name) {
+	case "", SimilarityCosine:
+		return cosineSimilarity, nil
+	case SimilarityDot:
+		return dotProduct, nil
+	case SimilarityEuclidean:
+		return euclideanSimilarity, nil
+	}
+	return nil, fmt.Errorf("unsupported similarity metric %q (want cosine, dot or euclidean)", name)
+}
+
+// dotProduct 计算两个向量的点积。
+func dotProduct(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// euclideanSimilarity 计算两个向量之间的欧氏距离 d，并转换为相似度 1/(1+d)。
+func euclideanSimilarity(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return 1 / (1 + math.Sqrt(sum))
+}
+
 // cosineSimilarity 计算两个向量之间的余弦相似度。
 func cosineSimilarity(a, b []float64) float64 {
 	var dotProduct, normA, normB float64
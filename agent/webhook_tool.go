@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// webhook 工具的默认超时（秒）
+const webhookDefaultTimeout = 30
+
+// webhookToolNameRe 限制 webhook 工具名称只包含字母、数字、下划线和连字符
+var webhookToolNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// WebhookToolConfig 定义了一个通过 HTTP webhook 实现的外部工具
+type WebhookToolConfig struct {
+	Name        string            `mapstructure:"name" json:"name"`                           // 工具名称
+	Description string            `mapstructure:"description" json:"description"`             // 提供给模型的工具描述
+	Parameters  map[string]any    `mapstructure:"parameters" json:"parameters,omitempty"`     // 参数的 JSON Schema
+	URL         string            `mapstructure:"url" json:"url"`                             // 接收工具调用的 URL
+	Headers     map[string]string `mapstructure:"headers" json:"headers,omitempty"`           // 额外的请求头，例如鉴权信息
+	TimeoutSecs int               `mapstructure:"timeout_secs" json:"timeout_secs,omitempty"` // 请求超时（秒）
+	Sensitive   bool              `mapstructure:"sensitive" json:"sensitive,omitempty"`       // 是否需要用户确认
+	Keywords    []string          `mapstructure:"keywords" json:"keywords,omitempty"`         // 工具调用验证使用的关键词，为空时不做关键词校验
+}
+
+// WebhookRequest 是发送给 webhook 的请求体
+type WebhookRequest struct {
+	Tool      string          `json:"tool"`       // 被调用的工具名称
+	Arguments json.RawMessage `json:"arguments"`  // 模型生成的参数
+	SessionID string          `json:"session_id"` // 当前会话 ID
+}
+
+// WebhookTool 将工具调用参数 POST 到外部 URL，并将响应作为工具结果返回
+type WebhookTool struct {
+	cfg        WebhookToolConfig
+	restricted bool // 为 true 时禁止访问内网地址（用于通过 API 动态注册的工具）
+}
+
+// NewWebhookTool 校验配置并创建 webhook 工具
+// restricted: 是否禁止访问内网地址，运行时通过 API 注册的工具应设置为 true
+func NewWebhookTool(cfg WebhookToolConfig, restricted bool) (*WebhookTool, error) {
+	if !webhookToolNameRe.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("invalid tool name %q", cfg.Name)
+	}
+	if cfg.Description == "" {
+		return nil, fmt.Errorf("description is required")
+	}
+	if _, err := validateOutboundURL(cfg.URL); err != nil {
+		return nil, err
+	}
+	if cfg.Parameters == nil {
+		cfg.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	return &WebhookTool{cfg: cfg, restricted: restricted}, nil
+}
+
+func (t *WebhookTool) Name() string                 { return t.cfg.Name }
+func (t *WebhookTool) Description() string          { return t.cfg.Description }
+func (t *WebhookTool) Schema() map[string]any       { return t.cfg.Parameters }
+func (t *WebhookTool) IsSensitive() bool            { return t.cfg.Sensitive }
+func (t *WebhookTool) ValidationKeywords() []string { return t.cfg.Keywords }
+func (t *WebhookTool) Run(ctx context.Context, argsJSON string, sessionID string, _ *Agent, _ chan<- StreamEvent) (string, error) {
+	ctx, span := tracer.Start(ctx, "Tool.Webhook")
+	defer span.End()
+	span.SetAttributes(attribute.String("tool", t.cfg.Name), attribute.String("url", t.cfg.URL))
+
+	if argsJSON == "" {
+		argsJSON = "{}"
+	}
+	if !json.Valid([]byte(argsJSON)) {
+		return "", fmt.Errorf("invalid args: not valid JSON")
+	}
+	body, err := json.Marshal(WebhookRequest{Tool: t.cfg.Name, Arguments: json.RawMessage(argsJSON), SessionID: sessionID})
+	if err != nil {
+		return "", err
+	}
+
+	timeout := t.cfg.TimeoutSecs
+	if timeout <= 0 {
+		timeout = webhookDefaultTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	if t.restricted {
+		client = newSSRFSafeClient(time.Duration(timeout) * time.Second)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("invalid request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", markTransient(fmt.Errorf("webhook request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, httpRequestReadLimit))
+	if err != nil {
+		return "", markTransient(fmt.Errorf("read webhook response failed: %w", err))
+	}
+	span.SetAttributes(attribute.Int("status", resp.StatusCode))
+
+	if resp.StatusCode >= 500 {
+		return "", markTransient(fmt.Errorf("webhook status %d: %s", resp.StatusCode, truncateString(string(respBody), 200)))
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Sprintf("webhook error: status %d\n%s", resp.StatusCode, truncateString(string(respBody), httpRequestMaxResponse)), nil
+	}
+	return truncateString(string(respBody), httpRequestMaxResponse), nil
+}
+
+// RegisterWebhookTool 在运行时为 Agent 注册一个 webhook 工具
+// 不能覆盖已注册的同名工具
+func (a *Agent) RegisterWebhookTool(cfg WebhookToolConfig, restricted bool) error {
+	tool, err := NewWebhookTool(cfg, restricted)
+	if err != nil {
+		return err
+	}
+	if _, exists := a.toolRegistry.Get(tool.Name()); exists {
+		return fmt.Errorf("tool %q is already registered", tool.Name())
+	}
+	a.toolRegistry.Register(tool)
+	Logger.Info().Str("tool", tool.Name()).Str("url", cfg.URL).Msg("Registered webhook tool")
+	return nil
+}
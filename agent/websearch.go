@@ -7,21 +7,31 @@ package agent
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+// DefaultWebUserAgent 是默认的 User-Agent，模拟常见浏览器以减少被网站拦截
+const DefaultWebUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
 // WebSearchArgs 定义了网页搜索工具的参数结构
 type WebSearchArgs struct {
 	Query      string `json:"query"`                 // 搜索查询字符串
 	NumResults int    `json:"num_results,omitempty"` // 返回的搜索结果数量，可选
-	FetchPages bool   `json:"fetch_pages,omitempty"` // 是否抓取搜索结果页面的完整内容，可选
+	FetchPages bool   `json:"fetch_pages,omitempty"` // 是否抓取所有搜索结果页面的完整内容，可选
+	FetchTopN  int    `json:"fetch_top_n,omitempty"` // 只抓取前 N 个结果的完整内容，其余只返回摘要；大于 0 时优先于 FetchPages，可选
 	Timeout    int    `json:"timeout,omitempty"`     // 搜索请求的超时时间（秒），可选
+	Region     string `json:"region,omitempty"`      // DuckDuckGo 地区代码，例如 "us-en"、"cn-zh"，对应 kl 参数，可选
+	SafeSearch string `json:"safe_search,omitempty"` // 安全搜索级别："strict"、"moderate" 或 "off"，对应 kp 参数，可选
+	// MaxContentLen 每个抓取页面保留的最大字符数，超出部分被截断，可选
+	MaxContentLen int `json:"max_content_len,omitempty"`
 }
 
 // WebSearchResult 定义了单个网页搜索结果的结构
@@ -33,20 +43,132 @@ type WebSearchResult struct {
 	Content string `json:"content,omitempty"` // 抓取到的页面完整内容，如果 FetchPages 为 true
 }
 
-// WebSearch 执行网页搜索，使用 DuckDuckGo 的 HTML 接口
-// args: 网页搜索的参数
-// 返回搜索结果列表和可能发生的错误
-func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
-	Logger.Info().Str("query", args.Query).Msg("Executing web_search tool")
+// web_search 参数的默认值和上限，配置未设置时使用
+const (
+	DefaultWebSearchResults    = 10 // 默认返回的结果数量
+	DefaultWebSearchMaxResults = 20 // 结果数量上限
+	DefaultWebSearchTimeout    = 15 // 默认超时（秒）
+	DefaultWebSearchMaxTimeout = 60 // 超时上限（秒）
+
+	DefaultWebSearchContentLen    = 4000  // 每个抓取页面默认保留的字符数
+	DefaultWebSearchMaxContentLen = 20000 // 每个抓取页面保留字符数的上限
+)
+
+// webSearchSafeSearch 将安全搜索级别映射为 DuckDuckGo 的 kp 参数值
+var webSearchSafeSearch = map[string]string{
+	"strict":   "1",
+	"moderate": "-1",
+	"off":      "-2",
+}
+
+// webSearchURL 构造 DuckDuckGo HTML 搜索地址，未指定地区和安全搜索时保持默认行为
+func webSearchURL(args WebSearchArgs) (string, error) {
+	params := url.Values{}
+	params.Set("q", args.Query)
+	if args.Region != "" {
+		params.Set("kl", strings.ToLower(args.Region))
+	}
+	if args.SafeSearch != "" {
+		kp, ok := webSearchSafeSearch[strings.ToLower(args.SafeSearch)]
+		if !ok {
+			return "", fmt.Errorf("invalid safe_search '%s': use strict, moderate or off", args.SafeSearch)
+		}
+		params.Set("kp", kp)
+	}
+	return "https://html.duckduckgo.com/html/?" + params.Encode(), nil
+}
+
+// normalizeResultURL 归一化搜索结果链接用于去重：忽略协议、主机名大小写、www 前缀、
+// 默认端口、片段、末尾斜杠以及 utm_* 跟踪参数。无法解析时返回原始链接
+func normalizeResultURL(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return link
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	q := u.Query()
+	for key := range q {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") {
+			q.Del(key)
+		}
+	}
+	normalized := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if encoded := q.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+// normalizeWebSearchArgs 根据配置填充默认值，并将结果数量和超时限制在上限以内
+func normalizeWebSearchArgs(args WebSearchArgs, cfg WebSearchConfig) WebSearchArgs {
+	defaultResults := cfg.DefaultResults
+	if defaultResults <= 0 {
+		defaultResults = DefaultWebSearchResults
+	}
+	maxResults := cfg.MaxResults
+	if maxResults <= 0 {
+		maxResults = DefaultWebSearchMaxResults
+	}
+	defaultTimeout := cfg.DefaultTimeout
+	if defaultTimeout <= 0 {
+		defaultTimeout = DefaultWebSearchTimeout
+	}
+	maxTimeout := cfg.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = DefaultWebSearchMaxTimeout
+	}
+
 	if args.NumResults <= 0 {
-		args.NumResults = 10 // 默认返回 10 个结果
+		args.NumResults = defaultResults
 	}
+	args.NumResults = min(args.NumResults, maxResults)
 	if args.Timeout <= 0 {
-		args.Timeout = 15 // 默认超时 15 秒
+		args.Timeout = defaultTimeout
+	}
+	args.Timeout = min(args.Timeout, maxTimeout)
+
+	defaultContentLen := cfg.DefaultContentLen
+	if defaultContentLen <= 0 {
+		defaultContentLen = DefaultWebSearchContentLen
+	}
+	maxContentLen := cfg.MaxContentLen
+	if maxContentLen <= 0 {
+		maxContentLen = DefaultWebSearchMaxContentLen
+	}
+	if args.MaxContentLen <= 0 {
+		args.MaxContentLen = defaultContentLen
 	}
+	args.MaxContentLen = min(args.MaxContentLen, maxContentLen)
+	return args
+}
+
+// WebSearch 执行网页搜索，使用 DuckDuckGo 的 HTML 接口
+// args: 网页搜索的参数
+// cfg: 网页搜索配置，用于设置请求头以及结果数量和超时的默认值与上限
+// 返回搜索结果列表和可能发生的错误
+func WebSearch(args WebSearchArgs, cfg WebSearchConfig) ([]WebSearchResult, error) {
+	return WebSearchWithProgress(args, cfg, nil)
+}
+
+// WebSearchWithProgress 与 WebSearch 相同，但在抓取页面时通过 onProgress 报告进度
+// onProgress 可能被多个抓取协程并发调用，为 nil 时不报告
+func WebSearchWithProgress(args WebSearchArgs, cfg WebSearchConfig, onProgress func(msg string)) ([]WebSearchResult, error) {
+	report := func(format string, a ...any) {
+		if onProgress != nil {
+			onProgress(fmt.Sprintf(format, a...))
+		}
+	}
+
+	Logger.Info().Str("query", args.Query).Msg("Executing web_search tool")
+	args = normalizeWebSearchArgs(args, cfg)
 
-	query := url.QueryEscape(args.Query)                        // 对查询字符串进行 URL 编码
-	searchURL := "https://html.duckduckgo.com/html/?q=" + query // DuckDuckGo HTML 搜索接口
+	searchURL, err := webSearchURL(args) // DuckDuckGo HTML 搜索接口
+	if err != nil {
+		return nil, err
+	}
 
 	// 创建带有超时设置的 HTTP 客户端
 	client := &http.Client{
@@ -55,17 +177,21 @@ func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
 
 	// 创建 HTTP GET 请求
 	req, _ := http.NewRequest("GET", searchURL, nil)
-	req.Header.Set("User-Agent", "golang-ai-agent/1.0") // 设置 User-Agent
+	setWebHeaders(req, cfg) // 设置 User-Agent 等请求头
 
 	// 发送搜索请求
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("search request failed: %w", err)
+		return nil, markTransient(fmt.Errorf("search request failed: %w", err)) // 网络错误可以重试
 	}
 	defer resp.Body.Close() // 确保响应体关闭
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("search status %d", resp.StatusCode)
+		err := fmt.Errorf("search status %d", resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return nil, markTransient(err) // 限流和服务端错误可以重试
+		}
+		return nil, err
 	}
 
 	// 使用 goquery 解析 HTML 响应
@@ -75,6 +201,7 @@ func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
 	}
 
 	var results []WebSearchResult
+	seen := make(map[string]bool) // 已收录结果的归一化链接，用于去重
 
 	// 遍历搜索结果，提取标题、链接和摘要
 	doc.Find(".result").EachWithBreak(func(i int, s *goquery.Selection) bool {
@@ -99,6 +226,14 @@ func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
 			}
 		}
 
+		if link != "" {
+			key := normalizeResultURL(link)
+			if seen[key] {
+				return true // 跳过重复的链接
+			}
+			seen[key] = true
+		}
+
 		results = append(results, WebSearchResult{
 			Title:   title,
 			Link:    link,
@@ -108,28 +243,43 @@ func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
 	})
 
 	// 如果请求抓取页面内容且有搜索结果，则并发抓取页面
-	if args.FetchPages && len(results) > 0 {
+	// 确定需要抓取完整内容的结果数量：fetch_top_n 只抓取前 N 个，fetch_pages 抓取全部
+	fetchCount := 0
+	if args.FetchTopN > 0 {
+		fetchCount = min(args.FetchTopN, len(results))
+	} else if args.FetchPages {
+		fetchCount = len(results)
+	}
+
+	if fetchCount > 0 {
+		report("找到 %d 个结果，正在抓取前 %d 个页面的内容...", len(results), fetchCount)
 		var wg sync.WaitGroup
-		wg.Add(len(results))
+		var fetched atomic.Int32
+		wg.Add(fetchCount)
 
-		for i := range results {
+		for i := range fetchCount {
 			go func(idx int) {
 				defer wg.Done()
 				if results[idx].Link == "" {
 					return
 				}
-				txt, err := fetchPageText(results[idx].Link, args.Timeout) // 抓取页面文本
+				txt, err := fetchPageText(results[idx].Link, args.Timeout, cfg) // 抓取页面文本
 				if err == nil {
-					// 将页面内容截断到合理长度
-					const maxContentLength = 4000
-					if len(txt) > maxContentLength {
-						results[idx].Content = txt[:maxContentLength] + "\n...[truncated]"
+					// 将页面内容按字符截断到 max_content_len，避免切断多字节字符
+					if runes := []rune(txt); len(runes) > args.MaxContentLen {
+						results[idx].Content = string(runes[:args.MaxContentLen]) + "\n...[truncated]"
 					} else {
 						results[idx].Content = txt
 					}
 				} else {
 					results[idx].Content = fmt.Sprintf("fetch error: %v", err) // 记录抓取错误
 				}
+				done := fetched.Add(1)
+				if err != nil {
+					report("[%d/%d] 抓取失败: %s (%v)", done, fetchCount, results[idx].Link, err)
+				} else {
+					report("[%d/%d] 已抓取: %s", done, fetchCount, results[idx].Link)
+				}
 			}(i)
 		}
 		wg.Wait() // 等待所有页面抓取完成
@@ -138,15 +288,22 @@ func WebSearch(args WebSearchArgs) ([]WebSearchResult, error) {
 	return results, nil
 }
 
+// fetchPageMaxBytes 是抓取页面时读取的响应体最大字节数，超出部分被忽略
+const fetchPageMaxBytes = 5 << 20
+
 // fetchPageText 抓取指定 URL 的页面文本内容
 // pageURL: 要抓取的页面 URL
 // timeout: HTTP 请求超时时间（秒）
+// cfg: 网页搜索配置，用于设置请求头
 // 返回页面文本内容和可能发生的错误
-func fetchPageText(pageURL string, timeout int) (string, error) {
-	client := &http.Client{Timeout: time.Duration(timeout) * time.Second} // 创建带有超时设置的 HTTP 客户端
+func fetchPageText(pageURL string, timeout int, cfg WebSearchConfig) (string, error) {
+	if _, err := validateOutboundURL(pageURL); err != nil {
+		return "", err
+	}
+	client := newSSRFSafeClient(time.Duration(timeout) * time.Second) // 创建带有超时设置且禁止访问内网地址的 HTTP 客户端
 
 	req, _ := http.NewRequest("GET", pageURL, nil)
-	req.Header.Set("User-Agent", "golang-ai-agent/1.0") // 设置 User-Agent
+	setWebHeaders(req, cfg) // 设置 User-Agent 等请求头
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -158,8 +315,8 @@ func fetchPageText(pageURL string, timeout int) (string, error) {
 		return "", fmt.Errorf("failed with status: %d", resp.StatusCode)
 	}
 
-	// 使用 goquery 解析 HTML 响应
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	// 使用 goquery 解析 HTML 响应，限制读取的大小，避免超大页面耗尽内存
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, fetchPageMaxBytes))
 	if err != nil {
 		return "", err
 	}
@@ -178,3 +335,19 @@ func fetchPageText(pageURL string, timeout int) (string, error) {
 
 	return text, nil
 }
+
+// setWebHeaders 根据配置为请求设置 User-Agent、Accept-Language 和额外的请求头
+func setWebHeaders(req *http.Request, cfg WebSearchConfig) {
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = DefaultWebUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	if cfg.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", cfg.AcceptLanguage)
+	}
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 会话工作区的默认限制
+const (
+	DefaultWorkspaceMaxFiles   = 200 // 每个会话工作区最多允许的文件数
+	DefaultWorkspaceMaxTotalMB = 50  // 每个会话工作区允许的总大小 (MB)
+)
+
+// WorkspaceDir 返回指定会话的工作区目录路径（不保证目录存在）
+func (a *Agent) WorkspaceDir(sessionID string) string {
+	return filepath.Join(a.config.Workspace.BaseDir, filepath.Base(sessionID))
+}
+
+// ResolveWorkspacePath 将相对路径解析为会话工作区内的绝对路径
+// 拒绝绝对路径以及任何逃逸出工作区的路径
+func (a *Agent) ResolveWorkspacePath(sessionID, rel string) (string, error) {
+	if sessionID == "" {
+		return "", fmt.Errorf("no active session for workspace")
+	}
+	if !ValidSessionID(sessionID) {
+		return "", ErrInvalidSessionID
+	}
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("absolute path not allowed in workspace")
+	}
+	root, err := filepath.Abs(a.WorkspaceDir(sessionID))
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(root, rel)
+	if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the session workspace")
+	}
+	return full, nil
+}
+
+// workspaceUsage 统计工作区中已有的文件数量和总大小
+func workspaceUsage(dir string) (int, int64, error) {
+	var count int
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		count++
+		total += info.Size()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	return count, total, err
+}
+
+// SaveWorkspaceFile 将文件保存到会话工作区，并检查文件数量和总大小限制
+// 同名文件会被覆盖，覆盖时旧文件的大小不计入限制
+func (a *Agent) SaveWorkspaceFile(sessionID, name string, content []byte) error {
+	full, err := a.ResolveWorkspacePath(sessionID, filepath.Base(name))
+	if err != nil {
+		return err
+	}
+
+	maxFiles := a.config.Workspace.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultWorkspaceMaxFiles
+	}
+	maxTotalMB := a.config.Workspace.MaxTotalMB
+	if maxTotalMB <= 0 {
+		maxTotalMB = DefaultWorkspaceMaxTotalMB
+	}
+
+	dir := a.WorkspaceDir(sessionID)
+	count, total, err := workspaceUsage(dir)
+	if err != nil {
+		return fmt.Errorf("workspace usage error: %w", err)
+	}
+	if info, err := os.Stat(full); err == nil {
+		count--
+		total -= info.Size()
+	}
+	if count+1 > maxFiles {
+		return fmt.Errorf("workspace file limit exceeded (max %d files)", maxFiles)
+	}
+	if total+int64(len(content)) > int64(maxTotalMB)*1024*1024 {
+		return fmt.Errorf("workspace size limit exceeded (max %d MB)", maxTotalMB)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(full, content, 0o644)
+}
+
+// copyWorkspaceTo 将会话工作区中的所有文件复制到目标目录，用于代码沙箱
+func (a *Agent) copyWorkspaceTo(sessionID, dst string) error {
+	if !ValidSessionID(sessionID) {
+		return ErrInvalidSessionID
+	}
+	src := a.WorkspaceDir(sessionID)
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, 0o644)
+	})
+}
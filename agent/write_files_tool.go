@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxWriteFilesCount = 50               // write_files 单次调用允许写入的最大文件数
+	maxWriteFilesBytes = 10 * 1024 * 1024 // write_files 单次调用允许写入的内容总大小，与 write_file 的单文件上限一致
+)
+
+// WriteFilesArgs 定义了 write_files 工具的参数结构
+type WriteFilesArgs struct {
+	Files []WriteFileArgs `json:"files"` // 要写入的文件，按顺序写入
+}
+
+// WriteFileResult 是 write_files 中单个文件的写入结果
+type WriteFileResult struct {
+	Path   string `json:"path"`
+	OK     bool   `json:"ok"`
+	Result string `json:"result"` // "written"、"appended" 或错误信息
+}
+
+// WriteFilesResult 是 write_files 返回给模型的结构化结果
+type WriteFilesResult struct {
+	Written int               `json:"written"` // 成功写入的文件数
+	Failed  int               `json:"failed"`  // 写入失败的文件数
+	Files   []WriteFileResult `json:"files"`
+}
+
+// WriteFilesTool 一次写入多个文件，适合生成项目脚手架等多文件场景
+// 所有文件先统一校验，任何一个路径或扩展名不合法时不写入任何文件，避免留下不完整的结果
+type WriteFilesTool struct{}
+
+func (t *WriteFilesTool) Name() string { return "write_files" }
+func (t *WriteFilesTool) Description() string {
+	return "Writes multiple files in one call, e.g. when scaffolding a project. Paths must be relative and stay inside the working directory. All files are validated first; if any is invalid nothing is written. Returns per-file results. Use this ONLY when the user explicitly asks to create or save files."
+}
+func (t *WriteFilesTool) Schema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"files": map[string]any{
+				"type":        "array",
+				"description": fmt.Sprintf("The files to write, at most %d.", maxWriteFilesCount),
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"path":    map[string]any{"type": "string", "description": "The relative path to the file."},
+						"content": map[string]any{"type": "string", "description": "The content to write."},
+						"mode":    map[string]any{"type": "string", "description": "Write mode: 'overwrite' (default) or 'append'."},
+					},
+					"required": []string{"path", "content"},
+				},
+			},
+		},
+		"required": []string{"files"},
+	}
+}
+func (t *WriteFilesTool) IsSensitive() bool { return true }
+func (t *WriteFilesTool) Run(ctx context.Context, argsJSON string, _ string, a *Agent, _ chan<- StreamEvent) (string, error) {
+	_, span := tracer.Start(ctx, "Tool.WriteFiles")
+	defer span.End()
+
+	var args WriteFilesArgs
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("invalid args: %v", err)
+	}
+	span.SetAttributes(attribute.Int("files.count", len(args.Files)))
+
+	if err := validateWriteFiles(args.Files, a.config.WriteFile.AllowedExtensions); err != nil {
+		return "write error: " + err.Error() + "; no files were written", nil
+	}
+
+	result := WriteFilesResult{Files: make([]WriteFileResult, 0, len(args.Files))}
+	for _, f := range args.Files {
+		res := WriteFile(f)
+		ok := res == "written" || res == "appended"
+		if ok {
+			result.Written++
+		} else {
+			result.Failed++
+		}
+		result.Files = append(result.Files, WriteFileResult{Path: f.Path, OK: ok, Result: res})
+	}
+	span.SetAttributes(attribute.Int("files.written", result.Written), attribute.Int("files.failed", result.Failed))
+
+	bs, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal write_files result: %v", err)
+	}
+	return string(bs), nil
+}
+
+// validateWriteFiles 在写入前校验所有文件：数量、总大小、写入模式、路径不能是绝对路径或跳出工作目录，
+// 扩展名必须在 write_file.allowed_extensions 中，同一路径不能出现两次
+func validateWriteFiles(files []WriteFileArgs, allowed []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("files is empty")
+	}
+	if len(files) > maxWriteFilesCount {
+		return fmt.Errorf("too many files: %d (max %d)", len(files), maxWriteFilesCount)
+	}
+	total := 0
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Path == "" {
+			return fmt.Errorf("file path is empty")
+		}
+		if !filepath.IsLocal(f.Path) {
+			return fmt.Errorf("%s: path must be relative and stay inside the working directory", f.Path)
+		}
+		if f.Mode != "" && f.Mode != "overwrite" && f.Mode != "append" {
+			return fmt.Errorf("%s: invalid mode %q, use 'overwrite' or 'append'", f.Path, f.Mode)
+		}
+		if !writeExtensionAllowed(f.Path, allowed) {
+			return fmt.Errorf("%s: extension %q is not allowed, allowed extensions: %s", f.Path, filepath.Ext(f.Path), strings.Join(allowed, ", "))
+		}
+		clean := filepath.Clean(f.Path)
+		if seen[clean] {
+			return fmt.Errorf("%s: duplicate path", f.Path)
+		}
+		seen[clean] = true
+		total += len(f.Content)
+	}
+	if total > maxWriteFilesBytes {
+		return fmt.Errorf("content too large: %d bytes in total (max 10MB)", total)
+	}
+	return nil
+}
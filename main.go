@@ -4,6 +4,8 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +20,10 @@ import (
 
 // main 函数启动HTTP服务器并初始化核心组件
 func main() {
+	// 命令行参数：转换向量文件格式后退出
+	convertVectors := flag.String("convert-vectors", "", "convert the vector store from storage.vector_format to the given format (jsonl or binary) and exit")
+	flag.Parse()
+
 	// 加载应用程序配置
 	cfg, err := agent.LoadConfig()
 	if err != nil {
@@ -31,6 +37,16 @@ func main() {
 	// 使用 defer 确保日志系统在 main 函数退出时被关闭，释放资源
 	defer agent.CloseLogger()
 
+	if *convertVectors != "" {
+		n, err := agent.ConvertVectorStore(cfg.Storage.VectorPath, cfg.Storage.VectorFormat, *convertVectors)
+		if err != nil {
+			agent.Logger.Fatal().Err(err).Msg("Vector store conversion failed")
+		}
+		agent.Logger.Info().Int("documents", n).Str("from", cfg.Storage.VectorFormat).Str("to", *convertVectors).
+			Msg("Vector store converted; set storage.vector_format accordingly")
+		return
+	}
+
 	// 初始化 OpenTelemetry Tracer Provider，用于分布式追踪
 	tp, err := agent.InitTracerProvider(cfg.Service.Version)
 	if err != nil {
@@ -44,7 +60,14 @@ func main() {
 	}()
 
 	// 初始化会话记忆存储
-	mem, err := agent.NewMemoryV3(cfg.Storage.MemoryPath)
+	mem, err := agent.NewMemoryV3(cfg.Storage.MemoryPath,
+		agent.WithPersistEveryN(cfg.Storage.PersistEveryN),
+		agent.WithPersistOnSessionChange(cfg.Storage.PersistOnSessionChange),
+		agent.WithPrettyJSON(cfg.Storage.PrettyJSON),
+		agent.WithCompressArchived(cfg.Storage.CompressArchived),
+		agent.WithFlatLog(cfg.Storage.FlatLog),
+		agent.WithFlatLogLimits(cfg.Storage.MaxConversations, cfg.Storage.MaxNotes),
+	)
 	if err != nil {
 		agent.Logger.Fatal().Err(err).Msg("Memory init error")
 	}
@@ -56,7 +79,14 @@ func main() {
 	}()
 
 	// 初始化向量存储，用于 RAG (检索增强生成)
-	vectorStore, err := agent.NewInMemoryVectorStore(cfg.Storage.VectorPath)
+	similarity, err := agent.SimilarityByName(cfg.Storage.VectorMetric)
+	if err != nil {
+		agent.Logger.Fatal().Err(err).Msg("Invalid vector store config")
+	}
+	vectorStore, err := agent.NewInMemoryVectorStore(cfg.Storage.VectorPath,
+		agent.WithVectorFormat(cfg.Storage.VectorFormat),
+		agent.WithSimilarity(similarity),
+	)
 	if err != nil {
 		agent.Logger.Fatal().Err(err).Msg("Vector store init error")
 	}
@@ -67,19 +97,101 @@ func main() {
 		}
 	}()
 
+	// 初始化入库任务索引，用于恢复中断的知识入库
+	ingestJobs, err := agent.NewIngestJobStore(cfg.Storage.VectorPath)
+	if err != nil {
+		agent.Logger.Fatal().Err(err).Msg("Ingest job store init error")
+	}
+
 	// 创建 Ollama 客户端，用于与大语言模型交互
-	ollama := agent.NewOllamaClient(cfg)
+	var ollamaOpts []agent.OllamaClientOption
+	if cfg.Ollama.Temperature != nil {
+		ollamaOpts = append(ollamaOpts, agent.WithTemperature(*cfg.Ollama.Temperature))
+	}
+	if cfg.Ollama.Seed != nil {
+		ollamaOpts = append(ollamaOpts, agent.WithDefaultSeed(*cfg.Ollama.Seed))
+	}
+	if len(cfg.Ollama.Stop) > 0 {
+		ollamaOpts = append(ollamaOpts, agent.WithStopSequences(cfg.Ollama.Stop))
+	}
+	if cfg.Ollama.Cache.Enabled {
+		ollamaOpts = append(ollamaOpts, agent.WithResponseCache(time.Duration(cfg.Ollama.Cache.TTLSecs)*time.Second, cfg.Ollama.Cache.MaxEntries))
+	}
+	ollama := agent.NewOllamaClient(cfg, ollamaOpts...)
+	if cfg.Ollama.VerifyModel {
+		verifyOllamaModel(ollama)
+	}
+
+	// 配置了备用服务时，使用故障转移链包装主服务
+	var llm agent.LLMProvider = ollama
+	if len(cfg.Ollama.Fallbacks) > 0 {
+		targets := []agent.FallbackTarget{{Name: "primary", Provider: ollama}}
+		for i, fb := range cfg.Ollama.Fallbacks {
+			fbCfg := cfg
+			fbCfg.Ollama.URL = fb.URL
+			if fb.Model != "" {
+				fbCfg.Ollama.DefaultModel = fb.Model
+			}
+			if fb.TimeoutSecs > 0 {
+				fbCfg.Ollama.TimeoutSecs = fb.TimeoutSecs
+			}
+			name := fb.Name
+			if name == "" {
+				name = fmt.Sprintf("fallback-%d", i+1)
+			}
+			targets = append(targets, agent.FallbackTarget{Name: name, Provider: agent.NewOllamaClient(fbCfg, ollamaOpts...), Model: fb.Model})
+		}
+		llm = agent.NewFallbackProvider(targets...)
+	}
+	// 熔断器包装整个故障转移链，所有服务都失败才计为一次失败
+	if cfg.Ollama.CircuitBreaker.FailureThreshold > 0 {
+		llm = agent.NewCircuitBreakerProvider(llm, cfg.Ollama.CircuitBreaker.FailureThreshold,
+			time.Duration(cfg.Ollama.CircuitBreaker.CooldownSecs)*time.Second)
+	}
+
+	// 创建嵌入服务，未配置独立端点时回退到主 Ollama 客户端
+	// 嵌入不参与故障转移，以保证向量来自同一个模型
+	embedder := agent.NewEmbeddingProvider(cfg, ollama)
 
 	// --- 多 Agent 初始化 ---
 	// 第一阶段：创建所有 Agent 实例
 	agents := make(map[string]*agent.Agent)
 	for name, agentConfig := range cfg.Agent.Agents {
-		agents[name] = agent.NewAgent(ollama, mem, vectorStore, cfg, agentConfig)
+		agents[name] = agent.NewAgent(llm, embedder, mem, vectorStore, cfg, agentConfig)
+	}
+
+	// 所有 Agent 共享一个确认管理器，子 Agent 的确认请求也能通过主 Agent 的入口响应
+	confirmOpts := []agent.ConfirmationOption{agent.WithConfirmationTimeout(time.Duration(cfg.Confirmation.TimeoutSecs) * time.Second)}
+	switch cfg.Confirmation.Store {
+	case "", "memory":
+	case "file":
+		store, err := agent.NewFileConfirmationStore(cfg.Confirmation.Dir)
+		if err != nil {
+			agent.Logger.Fatal().Err(err).Msg("Confirmation store init error")
+		}
+		confirmOpts = append(confirmOpts, agent.WithConfirmationStore(store, time.Duration(cfg.Confirmation.PollMillis)*time.Millisecond))
+	default:
+		agent.Logger.Fatal().Str("store", cfg.Confirmation.Store).Msg("Unsupported confirmation store")
+	}
+	confirmations := agent.NewConfirmationManager(confirmOpts...)
+	defer confirmations.Close()
+
+	// 所有 Agent 共享一个工具调用审计日志
+	var toolAudit *agent.ToolAuditLog
+	if cfg.Audit.Enabled {
+		toolAudit, err = agent.NewToolAuditLog(cfg.Audit.Path, cfg.Audit.MaxFieldChars)
+		if err != nil {
+			agent.Logger.Fatal().Err(err).Msg("Tool audit log init error")
+		}
+		defer toolAudit.Close()
 	}
 
 	// 第二阶段：为每个 Agent 注入其他 Agent 的引用
 	for _, a := range agents {
 		a.SetOtherAgents(agents)
+		a.SetIngestJobStore(ingestJobs)
+		a.SetConfirmationManager(confirmations)
+		a.SetToolAuditLog(toolAudit)
 	}
 
 	// 获取 "foreman" Agent 作为主 Agent
@@ -88,6 +200,14 @@ func main() {
 		agent.Logger.Fatal().Msg("foreman agent not found in config")
 	}
 
+	// 启动闲置会话归档，服务关闭时停止
+	archiveCtx, stopArchiver := context.WithCancel(context.Background())
+	defer stopArchiver()
+	foremanAgent.StartIdleSessionArchiver(archiveCtx,
+		time.Duration(cfg.Storage.IdleSessionMinutes)*time.Minute,
+		time.Duration(cfg.Storage.IdleCheckMinutes)*time.Minute,
+	)
+
 	// 创建一个新的 HTTP 路由器
 	r := mux.NewRouter()
 	// 注册所有 HTTP 路由和处理器
@@ -98,14 +218,15 @@ func main() {
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}), // 允许所有来源，开发环境方便，生产环境建议指定具体域名
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With", web.RequestIDHeader, web.IdempotencyKeyHeader}),
+		handlers.ExposedHeaders([]string{web.RequestIDHeader, web.IdempotentReplayedHeader}),
 	)
 
 	// 配置 HTTP 服务器
 	srv := &http.Server{
 		Handler:      corsHandler(r), // 将 CORS 中间件应用于路由器
 		Addr:         cfg.Server.Address,
-		WriteTimeout: 0, // 对于流式响应，写入超时设置为 0 (无超时)
+		WriteTimeout: 0, // 对于流式响应，写入超时设置为 0 (无超时)；非流式端点的超时由路由级 TimeoutHandler 控制
 		ReadTimeout:  30 * time.Second,
 	}
 
@@ -138,3 +259,19 @@ func main() {
 
 	agent.Logger.Info().Msg("Server exiting")
 }
+
+// verifyOllamaModel 检查默认模型是否已安装在 Ollama 服务上，只记录警告，不影响启动
+func verifyOllamaModel(ollama *agent.OllamaClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok, err := ollama.HasModel(ctx)
+	if err != nil {
+		agent.Logger.Warn().Err(err).Str("model", ollama.Model()).Msg("Could not verify default model, Ollama /api/tags request failed")
+		return
+	}
+	if !ok {
+		agent.Logger.Warn().Str("model", ollama.Model()).Msg("Default model is not installed on the Ollama server; run `ollama pull` or change ollama.default_model")
+		return
+	}
+	agent.Logger.Info().Str("model", ollama.Model()).Msg("Default model verified")
+}
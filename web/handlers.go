@@ -7,13 +7,21 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -29,20 +37,37 @@ var allowedExtensions = map[string]bool{
 
 // AgentRequest 定义了 /agent 接口的请求结构
 type AgentRequest struct {
-	Prompt    string `json:"prompt"`               // 用户输入的提示词
-	SessionID string `json:"session_id,omitempty"` // 会话 ID，可选
-	Model     string `json:"model,omitempty"`      // 指定使用的模型，可选
+	Prompt    string   `json:"prompt"`               // 用户输入的提示词
+	SessionID string   `json:"session_id,omitempty"` // 会话 ID，可选
+	Model     string   `json:"model,omitempty"`      // 指定使用的模型，可选
+	Plan      bool     `json:"plan,omitempty"`       // 计划 (dry-run) 模式：只返回将要调用的工具，不实际执行，可选
+	Context   []string `json:"context,omitempty"`    // 仅用于本次请求的上下文文档，不写入会话历史或向量库，可选
+	// ResponseSchema 要求回答为符合该 JSON Schema 的 JSON，校验失败时自动修复，结果通过 structured 字段返回，可选
+	ResponseSchema map[string]any `json:"response_schema,omitempty"`
+	// IncludeReasoning 将模型的 <think> 推理内容从回答中分离并通过 reasoning 字段返回，也可以使用 ?reasoning=true，可选
+	IncludeReasoning bool `json:"include_reasoning,omitempty"`
+	// Stop 本次请求的停止序列，覆盖 ollama.stop 配置，传入空数组表示不使用停止序列，可选
+	Stop []string `json:"stop,omitempty"`
+	// Seed 本次请求的随机种子，覆盖 ollama.seed 配置，与 temperature 0 一起使用时结果可复现，可选
+	Seed *int `json:"seed,omitempty"`
 }
 
 // AgentResponse 定义了 /agent 接口的响应结构
 type AgentResponse struct {
-	Answer    string `json:"answer"`     // AI 的回答内容
-	SessionID string `json:"session_id"` // 当前会话 ID
+	Answer           string                              `json:"answer"`                       // AI 的回答内容
+	SessionID        string                              `json:"session_id"`                   // 当前会话 ID
+	PlannedToolCalls []agent.PlannedToolCallEventPayload `json:"planned_tool_calls,omitempty"` // 计划模式下模型提出的工具调用
+	Structured       json.RawMessage                     `json:"structured,omitempty"`         // 请求指定 response_schema 时，经过校验的 JSON 回答
+	Reasoning        string                              `json:"reasoning,omitempty"`          // 请求 include_reasoning 时，与回答分离的推理内容
 }
 
 // SessionCreateRequest 定义了创建会话接口的请求结构
 type SessionCreateRequest struct {
-	Title string `json:"title"` // 会话标题
+	Title        string `json:"title"`                   // 会话标题
+	SystemPrompt string `json:"system_prompt,omitempty"` // 会话专属的系统提示词，可选
+	// AllowedTools 会话允许使用的工具，可选；省略时不限制，空列表表示只能聊天
+	// 由包工头分派的任务还需要列出 call_coder、call_researcher 等调用协作 Agent 的工具
+	AllowedTools []string `json:"allowed_tools,omitempty"`
 }
 
 // SessionCreateResponse 定义了创建会话接口的响应结构
@@ -51,16 +76,97 @@ type SessionCreateResponse struct {
 	Message   string `json:"message"`    // 成功消息
 }
 
-// SessionsListResponse 定义了获取会话列表接口的响应结构
+// SessionsListResponse 定义了获取会话列表接口的旧版响应结构 (?format=map)
 type SessionsListResponse struct {
 	Sessions map[string]map[string]interface{} `json:"sessions"` // 会话列表映射
 }
 
+// SessionsPageResponse 定义了获取会话列表接口的响应结构，会话按顺序排列并分页
+type SessionsPageResponse struct {
+	Sessions []agent.ConversationSessionMeta `json:"sessions"` // 当前页的会话列表
+	Total    int                             `json:"total"`    // 筛选后的会话总数
+	Offset   int                             `json:"offset"`   // 当前页的偏移量
+	Limit    int                             `json:"limit"`    // 每页数量，0 表示不限制
+}
+
+// SessionDetailResponse 定义了获取单个会话元数据接口的响应结构
+type SessionDetailResponse struct {
+	agent.ConversationSessionMeta
+	IsCurrent      bool `json:"is_current"`      // 是否为当前会话
+	LoadedMessages int  `json:"loaded_messages"` // 内存中已加载的消息数量（启动时可能只加载最近的部分）
+}
+
 // SessionMessagesResponse 定义了获取会话消息接口的响应结构
 type SessionMessagesResponse struct {
 	Messages []agent.ChatMessage `json:"messages"` // 会话中的消息列表
 }
 
+// KnowledgeSourcesResponse 定义了获取知识库来源列表接口的响应结构
+type KnowledgeSourcesResponse struct {
+	Sources []agent.SourceInfo `json:"sources"` // 来源列表
+}
+
+// KnowledgeChunk 是知识库块在接口中的表示，不包含嵌入向量
+type KnowledgeChunk struct {
+	ID       string         `json:"id"`       // 文档 ID
+	Content  string         `json:"content"`  // 块的文本内容
+	Metadata map[string]any `json:"metadata"` // 块的元数据
+}
+
+// IngestJobsResponse 定义了获取入库任务状态接口的响应结构
+type IngestJobsResponse struct {
+	Jobs []agent.IngestJob `json:"jobs"` // 入库任务列表，最近开始的在前
+}
+
+// ToolsResponse 定义了工具列表接口的响应结构
+type ToolsResponse struct {
+	Agent string           `json:"agent"` // 工具所属的 Agent 角色
+	Tools []agent.ToolInfo `json:"tools"` // 已注册的工具，包括被禁用的工具
+}
+
+// ResumeIngestRequest 定义了恢复入库接口的请求结构
+type ResumeIngestRequest struct {
+	Source string `json:"source"` // 要恢复的来源标识符
+}
+
+// KnowledgeChunksResponse 定义了获取指定来源块列表接口的响应结构
+type KnowledgeChunksResponse struct {
+	Source string           `json:"source"` // 来源标识符
+	Chunks []KnowledgeChunk `json:"chunks"` // 按顺序排列的块
+}
+
+// RegisterToolResponse 定义了注册 webhook 工具接口的响应结构
+type RegisterToolResponse struct {
+	Name    string `json:"name"`    // 已注册的工具名称
+	Message string `json:"message"` // 提示信息
+}
+
+// StatsResponse 定义了运行统计接口的响应结构
+type StatsResponse struct {
+	agent.MemoryStats
+	VectorDocuments int                `json:"vector_documents"` // 向量存储中的文档（块）总数
+	VectorSources   int                `json:"vector_sources"`   // 向量存储中的来源数量
+	Sandbox         agent.SandboxStats `json:"sandbox"`          // 代码沙箱的并发槽位、排队和等待时间统计
+}
+
+// BackupResponse 定义了记忆备份接口的响应结构
+type BackupResponse struct {
+	Path         string `json:"path"`          // 快照所在目录
+	SessionFiles int    `json:"session_files"` // 复制的会话文件数量
+}
+
+// ReadinessResponse 定义了深度就绪检查接口的响应结构
+type ReadinessResponse struct {
+	Status string                  `json:"status"` // 整体状态：ok / degraded / down
+	Checks []agent.SubsystemHealth `json:"checks"` // 各存储子系统的检查结果
+}
+
+// TokenCountResponse 定义了 token 估算接口的响应结构
+type TokenCountResponse struct {
+	Tokens     int `json:"tokens"`     // 估算的 token 数量
+	Characters int `json:"characters"` // 文本的字符数
+}
+
 // ModelsResponse 定义了获取模型列表接口的响应结构
 type ModelsResponse struct {
 	Models []string `json:"models"` // 可用模型名称列表
@@ -68,7 +174,7 @@ type ModelsResponse struct {
 
 // AgentHandler 处理 POST /agent 请求 (非流式)
 // 接收用户提示，调用 Agent 进行处理，并返回完整的 JSON 响应
-func AgentHandler(a *agent.Agent) http.HandlerFunc {
+func AgentHandler(a *agent.Agent, limiter *RunLimiter, cfg agent.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var payload AgentRequest
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -76,13 +182,57 @@ func AgentHandler(a *agent.Agent) http.HandlerFunc {
 			return
 		}
 
+		// 在任何会话或模型调用之前检查提示词长度
+		if err := checkPromptLength(payload.Prompt, cfg.Server.MaxPromptChars); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if payload.SessionID != "" && !checkSessionID(w, payload.SessionID) {
+			return
+		}
+
+		// 同一会话同一时刻只允许一次运行，已有运行时返回 409
+		sessionKey := runSessionKey(a, payload.SessionID)
+		if !limiter.TryAcquireSession(sessionKey) {
+			writeSessionBusy(w)
+			return
+		}
+		defer limiter.ReleaseSession(sessionKey)
+
+		// 获取全局运行槽位，已满时直接返回 503
+		if !limiter.TryAcquire() {
+			writeBusy(w)
+			return
+		}
+		defer limiter.Release()
+
+		// 计划模式可以通过请求体字段或 ?plan=true 查询参数开启
+		ctx := r.Context()
+		if payload.Plan || r.URL.Query().Get("plan") == "true" {
+			ctx = agent.WithPlanMode(ctx)
+		}
+		if len(payload.Context) > 0 {
+			ctx = agent.WithContextDocuments(ctx, payload.Context)
+		}
+		if payload.ResponseSchema != nil {
+			ctx = agent.WithResponseSchema(ctx, payload.ResponseSchema)
+		}
+		if payload.Stop != nil {
+			ctx = agent.WithStop(ctx, payload.Stop)
+		}
+		if payload.Seed != nil {
+			ctx = agent.WithSeed(ctx, *payload.Seed)
+		}
+
 		// 使用流式方法，但在内部聚合结果，以便复用 Agent 的核心逻辑
 		events := make(chan agent.StreamEvent)
-		go a.StreamRunWithSessionAndImages(r.Context(), payload.Prompt, payload.SessionID, nil, payload.Model, events)
+		go a.StreamRunWithSessionAndImages(ctx, payload.Prompt, payload.SessionID, nil, payload.Model, events)
 
 		var finalAnswer strings.Builder
 		var toolOutput strings.Builder
-		var lastError string
+		var reasoning strings.Builder
+		var lastError, lastErrorCode string
+		var plannedToolCalls []agent.PlannedToolCallEventPayload
 
 		// 消费事件流并聚合结果
 		for event := range events {
@@ -91,6 +241,8 @@ func AgentHandler(a *agent.Agent) http.HandlerFunc {
 				if p, ok := event.Payload.(agent.TokenEventPayload); ok {
 					finalAnswer.WriteString(p.Text)
 				}
+			case "answer_reset":
+				finalAnswer.Reset()
 			case "tool_output":
 				if p, ok := event.Payload.(agent.ToolOutputEventPayload); ok {
 					toolOutput.WriteString(p.Output)
@@ -99,14 +251,29 @@ func AgentHandler(a *agent.Agent) http.HandlerFunc {
 				if p, ok := event.Payload.(agent.FinalAnswerEventPayload); ok {
 					finalAnswer.WriteString(p.Text)
 				}
+			case "tool_planned":
+				if p, ok := event.Payload.(agent.PlannedToolCallEventPayload); ok {
+					plannedToolCalls = append(plannedToolCalls, p)
+				}
+			case "reasoning":
+				if p, ok := event.Payload.(agent.ReasoningEventPayload); ok {
+					reasoning.WriteString(p.Text)
+				}
 			case "error":
 				if p, ok := event.Payload.(agent.ErrorEventPayload); ok {
 					lastError = p.Message
+					lastErrorCode = p.Code
 				}
 			}
 		}
 
 		if lastError != "" {
+			// 熔断器打开时快速返回 503，提示客户端稍后重试
+			if lastErrorCode == agent.ErrorCodeUnavailable {
+				w.Header().Set("Retry-After", strconv.Itoa(max(cfg.Ollama.CircuitBreaker.CooldownSecs, 1)))
+				http.Error(w, fmt.Sprintf("agent error: %v", lastError), http.StatusServiceUnavailable)
+				return
+			}
 			http.Error(w, fmt.Sprintf("agent error: %v", lastError), 500)
 			return
 		}
@@ -118,13 +285,32 @@ func AgentHandler(a *agent.Agent) http.HandlerFunc {
 		}
 
 		response := AgentResponse{
-			Answer:    answer,
-			SessionID: a.GetMemory().GetCurrentSessionID(),
+			Answer:           answer,
+			SessionID:        a.GetMemory().GetCurrentSessionID(),
+			PlannedToolCalls: plannedToolCalls,
+		}
+		// 推理内容：开启 strip_reasoning 时由 reasoning 事件提供，否则从回答中的 <think> 块分离
+		if payload.IncludeReasoning || r.URL.Query().Get("reasoning") == "true" {
+			var inline string
+			response.Answer, inline = agent.SplitReasoning(answer)
+			response.Reasoning = strings.TrimSpace(reasoning.String() + "\n\n" + inline)
+			answer = response.Answer
+		}
+
+		// 结构化输出：校验并在必要时修复回答，计划模式下没有最终回答，不做校验
+		if payload.ResponseSchema != nil && !agent.IsPlanMode(ctx) {
+			structured, err := a.EnforceResponseSchema(ctx, answer, payload.ResponseSchema)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("structured output error: %v", err), http.StatusBadGateway)
+				return
+			}
+			response.Structured = structured
+			response.Answer = string(structured)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode agent response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode agent response")
 		}
 	}
 }
@@ -147,7 +333,7 @@ func CreateSessionHandler(a *agent.Agent) http.HandlerFunc {
 		sessionID := uuid.New().String()
 
 		// 创建会话
-		a.GetMemory().CreateSession(sessionID, payload.Title)
+		a.GetMemory().CreateSession(sessionID, payload.Title, payload.SystemPrompt, agent.WithSessionAllowedTools(payload.AllowedTools))
 
 		response := SessionCreateResponse{
 			SessionID: sessionID,
@@ -157,27 +343,218 @@ func CreateSessionHandler(a *agent.Agent) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode session creation response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode session creation response")
 		}
 	}
 }
 
-// ListSessionsHandler 处理 GET /sessions 请求，列出所有会话
+// SessionTagRequest 定义了添加会话标签接口的请求结构
+type SessionTagRequest struct {
+	Tag string `json:"tag"` // 标签名称
+}
+
+// SessionInstructionRequest 定义了向会话追加系统指令接口的请求结构
+type SessionInstructionRequest struct {
+	Content string `json:"content"` // 系统指令内容，例如 "从现在开始请用英文回答"
+}
+
+// ListSessionsHandler 处理 GET /sessions 请求，列出会话
+// 查询参数：
+//   - sort: 排序字段，"last_active"（默认）或 "created"
+//   - order: "desc"（默认，最近的在前）或 "asc"
+//   - limit / offset: 分页参数
+//   - tag: 只返回带有指定标签的会话
+//   - format=map: 返回旧版的 {id: meta} 映射格式，不支持排序和分页
 func ListSessionsHandler(a *agent.Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		sessions := a.GetMemory().GetAllSessions()
-		response := SessionsListResponse{
+		q := r.URL.Query()
+		tag := q.Get("tag")
+
+		if q.Get("format") == "map" {
+			sessions := a.GetMemory().GetAllSessions()
+			if tag != "" {
+				for id, s := range sessions {
+					tags, _ := s["tags"].([]string)
+					if !slices.Contains(tags, tag) {
+						delete(sessions, id)
+					}
+				}
+			}
+			writeJSON(w, SessionsListResponse{Sessions: sessions}, "Failed to encode session list response")
+			return
+		}
+
+		opts := agent.SessionListOptions{
+			SortBy:    q.Get("sort"),
+			Ascending: q.Get("order") == "asc",
+			Tag:       tag,
+		}
+		if opts.SortBy != "" && opts.SortBy != "last_active" && opts.SortBy != "created" {
+			http.Error(w, "sort must be 'last_active' or 'created'", 400)
+			return
+		}
+		var err error
+		if opts.Limit, err = queryInt(q.Get("limit")); err != nil {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		if opts.Offset, err = queryInt(q.Get("offset")); err != nil {
+			http.Error(w, "invalid offset", 400)
+			return
+		}
+
+		sessions, total := a.GetMemory().ListSessions(opts)
+		writeJSON(w, SessionsPageResponse{
 			Sessions: sessions,
+			Total:    total,
+			Offset:   opts.Offset,
+			Limit:    opts.Limit,
+		}, "Failed to encode session list response")
+	}
+}
+
+// AddSessionTagHandler 处理 POST /session/{id}/tags 请求，为会话添加标签
+func AddSessionTagHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := mux.Vars(r)["id"]
+		if !checkSessionID(w, sessionID) {
+			return
+		}
+		var payload SessionTagRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad request: "+err.Error(), 400)
+			return
+		}
+		payload.Tag = strings.TrimSpace(payload.Tag)
+		if payload.Tag == "" {
+			http.Error(w, "tag is required", 400)
+			return
+		}
+
+		if !a.GetMemory().AddSessionTag(sessionID, payload.Tag) {
+			http.Error(w, "session not found", 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AddSessionInstructionHandler 处理 POST /session/{id}/system 请求，向会话历史追加一条系统消息
+func AddSessionInstructionHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := mux.Vars(r)["id"]
+		if !checkSessionID(w, sessionID) {
+			return
+		}
+		var payload SessionInstructionRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad request: "+err.Error(), 400)
+			return
+		}
+
+		if err := a.AddSessionInstruction(sessionID, payload.Content); err != nil {
+			if errors.Is(err, agent.ErrSessionNotFound) {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SessionForkRequest 定义了分叉会话接口的请求结构
+type SessionForkRequest struct {
+	UpToIndex *int `json:"up_to_index,omitempty"` // 复制到该消息索引（包含），索引与 GET /session/{id}/messages 一致；省略时复制全部消息
+}
+
+// ForkSessionHandler 处理 POST /session/{id}/fork 请求，将会话截至指定消息的历史复制到一个新会话
+// 原会话不受影响，新会话不会自动成为当前会话
+func ForkSessionHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := mux.Vars(r)["id"]
+		if !checkSessionID(w, sessionID) {
+			return
+		}
+		var payload SessionForkRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "bad request: "+err.Error(), 400)
+			return
+		}
+		upToIndex := -1
+		if payload.UpToIndex != nil {
+			if *payload.UpToIndex < 0 {
+				http.Error(w, "up_to_index must not be negative", 400)
+				return
+			}
+			upToIndex = *payload.UpToIndex
+		}
+
+		newID, err := a.GetMemory().ForkSession(sessionID, upToIndex)
+		if err != nil {
+			if errors.Is(err, agent.ErrSessionNotFound) {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(SessionCreateResponse{
+			SessionID: newID,
+			Message:   fmt.Sprintf("已从会话 '%s' 分叉出新会话", sessionID),
+		}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode session fork response")
+		}
+	}
+}
+
+// RemoveSessionTagHandler 处理 DELETE /session/{id}/tags/{tag} 请求，从会话中移除标签
+func RemoveSessionTagHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !checkSessionID(w, vars["id"]) {
+			return
+		}
+		if !a.GetMemory().RemoveSessionTag(vars["id"], vars["tag"]) {
+			http.Error(w, "session not found", 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetSessionHandler 处理 GET /session/{id} 请求，返回指定会话的完整元数据
+func GetSessionHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := mux.Vars(r)["id"]
+		if !checkSessionID(w, sessionID) {
+			return
+		}
+		meta, loaded, exists := a.GetMemory().GetSessionMeta(sessionID)
+		if !exists {
+			http.Error(w, "session not found", 404)
+			return
+		}
+
+		response := SessionDetailResponse{
+			ConversationSessionMeta: meta,
+			IsCurrent:               a.GetMemory().GetCurrentSessionID() == sessionID,
+			LoadedMessages:          loaded,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode session list response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode session detail response")
 		}
 	}
 }
 
 // GetSessionMessagesHandler 处理 GET /session/{id}/messages 请求，获取指定会话的历史消息
+// 可通过 ?role=user,assistant 只返回指定角色，通过 ?since=&until= (RFC3339) 限定时间范围
 func GetSessionMessagesHandler(a *agent.Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -186,8 +563,16 @@ func GetSessionMessagesHandler(a *agent.Agent) http.HandlerFunc {
 			http.Error(w, "session id is required", 400)
 			return
 		}
+		if !checkSessionID(w, sessionID) {
+			return
+		}
 
-		msgs, exists := a.GetMemory().GetSessionMessages(sessionID)
+		filter, err := parseMessageFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		msgs, exists := a.GetMemory().FilterSessionMessages(sessionID, filter)
 		if !exists {
 			http.Error(w, "session not found", 404)
 			return
@@ -199,11 +584,39 @@ func GetSessionMessagesHandler(a *agent.Agent) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode session messages response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode session messages response")
 		}
 	}
 }
 
+// parseMessageFilter 解析消息筛选参数：
+// role 可重复或以逗号分隔 (例如 role=user,assistant)，since/until 为 RFC3339 时间
+func parseMessageFilter(q url.Values) (agent.MessageFilter, error) {
+	var f agent.MessageFilter
+	for _, v := range q["role"] {
+		for _, role := range strings.Split(v, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				f.Roles = append(f.Roles, role)
+			}
+		}
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid since: must be an RFC3339 time")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid until: must be an RFC3339 time")
+		}
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && f.Until.Before(f.Since) {
+		return f, fmt.Errorf("until must not be before since")
+	}
+	return f, nil
+}
+
 // GetModelsHandler 处理 GET /config/models 请求，获取可用模型列表
 func GetModelsHandler(cfg agent.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -212,7 +625,7 @@ func GetModelsHandler(cfg agent.Config) http.HandlerFunc {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode models response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode models response")
 		}
 	}
 }
@@ -226,6 +639,9 @@ func SwitchSessionHandler(a *agent.Agent) http.HandlerFunc {
 			http.Error(w, "session id is required", 400)
 			return
 		}
+		if !checkSessionID(w, sessionID) {
+			return
+		}
 
 		if a.GetMemory().SetCurrentSession(sessionID) {
 			response := map[string]string{
@@ -233,7 +649,7 @@ func SwitchSessionHandler(a *agent.Agent) http.HandlerFunc {
 			}
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode(response); err != nil {
-				agent.Logger.Error().Err(err).Msg("Failed to encode switch session response")
+				agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode switch session response")
 			}
 		} else {
 			http.Error(w, fmt.Sprintf("会话 ID '%s' 不存在", sessionID), 404)
@@ -242,59 +658,362 @@ func SwitchSessionHandler(a *agent.Agent) http.HandlerFunc {
 	}
 }
 
+// readUploadedFile 解析 multipart 表单中的 "file" 字段，校验文件类型并读取内容
+// 校验失败时会直接写入错误响应并返回 ok=false
+func readUploadedFile(w http.ResponseWriter, r *http.Request) (filename string, content string, ok bool) {
+	// 限制上传大小为 10MB
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "file too large", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "invalid file", http.StatusBadRequest)
+		return "", "", false
+	}
+	defer file.Close()
+
+	// 清理文件名以防止路径遍历攻击
+	filename = filepath.Base(header.Filename)
+
+	// 验证文件扩展名是否在白名单中
+	ext := filepath.Ext(filename)
+	if !allowedExtensions[ext] {
+		http.Error(w, fmt.Sprintf("file type %s not allowed", ext), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	// 读取文件内容
+	contentBytes, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "read file error", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return filename, string(contentBytes), true
+}
+
 // UploadHandler 处理文件上传请求，并将文件内容入库到向量存储 (RAG)
 func UploadHandler(a *agent.Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 限制上传大小为 10MB
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			http.Error(w, "file too large", http.StatusBadRequest)
+		filename, content, ok := readUploadedFile(w, r)
+		if !ok {
+			return
+		}
+
+		// 内容未变化时跳过重新入库
+		if a.SourceUnchanged(filename, content) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]string{
+				"message": fmt.Sprintf("文件 '%s' 内容未变化，已跳过入库", filename),
+			}); err != nil {
+				agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode upload response")
+			}
+			return
+		}
+
+		// 异步处理入库，避免阻塞 HTTP 响应；响应返回后请求上下文即被取消，因此入库只保留其中的值，
+		// 整体时长由 ingest.timeout_secs 限制
+		ingestCtx := context.WithoutCancel(r.Context())
+		goSafe(r.Context(), "ingest", func() {
+			if err := a.IngestContent(ingestCtx, filename, content); err != nil {
+				agent.Logger.Error().Ctx(r.Context()).Err(err).Str("filename", filename).Msg("Ingest failed")
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{
+			"message": fmt.Sprintf("文件 '%s' 已接收，正在后台处理...", filename),
+		}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode upload response")
+		}
+	}
+}
+
+// UploadStreamHandler 处理 POST /upload/stream 请求，同步入库上传的文件并通过 SSE 推送进度
+// 每处理完一个文本块发送一次 "ingest_progress" 事件，结束时发送 "ingest_complete" 事件汇总结果
+func UploadStreamHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filename, content, ok := readUploadedFile(w, r)
+		if !ok {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", 500)
+			return
+		}
+
+		// 设置 SSE 相关的 HTTP 头
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		writeEvent := func(event agent.StreamEvent) {
+			jsonBytes, err := json.Marshal(withErrorCode(event))
+			if err != nil {
+				agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to marshal ingest stream event")
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", jsonBytes)
+			flusher.Flush()
+		}
+
+		// 内容未变化时跳过重新入库
+		if a.SourceUnchanged(filename, content) {
+			writeEvent(agent.StreamEvent{Type: "ingest_complete", Payload: agent.IngestResultEventPayload{Source: filename, Success: true, Skipped: true}})
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		// 入库在后台进行，进度通道在入库结束后由 IngestContentWithProgress 关闭
+		// 客户端断开时请求上下文被取消，入库停止嵌入剩余的块，之后可以通过 /knowledge/ingest/resume 补齐
+		progress := make(chan agent.IngestProgressEventPayload)
+		errCh := make(chan error, 1)
+		go func() {
+			// IngestContentWithProgress 通过 defer 关闭 progress，panic 时也会关闭，这里只需把 panic 转为错误
+			defer func() {
+				if p := recover(); p != nil {
+					agent.Logger.Error().Ctx(r.Context()).Interface("panic", p).Bytes("stack", debug.Stack()).Msg("Recovered from panic during ingest")
+					errCh <- fmt.Errorf("internal error during ingest")
+				}
+			}()
+			errCh <- a.IngestContentWithProgress(r.Context(), filename, content, progress)
+		}()
+
+		var last agent.IngestProgressEventPayload
+		for p := range progress {
+			last = p
+			if r.Context().Err() == nil {
+				writeEvent(agent.StreamEvent{Type: "ingest_progress", Payload: p})
+			}
+		}
+
+		err := <-errCh
+		result := agent.IngestResultEventPayload{
+			Source:    filename,
+			Success:   err == nil,
+			Succeeded: last.Completed - last.Failed,
+			Failed:    last.Failed,
+			Total:     last.Total,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		writeEvent(agent.StreamEvent{Type: "ingest_complete", Payload: result})
+	}
+}
+
+// ListKnowledgeSourcesHandler 处理 GET /knowledge/sources 请求，列出知识库中的所有来源
+func ListKnowledgeSourcesHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sources, err := a.GetVectorStore().ListSources()
 		if err != nil {
-			http.Error(w, "invalid file", http.StatusBadRequest)
+			http.Error(w, "list sources error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer file.Close()
 
-		// 清理文件名以防止路径遍历攻击
-		filename := filepath.Base(header.Filename)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(KnowledgeSourcesResponse{Sources: sources}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode knowledge sources response")
+		}
+	}
+}
 
-		// 验证文件扩展名是否在白名单中
-		ext := filepath.Ext(filename)
-		if !allowedExtensions[ext] {
-			http.Error(w, fmt.Sprintf("file type %s not allowed", ext), http.StatusBadRequest)
+// GetKnowledgeChunksHandler 处理 GET /knowledge/chunks?source=... 请求，按顺序返回指定来源的所有块
+func GetKnowledgeChunksHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source := r.URL.Query().Get("source")
+		if source == "" {
+			http.Error(w, "source is required", 400)
 			return
 		}
 
-		// 读取文件内容
-		contentBytes, err := io.ReadAll(file)
+		docs, err := a.GetVectorStore().GetSourceChunks(source)
 		if err != nil {
-			http.Error(w, "read file error", http.StatusInternalServerError)
+			http.Error(w, "get source chunks error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		content := string(contentBytes)
 
-		// 异步处理入库，避免阻塞 HTTP 响应
-		go func() {
-			if err := a.IngestContent(filename, content); err != nil {
-				agent.Logger.Error().Err(err).Str("filename", filename).Msg("Ingest failed")
+		chunks := make([]KnowledgeChunk, 0, len(docs))
+		for _, doc := range docs {
+			chunks = append(chunks, KnowledgeChunk{ID: doc.ID, Content: doc.Content, Metadata: doc.Metadata})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(KnowledgeChunksResponse{Source: source, Chunks: chunks}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode knowledge chunks response")
+		}
+	}
+}
+
+// ListIngestJobsHandler 处理 GET /knowledge/ingest 请求，返回入库任务的状态
+// 查询参数 source 可选，指定时只返回该来源的任务
+func ListIngestJobsHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := a.GetIngestJobStore()
+		jobs := []agent.IngestJob{}
+		if source := r.URL.Query().Get("source"); source != "" {
+			job, ok := store.Get(source)
+			if !ok {
+				http.Error(w, fmt.Sprintf("no ingest job for source '%s'", source), http.StatusNotFound)
+				return
 			}
-		}()
+			jobs = append(jobs, job)
+		} else if all := store.List(); all != nil {
+			jobs = all
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(IngestJobsResponse{Jobs: jobs}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode ingest jobs response")
+		}
+	}
+}
+
+// ResumeIngestHandler 处理 POST /knowledge/ingest/resume 请求，在后台只重新嵌入缺失的块
+// 进度可以通过 GET /knowledge/ingest?source=... 查询
+func ResumeIngestHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload ResumeIngestRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad request: "+err.Error(), 400)
+			return
+		}
+		if payload.Source == "" {
+			http.Error(w, "source is required", 400)
+			return
+		}
+
+		job, ok := a.GetIngestJobStore().Get(payload.Source)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no ingest job for source '%s'", payload.Source), http.StatusNotFound)
+			return
+		}
+		if job.Status == agent.IngestStatusRunning {
+			http.Error(w, fmt.Sprintf("ingest for source '%s' is already running", payload.Source), http.StatusConflict)
+			return
+		}
+
+		ingestCtx := context.WithoutCancel(r.Context())
+		goSafe(r.Context(), "resume_ingest", func() {
+			if err := a.ResumeIngest(ingestCtx, payload.Source, nil); err != nil {
+				agent.Logger.Error().Ctx(r.Context()).Err(err).Str("source", payload.Source).Msg("Resume ingest failed")
+			}
+		})
 
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
 		if err := json.NewEncoder(w).Encode(map[string]string{
-			"message": fmt.Sprintf("文件 '%s' 已接收，正在后台处理...", filename),
+			"message": fmt.Sprintf("来源 '%s' 正在后台恢复入库...", payload.Source),
 		}); err != nil {
-			agent.Logger.Error().Err(err).Msg("Failed to encode upload response")
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode resume ingest response")
+		}
+	}
+}
+
+// ReindexHandler 处理 POST /knowledge/reindex 请求，在后台用当前嵌入模型重新嵌入所有文档并原子切换
+// 已有重建任务在运行时返回 409；进度可以通过 GET /knowledge/reindex/status 查询
+func ReindexHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := a.StartReindex(context.WithoutCancel(r.Context()))
+		if errors.Is(err, agent.ErrReindexRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "reindex error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode reindex response")
+		}
+	}
+}
+
+// ReindexStatusHandler 处理 GET /knowledge/reindex/status 请求，返回最近一次重建索引任务的进度
+func ReindexStatusHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a.ReindexStatus()); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode reindex status response")
+		}
+	}
+}
+
+// UploadSessionFilesHandler 处理 POST /session/{id}/files 请求
+// 将上传的文件 (multipart 字段 "files" 或 "file") 存入该会话的工作区，供 read_file/run_code/git_cmd 使用
+func UploadSessionFilesHandler(a *agent.Agent, cfg agent.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := mux.Vars(r)["id"]
+		if !checkSessionID(w, sessionID) {
+			return
+		}
+		if _, exists := a.GetMemory().GetSessionMessages(sessionID); !exists {
+			http.Error(w, "session not found", 404)
+			return
+		}
+
+		maxTotalMB := cfg.Workspace.MaxTotalMB
+		if maxTotalMB <= 0 {
+			maxTotalMB = agent.DefaultWorkspaceMaxTotalMB
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxTotalMB)<<20)
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "upload too large or malformed", http.StatusBadRequest)
+			return
+		}
+
+		headers := append(r.MultipartForm.File["files"], r.MultipartForm.File["file"]...)
+		if len(headers) == 0 {
+			http.Error(w, "no files uploaded", http.StatusBadRequest)
+			return
+		}
+
+		var saved []string
+		for _, header := range headers {
+			file, err := header.Open()
+			if err != nil {
+				http.Error(w, "invalid file", http.StatusBadRequest)
+				return
+			}
+			content, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				http.Error(w, "read file error", http.StatusInternalServerError)
+				return
+			}
+
+			// 清理文件名以防止路径遍历攻击
+			filename := filepath.Base(header.Filename)
+			if err := a.SaveWorkspaceFile(sessionID, filename, content); err != nil {
+				http.Error(w, fmt.Sprintf("save %s failed: %v", filename, err), http.StatusBadRequest)
+				return
+			}
+			saved = append(saved, filename)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"session_id": sessionID,
+			"files":      saved,
+		}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode session files upload response")
 		}
 	}
 }
 
 // AgentStreamHandler 处理 SSE (Server-Sent Events) 流式请求
 // 允许客户端实时接收 AI 的思考过程、工具调用和最终回答
-func AgentStreamHandler(a *agent.Agent) http.HandlerFunc {
+func AgentStreamHandler(a *agent.Agent, limiter *RunLimiter, cfg agent.Config) http.HandlerFunc {
+	// SSE 进度心跳的退避参数：长时间没有事件时按指数退避发送 "progress" 事件，收到真实事件后重置
+	progressInitialInterval := secondsOrDefault(cfg.Server.SSEHeartbeatSecs, 2)
+	progressMaxInterval := max(secondsOrDefault(cfg.Server.SSEHeartbeatMaxSecs, 30), progressInitialInterval)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		p := r.URL.Query().Get("prompt")
 		sessionID := r.URL.Query().Get("session_id")
@@ -304,6 +1023,28 @@ func AgentStreamHandler(a *agent.Agent) http.HandlerFunc {
 			http.Error(w, "prompt required", 400)
 			return
 		}
+		if sessionID != "" && !checkSessionID(w, sessionID) {
+			return
+		}
+		if err := checkPromptLength(p, cfg.Server.MaxPromptChars); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// 同一会话同一时刻只允许一次运行，已有运行时返回 409
+		sessionKey := runSessionKey(a, sessionID)
+		if !limiter.TryAcquireSession(sessionKey) {
+			writeSessionBusy(w)
+			return
+		}
+		defer limiter.ReleaseSession(sessionKey)
+
+		// 获取全局运行槽位，已满时直接返回 503
+		if !limiter.TryAcquire() {
+			writeBusy(w)
+			return
+		}
+		defer limiter.Release()
 
 		// 设置 SSE 相关的 HTTP 头
 		w.Header().Set("Content-Type", "text/event-stream")
@@ -320,15 +1061,236 @@ func AgentStreamHandler(a *agent.Agent) http.HandlerFunc {
 		// 启动 Agent 的流式处理
 		go a.StreamRunWithSessionAndImages(r.Context(), p, sessionID, nil, model, events)
 
-		// 将事件实时推送到客户端
-		for event := range events {
-			jsonBytes, err := json.Marshal(event)
+		writeEvent := func(event agent.StreamEvent) {
+			jsonBytes, err := json.Marshal(withErrorCode(event))
 			if err != nil {
 				log.Printf("Error marshaling stream event: %v", err)
-				continue
+				return
 			}
 			fmt.Fprintf(w, "data: %s\n\n", jsonBytes)
 			flusher.Flush()
 		}
+
+		// 将事件实时推送到客户端
+		// 模型长时间无输出时（例如非流式模型或耗时的工具），按指数退避发送进度心跳，让连接保持可感知
+		start := time.Now()
+		iteration := 0
+		interval := progressInitialInterval
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if p, ok := event.Payload.(agent.IterationEventPayload); ok {
+					iteration = p.Iteration
+				}
+				writeEvent(event)
+				interval = progressInitialInterval
+				timer.Reset(interval)
+			case <-timer.C:
+				writeEvent(agent.StreamEvent{
+					Type: "progress",
+					Payload: agent.ProgressEventPayload{
+						Iteration:   iteration,
+						ElapsedSecs: int(time.Since(start).Seconds()),
+					},
+				})
+				interval = min(interval*2, progressMaxInterval)
+				timer.Reset(interval)
+			}
+		}
+	}
+}
+
+// withErrorCode 保证发送给客户端的 "error" 事件总是带有错误码，未设置时视为内部错误
+func withErrorCode(event agent.StreamEvent) agent.StreamEvent {
+	if p, ok := event.Payload.(agent.ErrorEventPayload); ok && event.Type == "error" && p.Code == "" {
+		p.Code = agent.ErrorCodeInternal
+		event.Payload = p
+	}
+	return event
+}
+
+// ListToolsHandler 处理 GET /tools 请求，返回主 Agent 注册的工具及模型收到的元数据
+// 查询参数 agent 可选，例如 ?agent=coder，用于查看协作 Agent 的工具
+func ListToolsHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := a
+		name := r.URL.Query().Get("agent")
+		if name != "" && name != a.GetRole() {
+			other, ok := a.GetOtherAgent(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("agent '%s' not found", name), http.StatusNotFound)
+				return
+			}
+			target = other
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ToolsResponse{Agent: target.GetRole(), Tools: target.ListTools()}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode tools response")
+		}
+	}
+}
+
+// StatsHandler 处理 GET /stats 请求，返回会话、消息、笔记和向量文档的汇总数量以及代码沙箱的使用情况
+func StatsHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := StatsResponse{MemoryStats: a.GetMemory().Stats(), Sandbox: a.SandboxStats()}
+
+		vs := a.GetVectorStore()
+		docs, err := vs.Count()
+		if err != nil {
+			http.Error(w, "failed to count vector documents: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sources, err := vs.ListSources()
+		if err != nil {
+			http.Error(w, "failed to list knowledge sources: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.VectorDocuments = docs
+		resp.VectorSources = len(sources)
+
+		writeJSON(w, resp, "Failed to encode stats response")
+	}
+}
+
+// BackupHandler 处理 POST /admin/backup 请求，在服务运行时将 memory.json 和会话文件快照到 storage.backup_dir 下的新目录
+// 快照期间短暂暂停记忆存储的磁盘写入，保证元数据与会话文件一致；需要开启 storage.allow_backup
+func BackupHandler(a *agent.Agent, cfg agent.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Storage.AllowBackup {
+			http.Error(w, "backup is disabled", http.StatusForbidden)
+			return
+		}
+
+		dir := filepath.Join(cfg.Storage.BackupDir, "memory-"+time.Now().Format("20060102-150405.000"))
+		n, err := a.GetMemory().Snapshot(dir)
+		if err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Str("dir", dir).Msg("Memory backup failed")
+			http.Error(w, "backup error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		agent.Logger.Info().Ctx(r.Context()).Str("dir", dir).Int("session_files", n).Msg("Memory backup created")
+		writeJSON(w, BackupResponse{Path: dir, SessionFiles: n}, "Failed to encode backup response")
+	}
+}
+
+// ReadinessHandler 处理 GET /readyz 请求，检查记忆存储和向量存储的写入队列与后台持久化协程
+// 整体状态取各子系统中最差的一项；任一子系统 down 时返回 503，degraded 仍返回 200 以免流量被摘除
+func ReadinessHandler(a *agent.Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := ReadinessResponse{Status: agent.HealthOK, Checks: a.Readiness()}
+		for _, c := range resp.Checks {
+			switch c.Status {
+			case agent.HealthDown:
+				resp.Status = agent.HealthDown
+			case agent.HealthDegraded:
+				if resp.Status == agent.HealthOK {
+					resp.Status = agent.HealthDegraded
+				}
+			}
+		}
+		if resp.Status != agent.HealthOK {
+			agent.Logger.Warn().Ctx(r.Context()).Str("status", resp.Status).Interface("checks", resp.Checks).Msg("Readiness check not ok")
+		}
+		if resp.Status == agent.HealthDown {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, resp, "Failed to encode readiness response")
+	}
+}
+
+// TokenCountHandler 处理 GET /tokens?text=... 请求，估算文本的 token 数量
+func TokenCountHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text := r.URL.Query().Get("text")
+		writeJSON(w, TokenCountResponse{
+			Tokens:     agent.EstimateTokens(text),
+			Characters: utf8.RuneCountInString(text),
+		}, "Failed to encode token count response")
+	}
+}
+
+// RegisterToolHandler 处理 POST /tools/register 请求，在运行时注册 webhook 工具
+// 需要在配置中开启 webhook_tools.allow_register，动态注册的工具禁止访问内网地址
+func RegisterToolHandler(a *agent.Agent, cfg agent.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.WebhookTools.AllowRegister {
+			http.Error(w, "tool registration is disabled", http.StatusForbidden)
+			return
+		}
+
+		var payload agent.WebhookToolConfig
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad request: "+err.Error(), 400)
+			return
+		}
+		if err := a.RegisterWebhookTool(payload, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(RegisterToolResponse{
+			Name:    payload.Name,
+			Message: fmt.Sprintf("工具 '%s' 已注册", payload.Name),
+		}); err != nil {
+			agent.Logger.Error().Ctx(r.Context()).Err(err).Msg("Failed to encode tool registration response")
+		}
+	}
+}
+
+// checkSessionID 校验客户端传入的会话 ID，不合法时返回 400 并返回 false
+func checkSessionID(w http.ResponseWriter, sessionID string) bool {
+	if !agent.ValidSessionID(sessionID) {
+		http.Error(w, agent.ErrInvalidSessionID.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkPromptLength 检查提示词是否超过允许的最大字符数，limit<=0 表示不限制
+func checkPromptLength(prompt string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	if n := utf8.RuneCountInString(prompt); n > limit {
+		return fmt.Errorf("prompt too long: %d characters exceeds the limit of %d", n, limit)
+	}
+	return nil
+}
+
+// secondsOrDefault 将配置中的秒数转换为 time.Duration，非正数时使用默认值
+func secondsOrDefault(secs, def int) time.Duration {
+	if secs <= 0 {
+		secs = def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// queryInt 解析非负整数查询参数，空字符串视为 0
+func queryInt(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid non-negative integer: %q", v)
+	}
+	return n, nil
+}
+
+// writeJSON 将响应编码为 JSON 写出，编码失败时记录日志
+func writeJSON(w http.ResponseWriter, v any, errMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		agent.Logger.Error().Err(err).Msg(errMsg)
 	}
 }
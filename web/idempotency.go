@@ -0,0 +1,188 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/louis-xie-programmer/easy-agent/agent"
+)
+
+// IdempotencyKeyHeader 是客户端用于标识重试请求的 HTTP 头
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader 标记响应来自缓存的结果，而不是重新执行
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotentBodyBytes 是带 Idempotency-Key 的请求体上限，请求体需要整体读入以计算哈希
+const maxIdempotentBodyBytes = 10 << 20
+
+// IdempotencyCache 在短时间内缓存带有 Idempotency-Key 的请求结果
+// 客户端因网络问题重试时直接返回已完成的结果，避免重复写入会话消息和重复执行工具
+type IdempotencyCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration                // 已完成结果的保留时间
+	maxEntries int                          // 最多保留的结果数，超出时淘汰最早过期的条目
+	entries    map[string]*idempotencyEntry // 缓存键到结果的映射
+}
+
+// idempotencyEntry 是一个进行中或已完成的请求
+type idempotencyEntry struct {
+	done      bool     // 请求是否已完成，未完成时重复请求返回 409
+	bodyHash  [32]byte // 请求体的 SHA-256，同一个键搭配不同的请求体时返回 422
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// NewIdempotencyCache 创建幂等结果缓存，ttl<=0 时返回 nil 表示不启用
+func NewIdempotencyCache(ttl time.Duration, maxEntries int) *IdempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return &IdempotencyCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*idempotencyEntry)}
+}
+
+// begin 查找键对应的结果；不存在时登记为进行中并返回 nil, true，调用方必须随后调用 finish
+func (c *IdempotencyCache) begin(key string, bodyHash [32]byte) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok && (!e.done || now.Before(e.expiresAt)) {
+		copied := *e
+		return &copied, false
+	}
+	c.purgeLocked(now)
+	c.entries[key] = &idempotencyEntry{bodyHash: bodyHash}
+	return nil, true
+}
+
+// finish 保存成功的结果；失败的请求不缓存，客户端可以用同一个键重试
+func (c *IdempotencyCache) finish(key string, bodyHash [32]byte, rec *idempotencyRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rec.status < 200 || rec.status >= 300 {
+		delete(c.entries, key)
+		return
+	}
+	c.entries[key] = &idempotencyEntry{
+		done:      true,
+		bodyHash:  bodyHash,
+		status:    rec.status,
+		header:    rec.Header().Clone(),
+		body:      rec.body.Bytes(),
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
+
+// purgeLocked 删除过期的结果，仍然超出上限时淘汰最早过期的已完成结果，调用方必须持有 mu
+func (c *IdempotencyCache) purgeLocked(now time.Time) {
+	for key, e := range c.entries {
+		if e.done && !now.Before(e.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	for len(c.entries) >= c.maxEntries {
+		oldest := ""
+		for key, e := range c.entries {
+			if e.done && (oldest == "" || e.expiresAt.Before(c.entries[oldest].expiresAt)) {
+				oldest = key
+			}
+		}
+		if oldest == "" {
+			return // 全部是进行中的请求，不能淘汰
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// idempotencyRecorder 在写出响应的同时记录状态码和响应体
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotency 对带有 Idempotency-Key 头的请求去重：已完成的请求直接返回缓存的结果，
+// 仍在进行中的请求返回 409，同一个键搭配不同的请求体返回 422；没有该头或 cache 为 nil 时直接执行
+func withIdempotency(cache *IdempotencyCache, next http.Handler) http.Handler {
+	if cache == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validRequestID(key) {
+			http.Error(w, "invalid Idempotency-Key: up to 128 printable ASCII characters are allowed", http.StatusBadRequest)
+			return
+		}
+		cacheKey := r.Method + " " + r.URL.Path + " " + key
+
+		// 读入请求体计算哈希，再放回供后续处理器读取
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+
+		prev, fresh := cache.begin(cacheKey, bodyHash)
+		if !fresh {
+			if prev.bodyHash != bodyHash {
+				agent.Logger.Warn().Ctx(r.Context()).Str("idempotency_key", key).Msg("Idempotency-Key reused with a different request body")
+				http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+				return
+			}
+			if !prev.done {
+				w.Header().Set("Retry-After", strconv.Itoa(runRetryAfterSecs))
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			agent.Logger.Info().Ctx(r.Context()).Str("idempotency_key", key).Msg("Replaying cached response for idempotent request")
+			for k, v := range prev.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(prev.status)
+			w.Write(prev.body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		defer func() { cache.finish(cacheKey, bodyHash, rec) }()
+		next.ServeHTTP(rec, r)
+	})
+}
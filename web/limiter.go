@@ -0,0 +1,102 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/louis-xie-programmer/easy-agent/agent"
+)
+
+// runRetryAfterSecs 是并发已满时通过 Retry-After 头建议客户端等待的秒数
+const runRetryAfterSecs = 5
+
+// RunLimiter 是一个全局信号量，用于限制同时运行的 Agent 请求数量
+// 每次 Agent 运行都可能触发多次 LLM 调用、网页搜索和沙箱容器，无限制的并发会耗尽机器资源
+// 同时记录正在运行的会话，同一会话同一时刻只允许一次运行，避免消息交错写入会话历史
+type RunLimiter struct {
+	sem chan struct{} // 信号量通道，为 nil 时表示不限制
+
+	mu       sync.Mutex
+	sessions map[string]struct{} // 正在运行的会话 ID
+}
+
+// NewRunLimiter 创建一个新的 RunLimiter
+// maxRuns: 最大并发运行数，小于等于 0 时表示不限制
+func NewRunLimiter(maxRuns int) *RunLimiter {
+	l := &RunLimiter{sessions: make(map[string]struct{})}
+	if maxRuns > 0 {
+		l.sem = make(chan struct{}, maxRuns)
+	}
+	return l
+}
+
+// TryAcquire 尝试获取一个运行槽位，不会阻塞
+// 返回 true 表示获取成功，调用方必须在运行结束后调用 Release
+func (l *RunLimiter) TryAcquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release 释放一个运行槽位
+func (l *RunLimiter) Release() {
+	if l.sem == nil {
+		return
+	}
+	<-l.sem
+}
+
+// TryAcquireSession 尝试占用会话，不会阻塞；会话已有运行时返回 false
+// sessionID 为空时不做限制。成功时调用方必须在运行结束后调用 ReleaseSession
+func (l *RunLimiter) TryAcquireSession(sessionID string) bool {
+	if sessionID == "" {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, busy := l.sessions[sessionID]; busy {
+		return false
+	}
+	l.sessions[sessionID] = struct{}{}
+	return true
+}
+
+// ReleaseSession 释放会话占用
+func (l *RunLimiter) ReleaseSession(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	l.mu.Lock()
+	delete(l.sessions, sessionID)
+	l.mu.Unlock()
+}
+
+// runSessionKey 返回一次运行实际使用的会话 ID：未指定时 Agent 使用当前会话
+func runSessionKey(a *agent.Agent, sessionID string) string {
+	if sessionID != "" {
+		return sessionID
+	}
+	return a.GetMemory().GetCurrentSessionID()
+}
+
+// errSessionBusy 是会话已有运行时返回给客户端的提示
+const errSessionBusy = "session busy: another request for this session is still running, please retry later"
+
+// writeSessionBusy 在会话已有运行时返回 409 和 Retry-After 头
+func writeSessionBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(runRetryAfterSecs))
+	http.Error(w, errSessionBusy, http.StatusConflict)
+}
+
+// writeBusy 在并发已满时返回 503 和 Retry-After 头
+func writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(runRetryAfterSecs))
+	http.Error(w, "server busy: too many concurrent agent runs", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,85 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+	"github.com/louis-xie-programmer/easy-agent/agent"
+)
+
+// RequestIDHeader 是用于传递请求关联 ID 的 HTTP 头
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen 是接受客户端传入请求 ID 的最大长度
+const maxRequestIDLen = 128
+
+// requestIDMiddleware 为每个请求分配关联 ID：优先使用客户端传入的 X-Request-ID，否则生成新的 UUID
+// ID 会写入请求上下文（日志通过 .Ctx(ctx) 自动携带）并通过响应头返回
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(agent.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID 检查客户端传入的请求 ID，只接受长度有限的可打印 ASCII 字符，防止日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverMiddleware 捕获处理器中的 panic，记录堆栈和请求 ID 后返回 500，保证服务继续运行
+// http.ErrAbortHandler 是标准库用于中止响应的约定，需要继续向上抛出
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			agent.Logger.Error().Ctx(r.Context()).
+				Interface("panic", p).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Bytes("stack", debug.Stack()).
+				Msg("Recovered from panic in HTTP handler")
+			// 响应头可能已经写出，此时 http.Error 只会追加内容，不会影响服务
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goSafe 在新的 goroutine 中运行 fn，捕获其中的 panic 并记录日志，避免后台任务导致进程崩溃
+// name: 用于日志的任务名称
+func goSafe(ctx context.Context, name string, fn func()) {
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				agent.Logger.Error().Ctx(ctx).
+					Interface("panic", p).
+					Str("task", name).
+					Bytes("stack", debug.Stack()).
+					Msg("Recovered from panic in background goroutine")
+			}
+		}()
+		fn()
+	}()
+}
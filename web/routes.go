@@ -2,6 +2,7 @@ package web
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/louis-xie-programmer/easy-agent/agent"
@@ -12,32 +13,75 @@ import (
 // a: Agent 核心实例，用于处理业务逻辑
 // cfg: 应用程序配置
 func RegisterRoutes(r *mux.Router, a *agent.Agent, cfg agent.Config) {
+	// 全局并发限制器，由所有触发 Agent 运行的端点共享
+	limiter := NewRunLimiter(cfg.Agent.MaxConcurrentRuns)
+
+	// 为每个请求分配关联 ID，贯穿 Agent 循环、工具调用和 LLM 调用的日志；
+	// 随后捕获处理器中的 panic，使日志能够带上请求 ID
+	r.Use(requestIDMiddleware, recoverMiddleware)
+
+	// 非流式端点使用按路由的超时保护，SSE 与 WebSocket 端点不设超时
+	short := func(h http.HandlerFunc) http.Handler { return withTimeout(h, cfg.Server.RequestTimeoutSecs) }
+	long := func(h http.HandlerFunc) http.Handler { return withTimeout(h, cfg.Server.AgentTimeoutSecs) }
+
+	// 带 Idempotency-Key 头的重试请求直接返回首次成功的结果
+	idempotency := NewIdempotencyCache(time.Duration(cfg.Server.IdempotencyTTLSecs)*time.Second, cfg.Server.IdempotencyMaxEntries)
+
 	// RESTful API 端点：接收 JSON 请求并返回 AI 回答
 	// HTTP API: POST /agent { prompt: "..." } -> JSON { answer: "..." }
-	r.HandleFunc("/agent", AgentHandler(a)).Methods("POST")
+	r.Handle("/agent", withIdempotency(idempotency, long(AgentHandler(a, limiter, cfg)))).Methods("POST")
 
 	// 会话管理端点
-	r.HandleFunc("/session", CreateSessionHandler(a)).Methods("POST")                   // 创建新会话
-	r.HandleFunc("/session", SwitchSessionHandler(a)).Methods("PUT")                    // 切换会话
-	r.HandleFunc("/sessions", ListSessionsHandler(a)).Methods("GET")                    // 列出所有会话
-	r.HandleFunc("/session/{id}/messages", GetSessionMessagesHandler(a)).Methods("GET") // 获取指定会话的消息历史
+	r.Handle("/session", short(CreateSessionHandler(a))).Methods("POST")                      // 创建新会话
+	r.Handle("/session", short(SwitchSessionHandler(a))).Methods("PUT")                       // 切换会话
+	r.Handle("/sessions", short(ListSessionsHandler(a))).Methods("GET")                       // 列出所有会话
+	r.Handle("/session/{id}", short(GetSessionHandler(a))).Methods("GET")                     // 获取指定会话的完整元数据
+	r.Handle("/session/{id}/messages", short(GetSessionMessagesHandler(a))).Methods("GET")    // 获取指定会话的消息历史，支持 ?role=&since=&until= 筛选
+	r.Handle("/session/{id}/files", short(UploadSessionFilesHandler(a, cfg))).Methods("POST") // 上传文件到会话工作区
+	r.Handle("/session/{id}/tags", short(AddSessionTagHandler(a))).Methods("POST")            // 为会话添加标签
+	r.Handle("/session/{id}/tags/{tag}", short(RemoveSessionTagHandler(a))).Methods("DELETE") // 移除会话标签
+	r.Handle("/session/{id}/system", short(AddSessionInstructionHandler(a))).Methods("POST")  // 向会话追加系统指令
+	r.Handle("/session/{id}/fork", short(ForkSessionHandler(a))).Methods("POST")              // 复制会话截至指定消息的历史到新会话
 
 	// 配置端点
-	r.HandleFunc("/config/models", GetModelsHandler(cfg)).Methods("GET") // 获取可用模型列表
+	r.Handle("/config/models", short(GetModelsHandler(cfg))).Methods("GET") // 获取可用模型列表
+
+	// 运行统计端点
+	r.Handle("/stats", short(StatsHandler(a))).Methods("GET") // 会话、消息、笔记和向量文档的汇总数量
+
+	// 工具端点
+	r.Handle("/tokens", short(TokenCountHandler())).Methods("GET")                  // 估算文本的 token 数量
+	r.Handle("/tools", short(ListToolsHandler(a))).Methods("GET")                   // 列出已注册工具的名称、描述、Schema 和敏感性，支持 ?agent=
+	r.Handle("/tools/register", short(RegisterToolHandler(a, cfg))).Methods("POST") // 运行时注册 webhook 工具
 
 	// 文件上传端点 (RAG - 检索增强生成)
-	r.HandleFunc("/upload", UploadHandler(a)).Methods("POST") // 上传文件并入库
+	r.Handle("/upload", long(UploadHandler(a))).Methods("POST")            // 上传文件并入库
+	r.HandleFunc("/upload/stream", UploadStreamHandler(a)).Methods("POST") // 上传文件并通过 SSE 推送入库进度
+
+	// 知识库浏览端点
+	r.Handle("/knowledge/sources", short(ListKnowledgeSourcesHandler(a))).Methods("GET") // 列出知识库来源
+	r.Handle("/knowledge/chunks", short(GetKnowledgeChunksHandler(a))).Methods("GET")    // 获取指定来源的块
+	r.Handle("/knowledge/ingest", short(ListIngestJobsHandler(a))).Methods("GET")        // 查询入库任务状态
+	r.Handle("/knowledge/ingest/resume", short(ResumeIngestHandler(a))).Methods("POST")  // 恢复中断的入库
+	r.Handle("/knowledge/reindex", short(ReindexHandler(a))).Methods("POST")             // 后台用当前嵌入模型重建向量索引
+	r.Handle("/knowledge/reindex/status", short(ReindexStatusHandler(a))).Methods("GET") // 查询重建索引进度
 
 	// SSE 流式响应端点：支持服务器发送事件
 	// SSE streaming: GET /stream?prompt=...
-	r.HandleFunc("/stream", AgentStreamHandler(a)).Methods("GET") // 流式获取 AI 响应
+	r.HandleFunc("/stream", AgentStreamHandler(a, limiter, cfg)).Methods("GET") // 流式获取 AI 响应
 
 	// WebSocket API：支持实时双向通信
-	r.HandleFunc("/ws", WebSocketHandler(a)).Methods("GET") // WebSocket 连接端点
+	r.HandleFunc("/ws", WebSocketHandler(a, limiter, cfg)).Methods("GET") // WebSocket 连接端点
+
+	// 管理端点：在服务运行时生成记忆存储的一致性快照
+	r.Handle("/admin/backup", long(BackupHandler(a, cfg))).Methods("POST")
+
+	// 深度就绪检查：检查存储子系统的写入队列是否积压、后台持久化协程是否存活
+	r.Handle("/readyz", short(ReadinessHandler(a))).Methods("GET")
 
 	// 静态文件服务：提供 HTML 客户端界面
 	// 将所有未匹配的路径请求映射到静态文件目录
-	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(cfg.Server.StaticPath))))
+	r.PathPrefix("/").Handler(withTimeout(http.StripPrefix("/", http.FileServer(http.Dir(cfg.Server.StaticPath))), cfg.Server.RequestTimeoutSecs))
 
 	// 健康检查端点：返回 200 表示服务正常运行
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -45,3 +89,12 @@ func RegisterRoutes(r *mux.Router, a *agent.Agent, cfg agent.Config) {
 		_, _ = w.Write([]byte("ok"))
 	})
 }
+
+// withTimeout 为非流式处理器设置整体处理超时，超时后返回 503 并取消请求上下文
+// secs<=0 表示不限制。http.TimeoutHandler 不支持 Flush，因此不能用于 SSE 和 WebSocket 端点
+func withTimeout(h http.Handler, secs int) http.Handler {
+	if secs <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, time.Duration(secs)*time.Second, "request timed out")
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/louis-xie-programmer/easy-agent/agent"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -26,7 +28,7 @@ var upgrader = websocket.Upgrader{
 
 // WSMessage 定义了 WebSocket 通信中通用消息的结构
 type WSMessage struct {
-	Type    string          `json:"type"`    // 消息类型，例如 "prompt" | "ping" | "tool_confirmation" | "stop"
+	Type    string          `json:"type"`    // 消息类型，例如 "prompt" | "ping" | "tool_confirmation" | "stop" | "create_session" | "switch_session" | "list_sessions"
 	Payload json.RawMessage `json:"payload"` // 消息负载，JSON 对象，具体内容取决于消息类型
 }
 
@@ -36,6 +38,9 @@ type WSPrompt struct {
 	SessionID string   `json:"session_id,omitempty"` // 会话 ID，可选
 	Images    []string `json:"images,omitempty"`     // Base64 编码的图片数据，支持多模态
 	Model     string   `json:"model,omitempty"`      // 指定使用的模型名称，可选
+	Context   []string `json:"context,omitempty"`    // 仅用于本次请求的上下文文档，不会持久化，可选
+	Stop      []string `json:"stop,omitempty"`       // 本次请求的停止序列，覆盖 ollama.stop 配置，可选
+	Seed      *int     `json:"seed,omitempty"`       // 本次请求的随机种子，覆盖 ollama.seed 配置，可选
 }
 
 // WSConfirmation 定义了 "tool_confirmation" 类型消息的负载结构
@@ -44,18 +49,36 @@ type WSConfirmation struct {
 	Allowed        bool   `json:"allowed"`         // 用户是否允许执行操作 (true 表示允许，false 表示拒绝)
 }
 
+// WSSwitchSession 定义了 "switch_session" 类型消息的负载结构
+type WSSwitchSession struct {
+	SessionID string `json:"session_id"` // 要切换到的会话 ID
+}
+
+// WSListSessions 定义了 "list_sessions" 类型消息的负载结构，字段含义与 GET /sessions 的查询参数相同
+type WSListSessions struct {
+	Sort   string `json:"sort,omitempty"`   // 排序字段，"last_active"（默认）或 "created"
+	Order  string `json:"order,omitempty"`  // "desc"（默认）或 "asc"
+	Tag    string `json:"tag,omitempty"`    // 只返回带有指定标签的会话
+	Limit  int    `json:"limit,omitempty"`  // 每页数量，0 表示不限制
+	Offset int    `json:"offset,omitempty"` // 偏移量
+}
+
 // Client 是 WebSocket 连接的封装，包含一个互斥锁以确保对连接的写入是线程安全的。
 type Client struct {
-	conn       *websocket.Conn    // WebSocket 连接实例
-	mu         sync.Mutex         // 互斥锁，用于保护对 conn 的写入操作
-	cancelFunc context.CancelFunc // 用于取消当前操作的函数
-	cancelMu   sync.Mutex         // 互斥锁，用于保护 cancelFunc 的并发访问
+	conn         *websocket.Conn    // WebSocket 连接实例
+	mu           sync.Mutex         // 互斥锁，用于保护对 conn 的写入操作
+	cancelFunc   context.CancelFunc // 用于取消当前操作的函数
+	cancelMu     sync.Mutex         // 互斥锁，用于保护 cancelFunc 的并发访问
+	writeTimeout time.Duration      // 单次写入的超时时间，0 表示不设置
 }
 
 // SafeWriteJSON 安全地将 JSON 消息写入 WebSocket 连接。
 func (c *Client) SafeWriteJSON(v interface{}) error {
 	c.mu.Lock() // 获取写入锁
 	defer c.mu.Unlock()
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)) // 防止写入在失效连接上无限阻塞
+	}
 	return c.conn.WriteJSON(v) // 写入 JSON 消息
 }
 
@@ -81,13 +104,16 @@ var (
 	clients = make(map[*Client]bool) // 客户端映射
 	// clientsMutex 是一个互斥锁，用于保护 clients 映射本身的并发访问
 	clientsMutex = sync.RWMutex{}
+	// pingOnce 确保 ping 循环只启动一次
+	pingOnce sync.Once
 )
 
-// init 函数在包加载时执行，用于启动一个 goroutine，定期向所有客户端发送 ping 消息，
+// startPingLoop 启动一个 goroutine，按配置的间隔定期向所有客户端发送 ping 消息，
 // 以保持连接活跃并清理已断开的连接。
-func init() {
+// 除了应用层的 {"type":"ping"} 消息外，还会发送 WebSocket 控制帧 ping，浏览器会自动回复 pong，用于延长读超时。
+func startPingLoop(interval time.Duration) {
 	go func() {
-		ticker := time.NewTicker(30 * time.Second) // 每 30 秒发送一次 ping
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		for range ticker.C {
@@ -103,6 +129,9 @@ func init() {
 				err := client.SafeWriteJSON(map[string]any{
 					"type": "ping", // 发送 ping 消息
 				})
+				if err == nil {
+					err = client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+				}
 				if err != nil {
 					log.Printf("Ping to client failed, removing: %v", err)
 					// 移除已断开的连接
@@ -118,7 +147,16 @@ func init() {
 
 // WebSocketHandler 处理 WebSocket 连接请求
 // a: Agent 核心实例
-func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
+// limiter: 全局并发运行限制器
+// cfg: 应用程序配置，用于读取 ping 间隔
+func WebSocketHandler(a *agent.Agent, limiter *RunLimiter, cfg agent.Config) http.HandlerFunc {
+	// 读超时为 ping 间隔的 2 倍：期间收到任何消息或 pong 都会延长读超时
+	// 写超时与 ping 间隔相同：一次写入阻塞超过一个 ping 周期即视为连接失效
+	pingInterval := secondsOrDefault(cfg.Server.WSPingIntervalSecs, 30)
+	readTimeout := 2 * pingInterval
+	writeTimeout := pingInterval
+	pingOnce.Do(func() { startPingLoop(pingInterval) })
+
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// 将 HTTP 连接升级为 WebSocket 连接
@@ -129,7 +167,13 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 		}
 		defer conn.Close() // 确保 WebSocket 连接在函数退出时关闭
 
-		client := &Client{conn: conn} // 创建新的客户端实例
+		client := &Client{conn: conn, writeTimeout: writeTimeout} // 创建新的客户端实例
+
+		// 设置读超时，并在收到 pong 时延长
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(readTimeout))
+		})
 
 		// 将新客户端添加到活跃客户端列表中
 		clientsMutex.Lock()
@@ -159,6 +203,8 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 				}
 				return // 退出循环，关闭连接
 			}
+			// 收到任何消息都说明连接仍然活跃
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
 
 			switch msg.Type {
 
@@ -180,7 +226,7 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 				if err := json.Unmarshal(msg.Payload, &p); err != nil {
 					client.SafeWriteJSON(agent.StreamEvent{
 						Type:    "error",
-						Payload: agent.ErrorEventPayload{Message: "invalid prompt format"},
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: "invalid prompt format"},
 					})
 					continue
 				}
@@ -189,13 +235,55 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 				if p.Prompt == "" && len(p.Images) == 0 {
 					client.SafeWriteJSON(agent.StreamEvent{
 						Type:    "error",
-						Payload: agent.ErrorEventPayload{Message: "prompt or image is required"},
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: "prompt or image is required"},
+					})
+					continue
+				}
+				if err := checkPromptLength(p.Prompt, cfg.Server.MaxPromptChars); err != nil {
+					client.SafeWriteJSON(agent.StreamEvent{
+						Type:    "error",
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: err.Error()},
+					})
+					continue
+				}
+				if p.SessionID != "" && !agent.ValidSessionID(p.SessionID) {
+					client.SafeWriteJSON(agent.StreamEvent{
+						Type:    "error",
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: agent.ErrInvalidSessionID.Error()},
+					})
+					continue
+				}
+
+				// 同一会话同一时刻只允许一次运行
+				sessionKey := runSessionKey(a, p.SessionID)
+				if !limiter.TryAcquireSession(sessionKey) {
+					client.SafeWriteJSON(agent.StreamEvent{
+						Type:    "error",
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBusy, Message: errSessionBusy},
+					})
+					continue
+				}
+
+				// 获取全局运行槽位，已满时通知客户端稍后重试
+				if !limiter.TryAcquire() {
+					limiter.ReleaseSession(sessionKey)
+					client.SafeWriteJSON(agent.StreamEvent{
+						Type:    "error",
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBusy, Message: "server busy: too many concurrent agent runs, please retry later"},
 					})
 					continue
 				}
 
 				// 在新的 goroutine 中处理提示，避免阻塞读取循环
-				go handlePromptWS(client, a, r.Context(), p)
+				goSafe(r.Context(), "ws_prompt", func() {
+					defer limiter.ReleaseSession(sessionKey)
+					defer limiter.Release()
+					handlePromptWS(client, a, r.Context(), p)
+				})
+
+			case "create_session", "switch_session", "list_sessions":
+				// 会话管理消息，使单个 WebSocket 连接即可管理完整的对话生命周期
+				handleSessionWS(client, a, msg)
 
 			case "tool_confirmation":
 				var c WSConfirmation
@@ -203,7 +291,7 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 				if err := json.Unmarshal(msg.Payload, &c); err != nil {
 					client.SafeWriteJSON(agent.StreamEvent{
 						Type:    "error",
-						Payload: agent.ErrorEventPayload{Message: "invalid confirmation format"},
+						Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: "invalid confirmation format"},
 					})
 					continue
 				}
@@ -213,13 +301,107 @@ func WebSocketHandler(a *agent.Agent) http.HandlerFunc {
 			default:
 				client.SafeWriteJSON(agent.StreamEvent{
 					Type:    "error",
-					Payload: agent.ErrorEventPayload{Message: "unknown ws event type"},
+					Payload: agent.ErrorEventPayload{Code: agent.ErrorCodeBadRequest, Message: "unknown ws event type"},
 				})
 			}
 		}
 	}
 }
 
+// handleSessionWS 处理会话管理消息，并以对应的响应消息回复：
+//   - create_session -> session_created
+//   - switch_session -> session_switched
+//   - list_sessions  -> sessions
+func handleSessionWS(client *Client, a *agent.Agent, msg WSMessage) {
+	writeError := func(message string) {
+		client.SafeWriteJSON(agent.NewErrorEvent(agent.ErrorCodeBadRequest, message))
+	}
+	mem := a.GetMemory()
+
+	switch msg.Type {
+	case "create_session":
+		var p SessionCreateRequest
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			writeError("invalid create_session format")
+			return
+		}
+		if p.Title == "" {
+			writeError("title is required")
+			return
+		}
+		sessionID := uuid.New().String()
+		mem.CreateSession(sessionID, p.Title, p.SystemPrompt, agent.WithSessionAllowedTools(p.AllowedTools))
+		client.SafeWriteJSON(agent.StreamEvent{
+			Type: "session_created",
+			Payload: SessionCreateResponse{
+				SessionID: sessionID,
+				Message:   fmt.Sprintf("会话 '%s' 已创建", p.Title),
+			},
+		})
+
+	case "switch_session":
+		var p WSSwitchSession
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			writeError("invalid switch_session format")
+			return
+		}
+		if p.SessionID == "" {
+			writeError("session_id is required")
+			return
+		}
+		if !agent.ValidSessionID(p.SessionID) {
+			writeError(agent.ErrInvalidSessionID.Error())
+			return
+		}
+		if !mem.SetCurrentSession(p.SessionID) {
+			writeError(fmt.Sprintf("会话 ID '%s' 不存在", p.SessionID))
+			return
+		}
+		client.SafeWriteJSON(agent.StreamEvent{
+			Type: "session_switched",
+			Payload: map[string]string{
+				"session_id": p.SessionID,
+				"message":    fmt.Sprintf("已切换到会话 ID: %s", p.SessionID),
+			},
+		})
+
+	case "list_sessions":
+		var p WSListSessions
+		// 负载可以为空，此时使用默认参数
+		if len(msg.Payload) > 0 {
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				writeError("invalid list_sessions format")
+				return
+			}
+		}
+		if p.Sort != "" && p.Sort != "last_active" && p.Sort != "created" {
+			writeError("sort must be 'last_active' or 'created'")
+			return
+		}
+		if p.Limit < 0 || p.Offset < 0 {
+			writeError("limit and offset must be non-negative")
+			return
+		}
+		opts := agent.SessionListOptions{
+			SortBy:    p.Sort,
+			Ascending: p.Order == "asc",
+			Tag:       p.Tag,
+			Offset:    p.Offset,
+			Limit:     p.Limit,
+		}
+		sessions, total := mem.ListSessions(opts)
+		client.SafeWriteJSON(agent.StreamEvent{
+			Type: "sessions",
+			Payload: SessionsPageResponse{
+				Sessions: sessions,
+				Total:    total,
+				Offset:   opts.Offset,
+				Limit:    opts.Limit,
+			},
+		})
+	}
+}
+
 // handlePromptWS 在独立的 goroutine 中处理 WebSocket 提示消息
 // client: WebSocket 客户端实例
 // a: Agent 核心实例
@@ -240,13 +422,23 @@ func handlePromptWS(client *Client, a *agent.Agent, parentCtx context.Context, p
 	// 创建一个通道以接收来自 Agent 的流式事件
 	events := make(chan agent.StreamEvent)
 
+	if len(p.Context) > 0 {
+		ctx = agent.WithContextDocuments(ctx, p.Context)
+	}
+	if p.Stop != nil {
+		ctx = agent.WithStop(ctx, p.Stop)
+	}
+	if p.Seed != nil {
+		ctx = agent.WithSeed(ctx, *p.Seed)
+	}
+
 	// 在新的 goroutine 中启动 Agent 的流式处理
 	// 传入可取消的上下文
 	go a.StreamRunWithSessionAndImages(ctx, p.Prompt, p.SessionID, p.Images, p.Model, events)
 
 	// 将来自 Agent 的事件转发到 WebSocket 客户端
 	for event := range events {
-		if err := client.SafeWriteJSON(event); err != nil {
+		if err := client.SafeWriteJSON(withErrorCode(event)); err != nil {
 			log.Printf("Write to websocket error: %v", err)
 			// 如果客户端已断开连接，则停止转发
 			break